@@ -2,6 +2,7 @@ package autopilot
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
@@ -512,6 +513,25 @@ func (a *Agent) controller() {
 	}
 }
 
+// quitContext returns a context that will be cancelled when the agent is
+// signalled to exit, or the returned cancel function is called.
+func (a *Agent) quitContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		select {
+		case <-a.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 // openChans queries the agent's heuristic for a set of channel candidates, and
 // attempts to open channels to them.
 func (a *Agent) openChans(availableFunds btcutil.Amount, numChans uint32,
@@ -577,9 +597,16 @@ func (a *Agent) openChans(availableFunds btcutil.Amount, numChans uint32,
 	}
 
 	// Use the heuristic to calculate a score for each node in the
-	// graph.
-	scores, err := a.cfg.Heuristic.NodeScores(
-		a.cfg.Graph, totalChans, chanSize, nodes,
+	// graph. We pass along a context that will be cancelled if the agent
+	// is stopped, such that we won't wait for a lengthy computation to
+	// finish during shutdown. It also carries a fresh memo, such that
+	// sub-heuristics shared by several combinators are only queried once.
+	ctx, cancel := a.quitContext()
+	defer cancel()
+	ctx = WithScoreMemo(ctx, NewScoreMemo())
+
+	scores, err := QueryNodeScores(
+		ctx, a.cfg.Heuristic, a.cfg.Graph, totalChans, chanSize, nodes,
 	)
 	if err != nil {
 		return fmt.Errorf("unable to calculate node scores : %v", err)
@@ -606,20 +633,37 @@ func (a *Agent) openChans(availableFunds btcutil.Amount, numChans uint32,
 			continue
 		}
 
+		// If the heuristic suggested a smaller channel for this
+		// node, we'll use that instead, as long as it isn't below the
+		// minimum channel size.
+		nodeChanSize := chanSize
+		if suggested := scores[nID].ChanSize; suggested > 0 &&
+			suggested < nodeChanSize {
+
+			nodeChanSize = suggested
+			if nodeChanSize < a.cfg.Constraints.MinChanSize() {
+				nodeChanSize = a.cfg.Constraints.MinChanSize()
+			}
+		}
+
 		// Track the available funds we have left.
-		if availableFunds < chanSize {
-			chanSize = availableFunds
+		if availableFunds < nodeChanSize {
+			nodeChanSize = availableFunds
 		}
-		availableFunds -= chanSize
+		availableFunds -= nodeChanSize
 
 		// If we run out of funds, we can break early.
-		if chanSize < a.cfg.Constraints.MinChanSize() {
+		if nodeChanSize < a.cfg.Constraints.MinChanSize() {
 			break
 		}
 
+		if reason := scores[nID].Reason; reason != "" {
+			log.Debugf("Selected node %x: %v", nID[:], reason)
+		}
+
 		chanCandidates[nID] = &AttachmentDirective{
 			NodeID:  nID,
-			ChanAmt: chanSize,
+			ChanAmt: nodeChanSize,
 			Addrs:   addrs,
 		}
 	}
@@ -0,0 +1,298 @@
+package autopilot
+
+import (
+	"bytes"
+	"context"
+	prand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// BetweennessAttachment is an implementation of the AttachmentHeuristic
+// interface that scores nodes according to their betweenness centrality in the
+// channel graph. Nodes with a high betweenness centrality sit on many shortest
+// paths between other nodes, so opening a channel to them will improve our
+// own position in the graph, and with that the routing fees we can earn. The
+// centrality of a candidate is used as a proxy for the improvement of our own
+// betweenness, as computing the actual improvement would require recomputing
+// the centrality for each candidate.
+//
+// Computing the exact betweenness centrality takes O(VE) time, which is too
+// slow for mainnet-sized graphs. The heuristic will therefore approximate it
+// by only computing the shortest paths from a random sample of source nodes.
+type BetweennessAttachment struct {
+	sampleSize int
+
+	rand    *prand.Rand
+	randMtx sync.Mutex
+}
+
+// NewBetweennessAttachment creates a new instance of a BetweennessAttachment
+// heuristic. The sample size is the number of source nodes used to
+// approximate the betweenness centrality. If it is zero or larger than the
+// number of nodes in the graph, the exact centrality is computed.
+func NewBetweennessAttachment(sampleSize int) *BetweennessAttachment {
+	return &BetweennessAttachment{
+		sampleSize: sampleSize,
+		rand:       prand.New(prand.NewSource(time.Now().Unix())),
+	}
+}
+
+// A compile time assertion to ensure BetweennessAttachment meets the
+// ContextAttachmentHeuristic interface.
+var _ ContextAttachmentHeuristic = (*BetweennessAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (b *BetweennessAttachment) Name() string {
+	return "betweenness"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score given to each node is its (approximate) betweenness centrality,
+// scaled such that the most central node among the nodes to score is given a
+// score of 1.0.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (b *BetweennessAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return b.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the computation if
+// the passed context is cancelled.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (b *BetweennessAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	centrality, err := b.centrality(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// Find the highest centrality among the candidates, as this will be
+	// given the max score.
+	var maxCentrality float64
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		if centrality[nID] > maxCentrality {
+			maxCentrality = centrality[nID]
+		}
+	}
+
+	// If none of the candidates lie on any shortest paths, we cannot
+	// determine any preferences.
+	if maxCentrality == 0 {
+		return nil, nil
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		c := centrality[nID]
+
+		_, ok := existingPeers[nID]
+		switch {
+
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		case ok:
+			continue
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		case c == 0:
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  c / maxCentrality,
+		}
+	}
+
+	return candidates, nil
+}
+
+// centrality computes the (approximate) betweenness centrality of each node in
+// the graph using Brandes' algorithm, only considering paths from the sampled
+// source nodes.
+func (b *BetweennessAttachment) centrality(ctx context.Context,
+	g ChannelGraph) (map[NodeID]float64, error) {
+
+	// We'll start by creating an adjacency list for the graph, with each
+	// node assigned an index.
+	var (
+		nodeIDs []NodeID
+		indexes = make(map[NodeID]int)
+		adj     [][]int
+	)
+	indexOf := func(nID NodeID) int {
+		if i, ok := indexes[nID]; ok {
+			return i
+		}
+
+		i := len(nodeIDs)
+		indexes[nID] = i
+		nodeIDs = append(nodeIDs, nID)
+		adj = append(adj, nil)
+		return i
+	}
+
+	err := g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Multiple channels between the same pair of nodes don't add
+		// any shortest paths, so we only add each neighbor once.
+		i := indexOf(NodeID(n.PubKey()))
+		neighbors := make(map[int]struct{})
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			j := indexOf(NodeID(e.Peer.PubKey()))
+			if _, ok := neighbors[j]; ok {
+				return nil
+			}
+			neighbors[j] = struct{}{}
+
+			adj[i] = append(adj[i], j)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	numNodes := len(nodeIDs)
+	sources := b.sampleSources(nodeIDs)
+
+	centrality := make([]float64, numNodes)
+	var (
+		stack    = make([]int, 0, numNodes)
+		queue    = make([]int, 0, numNodes)
+		preds    = make([][]int, numNodes)
+		numPaths = make([]float64, numNodes)
+		dist     = make([]int, numNodes)
+		delta    = make([]float64, numNodes)
+	)
+	for _, s := range sources {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Reset the per-source state.
+		stack = stack[:0]
+		queue = queue[:0]
+		for i := 0; i < numNodes; i++ {
+			preds[i] = preds[i][:0]
+			numPaths[i] = 0
+			dist[i] = -1
+			delta[i] = 0
+		}
+		numPaths[s] = 1
+		dist[s] = 0
+
+		// Do a BFS from the source, counting the number of shortest
+		// paths to each node.
+		queue = append(queue, s)
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			stack = append(stack, v)
+
+			for _, w := range adj[v] {
+				if dist[w] < 0 {
+					dist[w] = dist[v] + 1
+					queue = append(queue, w)
+				}
+
+				if dist[w] == dist[v]+1 {
+					numPaths[w] += numPaths[v]
+					preds[w] = append(preds[w], v)
+				}
+			}
+		}
+
+		// Now go through the nodes in order of decreasing distance
+		// from the source, accumulating their dependencies.
+		for i := len(stack) - 1; i >= 0; i-- {
+			w := stack[i]
+			for _, v := range preds[w] {
+				delta[v] += numPaths[v] / numPaths[w] *
+					(1 + delta[w])
+			}
+
+			if w != s {
+				centrality[w] += delta[w]
+			}
+		}
+	}
+
+	// Scale the result to account for the sampling. Since the graph is
+	// undirected, each path is counted twice when all nodes are used as
+	// sources.
+	scale := 0.5
+	if len(sources) > 0 {
+		scale *= float64(numNodes) / float64(len(sources))
+	}
+
+	result := make(map[NodeID]float64, numNodes)
+	for i, nID := range nodeIDs {
+		result[nID] = centrality[i] * scale
+	}
+
+	return result, nil
+}
+
+// sampleSources returns the indexes of the nodes that should be used as
+// sources when approximating the betweenness centrality.
+func (b *BetweennessAttachment) sampleSources(nodeIDs []NodeID) []int {
+	numNodes := len(nodeIDs)
+	sources := make([]int, numNodes)
+	for i := range sources {
+		sources[i] = i
+	}
+
+	if b.sampleSize <= 0 || b.sampleSize >= numNodes {
+		return sources
+	}
+
+	// The order in which the graph is traversed is not guaranteed to be
+	// stable, so we sort the nodes before sampling to make the sample only
+	// depend on the state of the random source.
+	sort.Slice(sources, func(i, j int) bool {
+		x, y := nodeIDs[sources[i]], nodeIDs[sources[j]]
+		return bytes.Compare(x[:], y[:]) < 0
+	})
+
+	b.randMtx.Lock()
+	defer b.randMtx.Unlock()
+
+	sample := make([]int, b.sampleSize)
+	for i, j := range b.rand.Perm(numNodes)[:b.sampleSize] {
+		sample[i] = sources[j]
+	}
+
+	return sample
+}
@@ -0,0 +1,128 @@
+package autopilot
+
+import (
+	prand "math/rand"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestBetweennessAttachment checks that the BetweennessAttachment scores nodes
+// according to their betweenness centrality on a small graph with known
+// centrality values.
+func TestBetweennessAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// We'll create a path graph of five nodes:
+			//   node0 -- node1 -- node2 -- node3 -- node4
+			// The end nodes are on no shortest paths, node1 and
+			// node3 are on three each, and node2 is on four.
+			keys, nIDs := genTestNodes(t1, 5)
+			for i := 0; i < len(keys)-1; i++ {
+				_, _, err := g.addRandChannel(
+					keys[i], keys[i+1],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			// An extra channel between two nodes shouldn't affect
+			// the centrality.
+			_, _, err = g.addRandChannel(
+				keys[0], keys[1], btcutil.SatoshiPerBitcoin,
+			)
+			if err != nil {
+				t1.Fatalf("unable to add channel: %v", err)
+			}
+
+			expected := map[NodeID]float64{
+				nIDs[1]: 0.75,
+				nIDs[2]: 1.0,
+				nIDs[3]: 0.75,
+			}
+
+			assertScores := func(b *BetweennessAttachment) {
+				scores, err := b.NodeScores(
+					g, nil, btcutil.SatoshiPerBitcoin,
+					nodeSet(nIDs...),
+				)
+				if err != nil {
+					t1.Fatalf("unable to get scores: %v",
+						err)
+				}
+
+				if len(scores) != len(expected) {
+					t1.Fatalf("expected %d scores, got %d",
+						len(expected), len(scores))
+				}
+				for nID, exp := range expected {
+					s, ok := scores[nID]
+					if !ok {
+						t1.Fatalf("node %x not scored",
+							nID[:])
+					}
+					if !floatEq(s.Score, exp) {
+						t1.Fatalf("expected score %v, "+
+							"got %v", exp, s.Score)
+					}
+				}
+			}
+
+			// Computing the exact centrality, or sampling all
+			// nodes, should give the known values.
+			assertScores(NewBetweennessAttachment(0))
+			assertScores(NewBetweennessAttachment(len(keys)))
+
+			// When sampling only some of the source nodes, the
+			// scores must still be in the range [0, 1.0], and a
+			// fixed seed should give reproducible results.
+			sampled := func() map[NodeID]*NodeScore {
+				b := NewBetweennessAttachment(2)
+				b.rand = prand.New(prand.NewSource(1))
+
+				scores, err := b.NodeScores(
+					g, nil, btcutil.SatoshiPerBitcoin,
+					nodeSet(nIDs...),
+				)
+				if err != nil {
+					t1.Fatalf("unable to get scores: %v",
+						err)
+				}
+
+				return scores
+			}
+
+			scores1 := sampled()
+			scores2 := sampled()
+			if len(scores1) != len(scores2) {
+				t1.Fatalf("sampled scores not reproducible")
+			}
+			for nID, s := range scores1 {
+				if s.Score < 0 || s.Score > 1.0 {
+					t1.Fatalf("invalid score %v", s.Score)
+				}
+				if scores2[nID].Score != s.Score {
+					t1.Fatalf("sampled scores not " +
+						"reproducible")
+				}
+			}
+		})
+		if !success {
+			break
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// BoostedAttachment is an implementation of the AttachmentHeuristic interface
+// that wraps another heuristic, and boosts the scores of the nodes found in
+// its whitelist. This lets operators nudge the autopilot towards trusted
+// peers, without fully overriding the wrapped heuristic.
+//
+// The score of a whitelisted node is multiplied by the boost factor, and
+// raised to at least the floor score. The result is capped at 1.0.
+type BoostedAttachment struct {
+	heuristic AttachmentHeuristic
+	factor    float64
+	floor     float64
+
+	whitelist map[NodeID]struct{}
+	sync.Mutex
+}
+
+// NewBoostedAttachment creates a new instance of a BoostedAttachment wrapping
+// the given heuristic. The scores of the nodes in the whitelist will be
+// multiplied by the given factor, which must be at least 1.0, and raised to at
+// least the given floor, which must be in the range [0, 1.0].
+func NewBoostedAttachment(h AttachmentHeuristic, whitelist map[NodeID]struct{},
+	factor, floor float64) (*BoostedAttachment, error) {
+
+	if factor < 1.0 {
+		return nil, fmt.Errorf("boost factor must be at least 1.0, "+
+			"was %v", factor)
+	}
+
+	if floor < 0 || floor > 1.0 {
+		return nil, fmt.Errorf("floor score must be in the range "+
+			"[0, 1.0], was %v", floor)
+	}
+
+	b := &BoostedAttachment{
+		heuristic: h,
+		factor:    factor,
+		floor:     floor,
+	}
+	b.SetWhitelist(whitelist)
+
+	return b, nil
+}
+
+// A compile time assertion to ensure BoostedAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*BoostedAttachment)(nil)
+var _ ScoreSettable = (*BoostedAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (b *BoostedAttachment) Name() string {
+	return "boosted"
+}
+
+// SetWhitelist replaces the set of nodes whose scores will be boosted. It is
+// safe to call while the heuristic is in use.
+func (b *BoostedAttachment) SetWhitelist(whitelist map[NodeID]struct{}) {
+	// We copy the whitelist, such that the caller can't modify it without
+	// holding the mutex.
+	w := make(map[NodeID]struct{}, len(whitelist))
+	for nID := range whitelist {
+		w[nID] = struct{}{}
+	}
+
+	b.Lock()
+	b.whitelist = w
+	b.Unlock()
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, except that the
+// scores of whitelisted nodes are boosted. Whitelisted nodes not scored by the
+// wrapped heuristic will be given the floor score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (b *BoostedAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return b.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (b *BoostedAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, b.heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if scores == nil {
+		scores = make(map[NodeID]*NodeScore)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	for nID := range b.whitelist {
+		// We only boost nodes we were asked to score.
+		if _, ok := nodes[nID]; !ok {
+			continue
+		}
+
+		var score float64
+		if s, ok := scores[nID]; ok {
+			score = s.Score
+		}
+
+		score = math.Min(math.Max(score*b.factor, b.floor), 1.0)
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return scores, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (b *BoostedAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(b.heuristic, targetHeuristic, newScores)
+}
@@ -0,0 +1,89 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestBoostedAttachment checks that the BoostedAttachment raises the scores of
+// whitelisted nodes relative to their baseline, keeps the scores of other
+// nodes untouched, and caps the boosted scores at 1.0.
+func TestBoostedAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	node4 := testNodeID(4)
+	node5 := testNodeID(5)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 0.2,
+			node2: 0.6,
+			node3: 0.05,
+			node5: 0.5,
+		},
+	}
+
+	// Whitelist all nodes but the last one. Node4 is not scored by the
+	// inner heuristic, and should be given the floor score.
+	whitelist := nodeSet(node1, node2, node3, node4)
+
+	const (
+		factor = 2.0
+		floor  = 0.25
+	)
+	boosted, err := NewBoostedAttachment(inner, whitelist, factor, floor)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := boosted.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(node1, node2, node3, node4, node5),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := map[NodeID]float64{
+		node1: 0.4,
+		node2: 1.0,
+		node3: floor,
+		node4: floor,
+		node5: 0.5,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v for node %x, got %v", exp,
+				nID[:], s.Score)
+		}
+
+		// Whitelisted nodes must have been raised relative to their
+		// baseline.
+		if _, ok := whitelist[nID]; ok && s.Score <= inner.scores[nID] {
+			t.Fatalf("whitelisted node %x not boosted", nID[:])
+		}
+	}
+
+	// Invalid parameters should be rejected.
+	if _, err := NewBoostedAttachment(inner, nil, 0.5, 0); err == nil {
+		t.Fatalf("expected factor below 1.0 to be rejected")
+	}
+	if _, err := NewBoostedAttachment(inner, nil, 2, 1.5); err == nil {
+		t.Fatalf("expected floor above 1.0 to be rejected")
+	}
+}
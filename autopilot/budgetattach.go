@@ -0,0 +1,141 @@
+package autopilot
+
+import (
+	"context"
+	"errors"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// BudgetAttachmentConfig houses the parameters of a BudgetAttachment.
+type BudgetAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be adjusted.
+	Heuristic AttachmentHeuristic
+
+	// Constraints is the budget model used to determine the funds and
+	// number of channels still available given the current set of
+	// channels and wallet balance.
+	Constraints AgentConstraints
+
+	// WalletBalance is a function closure that should return the current
+	// available balance of the backing wallet.
+	WalletBalance func() (btcutil.Amount, error)
+}
+
+// BudgetAttachment is an implementation of the AttachmentHeuristic interface
+// that wraps another heuristic, and suppresses its scores if opening a channel
+// of the requested size would exceed the funds available for new channels.
+// This prevents recommending channels that can't be funded.
+type BudgetAttachment struct {
+	cfg BudgetAttachmentConfig
+}
+
+// NewBudgetAttachment creates a new instance of a BudgetAttachment heuristic.
+func NewBudgetAttachment(cfg BudgetAttachmentConfig) (*BudgetAttachment,
+	error) {
+
+	switch {
+	case cfg.Heuristic == nil:
+		return nil, errors.New("heuristic must be set")
+	case cfg.Constraints == nil:
+		return nil, errors.New("constraints must be set")
+	case cfg.WalletBalance == nil:
+		return nil, errors.New("wallet balance must be set")
+	}
+
+	return &BudgetAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure BudgetAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*BudgetAttachment)(nil)
+var _ ScoreSettable = (*BudgetAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (b *BudgetAttachment) Name() string {
+	return "budget"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, as long as a channel
+// of the given size can be funded. If only a smaller channel can be funded,
+// the scores are scaled down by the fraction of the channel size that is
+// available. If no more channels can be opened at all, no scores are
+// returned.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (b *BudgetAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return b.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (b *BudgetAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	balance, err := b.cfg.WalletBalance()
+	if err != nil {
+		return nil, err
+	}
+
+	// If the budget doesn't allow for any more channels, we won't bother
+	// querying the wrapped heuristic.
+	available, numChans := b.cfg.Constraints.ChannelBudget(chans, balance)
+	if available <= 0 || numChans == 0 {
+		return make(map[NodeID]*NodeScore), nil
+	}
+
+	scores, err := QueryNodeScores(
+		ctx, b.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// If a channel of the requested size can be funded, the scores are
+	// left untouched.
+	if chanSize <= 0 || available >= chanSize {
+		return scores, nil
+	}
+
+	// Otherwise, we'll scale down the scores according to how much of the
+	// channel size we can afford.
+	fraction := float64(available) / float64(chanSize)
+	for _, score := range scores {
+		score.Score *= fraction
+	}
+
+	return scores, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (b *BudgetAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(b.cfg.Heuristic, targetHeuristic, newScores)
+}
@@ -0,0 +1,113 @@
+package autopilot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestBudgetAttachment checks that the BudgetAttachment suppresses the scores
+// of the wrapped heuristic when the requested channel size can't be funded.
+func TestBudgetAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+		},
+	}
+
+	// We'll allow up to two channels, allocating half of our funds.
+	constraints := NewConstraints(
+		btcutil.SatoshiPerBitcent, btcutil.SatoshiPerBitcoin, 2, 10,
+		0.5,
+	)
+
+	var (
+		balance    btcutil.Amount
+		balanceErr error
+	)
+	budget, err := NewBudgetAttachment(BudgetAttachmentConfig{
+		Heuristic:   inner,
+		Constraints: constraints,
+		WalletBalance: func() (btcutil.Amount, error) {
+			return balance, balanceErr
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	const chanSize = btcutil.SatoshiPerBitcoin
+	assertScores := func(chans []Channel, expected map[NodeID]float64) {
+		t.Helper()
+
+		scores, err := budget.NodeScores(nil, chans, chanSize, nodes)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+		for nID, exp := range expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("node %x not scored", nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("expected score %v, got %v", exp,
+					s.Score)
+			}
+		}
+	}
+
+	// With ample funds, the scores should be left untouched.
+	balance = 10 * btcutil.SatoshiPerBitcoin
+	assertScores(nil, map[NodeID]float64{node1: 1.0, node2: 0.5})
+
+	// If only half of the channel size can be funded, the scores should
+	// be halved.
+	balance = btcutil.SatoshiPerBitcoin
+	assertScores(nil, map[NodeID]float64{node1: 0.5, node2: 0.25})
+
+	// Once the channel limit is reached, no scores should be returned,
+	// without even querying the wrapped heuristic.
+	chans := []Channel{
+		{
+			ChanID:   randChanID(),
+			Capacity: btcutil.SatoshiPerBitcent,
+			Node:     testNodeID(3),
+		},
+		{
+			ChanID:   randChanID(),
+			Capacity: btcutil.SatoshiPerBitcent,
+			Node:     testNodeID(4),
+		},
+	}
+	balance = 10 * btcutil.SatoshiPerBitcoin
+	calls := inner.calls
+	assertScores(chans, nil)
+	if inner.calls != calls {
+		t.Fatalf("wrapped heuristic queried despite exhausted budget")
+	}
+
+	// The same goes if our funds are already fully allocated.
+	balance = 0
+	assertScores(chans[:1], nil)
+
+	// Failing to retrieve the wallet balance should be reported.
+	balanceErr = errors.New("wallet unavailable")
+	_, err = budget.NodeScores(nil, nil, chanSize, nodes)
+	if err != balanceErr {
+		t.Fatalf("expected wallet error, got %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package autopilot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// CachedAttachmentConfig houses the parameters of a CachedAttachment.
+type CachedAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be cached.
+	Heuristic AttachmentHeuristic
+
+	// MaxAge is the maximum amount of time cached scores will be returned
+	// before they are recomputed, even if the inputs didn't change. A zero
+	// value means cached scores never expire, in which case only scores
+	// for VersionedChannelGraphs are cached.
+	MaxAge time.Duration
+
+	// Clock is used to determine the current time. If nil, the default
+	// clock is used.
+	Clock clock.Clock
+}
+
+// cachedScores is a set of scores computed by the wrapped heuristic, along
+// with the key of the inputs they were computed for and the time they were
+// computed.
+type cachedScores struct {
+	key       [sha256.Size]byte
+	scores    map[NodeID]*NodeScore
+	timestamp time.Time
+}
+
+// CachedAttachment is an implementation of the AttachmentHeuristic interface
+// that wraps another heuristic, and memoizes the scores it returns. As long as
+// the graph version, the set of local channels, the channel size and the set
+// of nodes to score don't change, the scores will only be computed once by the
+// wrapped heuristic, until they reach the configured maximum age. Only the
+// scores for the latest inputs are kept, as the previous ones are unlikely to
+// be queried again once any of the inputs changed.
+//
+// NOTE: Changes to the graph can only be detected if the passed ChannelGraph
+// is a VersionedChannelGraph. For other graphs, the maximum age determines how
+// often the scores are recomputed, and without one their scores aren't cached
+// at all, as they'd otherwise never be recomputed.
+type CachedAttachment struct {
+	cfg CachedAttachmentConfig
+
+	// cached are the scores for the latest inputs, or nil if none have
+	// been computed yet.
+	cached *cachedScores
+
+	sync.Mutex
+}
+
+// NewCachedAttachment creates a new instance of a CachedAttachment heuristic.
+func NewCachedAttachment(cfg CachedAttachmentConfig) *CachedAttachment {
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewDefaultClock()
+	}
+
+	return &CachedAttachment{
+		cfg: cfg,
+	}
+}
+
+// A compile time assertion to ensure CachedAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*CachedAttachment)(nil)
+var _ ScoreSettable = (*CachedAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *CachedAttachment) Name() string {
+	return "cached"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic. If the heuristic was
+// already queried for the same inputs within the maximum age, the cached
+// scores are returned instead.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *CachedAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return c.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic in case the scores must be recomputed. If the
+// context marks a preview, cached scores are returned as usual, but freshly
+// computed scores don't replace them.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (c *CachedAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	// Without a graph version or a maximum age, the cached scores would
+	// never be recomputed after the graph changed.
+	if _, ok := graphVersion(g); !ok && c.cfg.MaxAge == 0 {
+		return QueryNodeScores(
+			ctx, c.cfg.Heuristic, g, chans, chanSize, nodes,
+		)
+	}
+
+	key := scoresCacheKey(g, chans, chanSize, nodes)
+	now := c.cfg.Clock.Now()
+
+	preview := IsScorePreview(ctx)
+
+	c.Lock()
+	cached := c.cached
+	c.Unlock()
+
+	if cached != nil && cached.key == key && !c.expired(cached, now) {
+		return copyScores(cached.scores), nil
+	}
+
+	// The scores were not found in the cache, so we'll query the wrapped
+	// heuristic. We don't hold the mutex during the computation, as it
+	// might take a while.
+	scores, err := QueryNodeScores(
+		ctx, c.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if preview {
+		return scores, nil
+	}
+
+	c.Lock()
+	c.cached = &cachedScores{
+		key:       key,
+		scores:    copyScores(scores),
+		timestamp: now,
+	}
+	c.Unlock()
+
+	return scores, nil
+}
+
+// expired returns whether the given cached scores have reached the maximum
+// age.
+func (c *CachedAttachment) expired(cached *cachedScores, now time.Time) bool {
+	return c.cfg.MaxAge != 0 && now.Sub(cached.timestamp) >= c.cfg.MaxAge
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// The scores are applied to the wrapped heuristic if it is ScoreSettable. If
+// they were applied, the cached scores are invalidated.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (c *CachedAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	applied, err := setInnerNodeScores(
+		c.cfg.Heuristic, targetHeuristic, newScores,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	if applied {
+		c.Lock()
+		c.cached = nil
+		c.Unlock()
+	}
+
+	return applied, nil
+}
+
+// scoresCacheKey computes a key uniquely identifying the inputs given to a
+// heuristic, by hashing the graph version, the set of local channels, the
+// channel size and the set of nodes to score.
+func scoresCacheKey(g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) [sha256.Size]byte {
+
+	h := sha256.New()
+
+	var scratch [8]byte
+	writeUint64 := func(v uint64) {
+		binary.BigEndian.PutUint64(scratch[:], v)
+		h.Write(scratch[:])
+	}
+
+	version, _ := graphVersion(g)
+	writeUint64(version)
+
+	// The channels and nodes are sorted before being hashed, such that the
+	// key doesn't depend on the order they were passed in.
+	sortedChans := make([]Channel, len(chans))
+	copy(sortedChans, chans)
+	sort.Slice(sortedChans, func(i, j int) bool {
+		return sortedChans[i].ChanID.ToUint64() <
+			sortedChans[j].ChanID.ToUint64()
+	})
+
+	writeUint64(uint64(len(sortedChans)))
+	for _, c := range sortedChans {
+		writeUint64(c.ChanID.ToUint64())
+		writeUint64(uint64(c.Capacity))
+		h.Write(c.Node[:])
+	}
+
+	writeUint64(uint64(chanSize))
+
+	sortedNodes := make([]NodeID, 0, len(nodes))
+	for nID := range nodes {
+		sortedNodes = append(sortedNodes, nID)
+	}
+	sort.Slice(sortedNodes, func(i, j int) bool {
+		return bytes.Compare(sortedNodes[i][:], sortedNodes[j][:]) < 0
+	})
+
+	writeUint64(uint64(len(sortedNodes)))
+	for _, nID := range sortedNodes {
+		h.Write(nID[:])
+	}
+
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// copyScores returns a deep copy of the given scores, such that the caller can
+// freely modify them.
+func copyScores(scores map[NodeID]*NodeScore) map[NodeID]*NodeScore {
+	c := make(map[NodeID]*NodeScore, len(scores))
+	for nID, score := range scores {
+		s := *score
+		c[nID] = &s
+	}
+
+	return c
+}
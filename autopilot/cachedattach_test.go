@@ -0,0 +1,355 @@
+package autopilot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/coreos/bbolt"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// versionedGraph is a memChannelGraph with a settable version.
+type versionedGraph struct {
+	*memChannelGraph
+	version uint64
+}
+
+func (v *versionedGraph) Version() uint64 {
+	return v.version
+}
+
+func (v *versionedGraph) Snapshot() (ChannelGraph, error) {
+	return &versionedGraph{
+		memChannelGraph: v.memChannelGraph.snapshot(),
+		version:         v.version,
+	}, nil
+}
+
+var _ VersionedChannelGraph = (*versionedGraph)(nil)
+var _ SnapshottableChannelGraph = (*versionedGraph)(nil)
+
+// TestCachedAttachment checks that the CachedAttachment only queries the
+// wrapped heuristic once for identical inputs, and recomputes the scores when
+// the inputs change or the cached scores expire.
+func TestCachedAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 1.0,
+		},
+	}
+
+	const maxAge = time.Minute
+	testClock := clock.NewTestClock(time.Unix(1000, 0))
+	cached := NewCachedAttachment(CachedAttachmentConfig{
+		Heuristic: inner,
+		MaxAge:    maxAge,
+		Clock:     testClock,
+	})
+
+	graph := &versionedGraph{memChannelGraph: newMemChannelGraph()}
+	chans := []Channel{
+		{
+			ChanID:   randChanID(),
+			Capacity: btcutil.SatoshiPerBitcoin,
+			Node:     testNodeID(3),
+		},
+	}
+	nodes := nodeSet(node1, node2)
+
+	assertCalls := func(expected int) {
+		t.Helper()
+
+		scores, err := cached.NodeScores(
+			graph, chans, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != 2 || scores[node1].Score != 0.5 ||
+			scores[node2].Score != 1.0 {
+
+			t.Fatalf("unexpected scores: %v", scores)
+		}
+
+		if inner.calls != expected {
+			t.Fatalf("expected inner heuristic to be queried %d "+
+				"times, was queried %d times", expected,
+				inner.calls)
+		}
+	}
+
+	// Querying the same inputs several times should only query the inner
+	// heuristic once.
+	assertCalls(1)
+	assertCalls(1)
+	assertCalls(1)
+
+	// Modifying the returned scores must not affect the cache.
+	scores, err := cached.NodeScores(
+		graph, chans, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	scores[node1].Score = 0
+	assertCalls(1)
+
+	// Changing the graph version should lead to a recomputation.
+	graph.version++
+	assertCalls(2)
+	assertCalls(2)
+
+	// The same goes for changing the set of channels.
+	chans = append(chans, Channel{
+		ChanID:   randChanID(),
+		Capacity: btcutil.SatoshiPerBitcoin,
+		Node:     testNodeID(4),
+	})
+	assertCalls(3)
+	assertCalls(3)
+
+	// And the set of nodes.
+	nodes[testNodeID(5)] = struct{}{}
+	assertCalls(4)
+	assertCalls(4)
+
+	// Advancing the clock to just before the max age should still return
+	// the cached scores, while reaching it should trigger a recomputation.
+	testClock.Advance(maxAge - time.Second)
+	assertCalls(4)
+
+	testClock.Advance(time.Second)
+	assertCalls(5)
+	assertCalls(5)
+
+	// Only the scores for the latest inputs are kept, so going back to
+	// previous inputs should lead to a recomputation.
+	delete(nodes, testNodeID(5))
+	assertCalls(6)
+	nodes[testNodeID(5)] = struct{}{}
+	assertCalls(7)
+	assertCalls(7)
+}
+
+// TestCachedAttachmentGraphChange checks that modifying one of the channel
+// graphs invalidates the cached scores.
+func TestCachedAttachmentGraphChange(t *testing.T) {
+	t.Parallel()
+
+	for _, chanGraph := range chanGraphs {
+		graph, cleanup, err := chanGraph.genFunc()
+		if err != nil {
+			t.Fatalf("unable to create graph: %v", err)
+		}
+		if cleanup != nil {
+			defer cleanup()
+		}
+
+		inner := &staticHeuristic{name: "inner"}
+		cached := NewCachedAttachment(CachedAttachmentConfig{
+			Heuristic: inner,
+		})
+
+		nodes := nodeSet(testNodeID(1))
+		for i := 0; i < 2; i++ {
+			_, err := cached.NodeScores(
+				graph, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to get scores: %v",
+					chanGraph.name, err)
+			}
+		}
+		if inner.calls != 1 {
+			t.Fatalf("%v: expected inner heuristic to be queried "+
+				"once, was queried %d times", chanGraph.name,
+				inner.calls)
+		}
+
+		// Writes to the database unrelated to the graph shouldn't
+		// invalidate the cached scores.
+		if dbGraph, ok := graph.(*databaseChannelGraph); ok {
+			db := dbGraph.db.Database()
+			err := db.Update(func(tx *bbolt.Tx) error {
+				b, err := tx.CreateBucketIfNotExists(
+					[]byte("unrelated"),
+				)
+				if err != nil {
+					return err
+				}
+				return b.Put([]byte("key"), []byte("value"))
+			})
+			if err != nil {
+				t.Fatalf("unable to write to database: %v", err)
+			}
+
+			_, err = cached.NodeScores(
+				graph, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to get scores: %v",
+					chanGraph.name, err)
+			}
+			if inner.calls != 1 {
+				t.Fatalf("%v: expected cached scores after "+
+					"unrelated write", chanGraph.name)
+			}
+		}
+
+		if _, err := graph.addRandNode(); err != nil {
+			t.Fatalf("%v: unable to add node: %v", chanGraph.name,
+				err)
+		}
+		_, err = cached.NodeScores(
+			graph, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("%v: unable to get scores: %v",
+				chanGraph.name, err)
+		}
+		if inner.calls != 2 {
+			t.Fatalf("%v: expected scores to be recomputed after "+
+				"graph change", chanGraph.name)
+		}
+	}
+}
+
+// TestCachedAttachmentUnversioned checks that the scores for graphs without a
+// version are only cached if a maximum age is set, as changes to the graph
+// can't be detected otherwise.
+func TestCachedAttachmentUnversioned(t *testing.T) {
+	t.Parallel()
+
+	graph := struct{ ChannelGraph }{newMemChannelGraph()}
+	nodes := nodeSet(testNodeID(1))
+
+	tests := []struct {
+		name          string
+		maxAge        time.Duration
+		expectedCalls int
+	}{
+		{
+			name:          "no max age",
+			expectedCalls: 3,
+		},
+		{
+			name:          "max age",
+			maxAge:        time.Minute,
+			expectedCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		inner := &staticHeuristic{name: "inner"}
+		cached := NewCachedAttachment(CachedAttachmentConfig{
+			Heuristic: inner,
+			MaxAge:    test.maxAge,
+			Clock:     clock.NewTestClock(time.Unix(1000, 0)),
+		})
+
+		for i := 0; i < 3; i++ {
+			_, err := cached.NodeScores(
+				graph, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t.Fatalf("test %q: unable to get scores: %v",
+					test.name, err)
+			}
+		}
+
+		if inner.calls != test.expectedCalls {
+			t.Fatalf("test %q: expected inner heuristic to be "+
+				"queried %d times, was queried %d times",
+				test.name, test.expectedCalls, inner.calls)
+		}
+	}
+}
+
+// TestCachedAttachmentPreview checks that previewing the scores of a
+// CachedAttachment returns cached scores, but doesn't store fresh ones.
+func TestCachedAttachmentPreview(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	nodes := nodeSet(node1)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+		},
+	}
+
+	const maxAge = time.Minute
+	testClock := clock.NewTestClock(time.Unix(1000, 0))
+	cached := NewCachedAttachment(CachedAttachmentConfig{
+		Heuristic: inner,
+		MaxAge:    maxAge,
+		Clock:     testClock,
+	})
+
+	preview := func() {
+		t.Helper()
+
+		scores, err := PreviewNodeScores(
+			context.Background(), cached, nil, nil,
+			btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to preview scores: %v", err)
+		}
+		if len(scores) != 1 || scores[node1].Score != 0.5 {
+			t.Fatalf("unexpected scores: %v", scores)
+		}
+	}
+	assertState := func(calls int, isCached bool) {
+		t.Helper()
+
+		if inner.calls != calls {
+			t.Fatalf("expected inner heuristic to be queried %d "+
+				"times, was queried %d times", calls,
+				inner.calls)
+		}
+
+		cached.Lock()
+		defer cached.Unlock()
+		if (cached.cached != nil) != isCached {
+			t.Fatalf("expected scores cached: %v, got: %v",
+				isCached, cached.cached != nil)
+		}
+	}
+
+	// Previewing the scores should compute them every time, without
+	// caching them.
+	preview()
+	assertState(1, false)
+	preview()
+	assertState(2, false)
+
+	// Once cached by a regular query, the preview should use the cached
+	// scores.
+	_, err := cached.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	assertState(3, true)
+	preview()
+	assertState(3, true)
+
+	// After the cached scores expire, the preview should recompute the
+	// scores, but leave the expired entry for the next regular query to
+	// replace.
+	testClock.Advance(maxAge)
+	preview()
+	assertState(4, true)
+}
@@ -0,0 +1,104 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// CapacityAttachment is an implementation of the AttachmentHeuristic
+// interface that scores nodes according to the total capacity of their
+// channels. Nodes with a high total capacity tend to be good routing
+// partners, so this complements the degree based PrefAttachment heuristic.
+type CapacityAttachment struct {
+}
+
+// NewCapacityAttachment creates a new instance of a CapacityAttachment
+// heuristic.
+func NewCapacityAttachment() *CapacityAttachment {
+	return &CapacityAttachment{}
+}
+
+// A compile time assertion to ensure CapacityAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*CapacityAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *CapacityAttachment) Name() string {
+	return "capacity"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score given to each node is proportional to the total capacity of its
+// channels in the graph, scaled such that the node with the highest capacity
+// among the nodes to score is given a score of 1.0. Nodes without any
+// capacity are given a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *CapacityAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	capacities, err := nodeCapacities(g)
+	if err != nil {
+		return nil, err
+	}
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// We'll first find the highest capacity among the candidates, as this
+	// will be given the max score.
+	var maxCapacity btcutil.Amount
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		if capacities[nID] > maxCapacity {
+			maxCapacity = capacities[nID]
+		}
+	}
+
+	// If none of the candidates have any capacity, we cannot determine
+	// any preferences, so we return, indicating all candidates get a score
+	// of zero.
+	if maxCapacity == 0 {
+		return nil, nil
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		capacity := capacities[nID]
+
+		_, ok := existingPeers[nID]
+		switch {
+
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		case ok:
+			continue
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		case capacity == 0:
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  float64(capacity) / float64(maxCapacity),
+			Reason: fmt.Sprintf("total capacity %v", capacity),
+		}
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,119 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestCapacityAttachment checks that the CapacityAttachment scores nodes
+// according to their total channel capacity, normalized such that the node
+// with the highest capacity is given a score of 1.0.
+func TestCapacityAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// We'll create four nodes with the following channels:
+			//  * node0 <-> node1: 4 BTC
+			//  * node0 <-> node2: 2 BTC
+			//  * node1 <-> node2: 1 BTC
+			// The last node won't have any channels.
+			keys, nIDs := genTestNodes(t1, 4)
+			edges := []struct {
+				a, b int
+				amt  btcutil.Amount
+			}{
+				{0, 1, 4 * btcutil.SatoshiPerBitcoin},
+				{0, 2, 2 * btcutil.SatoshiPerBitcoin},
+				{1, 2, 1 * btcutil.SatoshiPerBitcoin},
+			}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e.a], keys[e.b], e.amt,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			capAttach := NewCapacityAttachment()
+			scores, err := capAttach.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin,
+				nodeSet(nIDs...),
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			// The nodes have total capacities of 6, 5, 3 and 0
+			// BTC respectively.
+			expected := map[NodeID]float64{
+				nIDs[0]: 1.0,
+				nIDs[1]: 5.0 / 6.0,
+				nIDs[2]: 3.0 / 6.0,
+			}
+			if len(scores) != len(expected) {
+				t1.Fatalf("expected %d scores, got %d",
+					len(expected), len(scores))
+			}
+			for nID, exp := range expected {
+				s, ok := scores[nID]
+				if !ok {
+					t1.Fatalf("node %x not scored", nID[:])
+				}
+				if !floatEq(s.Score, exp) {
+					t1.Fatalf("expected score %v, got %v",
+						exp, s.Score)
+				}
+			}
+
+			expReason := "total capacity 6 BTC"
+			if scores[nIDs[0]].Reason != expReason {
+				t1.Fatalf("expected reason %q, got %q",
+					expReason, scores[nIDs[0]].Reason)
+			}
+
+			// The normalization is done across the candidate set,
+			// so if we only ask for the scores of node1 and node2,
+			// node1 should be given the max score. An existing
+			// channel with node0 should exclude it from the set.
+			chans := []Channel{{Node: nIDs[0]}}
+			scores, err = capAttach.NodeScores(
+				g, chans, btcutil.SatoshiPerBitcoin,
+				nodeSet(nIDs...),
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			expected = map[NodeID]float64{
+				nIDs[1]: 1.0,
+				nIDs[2]: 3.0 / 5.0,
+			}
+			if len(scores) != len(expected) {
+				t1.Fatalf("expected %d scores, got %d",
+					len(expected), len(scores))
+			}
+			for nID, exp := range expected {
+				if !floatEq(scores[nID].Score, exp) {
+					t1.Fatalf("expected score %v, got %v",
+						exp, scores[nID].Score)
+				}
+			}
+		})
+		if !success {
+			break
+		}
+	}
+}
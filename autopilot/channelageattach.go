@@ -0,0 +1,232 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// DefaultInsufficientHistoryScore is the score given to nodes with too few
+// channels to judge their stability if none is configured.
+const DefaultInsufficientHistoryScore = 0.5
+
+// ChannelAgeAttachmentConfig houses the parameters of a ChannelAgeAttachment.
+// The age of a channel is the number of blocks since it was funded, as given
+// by the block height of its short channel ID.
+type ChannelAgeAttachmentConfig struct {
+	// BestHeight returns the height of the current best block.
+	BestHeight func() (uint32, error)
+
+	// MaturityAge is the median channel age, in blocks, at which a node is
+	// given the full score.
+	MaturityAge uint32
+
+	// Curve is an optional function mapping the median channel age of a
+	// node, as a fraction of the maturity age in the range [0, 1.0], to
+	// its score. Its result is clamped to the range [0, 1.0]. If nil, the
+	// score grows linearly with the median age.
+	Curve func(float64) float64
+
+	// MinChannels is the number of channels a node must have for its
+	// median channel age to be considered. If zero, a single channel
+	// suffices.
+	MinChannels int
+
+	// InsufficientHistoryScore is the score given to nodes with fewer
+	// than MinChannels channels. It must be in the range [0, 1.0]. If
+	// zero, DefaultInsufficientHistoryScore is used.
+	InsufficientHistoryScore float64
+}
+
+// ChannelAgeAttachment is an implementation of the AttachmentHeuristic
+// interface that scores nodes by the median age of their channels. A node
+// whose channels are mostly long-lived has a track record of stability, while
+// a node churning channels is a less reliable peer. This signal is orthogonal
+// to the number of channels of a node.
+type ChannelAgeAttachment struct {
+	cfg ChannelAgeAttachmentConfig
+}
+
+// NewChannelAgeAttachment creates a new instance of a ChannelAgeAttachment
+// heuristic.
+func NewChannelAgeAttachment(cfg ChannelAgeAttachmentConfig) (
+	*ChannelAgeAttachment, error) {
+
+	if cfg.BestHeight == nil {
+		return nil, fmt.Errorf("best height source must be set")
+	}
+	if cfg.MaturityAge == 0 {
+		return nil, fmt.Errorf("maturity age must be positive")
+	}
+	if cfg.MinChannels < 0 {
+		return nil, fmt.Errorf("min channels must not be negative, "+
+			"was %d", cfg.MinChannels)
+	}
+	if cfg.InsufficientHistoryScore < 0 ||
+		cfg.InsufficientHistoryScore > 1.0 {
+
+		return nil, fmt.Errorf("insufficient history score must be "+
+			"in the range [0, 1.0], was %v",
+			cfg.InsufficientHistoryScore)
+	}
+
+	if cfg.MinChannels == 0 {
+		cfg.MinChannels = 1
+	}
+	if cfg.InsufficientHistoryScore == 0 {
+		cfg.InsufficientHistoryScore = DefaultInsufficientHistoryScore
+	}
+
+	return &ChannelAgeAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure ChannelAgeAttachment meets the
+// ContextAttachmentHeuristic interface.
+var _ ContextAttachmentHeuristic = (*ChannelAgeAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *ChannelAgeAttachment) Name() string {
+	return "channelage"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score of a node is determined by the median age of its channels as a
+// fraction of the maturity age, mapped through the configured curve. Nodes
+// whose median channel age is at least the maturity age are given a score of
+// 1.0 by the default linear curve, while nodes with too few channels are given
+// the configured neutral score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *ChannelAgeAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return c.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the traversal of
+// the graph if the passed context is cancelled.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (c *ChannelAgeAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	bestHeight, err := c.cfg.BestHeight()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get best height: %v", err)
+	}
+
+	// We'll gather the ages of the channels of each of the candidates.
+	channelAges := make(map[NodeID][]uint32)
+	err = g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		nID := NodeID(n.PubKey())
+		if _, ok := nodes[nID]; !ok {
+			return nil
+		}
+
+		var ages []uint32
+		err := n.ForEachChannel(func(e ChannelEdge) error {
+			// A channel funded after our best block, as we may
+			// lag behind the graph, is brand new.
+			var age uint32
+			if height := e.ChanID.BlockHeight; height < bestHeight {
+				age = bestHeight - height
+			}
+			ages = append(ages, age)
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		channelAges[nID] = ages
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		ages := channelAges[nID]
+
+		var (
+			score  float64
+			reason string
+		)
+		if len(ages) < c.cfg.MinChannels {
+			score = c.cfg.InsufficientHistoryScore
+			reason = fmt.Sprintf("%d channels", len(ages))
+		} else {
+			median := medianAge(ages)
+			score = c.ageScore(median)
+			reason = fmt.Sprintf("median channel age of %v blocks",
+				median)
+		}
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+			Reason: reason,
+		}
+	}
+
+	return scores, nil
+}
+
+// ageScore returns the score of a node with the given median channel age.
+func (c *ChannelAgeAttachment) ageScore(age float64) float64 {
+	ratio := clampScore(age / float64(c.cfg.MaturityAge))
+	if c.cfg.Curve == nil {
+		return ratio
+	}
+
+	// A curve yielding NaN or an infinite value is treated as giving a
+	// zero score.
+	score := c.cfg.Curve(ratio)
+	if !isFinite(score) {
+		return 0
+	}
+
+	return clampScore(score)
+}
+
+// medianAge returns the median of the given non-empty set of channel ages. The
+// ages are sorted in place.
+func medianAge(ages []uint32) float64 {
+	sort.Slice(ages, func(i, j int) bool {
+		return ages[i] < ages[j]
+	})
+
+	mid := len(ages) / 2
+	if len(ages)%2 == 1 {
+		return float64(ages[mid])
+	}
+
+	return (float64(ages[mid-1]) + float64(ages[mid])) / 2
+}
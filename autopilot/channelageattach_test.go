@@ -0,0 +1,187 @@
+package autopilot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// addChannelAgeNode adds a node to the graph with channels funded at the given
+// block heights, returning its ID.
+func addChannelAgeNode(t *testing.T, g *memChannelGraph,
+	heights ...uint32) NodeID {
+
+	t.Helper()
+
+	pub, err := randKey()
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+
+	node := memNode{pub: pub}
+	for _, height := range heights {
+		node.chans = append(node.chans, ChannelEdge{
+			Channel: Channel{
+				ChanID: lnwire.ShortChannelID{
+					BlockHeight: height,
+				},
+				Capacity: btcutil.SatoshiPerBitcoin,
+			},
+		})
+	}
+
+	nID := NewNodeID(pub)
+	g.graph[nID] = node
+
+	return nID
+}
+
+// TestChannelAgeAttachment checks that the ChannelAgeAttachment scores nodes by
+// the median age of their channels according to the configured curve.
+func TestChannelAgeAttachment(t *testing.T) {
+	t.Parallel()
+
+	const bestHeight = 10000
+
+	g := newMemChannelGraph()
+	noChannels := addChannelAgeNode(t, g)
+	single := addChannelAgeNode(t, g, bestHeight-1000)
+	churning := addChannelAgeNode(
+		t, g, bestHeight-10, bestHeight-100, bestHeight-3000,
+	)
+	mixed := addChannelAgeNode(
+		t, g, bestHeight-500, bestHeight-1500, bestHeight-2500,
+		bestHeight-4000,
+	)
+	stable := addChannelAgeNode(
+		t, g, bestHeight-2000, bestHeight-3000, bestHeight+5,
+	)
+	unknown := testNodeID(1)
+	nodes := nodeSet(noChannels, single, churning, mixed, stable, unknown)
+
+	tests := []struct {
+		name         string
+		curve        func(float64) float64
+		minChannels  int
+		insufficient float64
+		expected     map[NodeID]float64
+	}{
+		{
+			name: "linear",
+			expected: map[NodeID]float64{
+				noChannels: DefaultInsufficientHistoryScore,
+				unknown:    DefaultInsufficientHistoryScore,
+				single:     0.5,
+				churning:   0.05,
+				mixed:      1.0,
+				stable:     1.0,
+			},
+		},
+		{
+			name: "square with min channels",
+			curve: func(ratio float64) float64 {
+				return ratio * ratio
+			},
+			minChannels:  3,
+			insufficient: 0.1,
+			expected: map[NodeID]float64{
+				noChannels: 0.1,
+				unknown:    0.1,
+				single:     0.1,
+				churning:   0.0025,
+				mixed:      1.0,
+				stable:     1.0,
+			},
+		},
+		{
+			name: "zero curve",
+			curve: func(ratio float64) float64 {
+				if ratio < 0.5 {
+					return 0
+				}
+				return ratio
+			},
+			expected: map[NodeID]float64{
+				noChannels: DefaultInsufficientHistoryScore,
+				unknown:    DefaultInsufficientHistoryScore,
+				single:     0.5,
+				mixed:      1.0,
+				stable:     1.0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		h, err := NewChannelAgeAttachment(ChannelAgeAttachmentConfig{
+			BestHeight: func() (uint32, error) {
+				return bestHeight, nil
+			},
+			MaturityAge:              2000,
+			Curve:                    test.curve,
+			MinChannels:              test.minChannels,
+			InsufficientHistoryScore: test.insufficient,
+		})
+		if err != nil {
+			t.Fatalf("test %q: unable to create heuristic: %v",
+				test.name, err)
+		}
+
+		scores, err := h.NodeScores(
+			g, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to get scores: %v",
+				test.name, err)
+		}
+
+		if len(scores) != len(test.expected) {
+			t.Fatalf("test %q: expected %d scores, got %d",
+				test.name, len(test.expected), len(scores))
+		}
+		for nID, exp := range test.expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("test %q: node %x not scored",
+					test.name, nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("test %q: node %x: expected score "+
+					"%v, got %v", test.name, nID[:], exp,
+					s.Score)
+			}
+		}
+	}
+
+	// A failure to get the best height should be returned.
+	h, err := NewChannelAgeAttachment(ChannelAgeAttachmentConfig{
+		BestHeight: func() (uint32, error) {
+			return 0, errors.New("no best block")
+		},
+		MaturityAge: 2000,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	_, err = h.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err == nil {
+		t.Fatalf("expected best height error")
+	}
+
+	// Invalid configurations should be rejected.
+	bestHeightFunc := func() (uint32, error) { return bestHeight, nil }
+	configs := []ChannelAgeAttachmentConfig{
+		{MaturityAge: 2000},
+		{BestHeight: bestHeightFunc},
+		{BestHeight: bestHeightFunc, MaturityAge: 2000,
+			MinChannels: -1},
+		{BestHeight: bestHeightFunc, MaturityAge: 2000,
+			InsufficientHistoryScore: 1.1},
+	}
+	for _, cfg := range configs {
+		if _, err := NewChannelAgeAttachment(cfg); err == nil {
+			t.Fatalf("expected config to be rejected")
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package autopilot
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
 )
 
 // WeightedHeuristic is a tuple that associates a weight to an
@@ -11,41 +19,276 @@ import (
 // querying several heuristics for scores.
 type WeightedHeuristic struct {
 	// Weight is this AttachmentHeuristic's relative weight factor. It
-	// should be between 0.0 and 1.0.
+	// should be between 0.0 and 1.0. A heuristic with a weight of zero is
+	// effectively disabled, and won't be queried for scores.
 	Weight float64
 
+	// Transfer is an optional function applied to the sub-heuristic's
+	// score before it is weighted, allowing the signal to be shaped, e.g.
+	// by a step function or power curve. Its result is clamped to the
+	// range [0, 1.0]. If nil, the score is used as is.
+	Transfer func(float64) float64
+
+	// Retry is an optional policy determining how the sub-heuristic is
+	// retried if it fails, e.g. because it relies on a remote data source.
+	// The zero value disables retries.
+	Retry RetryPolicy
+
+	// Penalty indicates that the sub-heuristic's weighted score is
+	// subtracted from the combined score rather than added to it,
+	// allowing it to actively penalize nodes, e.g. for high fees or
+	// flapping channels. The weights of penalty heuristics don't count
+	// towards the weights of the rewarding ones summing to 1.0.
+	Penalty bool
+
 	AttachmentHeuristic
 }
 
+// RetryPolicy determines how often a failing sub-heuristic is queried again
+// within a scoring round, and how long to wait in between.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the sub-heuristic is
+	// queried within a scoring round, including the first attempt. Zero
+	// or one disables retries.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry. It is doubled for
+	// each subsequent retry.
+	BaseDelay time.Duration
+}
+
+// transferScore applies the heuristic's transfer function to the given score,
+// clamping the result to the range [0, 1.0].
+func (w *WeightedHeuristic) transferScore(score float64) float64 {
+	if w.Transfer == nil {
+		return score
+	}
+
+	// A transfer function yielding NaN or an infinite value, e.g. due to
+	// a division by zero, is treated as giving a zero score.
+	score = w.Transfer(score)
+	if !isFinite(score) {
+		return 0
+	}
+
+	return clampScore(score)
+}
+
+// queryNodeScores queries the heuristic for the scores of the given nodes,
+// retrying according to its retry policy if it fails. A retry is only
+// attempted if it can start before the context's deadline, such that the last
+// error is returned instead of waiting for the context to expire.
+func (w *WeightedHeuristic) queryNodeScores(ctx context.Context,
+	clk clock.Clock, g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	delay := w.Retry.BaseDelay
+	for attempt := 1; ; attempt++ {
+		scores, err := QueryNodeScores(
+			ctx, w.AttachmentHeuristic, g, chans, chanSize, nodes,
+		)
+		if err == nil || attempt >= w.Retry.MaxAttempts ||
+			ctx.Err() != nil {
+
+			return scores, err
+		}
+
+		deadline, ok := ctx.Deadline()
+		if ok && deadline.Sub(clk.Now()) < delay {
+			return nil, err
+		}
+
+		log.Debugf("Retrying failed heuristic %v in %v (attempt %d "+
+			"of %d): %v", w.Name(), delay, attempt+1,
+			w.Retry.MaxAttempts, err)
+
+		select {
+		case <-clk.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		delay *= 2
+	}
+}
+
+// isFinite returns whether the given value is neither NaN nor infinite.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// clampScore clamps the given score to the range [0, 1.0].
+func clampScore(score float64) float64 {
+	return math.Max(0, math.Min(1.0, score))
+}
+
+// validCombinedScore returns whether the given combined score is within the
+// range [0, 1.0], allowing for rounding errors up to weightSumEpsilon.
+func validCombinedScore(score float64) bool {
+	return score >= -weightSumEpsilon && score <= 1.0+weightSumEpsilon
+}
+
+// SubScorePolicy determines how a WeightedCombAttachment handles sub-scores
+// outside the range [0, 1.0], which indicate a misbehaving sub-heuristic.
+type SubScorePolicy uint8
+
+const (
+	// SubScoreReject fails the computation of the combined scores if any
+	// sub-score is out of range. This is the default policy.
+	SubScoreReject SubScorePolicy = iota
+
+	// SubScoreClamp clamps out of range sub-scores to the range [0, 1.0].
+	// NaN and infinite sub-scores, which usually stem from arithmetic
+	// edge cases such as a division by zero, are treated as zero.
+	SubScoreClamp
+)
+
+// String returns a human readable description of the policy.
+func (p SubScorePolicy) String() string {
+	switch p {
+	case SubScoreReject:
+		return "reject"
+	case SubScoreClamp:
+		return "clamp"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+}
+
+// minChanSizeFraction is the smallest fraction of the channel size nodes are
+// scored for that the combined channel size suggested for a node can be.
+const minChanSizeFraction = 0.1
+
+// FailurePolicy determines how a WeightedCombAttachment handles sub-heuristics
+// failing to compute their scores.
+type FailurePolicy uint8
+
+const (
+	// FailFast fails the computation of the combined scores if any
+	// sub-heuristic fails. This is the default policy.
+	FailFast FailurePolicy = iota
+
+	// BestEffort logs the failure of a sub-heuristic, and combines the
+	// scores of the remaining sub-heuristics, with the weight of the
+	// failed ones redistributed proportionally among them. The
+	// computation only fails if all sub-heuristics fail.
+	BestEffort
+)
+
+// String returns a human readable description of the policy.
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailFast:
+		return "fail-fast"
+	case BestEffort:
+		return "best-effort"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(p))
+	}
+}
+
+// weightSumEpsilon is the tolerance used when checking that the weights of
+// the sub-heuristics sum to 1.0, and that the combined scores are within the
+// range [0, 1.0], to allow for rounding errors.
+const weightSumEpsilon = 1e-6
+
 // WeightedCombAttachment is an implementation of the AttachmentHeuristic
 // interface that combines the scores given by several sub-heuristics into one.
 type WeightedCombAttachment struct {
+	// heuristics is the set of sub-heuristics along with their weights.
+	// The slice is replaced as a whole when the weights are updated, such
+	// that it can be used without holding the mutex once retrieved.
 	heuristics []*WeightedHeuristic
+
+	// subScorePolicy determines how out of range sub-scores are handled.
+	subScorePolicy SubScorePolicy
+
+	// failurePolicy determines how failing sub-heuristics are handled.
+	failurePolicy FailurePolicy
+
+	// normalizationFloor, if non-zero, enables the min-max normalization
+	// of the combined scores, and is the score the worst scored candidate
+	// is mapped to.
+	normalizationFloor float64
+
+	// maxChannelsPerNode is the number of existing channels to a node at
+	// which it is no longer considered a candidate. Zero or negative
+	// means unlimited.
+	maxChannelsPerNode int
+
+	// maxTotalNewCapacity is the maximum total size of the channels
+	// recommended in a single scoring round. Zero or negative means
+	// unlimited.
+	maxTotalNewCapacity btcutil.Amount
+
+	// minContributors is the number of sub-heuristics that must have
+	// given a node a non-zero score for it to be scored at all. Zero or
+	// negative means no minimum.
+	minContributors int
+
+	// copyGraph, if true, makes a copy of graphs that can't take a
+	// snapshot of themselves, to be given to the sub-heuristics.
+	copyGraph bool
+
+	// observer, if set, is invoked with the summary of each scoring
+	// round.
+	observer ScoringObserver
+
+	// clock is used to time the scoring rounds.
+	clock clock.Clock
+
+	sync.Mutex
 }
 
 // NewWeightedCombAttachment creates a new instance of a WeightedCombAttachment.
 func NewWeightedCombAttachment(h ...*WeightedHeuristic) (
 	*WeightedCombAttachment, error) {
 
-	// The sum of weights given to the sub-heuristics must sum to exactly
-	// 1.0.
+	if err := validateWeights(h); err != nil {
+		return nil, err
+	}
+
+	return &WeightedCombAttachment{
+		heuristics: h,
+		clock:      clock.NewDefaultClock(),
+	}, nil
+}
+
+// validateWeights checks that the weight of each sub-heuristic is in the range
+// [0, 1.0], and that the weights given to the rewarding sub-heuristics sum to
+// 1.0, within weightSumEpsilon.
+func validateWeights(h []*WeightedHeuristic) error {
 	var sum float64
 	for _, w := range h {
-		sum += w.Weight
+		kind := "weight"
+		if w.Penalty {
+			kind = "penalty weight"
+		}
+
+		// A rewarding weight outside of the range could be offset by
+		// another one, e.g. 1.5 and -0.5, so each weight is checked
+		// before summing them.
+		if !isFinite(w.Weight) || w.Weight < 0 || w.Weight > 1.0 {
+			return fmt.Errorf("%v of %v must be in the range "+
+				"[0, 1.0] (was %v)", kind, w.Name(), w.Weight)
+		}
+
+		if !w.Penalty {
+			sum += w.Weight
+		}
 	}
 
-	if sum != 1.0 {
-		return nil, fmt.Errorf("weights MUST sum to 1.0 (was %v)", sum)
+	if math.Abs(sum-1.0) > weightSumEpsilon {
+		return fmt.Errorf("weights MUST sum to 1.0 (was %v)", sum)
 	}
 
-	return &WeightedCombAttachment{
-		heuristics: h,
-	}, nil
+	return nil
 }
 
 // A compile time assertion to ensure WeightedCombAttachment meets the
-// AttachmentHeuristic and ScoreSettable interfaces.
-var _ AttachmentHeuristic = (*WeightedCombAttachment)(nil)
+// StreamingAttachmentHeuristic and ScoreSettable interfaces.
+var _ StreamingAttachmentHeuristic = (*WeightedCombAttachment)(nil)
 var _ ScoreSettable = (*WeightedCombAttachment)(nil)
 
 // Name returns the name of this heuristic.
@@ -55,6 +298,318 @@ func (c *WeightedCombAttachment) Name() string {
 	return "weightedcomb"
 }
 
+// Heuristics returns the sub-heuristics this heuristic combines, along with
+// their weights, in the order they were given. The returned heuristics are
+// copies, such that modifying them doesn't affect the combination.
+func (c *WeightedCombAttachment) Heuristics() []*WeightedHeuristic {
+	current := c.currentHeuristics()
+
+	heuristics := make([]*WeightedHeuristic, 0, len(current))
+	for _, h := range current {
+		hCopy := *h
+		heuristics = append(heuristics, &hCopy)
+	}
+
+	return heuristics
+}
+
+// Heuristic returns a copy of the sub-heuristic with the given name. The
+// returned boolean indicates whether it was found.
+func (c *WeightedCombAttachment) Heuristic(name string) (*WeightedHeuristic,
+	bool) {
+
+	for _, h := range c.currentHeuristics() {
+		if h.Name() == name {
+			hCopy := *h
+			return &hCopy, true
+		}
+	}
+
+	return nil, false
+}
+
+// SetWeights updates the weights of the named sub-heuristics. Sub-heuristics
+// not present in the map keep their current weight. An error is returned if
+// any of the names is unknown, or if the resulting weights don't sum to 1.0,
+// in which case the weights are left unchanged.
+func (c *WeightedCombAttachment) SetWeights(weights map[string]float64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	// We'll build the new set of heuristics from scratch, such that
+	// callers still using the previous set aren't affected.
+	heuristics := make([]*WeightedHeuristic, 0, len(c.heuristics))
+	found := make(map[string]struct{})
+	for _, h := range c.heuristics {
+		hCopy := *h
+		if w, ok := weights[h.Name()]; ok {
+			hCopy.Weight = w
+			found[h.Name()] = struct{}{}
+		}
+
+		heuristics = append(heuristics, &hCopy)
+	}
+
+	for name := range weights {
+		if _, ok := found[name]; !ok {
+			return fmt.Errorf("unknown heuristic %v", name)
+		}
+	}
+
+	if err := validateWeights(heuristics); err != nil {
+		return err
+	}
+
+	c.heuristics = heuristics
+
+	return nil
+}
+
+// SetSubScorePolicy sets the policy used to handle sub-scores outside the
+// range [0, 1.0].
+func (c *WeightedCombAttachment) SetSubScorePolicy(
+	policy SubScorePolicy) error {
+
+	switch policy {
+	case SubScoreReject, SubScoreClamp:
+	default:
+		return fmt.Errorf("unknown sub-score policy %v", policy)
+	}
+
+	c.Lock()
+	c.subScorePolicy = policy
+	c.Unlock()
+
+	return nil
+}
+
+// SetFailurePolicy sets the policy used to handle sub-heuristics failing to
+// compute their scores.
+func (c *WeightedCombAttachment) SetFailurePolicy(policy FailurePolicy) error {
+	switch policy {
+	case FailFast, BestEffort:
+	default:
+		return fmt.Errorf("unknown failure policy %v", policy)
+	}
+
+	c.Lock()
+	c.failurePolicy = policy
+	c.Unlock()
+
+	return nil
+}
+
+// SetNormalizationFloor enables the min-max normalization of the combined
+// scores of each scoring round, such that the best scored candidate is given a
+// score of 1.0, the worst scored one the given floor, and the scores of the
+// remaining candidates are rescaled linearly in between, preserving their
+// relative ordering. The floor must be in the range (0, 1.0]. Passing zero
+// disables the normalization, which is the default.
+//
+// NOTE: As the normalization requires knowing all of the combined scores,
+// NodeScoresStream won't emit any score until all of them are computed while
+// it is enabled.
+func (c *WeightedCombAttachment) SetNormalizationFloor(floor float64) error {
+	if !isFinite(floor) || floor < 0 || floor > 1.0 {
+		return fmt.Errorf("normalization floor %v out of range "+
+			"(0, 1]", floor)
+	}
+
+	c.Lock()
+	c.normalizationFloor = floor
+	c.Unlock()
+
+	return nil
+}
+
+// SetMaxChannelsPerNode sets the number of existing channels to a node at
+// which it will no longer be scored, to avoid concentrating too much liquidity
+// with a single peer. Zero or negative means unlimited, which is the default.
+func (c *WeightedCombAttachment) SetMaxChannelsPerNode(maxChans int) {
+	c.Lock()
+	c.maxChannelsPerNode = maxChans
+	c.Unlock()
+}
+
+// SetMaxTotalNewCapacity caps the total size of the channels recommended in a
+// single scoring round, such that the autopilot doesn't recommend more than
+// the operator's budget at once. The candidates are admitted by descending
+// score until the next one's channel size would exceed the cap, and all
+// remaining candidates are dropped. Zero or negative means unlimited, which is
+// the default.
+//
+// NOTE: As the cap requires knowing all of the combined scores,
+// NodeScoresStream won't emit any score until all of them are computed while
+// it is enabled.
+func (c *WeightedCombAttachment) SetMaxTotalNewCapacity(
+	maxCapacity btcutil.Amount) {
+
+	c.Lock()
+	c.maxTotalNewCapacity = maxCapacity
+	c.Unlock()
+}
+
+// SetMinContributors sets the number of sub-heuristics that must have given a
+// node a non-zero score for it to be included in the combined scores, to avoid
+// scoring a node highly based on the opinion of a single sub-heuristic. Nodes
+// scored by fewer sub-heuristics are dropped regardless of their combined
+// score. Sub-heuristics without any weight aren't counted. Zero or negative
+// means no minimum, which is the default.
+func (c *WeightedCombAttachment) SetMinContributors(minContributors int) {
+	c.Lock()
+	c.minContributors = minContributors
+	c.Unlock()
+}
+
+// SetCopyGraph sets whether graphs that aren't a SnapshottableChannelGraph,
+// such as the database graph, are copied into memory at the start of each
+// scoring round, such that all sub-heuristics see the same topology. Copying
+// requires reading the whole graph, so it is disabled by default, in which
+// case the sub-heuristics read the graph as they are queried.
+func (c *WeightedCombAttachment) SetCopyGraph(enabled bool) {
+	c.Lock()
+	c.copyGraph = enabled
+	c.Unlock()
+}
+
+// SetObserver sets the callback invoked with the summary of each completed
+// scoring round. Passing nil removes the observer, in which case no summaries
+// are computed.
+func (c *WeightedCombAttachment) SetObserver(observer ScoringObserver) {
+	c.Lock()
+	c.observer = observer
+	c.Unlock()
+}
+
+// currentHeuristics returns the current set of sub-heuristics. The returned
+// slice must not be modified.
+func (c *WeightedCombAttachment) currentHeuristics() []*WeightedHeuristic {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.heuristics
+}
+
+// currentSubScorePolicy returns the policy used to handle out of range
+// sub-scores.
+func (c *WeightedCombAttachment) currentSubScorePolicy() SubScorePolicy {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.subScorePolicy
+}
+
+// currentFailurePolicy returns the policy used to handle failing
+// sub-heuristics.
+func (c *WeightedCombAttachment) currentFailurePolicy() FailurePolicy {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.failurePolicy
+}
+
+// currentNormalizationFloor returns the floor of the normalized scores, zero
+// meaning the normalization is disabled.
+func (c *WeightedCombAttachment) currentNormalizationFloor() float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.normalizationFloor
+}
+
+// currentMaxTotalNewCapacity returns the maximum total size of the channels
+// recommended in a scoring round.
+func (c *WeightedCombAttachment) currentMaxTotalNewCapacity() btcutil.Amount {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.maxTotalNewCapacity
+}
+
+// currentMinContributors returns the number of sub-heuristics required to have
+// scored a node for it to be included.
+func (c *WeightedCombAttachment) currentMinContributors() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.minContributors
+}
+
+// currentCopyGraph returns whether graphs that can't take a snapshot of
+// themselves are copied.
+func (c *WeightedCombAttachment) currentCopyGraph() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.copyGraph
+}
+
+// currentObserver returns the callback invoked after each scoring round.
+func (c *WeightedCombAttachment) currentObserver() ScoringObserver {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.observer
+}
+
+// currentMaxChannelsPerNode returns the maximum number of channels per node.
+func (c *WeightedCombAttachment) currentMaxChannelsPerNode() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.maxChannelsPerNode
+}
+
+// filterSaturatedNodes returns the set of nodes we have fewer than maxChans
+// channels with. If maxChans is zero or negative, the nodes are returned as
+// is.
+func filterSaturatedNodes(nodes map[NodeID]struct{}, chans []Channel,
+	maxChans int) map[NodeID]struct{} {
+
+	if maxChans <= 0 {
+		return nodes
+	}
+
+	numChans := make(map[NodeID]int)
+	for _, c := range chans {
+		numChans[c.Node]++
+	}
+
+	filtered := make(map[NodeID]struct{}, len(nodes))
+	for nID := range nodes {
+		if numChans[nID] >= maxChans {
+			continue
+		}
+		filtered[nID] = struct{}{}
+	}
+
+	return filtered
+}
+
+// checkSubScore ensures the given sub-score of the named heuristic is within
+// the range [0, 1.0], either clamping it or returning an error according to
+// the given policy.
+func checkSubScore(name string, score float64,
+	policy SubScorePolicy) (float64, error) {
+
+	switch {
+	case score >= 0 && score <= 1.0:
+		return score, nil
+
+	// NaN and infinite scores can't be meaningfully clamped, so they are
+	// treated as zero.
+	case policy == SubScoreClamp && !isFinite(score):
+		return 0, nil
+
+	case policy == SubScoreClamp:
+		return clampScore(score), nil
+
+	default:
+		return 0, fmt.Errorf("score %v from heuristic %v out of "+
+			"range [0, 1]", score, name)
+	}
+}
+
 // NodeScores is a method that given the current channel graph, current set of
 // local channels and funds available, scores the given nodes according to the
 // preference of opening a channel with them. The returned channel candidates
@@ -63,7 +618,8 @@ func (c *WeightedCombAttachment) Name() string {
 //
 // The scores is determined by quering the set of sub-heuristics, then
 // combining these scores into a final score according to the active
-// configuration.
+// configuration. The weighted scores of any penalty heuristics are subtracted
+// from the weighted sum of the rewarding ones.
 //
 // The returned scores will be in the range [0, 1.0], where 0 indicates no
 // improvement in connectivity if a channel is opened to this node, while 1.0
@@ -74,58 +630,324 @@ func (c *WeightedCombAttachment) NodeScores(g ChannelGraph, chans []Channel,
 	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
 	map[NodeID]*NodeScore, error) {
 
-	// We now query each heuristic to determine the score they give to the
-	// nodes for the given channel size.
-	var subScores []map[NodeID]*NodeScore
-	for _, h := range c.heuristics {
-		s, err := h.NodeScores(
-			g, chans, chanSize, nodes,
+	return c.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the computation
+// if the passed context is cancelled. The context is passed along to the
+// sub-heuristics.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (c *WeightedCombAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores := make(map[NodeID]*NodeScore)
+	err := c.NodeScoresStream(
+		ctx, g, chans, chanSize, nodes, func(score *NodeScore) error {
+			scores[score.NodeID] = score
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scores, nil
+}
+
+// NodeScoresStream is equivalent to NodeScoresContext, but emits the combined
+// score of each node as soon as it is finalized, instead of collecting all of
+// them in a map. Nodes given a zero score are not emitted. If the callback
+// returns an error, no more scores are emitted and the error is returned.
+//
+// NOTE: The sub-heuristics are still queried for all of their scores before
+// the first combined score is emitted.
+//
+// NOTE: This is a part of the StreamingAttachmentHeuristic interface.
+func (c *WeightedCombAttachment) NodeScoresStream(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}, emit NodeScoreFunc) error {
+
+	// Without an observer, there's no need to summarize the scoring round.
+	observer := c.currentObserver()
+	if observer == nil {
+		return c.bufferedNodeScores(
+			ctx, g, chans, chanSize, nodes, nil, emit,
 		)
+	}
+
+	summary := &ScoringSummary{}
+	start := c.clock.Now()
+	err := c.bufferedNodeScores(
+		ctx, g, chans, chanSize, nodes, summary,
+		func(score *NodeScore) error {
+			summary.addScore(score.Score)
+			return emit(score)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	summary.Duration = c.clock.Now().Sub(start)
+
+	observer(summary)
+
+	return nil
+}
+
+// bufferedNodeScores is equivalent to streamNodeScores, but if enabled, caps
+// the total channel size of the combined scores, and then normalizes them,
+// before passing them to the given callback.
+func (c *WeightedCombAttachment) bufferedNodeScores(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}, summary *ScoringSummary,
+	emit NodeScoreFunc) error {
+
+	floor := c.currentNormalizationFloor()
+	maxCapacity := c.currentMaxTotalNewCapacity()
+	if floor == 0 && maxCapacity <= 0 {
+		return c.streamNodeScores(
+			ctx, g, chans, chanSize, nodes, summary, emit,
+		)
+	}
+
+	var scores []*NodeScore
+	err := c.streamNodeScores(
+		ctx, g, chans, chanSize, nodes, summary,
+		func(score *NodeScore) error {
+			scores = append(scores, score)
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if maxCapacity > 0 {
+		scores = capTotalCapacity(scores, chanSize, maxCapacity)
+	}
+	if floor != 0 {
+		normalizeScores(scores, floor)
+	}
+
+	for _, score := range scores {
+		if err := emit(score); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// capTotalCapacity returns the highest scores whose total channel size doesn't
+// exceed maxCapacity, sorted by descending score. Scores are admitted in that
+// order until the next one's channel size would exceed the cap. Scores without
+// a suggested channel size count as chanSize.
+func capTotalCapacity(scores []*NodeScore, chanSize,
+	maxCapacity btcutil.Amount) []*NodeScore {
+
+	// Ties are broken by node ID, such that the selection is
+	// deterministic.
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return bytes.Compare(
+			scores[i].NodeID[:], scores[j].NodeID[:],
+		) < 0
+	})
+
+	var total btcutil.Amount
+	for i, score := range scores {
+		size := chanSize
+		if score.ChanSize > 0 {
+			size = score.ChanSize
+		}
+
+		if total+size > maxCapacity {
+			return scores[:i]
+		}
+		total += size
+	}
+
+	return scores
+}
+
+// normalizeScores rescales the given scores in place, such that the highest
+// score becomes 1.0 and the lowest one the given floor. If all scores are
+// equal, they all become 1.0.
+func normalizeScores(scores []*NodeScore, floor float64) {
+	if len(scores) == 0 {
+		return
+	}
+
+	min, max := scores[0].Score, scores[0].Score
+	for _, score := range scores[1:] {
+		min = math.Min(min, score.Score)
+		max = math.Max(max, score.Score)
+	}
+
+	for _, score := range scores {
+		if max == min {
+			score.Score = 1.0
+			continue
+		}
+
+		rel := (score.Score - min) / (max - min)
+		score.Score = clampScore(floor + rel*(1.0-floor))
+	}
+}
+
+// streamNodeScores computes the combined scores of the given nodes, passing
+// each non-zero score to the given callback. If a summary is given, the
+// number of candidates and the time each sub-heuristic took are recorded in
+// it.
+func (c *WeightedCombAttachment) streamNodeScores(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}, summary *ScoringSummary,
+	emit NodeScoreFunc) error {
+
+	// Nodes we already have the maximum number of channels with won't be
+	// scored at all.
+	nodes = filterSaturatedNodes(
+		nodes, chans, c.currentMaxChannelsPerNode(),
+	)
+
+	// If there are no nodes to score, there's no need to query any of the
+	// sub-heuristics.
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	// We'll use the same set of weights throughout the computation, even
+	// if they are updated in the meantime.
+	heuristics := c.currentHeuristics()
+	policy := c.currentSubScorePolicy()
+	minContributors := c.currentMinContributors()
+
+	// All sub-heuristics will be given the same snapshot of the graph,
+	// such that they see the same topology, and don't race with any
+	// updates to the graph. Graphs that can't take a snapshot of
+	// themselves are only copied if enabled.
+	_, snapshottable := g.(SnapshottableChannelGraph)
+	if g != nil && (snapshottable || c.currentCopyGraph()) {
+		snapshot, err := SnapshotGraph(ctx, g)
 		if err != nil {
-			return nil, fmt.Errorf("unable to get sub score: %v",
-				err)
+			return err
 		}
+		g = snapshot
+	}
 
-		subScores = append(subScores, s)
+	var timer *subScoreTimer
+	if summary != nil {
+		summary.NumCandidates = len(nodes)
+		timer = newSubScoreTimer(c.clock, len(heuristics))
+	}
+
+	// We now query each heuristic to determine the score they give to the
+	// nodes for the given channel size.
+	subScores, failedWeight, err := querySubScores(
+		ctx, heuristics, g, chans, chanSize, nodes,
+		c.currentFailurePolicy(), c.clock, timer,
+	)
+	if err != nil {
+		return err
+	}
+
+	if summary != nil {
+		summary.HeuristicTimings = timer.timings(heuristics)
+	}
+
+	// The weight of any failed rewarding sub-heuristic is redistributed
+	// among the remaining ones, by scaling up their weights
+	// proportionally. Failed penalty heuristics simply don't penalize
+	// any node.
+	weightScale := 1.0
+	if failedWeight > 0 {
+		weightScale = 1.0 / (1.0 - failedWeight)
 	}
 
 	// We combine the scores given by the sub-heuristics by using the
 	// heruistics' given weight factor.
-	scores := make(map[NodeID]*NodeScore)
 	for nID := range nodes {
 		score := &NodeScore{
 			NodeID: nID,
 		}
 
+		// We'll also keep track of how many rewarding sub-heuristics
+		// gave the node a non-zero score, and of the penalty it was
+		// given.
+		var (
+			numContributors int
+			penalty         float64
+		)
+
 		// Each sub-heuristic should have scored the node, if not it is
 		// implicitly given a zero score by that heuristic.
-		for i, h := range c.heuristics {
-			sub, ok := subScores[i][nID]
-			if !ok {
+		for i, h := range heuristics {
+			// A heuristic without any weight effectively removes
+			// its contribution.
+			if h.Weight == 0 {
+				continue
+			}
+
+			var subScore float64
+			if sub, ok := subScores[i][nID]; ok {
+				subScore, err = checkSubScore(
+					h.Name(), sub.Score, policy,
+				)
+				if err != nil {
+					return err
+				}
+			}
+
+			if h.Penalty {
+				penalty += h.Weight * h.transferScore(subScore)
 				continue
 			}
+
+			if subScore > 0 {
+				numContributors++
+			}
+
 			// Use the heuristic's weight factor to determine of
 			// how much weight we should give to this particular
-			// score.
-			score.Score += h.Weight * sub.Score
+			// score, after it has been shaped by its transfer
+			// function.
+			score.Score += weightScale * h.Weight *
+				h.transferScore(subScore)
 		}
 
-		switch {
+		// Sanity check the new score. Rounding errors may push the
+		// score slightly out of range, in which case we'll clamp it,
+		// while anything beyond that indicates a bug. Only then is
+		// the penalty subtracted, with the result clamped again.
+		if !validCombinedScore(score.Score) {
+			return fmt.Errorf("Invalid node score from "+
+				"combination: %v", score.Score)
+		}
+		score.Score = clampScore(score.Score - penalty)
+
 		// Instead of adding a node with score 0 to the returned set,
-		// we just skip it.
-		case score.Score == 0:
+		// we just skip it. The same goes for nodes not enough of the
+		// sub-heuristics agree on.
+		if score.Score == 0 || numContributors < minContributors {
 			continue
-
-		// Sanity check the new score.
-		case score.Score < 0 || score.Score > 1.0:
-			return nil, fmt.Errorf("Invalid node score from "+
-				"combination: %v", score.Score)
 		}
 
-		scores[nID] = score
+		score.Reason = combineReasons(heuristics, subScores, nID)
+		score.ChanSize = combineChanSizes(
+			heuristics, subScores, nID, chanSize,
+		)
+		if err := emit(score); err != nil {
+			return err
+		}
 	}
 
-	return scores, nil
+	return nil
 }
 
 // SetNodeScores is used to set the internal map from NodeIDs to scores. The
@@ -141,17 +963,190 @@ func (c *WeightedCombAttachment) NodeScores(g ChannelGraph, chans []Channel,
 func (c *WeightedCombAttachment) SetNodeScores(targetHeuristic string,
 	newScores map[NodeID]float64) (bool, error) {
 
-	found := false
-	for _, h := range c.heuristics {
-		// It must be ScoreSettable to be available for external
-		// scores.
-		s, ok := h.AttachmentHeuristic.(ScoreSettable)
-		if !ok {
+	return setSubNodeScores(
+		c.currentHeuristics(), targetHeuristic, newScores,
+	)
+}
+
+// combineReasons summarizes the reasons given by the sub-heuristics for the
+// score of the given node, in the form "name: reason; name: reason". An empty
+// string is returned if none of the sub-heuristics gave a reason.
+func combineReasons(heuristics []*WeightedHeuristic,
+	subScores []map[NodeID]*NodeScore, nID NodeID) string {
+
+	var reasons []string
+	for i, h := range heuristics {
+		sub, ok := subScores[i][nID]
+		if !ok || sub.Reason == "" {
+			continue
+		}
+
+		reasons = append(
+			reasons, fmt.Sprintf("%v: %v", h.Name(), sub.Reason),
+		)
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+// combineChanSizes returns the weighted average of the channel sizes suggested
+// by the rewarding sub-heuristics for the given node, clamped to the range
+// [minChanSizeFraction*chanSize, chanSize]. Sub-heuristics scoring the node
+// without suggesting a size count as suggesting chanSize. Zero is returned if
+// none of the sub-heuristics suggested a size.
+func combineChanSizes(heuristics []*WeightedHeuristic,
+	subScores []map[NodeID]*NodeScore, nID NodeID,
+	chanSize btcutil.Amount) btcutil.Amount {
+
+	var (
+		weightedSum float64
+		weightSum   float64
+		suggested   bool
+	)
+	for i, h := range heuristics {
+		sub, ok := subScores[i][nID]
+		if !ok || h.Weight == 0 || h.Penalty {
+			continue
+		}
+
+		size := chanSize
+		if sub.ChanSize > 0 {
+			size = sub.ChanSize
+			suggested = true
+		}
+
+		weightedSum += h.Weight * float64(size)
+		weightSum += h.Weight
+	}
+
+	if !suggested {
+		return 0
+	}
+
+	size := btcutil.Amount(weightedSum / weightSum)
+	minSize := btcutil.Amount(minChanSizeFraction * float64(chanSize))
+	switch {
+	case size > chanSize:
+		return chanSize
+	case size < minSize:
+		return minSize
+	default:
+		return size
+	}
+}
+
+// querySubScores queries each of the given heuristics for the scores they give
+// to the nodes for the given channel size. The returned slice holds the sub
+// scores in the same order as the heuristics were given, with a nil map for
+// heuristics without any weight, as these are not queried. If a timer is
+// given, it records the time each heuristic took. If the context is
+// cancelled, no more heuristics will be queried and the context's error is
+// returned.
+//
+// Failing heuristics are retried according to their retry policy, waiting on
+// the given clock in between. With the BestEffort policy, heuristics still
+// failing are given a nil map as well, and the total weight of the failed
+// rewarding heuristics is returned. An error is only returned if all
+// rewarding heuristics with a weight failed.
+//
+// If the context carries a ScoreMemo, heuristics already queried with the same
+// inputs during this scoring round aren't queried again.
+func querySubScores(ctx context.Context, heuristics []*WeightedHeuristic,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}, policy FailurePolicy, clk clock.Clock,
+	timer *subScoreTimer) ([]map[NodeID]*NodeScore, float64, error) {
+
+	var (
+		subScores    []map[NodeID]*NodeScore
+		totalWeight  float64
+		failedWeight float64
+		lastErr      error
+		memo         = scoreMemoFromContext(ctx)
+	)
+	for i, h := range heuristics {
+		// Bail out early if we've been asked to stop before moving on
+		// to the next heuristic.
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		// A heuristic without any weight doesn't contribute to the
+		// combined score, so we won't query it at all. This also
+		// ensures a failing heuristic can be disabled by setting its
+		// weight to zero.
+		if h.Weight == 0 {
+			subScores = append(subScores, nil)
 			continue
 		}
 
-		// Heuristic supports scoring, attempt to set them.
-		applied, err := s.SetNodeScores(targetHeuristic, newScores)
+		var start time.Time
+		if timer != nil {
+			start = timer.clock.Now()
+		}
+
+		// If the heuristic was already queried by another combinator
+		// sharing the memo of this scoring round, its scores are
+		// reused.
+		s, err := memo.query(
+			ctx, h.AttachmentHeuristic, g, chans, chanSize, nodes,
+			func() (map[NodeID]*NodeScore, error) {
+				return h.queryNodeScores(
+					ctx, clk, g, chans, chanSize, nodes,
+				)
+			},
+		)
+		if timer != nil {
+			timer.durations[i] = timer.clock.Now().Sub(start)
+		}
+		if !h.Penalty {
+			totalWeight += h.Weight
+		}
+		if err != nil {
+			// If the heuristic aborted because the context was
+			// cancelled, we return the context's error as is.
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, 0, ctxErr
+			}
+
+			err = fmt.Errorf("unable to get sub score: %v", err)
+			if policy != BestEffort {
+				return nil, 0, err
+			}
+
+			log.Warnf("Ignoring failed heuristic %v: %v", h.Name(),
+				err)
+
+			if !h.Penalty {
+				failedWeight += h.Weight
+			}
+			lastErr = err
+			subScores = append(subScores, nil)
+			continue
+		}
+
+		subScores = append(subScores, s)
+	}
+
+	// If all rewarding heuristics failed, there's nothing left to
+	// combine, regardless of the penalty heuristics.
+	if lastErr != nil && failedWeight >= totalWeight {
+		return nil, 0, lastErr
+	}
+
+	return subScores, failedWeight, nil
+}
+
+// setSubNodeScores recursively applies the passed scores to each of the given
+// heuristics that is ScoreSettable. The returned boolean indicates whether the
+// targeted heuristic was found among them.
+func setSubNodeScores(heuristics []*WeightedHeuristic, targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	found := false
+	for _, h := range heuristics {
+		applied, err := setInnerNodeScores(
+			h.AttachmentHeuristic, targetHeuristic, newScores,
+		)
 		if err != nil {
 			return false, err
 		}
@@ -160,3 +1155,20 @@ func (c *WeightedCombAttachment) SetNodeScores(targetHeuristic string,
 
 	return found, nil
 }
+
+// setInnerNodeScores applies the passed scores to the given heuristic if it is
+// ScoreSettable. This is used by heuristics wrapping another heuristic to
+// forward the scores. The returned boolean indicates whether the targeted
+// heuristic was found.
+func setInnerNodeScores(h AttachmentHeuristic, targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	// It must be ScoreSettable to be available for external scores.
+	s, ok := h.(ScoreSettable)
+	if !ok {
+		return false, nil
+	}
+
+	// Heuristic supports scoring, attempt to set them.
+	return s.SetNodeScores(targetHeuristic, newScores)
+}
@@ -0,0 +1,1926 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// staticHeuristic is an AttachmentHeuristic that returns a fixed set of
+// scores, regardless of the passed graph and node set. Only nodes present in
+// the queried node set are returned.
+type staticHeuristic struct {
+	name      string
+	scores    map[NodeID]float64
+	reasons   map[NodeID]string
+	chanSizes map[NodeID]btcutil.Amount
+
+	// calls counts the number of times NodeScores has been called.
+	calls int
+}
+
+func (s *staticHeuristic) Name() string {
+	return s.name
+}
+
+func (s *staticHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	s.calls++
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID, score := range s.scores {
+		if _, ok := nodes[nID]; !ok {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID:   nID,
+			Score:    score,
+			Reason:   s.reasons[nID],
+			ChanSize: s.chanSizes[nID],
+		}
+	}
+
+	return scores, nil
+}
+
+var _ AttachmentHeuristic = (*staticHeuristic)(nil)
+
+// testNodeID returns a NodeID that is unique for the given index.
+func testNodeID(i byte) NodeID {
+	var n NodeID
+	n[0] = 0x02
+	n[32] = i
+	return n
+}
+
+// nodeSet returns a node set for the given node IDs.
+func nodeSet(nIDs ...NodeID) map[NodeID]struct{} {
+	nodes := make(map[NodeID]struct{})
+	for _, nID := range nIDs {
+		nodes[nID] = struct{}{}
+	}
+
+	return nodes
+}
+
+// floatEq checks whether the two floats are equal, allowing for a small
+// rounding error.
+func floatEq(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// TestWeightedCombAttachment checks that the WeightedCombAttachment combines
+// its sub-scores using their weighted sum.
+func TestWeightedCombAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.75, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.25, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(node1, node2, node3),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := map[NodeID]float64{
+		node1: 0.75*1.0 + 0.25*0.5,
+		node2: 0.75 * 0.5,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v, got %v", exp, s.Score)
+		}
+	}
+
+	// Weights not summing to 1.0 should be rejected.
+	_, err = NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.25, AttachmentHeuristic: h2},
+	)
+	if err == nil {
+		t.Fatalf("expected invalid weights to be rejected")
+	}
+}
+
+// TestWeightedCombAttachmentTransfer checks that the sub-scores are shaped by
+// the heuristics' transfer functions before being weighted.
+func TestWeightedCombAttachmentTransfer(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 0.8,
+			node2: 0.4,
+			node3: 0.2,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 0.5,
+		},
+	}
+
+	// The first heuristic only matters once its score crosses 0.5, while
+	// the second one is boosted beyond the valid range, which should be
+	// clamped.
+	step := func(s float64) float64 {
+		if s < 0.5 {
+			return 0
+		}
+		return 1
+	}
+	boost := func(s float64) float64 {
+		return 3 * s
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{
+			Weight:              0.75,
+			Transfer:            step,
+			AttachmentHeuristic: h1,
+		},
+		&WeightedHeuristic{
+			Weight:              0.25,
+			Transfer:            boost,
+			AttachmentHeuristic: h2,
+		},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(node1, node2, node3),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// Node 3 only scores below the step with the first heuristic, and
+	// isn't scored by the second, so it should be skipped.
+	expected := map[NodeID]float64{
+		node1: 0.75*1.0 + 0.25*1.0,
+		node2: 0.75*0.0 + 0.25*1.0,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v, got %v", exp, s.Score)
+		}
+	}
+}
+
+// TestWeightedCombAttachmentContext checks that the WeightedCombAttachment
+// stops querying its sub-heuristics once the passed context is cancelled.
+func TestWeightedCombAttachmentContext(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first heuristic will cancel the context when queried, which
+	// should result in the second heuristic never being queried.
+	h1 := &cancelHeuristic{cancel: cancel}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	_, err = QueryNodeScores(
+		ctx, comb, nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1),
+	)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if h2.calls != 0 {
+		t.Fatalf("expected second heuristic to not be queried, was "+
+			"queried %d times", h2.calls)
+	}
+
+	// Querying a regular heuristic with a cancelled context should also
+	// fail without the heuristic being queried.
+	_, err = QueryNodeScores(
+		ctx, h2, nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1),
+	)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if h2.calls != 0 {
+		t.Fatalf("expected heuristic to not be queried, was queried "+
+			"%d times", h2.calls)
+	}
+}
+
+// cancelHeuristic is an AttachmentHeuristic that calls the given cancel
+// function when queried, and returns an empty set of scores.
+type cancelHeuristic struct {
+	cancel func()
+}
+
+func (c *cancelHeuristic) Name() string {
+	return "cancel"
+}
+
+func (c *cancelHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	c.cancel()
+	return nil, nil
+}
+
+// TestWeightedCombAttachmentReasons checks that the WeightedCombAttachment
+// summarizes the reasons given by its sub-heuristics.
+func TestWeightedCombAttachmentReasons(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 1.0,
+		},
+		reasons: map[NodeID]string{
+			node1: "45 channels",
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 0.5,
+		},
+		reasons: map[NodeID]string{
+			node1: "total capacity 12.3 BTC",
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1, node2),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := "h1: 45 channels; h2: total capacity 12.3 BTC"
+	if scores[node1].Reason != expected {
+		t.Fatalf("expected reason %q, got %q", expected,
+			scores[node1].Reason)
+	}
+
+	// Without any reasons given by the sub-heuristics, the reason should
+	// be left empty.
+	if scores[node2].Reason != "" {
+		t.Fatalf("expected empty reason, got %q",
+			scores[node2].Reason)
+	}
+}
+
+// TestWeightedCombAttachmentHeuristics checks that the sub-heuristics of a
+// WeightedCombAttachment can be inspected without modifying them.
+func TestWeightedCombAttachmentHeuristics(t *testing.T) {
+	t.Parallel()
+
+	h1 := &staticHeuristic{name: "h1"}
+	h2 := &staticHeuristic{name: "h2"}
+	weighted := []*WeightedHeuristic{
+		{Weight: 0.75, AttachmentHeuristic: h1},
+		{Weight: 0.25, AttachmentHeuristic: h2},
+	}
+
+	comb, err := NewWeightedCombAttachment(weighted...)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	heuristics := comb.Heuristics()
+	if len(heuristics) != len(weighted) {
+		t.Fatalf("expected %d heuristics, got %d", len(weighted),
+			len(heuristics))
+	}
+	for i, h := range heuristics {
+		if h.Weight != weighted[i].Weight ||
+			h.AttachmentHeuristic != weighted[i].AttachmentHeuristic {
+
+			t.Fatalf("heuristic %d mismatch: expected %v, got %v",
+				i, weighted[i], h)
+		}
+	}
+
+	// Modifying the returned heuristics shouldn't affect the combination.
+	heuristics[0].Weight = 0
+	heuristics[1] = nil
+	for i, h := range comb.Heuristics() {
+		if h.Weight != weighted[i].Weight {
+			t.Fatalf("heuristic %d was modified", i)
+		}
+	}
+
+	h, ok := comb.Heuristic("h2")
+	if !ok {
+		t.Fatalf("heuristic h2 not found")
+	}
+	if h.Weight != 0.25 || h.AttachmentHeuristic != h2 {
+		t.Fatalf("unexpected heuristic %v", h)
+	}
+
+	if _, ok := comb.Heuristic("unknown"); ok {
+		t.Fatalf("expected unknown heuristic not to be found")
+	}
+}
+
+// TestWeightedCombAttachmentSetWeights checks that the weights of the
+// sub-heuristics can be updated while scores are being computed, without any
+// computation observing a mix of old and new weights.
+func TestWeightedCombAttachmentSetWeights(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	h1 := &staticHeuristic{
+		name:   "h1",
+		scores: map[NodeID]float64{node1: 1.0},
+	}
+	h2 := &staticHeuristic{
+		name:   "h2",
+		scores: map[NodeID]float64{node1: 0.5},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.25, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.75, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	// Invalid updates should be rejected, leaving the weights unchanged.
+	err = comb.SetWeights(map[string]float64{"h1": 0.5})
+	if err == nil {
+		t.Fatalf("expected weights not summing to 1.0 to be rejected")
+	}
+	err = comb.SetWeights(map[string]float64{"h1": 0.25, "h3": 0.75})
+	if err == nil {
+		t.Fatalf("expected unknown heuristic to be rejected")
+	}
+	if h, _ := comb.Heuristic("h1"); h.Weight != 0.25 {
+		t.Fatalf("weights modified by invalid update")
+	}
+
+	// Weights summing to 1.0 within the tolerance should be accepted.
+	err = comb.SetWeights(map[string]float64{
+		"h1": 0.3 + weightSumEpsilon/2, "h2": 0.7,
+	})
+	if err != nil {
+		t.Fatalf("unable to set weights: %v", err)
+	}
+
+	// Now we'll flip the weights back and forth while computing scores.
+	// Each score must correspond to one of the two sets of weights.
+	weights := []map[string]float64{
+		{"h1": 0.25, "h2": 0.75},
+		{"h1": 0.75, "h2": 0.25},
+	}
+	validScores := []float64{0.25 + 0.75*0.5, 0.75 + 0.25*0.5}
+	if err := comb.SetWeights(weights[0]); err != nil {
+		t.Fatalf("unable to set weights: %v", err)
+	}
+
+	quit := make(chan struct{})
+	errChan := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				errChan <- nil
+				return
+			default:
+			}
+
+			if err := comb.SetWeights(weights[i%2]); err != nil {
+				errChan <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		scores, err := comb.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1),
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		score := scores[node1].Score
+		if !floatEq(score, validScores[0]) &&
+			!floatEq(score, validScores[1]) {
+
+			t.Fatalf("score %v doesn't match any set of weights",
+				score)
+		}
+	}
+
+	close(quit)
+	if err := <-errChan; err != nil {
+		t.Fatalf("unable to set weights: %v", err)
+	}
+}
+
+// TestWeightedCombAttachmentSubScorePolicy checks that out of range sub-scores
+// from a misbehaving heuristic are either rejected or clamped, according to
+// the configured policy.
+func TestWeightedCombAttachmentSubScorePolicy(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	misbehaving := &staticHeuristic{
+		name: "misbehaving",
+		scores: map[NodeID]float64{
+			node1: 1.5,
+			node2: -0.5,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 0.5,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{
+			Weight:              0.5,
+			AttachmentHeuristic: misbehaving,
+		},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	// By default, the out of range scores should be rejected.
+	_, err = comb.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err == nil {
+		t.Fatalf("expected out of range sub-scores to be rejected")
+	}
+
+	// Once set to clamp, they should be clamped to the valid range.
+	if err := comb.SetSubScorePolicy(SubScoreClamp); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := map[NodeID]float64{
+		node1: 0.5*1.0 + 0.5*0.5,
+		node2: 0.5*0.0 + 0.5*0.5,
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v, got %v", exp, s.Score)
+		}
+	}
+
+	if err := comb.SetSubScorePolicy(SubScorePolicy(99)); err == nil {
+		t.Fatalf("expected unknown policy to be rejected")
+	}
+}
+
+// erroringHeuristic is an AttachmentHeuristic that always fails, counting the
+// number of times it was queried.
+type erroringHeuristic struct {
+	calls int
+}
+
+func (e *erroringHeuristic) Name() string {
+	return "erroring"
+}
+
+func (e *erroringHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	e.calls++
+	return nil, fmt.Errorf("heuristic failed")
+}
+
+var _ AttachmentHeuristic = (*erroringHeuristic)(nil)
+
+// TestCombAttachmentZeroWeight checks that sub-heuristics without any weight
+// are never queried, such that a failing heuristic can be disabled.
+func TestCombAttachmentZeroWeight(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	h1 := &staticHeuristic{
+		name:   "h1",
+		scores: map[NodeID]float64{node1: 0.5},
+	}
+	disabled := &erroringHeuristic{}
+
+	weighted, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0, AttachmentHeuristic: disabled},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	harmonic, err := NewHarmonicCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0, AttachmentHeuristic: disabled},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	for _, comb := range []AttachmentHeuristic{weighted, harmonic} {
+		scores, err := comb.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1),
+		)
+		if err != nil {
+			t.Fatalf("%v: unable to get scores: %v", comb.Name(),
+				err)
+		}
+
+		if !floatEq(scores[node1].Score, 0.5) {
+			t.Fatalf("%v: expected score 0.5, got %v",
+				comb.Name(), scores[node1].Score)
+		}
+	}
+
+	if disabled.calls != 0 {
+		t.Fatalf("zero weight heuristic was queried %d times",
+			disabled.calls)
+	}
+}
+
+// TestWeightedCombAttachmentNoNodes checks that no sub-heuristic is queried if
+// there are no nodes to score.
+func TestWeightedCombAttachmentNoNodes(t *testing.T) {
+	t.Parallel()
+
+	h1 := &staticHeuristic{name: "h1"}
+	h2 := &erroringHeuristic{}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if scores == nil || len(scores) != 0 {
+		t.Fatalf("expected empty scores, got %v", scores)
+	}
+
+	if h1.calls != 0 || h2.calls != 0 {
+		t.Fatalf("sub-heuristics were queried")
+	}
+}
+
+// TestWeightedCombAttachmentNonFinite checks that NaN and infinite sub-scores
+// don't corrupt the combined scores, being treated as zero unless the strict
+// policy is used.
+func TestWeightedCombAttachmentNonFinite(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	nodes := nodeSet(node1, node2, node3)
+
+	misbehaving := &staticHeuristic{
+		name: "misbehaving",
+		scores: map[NodeID]float64{
+			node1: math.NaN(),
+			node2: math.Inf(1),
+			node3: math.Inf(-1),
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 0.5,
+			node3: 0.5,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{
+			Weight:              0.5,
+			AttachmentHeuristic: misbehaving,
+		},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	// Under the default strict policy, each of the scores should be
+	// rejected.
+	for nID := range nodes {
+		_, err := comb.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(nID),
+		)
+		if err == nil {
+			t.Fatalf("expected score %v to be rejected",
+				misbehaving.scores[nID])
+		}
+	}
+
+	// Otherwise, they should be treated as zero.
+	if err := comb.SetSubScorePolicy(SubScoreClamp); err != nil {
+		t.Fatalf("unable to set policy: %v", err)
+	}
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != len(nodes) {
+		t.Fatalf("expected %d scores, got %d", len(nodes), len(scores))
+	}
+	for nID, s := range scores {
+		if !floatEq(s.Score, 0.25) {
+			t.Fatalf("expected score 0.25 for node %x, got %v",
+				nID[:], s.Score)
+		}
+	}
+
+	// The same goes for a transfer function yielding such values.
+	comb, err = NewWeightedCombAttachment(
+		&WeightedHeuristic{
+			Weight: 0.5,
+			Transfer: func(s float64) float64 {
+				return 1 / (s - 0.5)
+			},
+			AttachmentHeuristic: h2,
+		},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	scores, err = comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	for nID, s := range scores {
+		if !floatEq(s.Score, 0.25) {
+			t.Fatalf("expected score 0.25 for node %x, got %v",
+				nID[:], s.Score)
+		}
+	}
+}
+
+// TestWeightedCombAttachmentMaxChannelsPerNode checks that nodes we already
+// have the maximum number of channels with are not scored.
+func TestWeightedCombAttachmentMaxChannelsPerNode(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	nodes := nodeSet(node1, node2, node3)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 1.0,
+			node3: 1.0,
+		},
+	}
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: h1},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	// We have two channels with the first node, and one with the second.
+	chans := []Channel{
+		{ChanID: randChanID(), Node: node1},
+		{ChanID: randChanID(), Node: node1},
+		{ChanID: randChanID(), Node: node2},
+	}
+
+	tests := []struct {
+		max      int
+		expected []NodeID
+	}{
+		{
+			max:      0,
+			expected: []NodeID{node1, node2, node3},
+		},
+		{
+			max:      -1,
+			expected: []NodeID{node1, node2, node3},
+		},
+		{
+			max:      3,
+			expected: []NodeID{node1, node2, node3},
+		},
+		{
+			max:      2,
+			expected: []NodeID{node2, node3},
+		},
+		{
+			max:      1,
+			expected: []NodeID{node3},
+		},
+	}
+
+	for _, test := range tests {
+		comb.SetMaxChannelsPerNode(test.max)
+
+		scores, err := comb.NodeScores(
+			nil, chans, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(test.expected) {
+			t.Fatalf("max %d: expected %d scores, got %d",
+				test.max, len(test.expected), len(scores))
+		}
+		for _, nID := range test.expected {
+			if _, ok := scores[nID]; !ok {
+				t.Fatalf("max %d: node %x not scored",
+					test.max, nID[:])
+			}
+		}
+	}
+}
+
+// TestWeightedCombAttachmentMinContributors checks that nodes given a non-zero
+// score by fewer than the minimum number of sub-heuristics are excluded.
+func TestWeightedCombAttachmentMinContributors(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	nodes := nodeSet(node1, node2, node3)
+
+	// The first node is only scored by h1, as h3 doesn't have any weight,
+	// and the third one is given an explicit zero score by h2, so only the
+	// second node is given a non-zero score by two sub-heuristics.
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.6,
+			node3: 0.8,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node2: 0.4,
+			node3: 0,
+		},
+	}
+	h3 := &staticHeuristic{
+		name: "h3",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node3: 1.0,
+		},
+	}
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+		&WeightedHeuristic{Weight: 0, AttachmentHeuristic: h3},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	tests := []struct {
+		min      int
+		expected map[NodeID]float64
+	}{
+		{
+			min: 0,
+			expected: map[NodeID]float64{
+				node1: 0.5,
+				node2: 0.5,
+				node3: 0.4,
+			},
+		},
+		{
+			min: 1,
+			expected: map[NodeID]float64{
+				node1: 0.5,
+				node2: 0.5,
+				node3: 0.4,
+			},
+		},
+		{
+			min: 2,
+			expected: map[NodeID]float64{
+				node2: 0.5,
+			},
+		},
+		{
+			min:      3,
+			expected: map[NodeID]float64{},
+		},
+	}
+
+	for _, test := range tests {
+		comb.SetMinContributors(test.min)
+
+		scores, err := comb.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(test.expected) {
+			t.Fatalf("min %d: expected %d scores, got %d",
+				test.min, len(test.expected), len(scores))
+		}
+		for nID, expected := range test.expected {
+			score, ok := scores[nID]
+			if !ok {
+				t.Fatalf("min %d: node %x not scored",
+					test.min, nID[:])
+			}
+			if !floatEq(score.Score, expected) {
+				t.Fatalf("min %d: expected score %v for node "+
+					"%x, got %v", test.min, expected,
+					nID[:], score.Score)
+			}
+		}
+	}
+}
+
+// TestWeightedCombAttachmentObserver checks that the observer is given an
+// accurate summary of each scoring round, and that no observer is required.
+func TestWeightedCombAttachmentObserver(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	nodes := nodeSet(node1, node2, node3)
+
+	testClock := clock.NewTestClock(time.Unix(1000, 0))
+
+	// The first heuristic takes a second to compute its scores.
+	h1 := &graphObservingHeuristic{
+		t:    t,
+		name: "slow",
+		mutate: func() {
+			testClock.Advance(time.Second)
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "static",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	comb.clock = testClock
+
+	// Scoring without an observer should work as usual.
+	_, err = comb.NodeScores(
+		newMemChannelGraph(), nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	var summaries []*ScoringSummary
+	comb.SetObserver(func(s *ScoringSummary) {
+		summaries = append(summaries, s)
+	})
+
+	_, err = comb.NodeScores(
+		newMemChannelGraph(), nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	if len(summaries) != 1 {
+		t.Fatalf("expected 1 summary, got %d", len(summaries))
+	}
+	summary := summaries[0]
+
+	if summary.Duration != time.Second {
+		t.Fatalf("expected duration of 1s, got %v", summary.Duration)
+	}
+	if summary.NumCandidates != 3 || summary.NumScored != 2 {
+		t.Fatalf("expected 3 candidates and 2 scored nodes, got %d "+
+			"and %d", summary.NumCandidates, summary.NumScored)
+	}
+	if !floatEq(summary.MinScore, 0.25) ||
+		!floatEq(summary.MaxScore, 0.5) ||
+		!floatEq(summary.MeanScore, 0.375) {
+
+		t.Fatalf("unexpected score distribution: min=%v, max=%v, "+
+			"mean=%v", summary.MinScore, summary.MaxScore,
+			summary.MeanScore)
+	}
+
+	expectedTimings := []HeuristicTiming{
+		{Name: "slow", Duration: time.Second},
+		{Name: "static", Duration: 0},
+	}
+	if !reflect.DeepEqual(summary.HeuristicTimings, expectedTimings) {
+		t.Fatalf("expected timings %v, got %v", expectedTimings,
+			summary.HeuristicTimings)
+	}
+
+	// Removing the observer again should be safe.
+	comb.SetObserver(nil)
+	_, err = comb.NodeScores(
+		newMemChannelGraph(), nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("observer invoked after being removed")
+	}
+}
+
+// TestWeightedCombAttachmentStream checks that the scores emitted by
+// NodeScoresStream match the ones returned by NodeScores, and that an error
+// returned by the callback aborts the stream.
+func TestWeightedCombAttachmentStream(t *testing.T) {
+	t.Parallel()
+
+	const numNodes = 100
+
+	h1 := &staticHeuristic{
+		name:   "h1",
+		scores: make(map[NodeID]float64),
+	}
+	h2 := &staticHeuristic{
+		name:   "h2",
+		scores: make(map[NodeID]float64),
+	}
+
+	var nIDs []NodeID
+	for i := 0; i < numNodes; i++ {
+		nID := testNodeID(byte(i))
+		nIDs = append(nIDs, nID)
+
+		// Leave some of the nodes unscored by both heuristics.
+		if i%5 == 0 {
+			continue
+		}
+		h1.scores[nID] = float64(i) / numNodes
+		h2.scores[nID] = 1.0 - float64(i)/numNodes
+	}
+	nodes := nodeSet(nIDs...)
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.25, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.75, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	expected, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	streamed := make(map[NodeID]*NodeScore)
+	err = comb.NodeScoresStream(
+		context.Background(), nil, nil, btcutil.SatoshiPerBitcoin,
+		nodes, func(score *NodeScore) error {
+			if _, ok := streamed[score.NodeID]; ok {
+				return fmt.Errorf("node %x emitted twice",
+					score.NodeID[:])
+			}
+			streamed[score.NodeID] = score
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("unable to stream scores: %v", err)
+	}
+
+	if !reflect.DeepEqual(streamed, expected) {
+		t.Fatalf("streamed scores %v don't match %v", streamed,
+			expected)
+	}
+
+	// An error returned by the callback should stop the stream, and be
+	// returned as is.
+	errStop := fmt.Errorf("stop")
+	numEmitted := 0
+	err = comb.NodeScoresStream(
+		context.Background(), nil, nil, btcutil.SatoshiPerBitcoin,
+		nodes, func(score *NodeScore) error {
+			numEmitted++
+			return errStop
+		},
+	)
+	if err != errStop {
+		t.Fatalf("expected error %v, got %v", errStop, err)
+	}
+	if numEmitted != 1 {
+		t.Fatalf("expected 1 emitted score, got %d", numEmitted)
+	}
+
+	// StreamNodeScores should fall back to emitting the scores of
+	// heuristics not supporting streaming one by one.
+	streamed = make(map[NodeID]*NodeScore)
+	err = StreamNodeScores(
+		context.Background(), h1, nil, nil, btcutil.SatoshiPerBitcoin,
+		nodes, func(score *NodeScore) error {
+			streamed[score.NodeID] = score
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("unable to stream scores: %v", err)
+	}
+	if len(streamed) != len(h1.scores) {
+		t.Fatalf("expected %d scores, got %d", len(h1.scores),
+			len(streamed))
+	}
+}
+
+// TestWeightedCombAttachmentOvershoot checks that combined scores slightly
+// exceeding 1.0 due to rounding errors are clamped, while scores grossly out
+// of range are rejected.
+func TestWeightedCombAttachmentOvershoot(t *testing.T) {
+	t.Parallel()
+
+	node := testNodeID(1)
+	h := &staticHeuristic{
+		name: "static",
+		scores: map[NodeID]float64{
+			node: 1.0,
+		},
+	}
+
+	// The weights sum to slightly above 1.0, within the allowed
+	// tolerance, such that the weighted sum of the sub-scores is slightly
+	// above 1.0 as well.
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h},
+		&WeightedHeuristic{Weight: 0.5000001, AttachmentHeuristic: h},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if scores[node].Score != 1.0 {
+		t.Fatalf("expected score to be clamped to 1.0, got %v",
+			scores[node].Score)
+	}
+
+	// Weights grossly exceeding 1.0 can't be set through the API, but
+	// would produce an invalid score that must not be clamped.
+	comb.heuristics = []*WeightedHeuristic{
+		{Weight: 0.75, AttachmentHeuristic: h},
+		{Weight: 0.75, AttachmentHeuristic: h},
+	}
+	_, err = comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node),
+	)
+	if err == nil {
+		t.Fatalf("expected score out of range to be rejected")
+	}
+}
+
+// TestWeightedCombAttachmentChanSize checks that the channel sizes suggested by
+// the sub-heuristics are combined using their weights, and clamped to bounds
+// derived from the channel size.
+func TestWeightedCombAttachmentChanSize(t *testing.T) {
+	t.Parallel()
+
+	const chanSize = btcutil.SatoshiPerBitcoin
+
+	partial := testNodeID(1)
+	tooLarge := testNodeID(2)
+	tooSmall := testNodeID(3)
+	noSuggestion := testNodeID(4)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			partial:      1.0,
+			tooLarge:     1.0,
+			tooSmall:     1.0,
+			noSuggestion: 1.0,
+		},
+		chanSizes: map[NodeID]btcutil.Amount{
+			partial:  chanSize / 5,
+			tooLarge: 2 * chanSize,
+			tooSmall: 1000,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			partial:      1.0,
+			tooLarge:     1.0,
+			noSuggestion: 1.0,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.75, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.25, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, chanSize,
+		nodeSet(partial, tooLarge, tooSmall, noSuggestion),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := map[NodeID]btcutil.Amount{
+		// The second heuristic doesn't suggest a size, so it counts as
+		// suggesting the full channel size.
+		partial: btcutil.Amount(0.75*chanSize/5 + 0.25*chanSize),
+
+		// Suggestions exceeding the channel size are capped.
+		tooLarge: chanSize,
+
+		// Only the first heuristic scored this node, and its tiny
+		// suggestion is raised to the minimum.
+		tooSmall: chanSize / 10,
+
+		// Without any suggestion, there's no preference.
+		noSuggestion: 0,
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if s.ChanSize != exp {
+			t.Fatalf("node %x: expected channel size %v, got %v",
+				nID[:], exp, s.ChanSize)
+		}
+	}
+}
+
+// TestWeightedCombAttachmentFailurePolicy checks that a failing sub-heuristic
+// fails the combination by default, while with the BestEffort policy the
+// remaining sub-heuristics still produce scores.
+func TestWeightedCombAttachmentFailurePolicy(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+		},
+	}
+	failing := &erroringHeuristic{}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.3, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.2, AttachmentHeuristic: h2},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: failing},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	_, err = comb.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err == nil {
+		t.Fatalf("expected failing heuristic to fail the combination")
+	}
+
+	if err := comb.SetFailurePolicy(BestEffort); err != nil {
+		t.Fatalf("unable to set failure policy: %v", err)
+	}
+
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// The weight of the failed heuristic is redistributed, such that the
+	// remaining heuristics have weights of 0.6 and 0.4.
+	expected := map[NodeID]float64{
+		node1: 0.6*1.0 + 0.4*0.5,
+		node2: 0.6 * 0.5,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v, got %v", exp, s.Score)
+		}
+	}
+
+	// If all heuristics fail, the combination should fail as well.
+	comb, err = NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: failing},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	if err := comb.SetFailurePolicy(BestEffort); err != nil {
+		t.Fatalf("unable to set failure policy: %v", err)
+	}
+
+	_, err = comb.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err == nil {
+		t.Fatalf("expected combination to fail")
+	}
+
+	if err := comb.SetFailurePolicy(FailurePolicy(99)); err == nil {
+		t.Fatalf("expected unknown policy to be rejected")
+	}
+}
+
+// TestWeightedCombAttachmentNormalization checks that enabling the
+// normalization rescales the combined scores to the range [floor, 1.0], while
+// preserving their relative ordering.
+func TestWeightedCombAttachmentNormalization(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	node4 := testNodeID(4)
+	nodes := nodeSet(node1, node2, node3, node4)
+
+	h := &staticHeuristic{
+		name: "h",
+		scores: map[NodeID]float64{
+			node1: 0.4,
+			node2: 0.3,
+			node3: 0.2,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: h},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	checkScores := func(expected map[NodeID]float64) {
+		t.Helper()
+
+		scores, err := comb.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+		for nID, exp := range expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("node %x not scored", nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("expected score %v for node %x, got %v",
+					exp, nID[:], s.Score)
+			}
+		}
+	}
+
+	// Without normalization, the scores are left as is.
+	checkScores(map[NodeID]float64{
+		node1: 0.4,
+		node2: 0.3,
+		node3: 0.2,
+	})
+
+	// With a floor of 0.2, the best node should be given a score of 1.0,
+	// the worst nonzero one 0.2, and the one in between should be placed
+	// halfway. The node with a zero score should still be skipped.
+	if err := comb.SetNormalizationFloor(0.2); err != nil {
+		t.Fatalf("unable to set normalization floor: %v", err)
+	}
+	checkScores(map[NodeID]float64{
+		node1: 1.0,
+		node2: 0.6,
+		node3: 0.2,
+	})
+
+	// Disabling the normalization again should restore the raw scores.
+	if err := comb.SetNormalizationFloor(0); err != nil {
+		t.Fatalf("unable to disable normalization: %v", err)
+	}
+	checkScores(map[NodeID]float64{
+		node1: 0.4,
+		node2: 0.3,
+		node3: 0.2,
+	})
+
+	// If all candidates are given the same score, they should all be
+	// mapped to 1.0.
+	h.scores = map[NodeID]float64{
+		node1: 0.3,
+		node2: 0.3,
+	}
+	if err := comb.SetNormalizationFloor(0.5); err != nil {
+		t.Fatalf("unable to set normalization floor: %v", err)
+	}
+	checkScores(map[NodeID]float64{
+		node1: 1.0,
+		node2: 1.0,
+	})
+
+	invalidFloors := []float64{-0.1, 1.1, math.NaN(), math.Inf(1)}
+	for _, floor := range invalidFloors {
+		if err := comb.SetNormalizationFloor(floor); err == nil {
+			t.Fatalf("expected floor %v to be rejected", floor)
+		}
+	}
+}
+
+// flakyHeuristic is an AttachmentHeuristic that fails a given number of times
+// before returning the scores of the wrapped heuristic.
+type flakyHeuristic struct {
+	*staticHeuristic
+
+	failures int
+	calls    int
+}
+
+func (f *flakyHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, fmt.Errorf("transient failure")
+	}
+
+	return f.staticHeuristic.NodeScores(g, chans, chanSize, nodes)
+}
+
+var _ AttachmentHeuristic = (*flakyHeuristic)(nil)
+
+// TestWeightedCombAttachmentRetry checks that failing sub-heuristics are
+// retried according to their retry policy, and that retries aren't attempted
+// if they can't start before the context's deadline.
+func TestWeightedCombAttachmentRetry(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	nodes := nodeSet(node1)
+
+	newFlaky := func(failures int) *flakyHeuristic {
+		return &flakyHeuristic{
+			staticHeuristic: &staticHeuristic{
+				name:   "flaky",
+				scores: map[NodeID]float64{node1: 1.0},
+			},
+			failures: failures,
+		}
+	}
+	h2 := &staticHeuristic{
+		name:   "h2",
+		scores: map[NodeID]float64{node1: 0.5},
+	}
+
+	tests := []struct {
+		name          string
+		failures      int
+		retry         RetryPolicy
+		timeout       time.Duration
+		elapsed       time.Duration
+		expectedCalls int
+		expected      float64
+	}{
+		{
+			// The heuristic succeeds on the third attempt, so its
+			// score should be included.
+			name:     "retry succeeds",
+			failures: 2,
+			retry: RetryPolicy{
+				MaxAttempts: 3,
+				BaseDelay:   time.Millisecond,
+			},
+			expectedCalls: 3,
+			expected:      0.5*1.0 + 0.5*0.5,
+		},
+		{
+			// Without a retry policy, the heuristic is dropped
+			// after its first failure.
+			name:          "no retries",
+			failures:      2,
+			expectedCalls: 1,
+			expected:      0.5,
+		},
+		{
+			// The heuristic runs out of attempts, so it should be
+			// dropped.
+			name:     "attempts exhausted",
+			failures: 2,
+			retry: RetryPolicy{
+				MaxAttempts: 2,
+				BaseDelay:   time.Millisecond,
+			},
+			expectedCalls: 2,
+			expected:      0.5,
+		},
+		{
+			// The retry couldn't start before the deadline, so the
+			// heuristic should be dropped without waiting.
+			name:     "deadline",
+			failures: 2,
+			retry: RetryPolicy{
+				MaxAttempts: 3,
+				BaseDelay:   time.Hour,
+			},
+			timeout:       time.Minute,
+			expectedCalls: 1,
+			expected:      0.5,
+		},
+		{
+			// Most of the timeout has already elapsed according
+			// to the heuristic's clock, so the retry couldn't
+			// start before the deadline.
+			name:     "deadline by clock",
+			failures: 2,
+			retry: RetryPolicy{
+				MaxAttempts: 3,
+				BaseDelay:   time.Minute,
+			},
+			timeout:       time.Hour,
+			elapsed:       59*time.Minute + 30*time.Second,
+			expectedCalls: 1,
+			expected:      0.5,
+		},
+	}
+
+	for _, test := range tests {
+		flaky := newFlaky(test.failures)
+		comb, err := NewWeightedCombAttachment(
+			&WeightedHeuristic{
+				Weight:              0.5,
+				Retry:               test.retry,
+				AttachmentHeuristic: flaky,
+			},
+			&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to create heuristic: %v",
+				test.name, err)
+		}
+		if err := comb.SetFailurePolicy(BestEffort); err != nil {
+			t.Fatalf("test %q: unable to set failure policy: %v",
+				test.name, err)
+		}
+		if test.elapsed != 0 {
+			testClock := clock.NewTestClock(time.Now())
+			testClock.SetTime(testClock.Now().Add(test.elapsed))
+			comb.clock = testClock
+		}
+
+		ctx := context.Background()
+		if test.timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, test.timeout)
+			defer cancel()
+		}
+
+		scores, err := comb.NodeScoresContext(
+			ctx, nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to get scores: %v",
+				test.name, err)
+		}
+
+		if flaky.calls != test.expectedCalls {
+			t.Fatalf("test %q: expected %d calls, got %d",
+				test.name, test.expectedCalls, flaky.calls)
+		}
+
+		// A dropped heuristic has its weight redistributed, so the
+		// remaining one alone determines the score.
+		s, ok := scores[node1]
+		if !ok {
+			t.Fatalf("test %q: node not scored", test.name)
+		}
+		if !floatEq(s.Score, test.expected) {
+			t.Fatalf("test %q: expected score %v, got %v",
+				test.name, test.expected, s.Score)
+		}
+	}
+}
+
+// TestWeightedCombAttachmentPenalty checks that the weighted scores of penalty
+// heuristics are subtracted from the combined score, and that their weights
+// are validated separately from the rewarding ones.
+func TestWeightedCombAttachmentPenalty(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	node4 := testNodeID(4)
+	nodes := nodeSet(node1, node2, node3, node4)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+			node3: 0.5,
+			node4: 0.2,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+		},
+	}
+	penalty := &staticHeuristic{
+		name: "penalty",
+		scores: map[NodeID]float64{
+			node1: 0.4,
+			node2: 1.0,
+			node4: 1.0,
+		},
+	}
+
+	// The penalty weight doesn't count towards the rewarding weights
+	// summing to 1.0.
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.6, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.4, AttachmentHeuristic: h2},
+		&WeightedHeuristic{
+			Weight:              0.5,
+			Penalty:             true,
+			AttachmentHeuristic: penalty,
+		},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	// The second node's reward is cancelled out by its penalty, and the
+	// fourth node's penalty exceeds its reward, so neither are scored.
+	scores, err := comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := map[NodeID]float64{
+		node1: 0.8,
+		node3: 0.3,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("node %x: expected score %v, got %v", nID[:],
+				exp, s.Score)
+		}
+	}
+
+	// A failing penalty heuristic shouldn't penalize any node with the
+	// BestEffort policy, nor should its weight be redistributed.
+	comb, err = NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.6, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.4, AttachmentHeuristic: h2},
+		&WeightedHeuristic{
+			Weight:              0.5,
+			Penalty:             true,
+			AttachmentHeuristic: &erroringHeuristic{},
+		},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	if err := comb.SetFailurePolicy(BestEffort); err != nil {
+		t.Fatalf("unable to set failure policy: %v", err)
+	}
+
+	scores, err = comb.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != len(nodes) {
+		t.Fatalf("expected %d scores, got %d", len(nodes), len(scores))
+	}
+	if !floatEq(scores[node2].Score, 0.5) {
+		t.Fatalf("expected unpenalized score 0.5, got %v",
+			scores[node2].Score)
+	}
+
+	// All weights must be in the range [0, 1.0], while the rewarding
+	// weights must still sum to 1.0 on their own.
+	invalid := [][]*WeightedHeuristic{
+		{
+			{Weight: 1.5, AttachmentHeuristic: h1},
+			{Weight: -0.5, AttachmentHeuristic: penalty},
+		},
+		{
+			{Weight: 1.0, AttachmentHeuristic: h1},
+			{
+				Weight:              1.5,
+				Penalty:             true,
+				AttachmentHeuristic: penalty,
+			},
+		},
+		{
+			{Weight: 1.0, AttachmentHeuristic: h1},
+			{
+				Weight:              -0.5,
+				Penalty:             true,
+				AttachmentHeuristic: penalty,
+			},
+		},
+		{
+			{Weight: 0.5, AttachmentHeuristic: h1},
+			{
+				Weight:              0.5,
+				Penalty:             true,
+				AttachmentHeuristic: penalty,
+			},
+		},
+	}
+	for i, h := range invalid {
+		if _, err := NewWeightedCombAttachment(h...); err == nil {
+			t.Fatalf("expected weights %d to be rejected", i)
+		}
+	}
+
+	// Penalties can't be expressed by the harmonic combination.
+	_, err = NewHarmonicCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: h1},
+		&WeightedHeuristic{
+			Weight:              0.5,
+			Penalty:             true,
+			AttachmentHeuristic: penalty,
+		},
+	)
+	if err == nil {
+		t.Fatalf("expected penalty heuristic to be rejected")
+	}
+}
+
+// TestWeightedCombAttachmentMaxTotalNewCapacity checks that only the highest
+// scored nodes whose total channel size fits within the configured cap are
+// recommended.
+func TestWeightedCombAttachmentMaxTotalNewCapacity(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	node4 := testNodeID(4)
+	node5 := testNodeID(5)
+	nodes := nodeSet(node1, node2, node3, node4, node5)
+
+	h := &staticHeuristic{
+		name: "h",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 0.9,
+			node3: 0.1,
+			node4: 0.7,
+			node5: 0.3,
+		},
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 1.0, AttachmentHeuristic: h},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	const chanSize = btcutil.SatoshiPerBitcoin
+
+	checkScores := func(expected ...NodeID) {
+		t.Helper()
+
+		scores, err := comb.NodeScores(nil, nil, chanSize, nodes)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+		for _, nID := range expected {
+			if _, ok := scores[nID]; !ok {
+				t.Fatalf("node %x not recommended", nID[:])
+			}
+		}
+	}
+
+	// Without a cap, all scored nodes are recommended.
+	checkScores(node1, node2, node3, node4, node5)
+
+	// A cap fitting two and a half channels should only admit the two
+	// best nodes.
+	comb.SetMaxTotalNewCapacity(chanSize * 5 / 2)
+	checkScores(node2, node4)
+
+	// The cap is inclusive, so three full channels admit the three best
+	// nodes.
+	comb.SetMaxTotalNewCapacity(chanSize * 3)
+	checkScores(node2, node4, node1)
+
+	// A cap smaller than a single channel admits nothing.
+	comb.SetMaxTotalNewCapacity(chanSize / 2)
+	checkScores()
+
+	// Resetting the cap recommends all nodes again.
+	comb.SetMaxTotalNewCapacity(0)
+	checkScores(node1, node2, node3, node4, node5)
+
+	// The order should also be respected when streaming.
+	comb.SetMaxTotalNewCapacity(chanSize * 2)
+	var streamed []NodeID
+	err = comb.NodeScoresStream(
+		context.Background(), nil, nil, chanSize, nodes,
+		func(score *NodeScore) error {
+			streamed = append(streamed, score.NodeID)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("unable to stream scores: %v", err)
+	}
+	if len(streamed) != 2 || streamed[0] != node2 ||
+		streamed[1] != node4 {
+
+		t.Fatalf("expected nodes %x and %x, got %x", node2[:],
+			node4[:], streamed)
+	}
+}
@@ -0,0 +1,96 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// ConstantAttachment is an implementation of the AttachmentHeuristic interface
+// that gives every candidate node the same score, regardless of the graph. It
+// is useful as a baseline when composing heuristics, e.g. by giving it a small
+// weight within a WeightedCombAttachment such that every node gets a minimum
+// of consideration.
+//
+// The zero value is a valid heuristic giving every node a score of zero.
+type ConstantAttachment struct {
+	// score is the score given to every node.
+	score float64
+
+	// uniform indicates that every node should be given a score of
+	// 1/len(nodes), instead of the fixed score.
+	uniform bool
+}
+
+// NewConstantAttachment creates a new instance of a ConstantAttachment giving
+// every node the passed score, which must be in the range [0, 1.0].
+func NewConstantAttachment(score float64) (*ConstantAttachment, error) {
+	if score < 0 || score > 1.0 {
+		return nil, fmt.Errorf("score must be in the range [0, 1.0], "+
+			"was %v", score)
+	}
+
+	return &ConstantAttachment{
+		score: score,
+	}, nil
+}
+
+// NewUniformAttachment creates a new instance of a ConstantAttachment that
+// spreads a total score of 1.0 evenly among the candidates, giving each of the
+// nodes a score of 1/len(nodes).
+func NewUniformAttachment() *ConstantAttachment {
+	return &ConstantAttachment{
+		uniform: true,
+	}
+}
+
+// A compile time assertion to ensure ConstantAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*ConstantAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *ConstantAttachment) Name() string {
+	return "constant"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Every node is given the same score, which is either the fixed score of this
+// heuristic, or 1/len(nodes) in uniform mode. If the score is zero, an empty
+// map is returned.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *ConstantAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	scores := make(map[NodeID]*NodeScore)
+	if len(nodes) == 0 {
+		return scores, nil
+	}
+
+	score := c.score
+	if c.uniform {
+		score = 1.0 / float64(len(nodes))
+	}
+
+	// Nodes with a zero score are implicitly given that score by not
+	// being part of the returned map.
+	if score == 0 {
+		return scores, nil
+	}
+
+	for nID := range nodes {
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return scores, nil
+}
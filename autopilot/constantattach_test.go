@@ -0,0 +1,99 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestConstantAttachment checks that the ConstantAttachment gives every node
+// the configured score, and rejects scores out of range.
+func TestConstantAttachment(t *testing.T) {
+	t.Parallel()
+
+	nodes := nodeSet(testNodeID(1), testNodeID(2), testNodeID(3))
+
+	// The zero value should give every node a zero score, and thus not
+	// return any of them.
+	var zero ConstantAttachment
+	scores, err := zero.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != 0 {
+		t.Fatalf("expected no scores, got %d", len(scores))
+	}
+
+	constant, err := NewConstantAttachment(0.2)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	scores, err = constant.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != len(nodes) {
+		t.Fatalf("expected %d scores, got %d", len(nodes),
+			len(scores))
+	}
+	for nID := range nodes {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if s.Score != 0.2 {
+			t.Fatalf("expected score 0.2, got %v", s.Score)
+		}
+	}
+
+	for _, score := range []float64{-0.1, 1.1} {
+		if _, err := NewConstantAttachment(score); err == nil {
+			t.Fatalf("expected score %v to be rejected", score)
+		}
+	}
+}
+
+// TestUniformAttachment checks that the uniform mode of the ConstantAttachment
+// spreads a total score of 1.0 evenly among the nodes.
+func TestUniformAttachment(t *testing.T) {
+	t.Parallel()
+
+	uniform := NewUniformAttachment()
+
+	scores, err := uniform.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nil,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != 0 {
+		t.Fatalf("expected no scores, got %d", len(scores))
+	}
+
+	nodes := nodeSet(
+		testNodeID(1), testNodeID(2), testNodeID(3), testNodeID(4),
+	)
+	scores, err = uniform.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != len(nodes) {
+		t.Fatalf("expected %d scores, got %d", len(nodes),
+			len(scores))
+	}
+	for nID := range nodes {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if s.Score != 0.25 {
+			t.Fatalf("expected score 0.25, got %v", s.Score)
+		}
+	}
+}
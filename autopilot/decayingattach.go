@@ -0,0 +1,216 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// DecayingAttachmentConfig houses the parameters of a DecayingAttachment.
+type DecayingAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be smoothed.
+	Heuristic AttachmentHeuristic
+
+	// HalfLife is the amount of time after which a previously returned
+	// score only contributes half to the blended score.
+	HalfLife time.Duration
+
+	// Clock is used to determine the current time. If nil, the default
+	// clock is used.
+	Clock clock.Clock
+}
+
+// decayedScoreEpsilon is the score below which a blended score is considered
+// to have decayed to zero. Such nodes aren't returned, and their previous
+// scores are forgotten.
+const decayedScoreEpsilon = 1e-6
+
+// decayedScore is a score previously returned for a node, along with the time
+// it was returned.
+type decayedScore struct {
+	score     float64
+	timestamp time.Time
+}
+
+// DecayingAttachment is an implementation of the AttachmentHeuristic
+// interface that wraps another heuristic, and smooths its scores over time. A
+// single noisy graph snapshot can otherwise cause the recommendations of the
+// autopilot to oscillate.
+//
+// The score of a node is a blend of the score given by the wrapped heuristic
+// and the score previously returned for the node. The weight of the previous
+// score decays exponentially with the time elapsed since it was returned,
+// halving every half-life.
+type DecayingAttachment struct {
+	cfg DecayingAttachmentConfig
+
+	prevScores map[NodeID]decayedScore
+	sync.Mutex
+}
+
+// NewDecayingAttachment creates a new instance of a DecayingAttachment
+// heuristic.
+func NewDecayingAttachment(cfg DecayingAttachmentConfig) (*DecayingAttachment,
+	error) {
+
+	if cfg.HalfLife <= 0 {
+		return nil, fmt.Errorf("half-life must be positive, was %v",
+			cfg.HalfLife)
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewDefaultClock()
+	}
+
+	return &DecayingAttachment{
+		cfg:        cfg,
+		prevScores: make(map[NodeID]decayedScore),
+	}, nil
+}
+
+// A compile time assertion to ensure DecayingAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*DecayingAttachment)(nil)
+var _ ScoreSettable = (*DecayingAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DecayingAttachment) Name() string {
+	return "decaying"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score of a node seen for the first time is the one given by the wrapped
+// heuristic. For nodes scored before, the previous score is blended in with a
+// weight of 0.5^(elapsed/half-life). Any other fields of the wrapped
+// heuristic's NodeScore, such as the suggested channel size, are carried
+// through.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DecayingAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return d.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic. If the context marks a preview, the returned
+// scores aren't recorded as the ones to blend into the next scoring round.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (d *DecayingAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, d.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.cfg.Clock.Now()
+	preview := IsScorePreview(ctx)
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		// Nodes not returned by the wrapped heuristic have a score of
+		// zero. We copy the returned score, such that the wrapped
+		// heuristic's NodeScore isn't modified.
+		var candidate NodeScore
+		if s, ok := scores[nID]; ok && s != nil {
+			candidate = *s
+		}
+		candidate.NodeID = nID
+
+		score := candidate.Score
+		if prev, ok := d.prevScores[nID]; ok {
+			w := d.decayWeight(prev, now)
+			score = w*prev.score + (1-w)*candidate.Score
+		}
+
+		// We only need to remember nodes that have been given a score,
+		// as nodes never scored before will use the raw score anyway.
+		// During a preview, they are left untouched.
+		if score < decayedScoreEpsilon {
+			if !preview {
+				delete(d.prevScores, nID)
+			}
+			continue
+		}
+
+		if !preview {
+			d.prevScores[nID] = decayedScore{
+				score:     score,
+				timestamp: now,
+			}
+		}
+
+		candidate.Score = score
+		candidates[nID] = &candidate
+	}
+
+	// Nodes that are no longer queried would otherwise be remembered
+	// forever, so we forget them once their previous score has decayed
+	// to zero.
+	if !preview {
+		for nID, prev := range d.prevScores {
+			if _, ok := nodes[nID]; ok {
+				continue
+			}
+
+			decayed := d.decayWeight(prev, now) * prev.score
+			if decayed < decayedScoreEpsilon {
+				delete(d.prevScores, nID)
+			}
+		}
+	}
+
+	return candidates, nil
+}
+
+// decayWeight returns the weight of the given previous score at the given
+// time, which halves every half-life.
+func (d *DecayingAttachment) decayWeight(prev decayedScore,
+	now time.Time) float64 {
+
+	elapsed := now.Sub(prev.timestamp)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	halfLives := float64(elapsed) / float64(d.cfg.HalfLife)
+	return math.Pow(0.5, halfLives)
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (d *DecayingAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(d.cfg.Heuristic, targetHeuristic, newScores)
+}
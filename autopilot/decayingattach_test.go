@@ -0,0 +1,290 @@
+package autopilot
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// TestDecayingAttachment checks that the DecayingAttachment blends the scores
+// of the wrapped heuristic with the previously returned scores, weighted by
+// the time elapsed since they were returned.
+func TestDecayingAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+		},
+	}
+
+	testClock := clock.NewTestClock(time.Unix(1000000, 0))
+	decaying, err := NewDecayingAttachment(DecayingAttachmentConfig{
+		Heuristic: inner,
+		HalfLife:  time.Hour,
+		Clock:     testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	query := func() map[NodeID]*NodeScore {
+		scores, err := decaying.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+		return scores
+	}
+	assertScore := func(scores map[NodeID]*NodeScore, nID NodeID,
+		exp float64) {
+
+		t.Helper()
+
+		var score float64
+		if s, ok := scores[nID]; ok {
+			score = s.Score
+		}
+		if !floatEq(score, exp) {
+			t.Fatalf("expected score %v, got %v", exp, score)
+		}
+	}
+
+	// The first time the nodes are seen, the raw scores should be
+	// returned.
+	scores := query()
+	assertScore(scores, node1, 1.0)
+	assertScore(scores, node2, 0)
+
+	// Now the inner scores change. After one half-life, the previous
+	// score should make up half of the blended score.
+	inner.scores = map[NodeID]float64{
+		node1: 0.2,
+		node2: 0.8,
+	}
+	testClock.Advance(time.Hour)
+
+	scores = query()
+	assertScore(scores, node1, 0.6)
+	assertScore(scores, node2, 0.8)
+
+	// After two more half-lives, the previous score should only make up a
+	// quarter.
+	inner.scores = map[NodeID]float64{
+		node1: 0.2,
+	}
+	testClock.Advance(2 * time.Hour)
+
+	scores = query()
+	assertScore(scores, node1, 0.25*0.6+0.75*0.2)
+	assertScore(scores, node2, 0.25*0.8)
+
+	// Querying again without any time passing should return the same
+	// scores as last time.
+	scores = query()
+	assertScore(scores, node1, 0.25*0.6+0.75*0.2)
+	assertScore(scores, node2, 0.25*0.8)
+
+	_, err = NewDecayingAttachment(DecayingAttachmentConfig{
+		Heuristic: inner,
+	})
+	if err == nil {
+		t.Fatalf("expected zero half-life to be rejected")
+	}
+}
+
+// TestDecayingAttachmentPreview checks that previewing the scores of a
+// DecayingAttachment blends in the previous scores, but doesn't record the
+// returned ones.
+func TestDecayingAttachmentPreview(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+		},
+	}
+
+	testClock := clock.NewTestClock(time.Unix(1000000, 0))
+	decaying, err := NewDecayingAttachment(DecayingAttachmentConfig{
+		Heuristic: inner,
+		HalfLife:  time.Hour,
+		Clock:     testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	_, err = decaying.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	snapshot := func() map[NodeID]decayedScore {
+		decaying.Lock()
+		defer decaying.Unlock()
+
+		prev := make(map[NodeID]decayedScore, len(decaying.prevScores))
+		for nID, s := range decaying.prevScores {
+			prev[nID] = s
+		}
+		return prev
+	}
+	before := snapshot()
+
+	// After one half-life with changed inner scores, the preview should
+	// return the blended scores.
+	inner.scores = map[NodeID]float64{
+		node2: 0.8,
+	}
+	testClock.Advance(time.Hour)
+
+	scores, err := PreviewNodeScores(
+		context.Background(), decaying, nil, nil,
+		btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to preview scores: %v", err)
+	}
+	if len(scores) != 2 || !floatEq(scores[node1].Score, 0.5) ||
+		!floatEq(scores[node2].Score, 0.8) {
+
+		t.Fatalf("unexpected scores: %v", scores)
+	}
+
+	// The previous scores must be left untouched.
+	if !reflect.DeepEqual(snapshot(), before) {
+		t.Fatalf("expected previous scores %v, got %v", before,
+			snapshot())
+	}
+
+	// A regular query should therefore blend in the scores from before
+	// the preview.
+	scores, err = decaying.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != 2 || !floatEq(scores[node1].Score, 0.5) ||
+		!floatEq(scores[node2].Score, 0.8) {
+
+		t.Fatalf("unexpected scores: %v", scores)
+	}
+}
+
+// TestDecayingAttachmentPrune checks that the DecayingAttachment forgets the
+// previous scores of nodes once they've decayed to zero, including nodes that
+// are no longer queried, and that the other fields of the wrapped heuristic's
+// scores are carried through.
+func TestDecayingAttachmentPrune(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 1.0,
+			node3: 1.0,
+		},
+		reasons: map[NodeID]string{
+			node1: "reason",
+		},
+		chanSizes: map[NodeID]btcutil.Amount{
+			node1: btcutil.SatoshiPerBitcoin / 2,
+		},
+	}
+
+	testClock := clock.NewTestClock(time.Unix(1000000, 0))
+	decaying, err := NewDecayingAttachment(DecayingAttachmentConfig{
+		Heuristic: inner,
+		HalfLife:  time.Hour,
+		Clock:     testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := decaying.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(node1, node2, node3),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	s, ok := scores[node1]
+	if !ok {
+		t.Fatalf("node not scored")
+	}
+	if s.Reason != "reason" || s.ChanSize != btcutil.SatoshiPerBitcoin/2 {
+		t.Fatalf("expected reason and channel size to be carried "+
+			"through, got %v", s)
+	}
+
+	prevScores := func() map[NodeID]decayedScore {
+		decaying.Lock()
+		defer decaying.Unlock()
+
+		prev := make(map[NodeID]decayedScore, len(decaying.prevScores))
+		for nID, s := range decaying.prevScores {
+			prev[nID] = s
+		}
+		return prev
+	}
+	if len(prevScores()) != 3 {
+		t.Fatalf("expected 3 previous scores, got %v", prevScores())
+	}
+
+	// After a single half-life, the previous score of the node that is no
+	// longer queried hasn't decayed yet, so it should be remembered.
+	inner.scores = map[NodeID]float64{}
+	testClock.Advance(time.Hour)
+
+	_, err = decaying.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1, node2),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if _, ok := prevScores()[node3]; !ok {
+		t.Fatalf("expected previous score of node3 to be kept")
+	}
+
+	// Once enough half-lives have passed for the previous scores to decay
+	// to zero, both the queried and the no longer queried nodes should be
+	// forgotten.
+	testClock.Advance(30 * time.Hour)
+
+	scores, err = decaying.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodeSet(node1),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != 0 {
+		t.Fatalf("expected no scores, got %v", scores)
+	}
+	if prev := prevScores(); len(prev) != 0 {
+		t.Fatalf("expected previous scores to be pruned, got %v", prev)
+	}
+}
@@ -0,0 +1,247 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// DegreeCentralityAttachment is an implementation of the AttachmentHeuristic
+// interface that scores nodes by their degree, i.e. their number of channels,
+// relative to the highest degree in the graph. The degree of each node is
+// computed from the graph on the first scoring round. Afterwards, it is kept
+// up to date through the ChannelGraphObserver interface, such that only the
+// nodes affected by a change of the graph are updated.
+//
+// If the graph is a VersionedChannelGraph, the degrees are also recomputed
+// from scratch whenever the version of the graph changes, such that they
+// don't go stale if the heuristic isn't notified of the changes to the graph.
+//
+// NOTE: The heuristic should always be passed the same graph. If the graph
+// isn't a VersionedChannelGraph, the heuristic must be notified of all changes
+// to the graph made after the first scoring round.
+type DegreeCentralityAttachment struct {
+	// degrees is the number of channels of each node having any.
+	degrees map[NodeID]int
+
+	// numWithDegree is the number of nodes having each degree, which is
+	// used to keep track of the maximum degree as nodes are updated.
+	numWithDegree map[int]int
+
+	// maxDegree is the highest degree of any node in the graph.
+	maxDegree int
+
+	// initialized is true once the degrees have been computed from the
+	// graph.
+	initialized bool
+
+	// graphVersion is the version of the graph the degrees were last
+	// computed from, if the graph is a VersionedChannelGraph.
+	graphVersion uint64
+
+	sync.Mutex
+}
+
+// NewDegreeCentralityAttachment creates a new instance of a
+// DegreeCentralityAttachment heuristic.
+func NewDegreeCentralityAttachment() *DegreeCentralityAttachment {
+	return &DegreeCentralityAttachment{
+		degrees:       make(map[NodeID]int),
+		numWithDegree: make(map[int]int),
+	}
+}
+
+// A compile time assertion to ensure DegreeCentralityAttachment meets the
+// ContextAttachmentHeuristic and ChannelGraphObserver interfaces.
+var _ ContextAttachmentHeuristic = (*DegreeCentralityAttachment)(nil)
+var _ ChannelGraphObserver = (*DegreeCentralityAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DegreeCentralityAttachment) Name() string {
+	return "degreecentrality"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Each node is given a score equal to its degree divided by the highest degree
+// in the graph. Our existing peers are given a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DegreeCentralityAttachment) NodeScores(g ChannelGraph,
+	chans []Channel, chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return d.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the traversal of
+// the graph if the passed context is cancelled.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (d *DegreeCentralityAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	d.Lock()
+	defer d.Unlock()
+
+	version, versioned := graphVersion(g)
+	if !d.initialized || versioned && version != d.graphVersion {
+		if err := d.computeDegrees(ctx, g); err != nil {
+			return nil, err
+		}
+		d.graphVersion = version
+	}
+
+	// If there are no channels in the graph we cannot determine any
+	// preferences, so we return, indicating all candidates get a score of
+	// zero.
+	if d.maxDegree == 0 {
+		return nil, nil
+	}
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		degree := d.degrees[nID]
+		if _, ok := existingPeers[nID]; ok || degree == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  float64(degree) / float64(d.maxDegree),
+			Reason: fmt.Sprintf("%d channels", degree),
+		}
+	}
+
+	return scores, nil
+}
+
+// computeDegrees computes the degree of each node from scratch by traversing
+// the given graph.
+//
+// NOTE: The mutex MUST be held when calling this method.
+func (d *DegreeCentralityAttachment) computeDegrees(ctx context.Context,
+	g ChannelGraph) error {
+
+	degrees := make(map[NodeID]int)
+	err := g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var degree int
+		err := n.ForEachChannel(func(e ChannelEdge) error {
+			degree++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if degree > 0 {
+			degrees[NodeID(n.PubKey())] = degree
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.degrees = degrees
+	d.numWithDegree = make(map[int]int)
+	d.maxDegree = 0
+	for _, degree := range degrees {
+		d.numWithDegree[degree]++
+		if degree > d.maxDegree {
+			d.maxDegree = degree
+		}
+	}
+	d.initialized = true
+
+	return nil
+}
+
+// ChannelAdded increments the degree of both nodes.
+//
+// NOTE: This is a part of the ChannelGraphObserver interface.
+func (d *DegreeCentralityAttachment) ChannelAdded(node1, node2 NodeID) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.updateDegree(node1, 1)
+	d.updateDegree(node2, 1)
+}
+
+// ChannelRemoved decrements the degree of both nodes.
+//
+// NOTE: This is a part of the ChannelGraphObserver interface.
+func (d *DegreeCentralityAttachment) ChannelRemoved(node1, node2 NodeID) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.updateDegree(node1, -1)
+	d.updateDegree(node2, -1)
+}
+
+// updateDegree adds the given delta to the degree of the node, updating the
+// maximum degree accordingly. Updates made before the degrees were first
+// computed are ignored, as the computation will account for them.
+//
+// NOTE: The mutex MUST be held when calling this method.
+func (d *DegreeCentralityAttachment) updateDegree(nID NodeID, delta int) {
+	if !d.initialized {
+		return
+	}
+
+	oldDegree := d.degrees[nID]
+	newDegree := oldDegree + delta
+	if newDegree < 0 {
+		newDegree = 0
+	}
+	if newDegree == oldDegree {
+		return
+	}
+
+	if oldDegree > 0 {
+		d.numWithDegree[oldDegree]--
+		if d.numWithDegree[oldDegree] == 0 {
+			delete(d.numWithDegree, oldDegree)
+		}
+	}
+
+	if newDegree == 0 {
+		delete(d.degrees, nID)
+	} else {
+		d.degrees[nID] = newDegree
+		d.numWithDegree[newDegree]++
+	}
+
+	// As degrees only change by one at a time, the maximum degree can
+	// only drop to the new degree of the node that had it, if it was the
+	// only one.
+	switch {
+	case newDegree > d.maxDegree:
+		d.maxDegree = newDegree
+
+	case oldDegree == d.maxDegree && d.numWithDegree[oldDegree] == 0:
+		d.maxDegree = newDegree
+	}
+}
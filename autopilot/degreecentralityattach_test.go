@@ -0,0 +1,205 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestDegreeCentralityAttachment checks that the DegreeCentralityAttachment
+// computes the degrees of the nodes from the graph on the first scoring round,
+// and keeps them up to date incrementally as channels are added and removed.
+// Graph versions are hidden, such that the graph is only traversed once.
+func TestDegreeCentralityAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// Node0 is connected to nodes 1-4, while node1 is
+			// also connected to node2.
+			keys, nIDs := genTestNodes(t1, 6)
+			edges := [][2]int{
+				{0, 1}, {0, 2}, {0, 3}, {0, 4}, {1, 2},
+			}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e[0]], keys[e[1]],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			const chanSize = btcutil.SatoshiPerBitcoin
+			nodes := nodeSet(nIDs...)
+			chans := []Channel{{Node: nIDs[3]}}
+
+			unversioned := struct{ ChannelGraph }{g}
+
+			h := NewDegreeCentralityAttachment()
+			assertScores := func(g ChannelGraph,
+				expected map[NodeID]float64) {
+
+				t1.Helper()
+
+				scores, err := h.NodeScores(
+					g, chans, chanSize, nodes,
+				)
+				if err != nil {
+					t1.Fatalf("unable to get scores: %v",
+						err)
+				}
+
+				if len(scores) != len(expected) {
+					t1.Fatalf("expected %d scores, got %d",
+						len(expected), len(scores))
+				}
+				for nID, exp := range expected {
+					s, ok := scores[nID]
+					if !ok {
+						t1.Fatalf("node %x not scored",
+							nID[:])
+					}
+					if !floatEq(s.Score, exp) {
+						t1.Fatalf("expected score %v "+
+							"for node %x, got %v",
+							exp, nID[:], s.Score)
+					}
+				}
+			}
+
+			// Notifications received before the first scoring
+			// round should be ignored, as the degrees are then
+			// computed from the graph.
+			h.ChannelAdded(nIDs[4], nIDs[5])
+
+			// Node0 has the highest degree. Node3, our existing
+			// peer, and node5, without any channels, shouldn't be
+			// scored.
+			assertScores(unversioned, map[NodeID]float64{
+				nIDs[0]: 1.0,
+				nIDs[1]: 0.5,
+				nIDs[2]: 0.5,
+				nIDs[4]: 0.25,
+			})
+
+			// From now on, the graph shouldn't be traversed
+			// anymore, so we'll pass an empty one to make sure the
+			// scores are only updated through the notifications.
+			empty := struct{ ChannelGraph }{newMemChannelGraph()}
+
+			h.ChannelAdded(nIDs[4], nIDs[5])
+			assertScores(empty, map[NodeID]float64{
+				nIDs[0]: 1.0,
+				nIDs[1]: 0.5,
+				nIDs[2]: 0.5,
+				nIDs[4]: 0.5,
+				nIDs[5]: 0.25,
+			})
+
+			// Removing two of node0's channels should make it
+			// share the highest degree with nodes 1 and 2.
+			h.ChannelRemoved(nIDs[0], nIDs[3])
+			h.ChannelRemoved(nIDs[0], nIDs[4])
+			assertScores(empty, map[NodeID]float64{
+				nIDs[0]: 1.0,
+				nIDs[1]: 1.0,
+				nIDs[2]: 1.0,
+				nIDs[4]: 0.5,
+				nIDs[5]: 0.5,
+			})
+
+			// Adding channels to node5 should make it the new
+			// node with the highest degree.
+			h.ChannelAdded(nIDs[5], nIDs[1])
+			h.ChannelAdded(nIDs[5], nIDs[2])
+			assertScores(empty, map[NodeID]float64{
+				nIDs[0]: 2.0 / 3,
+				nIDs[1]: 1.0,
+				nIDs[2]: 1.0,
+				nIDs[4]: 1.0 / 3,
+				nIDs[5]: 1.0,
+			})
+
+			// Removing all channels should leave no node to be
+			// scored.
+			removed := [][2]int{
+				{0, 1}, {0, 2}, {1, 2}, {4, 5}, {5, 1}, {5, 2},
+			}
+			for _, e := range removed {
+				h.ChannelRemoved(nIDs[e[0]], nIDs[e[1]])
+			}
+			assertScores(empty, nil)
+		})
+		if !success {
+			break
+		}
+	}
+}
+
+// TestDegreeCentralityAttachmentGraphChange checks that the degrees are
+// recomputed once the version of the graph changes, even if the heuristic
+// wasn't notified of the change.
+func TestDegreeCentralityAttachmentGraphChange(t *testing.T) {
+	t.Parallel()
+
+	for _, chanGraph := range chanGraphs {
+		g, cleanup, err := chanGraph.genFunc()
+		if err != nil {
+			t.Fatalf("unable to create graph: %v", err)
+		}
+		if cleanup != nil {
+			defer cleanup()
+		}
+
+		keys, nIDs := genTestNodes(t, 3)
+		addChan := func(a, b int) {
+			_, _, err := g.addRandChannel(
+				keys[a], keys[b], btcutil.SatoshiPerBitcoin,
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to add channel: %v",
+					chanGraph.name, err)
+			}
+		}
+
+		h := NewDegreeCentralityAttachment()
+		scoreOf := func(nID NodeID) float64 {
+			scores, err := h.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin,
+				nodeSet(nIDs...),
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to get scores: %v",
+					chanGraph.name, err)
+			}
+			if s, ok := scores[nID]; ok {
+				return s.Score
+			}
+			return 0
+		}
+
+		addChan(0, 1)
+		if score := scoreOf(nIDs[2]); score != 0 {
+			t.Fatalf("%v: expected score 0, got %v",
+				chanGraph.name, score)
+		}
+
+		addChan(0, 2)
+		if score := scoreOf(nIDs[2]); !floatEq(score, 0.5) {
+			t.Fatalf("%v: expected score 0.5, got %v",
+				chanGraph.name, score)
+		}
+	}
+}
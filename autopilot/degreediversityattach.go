@@ -0,0 +1,147 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// DegreeDiversityConfig houses the parameters of a DegreeDiversityAttachment.
+// All degrees are expressed as multiples of the median degree of the nodes in
+// the graph.
+type DegreeDiversityConfig struct {
+	// BandLow is the lower bound of the target degree band.
+	BandLow float64
+
+	// BandHigh is the upper bound of the target degree band. It must be
+	// positive, and at least BandLow.
+	BandHigh float64
+
+	// HubCap is the degree above which nodes are considered hubs, and not
+	// scored at all. It must be at least BandHigh, or zero to disable the
+	// cap.
+	HubCap float64
+}
+
+// DegreeDiversityAttachment is an implementation of the AttachmentHeuristic
+// interface that favors nodes that are well, but not excessively, connected.
+// Only connecting to the largest hubs centralizes the network and creates
+// single points of failure, so nodes with a degree far above the median are
+// penalized, in order to support the decentralization of the network.
+type DegreeDiversityAttachment struct {
+	cfg DegreeDiversityConfig
+}
+
+// NewDegreeDiversityAttachment creates a new instance of a
+// DegreeDiversityAttachment heuristic.
+func NewDegreeDiversityAttachment(cfg DegreeDiversityConfig) (
+	*DegreeDiversityAttachment, error) {
+
+	if cfg.BandLow < 0 || cfg.BandHigh <= 0 || cfg.BandHigh < cfg.BandLow {
+		return nil, fmt.Errorf("invalid degree band [%v, %v]",
+			cfg.BandLow, cfg.BandHigh)
+	}
+
+	if cfg.HubCap != 0 && cfg.HubCap < cfg.BandHigh {
+		return nil, fmt.Errorf("hub cap %v below degree band",
+			cfg.HubCap)
+	}
+
+	return &DegreeDiversityAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure DegreeDiversityAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*DegreeDiversityAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DegreeDiversityAttachment) Name() string {
+	return "degreediversity"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Nodes with a degree within the target band are given a score of 1.0. Below
+// the band the score falls linearly towards zero, while above the band it
+// falls inversely proportional to the degree. Nodes above the hub cap are
+// given a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DegreeDiversityAttachment) NodeScores(g ChannelGraph,
+	chans []Channel, chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	degrees, err := nodeDegrees(g)
+	if err != nil {
+		return nil, err
+	}
+
+	median := medianDegree(degrees)
+	if median == 0 {
+		return nil, nil
+	}
+
+	low := d.cfg.BandLow * median
+	high := d.cfg.BandHigh * median
+	hubCap := d.cfg.HubCap * median
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		degree := float64(degrees[nID])
+
+		_, ok := existingPeers[nID]
+		switch {
+
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		case ok:
+			continue
+
+		// Nodes without channels and hubs are given a score of zero,
+		// so we skip them.
+		case degree == 0:
+			continue
+		case hubCap > 0 && degree > hubCap:
+			continue
+		}
+
+		score := 1.0
+		switch {
+		case degree < low:
+			score = degree / low
+		case degree > high:
+			score = high / degree
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return candidates, nil
+}
+
+// medianDegree returns the median degree of the nodes having any channels.
+func medianDegree(degrees map[NodeID]int) float64 {
+	var values []float64
+	for _, degree := range degrees {
+		if degree > 0 {
+			values = append(values, float64(degree))
+		}
+	}
+
+	return median(values)
+}
@@ -0,0 +1,120 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestDegreeDiversityAttachment checks that the DegreeDiversityAttachment
+// favors mid-tier nodes over hubs and poorly connected nodes.
+func TestDegreeDiversityAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// Node0 is a hub connected to all other nodes. Nodes
+			// 1-3 are leaves only connected to the hub, while
+			// nodes 4-9 are mid-tier nodes additionally connected
+			// in a ring. This gives a degree of 9 for the hub, 1
+			// for the leaves and 3 for the mid-tier nodes, with a
+			// median degree of 3.
+			keys, nIDs := genTestNodes(t1, 10)
+			var edges [][2]int
+			for i := 1; i < 10; i++ {
+				edges = append(edges, [2]int{0, i})
+			}
+			for i := 4; i < 10; i++ {
+				next := 4 + (i-3)%6
+				edges = append(edges, [2]int{i, next})
+			}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e[0]], keys[e[1]],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			// With a target band of [1.5, 4.5] channels and a hub
+			// cap of 7.5 channels, the hub should be skipped.
+			cfg := DegreeDiversityConfig{
+				BandLow:  0.5,
+				BandHigh: 1.5,
+				HubCap:   2.5,
+			}
+			diversity, err := NewDegreeDiversityAttachment(cfg)
+			if err != nil {
+				t1.Fatalf("unable to create heuristic: %v", err)
+			}
+
+			scores, err := diversity.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin,
+				nodeSet(nIDs...),
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			if _, ok := scores[nIDs[0]]; ok {
+				t1.Fatalf("expected hub to not be scored")
+			}
+			for i := 1; i < 10; i++ {
+				exp := 1.0
+				if i <= 3 {
+					exp = 1.0 / 1.5
+				}
+
+				s, ok := scores[nIDs[i]]
+				if !ok {
+					t1.Fatalf("node%d not scored", i)
+				}
+				if !floatEq(s.Score, exp) {
+					t1.Fatalf("expected score %v for "+
+						"node%d, got %v", exp, i,
+						s.Score)
+				}
+			}
+
+			// Without the hub cap, the hub should be penalized
+			// instead.
+			cfg.HubCap = 0
+			diversity, err = NewDegreeDiversityAttachment(cfg)
+			if err != nil {
+				t1.Fatalf("unable to create heuristic: %v", err)
+			}
+
+			scores, err = diversity.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin,
+				nodeSet(nIDs...),
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			s, ok := scores[nIDs[0]]
+			if !ok {
+				t1.Fatalf("expected hub to be scored")
+			}
+			if !floatEq(s.Score, 0.5) {
+				t1.Fatalf("expected score 0.5 for hub, got %v",
+					s.Score)
+			}
+		})
+		if !success {
+			break
+		}
+	}
+}
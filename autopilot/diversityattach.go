@@ -0,0 +1,170 @@
+package autopilot
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/tor"
+)
+
+const (
+	// ipv4BucketPrefixLen is the prefix length used to bucket IPv4
+	// addresses when no ASN information is available.
+	ipv4BucketPrefixLen = 16
+
+	// ipv6BucketPrefixLen is the prefix length used to bucket IPv6
+	// addresses when no ASN information is available.
+	ipv6BucketPrefixLen = 32
+
+	// onionBucket is the bucket all onion addresses are placed in.
+	onionBucket = "onion"
+)
+
+// ASNLookup is a function that returns the autonomous system number the given
+// IP address belongs to. The boolean indicates whether the ASN is known.
+type ASNLookup func(net.IP) (uint32, bool)
+
+// DiversityAttachment is an implementation of the AttachmentHeuristic
+// interface that prefers nodes in network locations we're not already
+// connected to. This makes the node more resilient against regional outages,
+// and encourages a topological and geographical spread of our channels.
+//
+// The advertised addresses of each node are placed in network buckets: IPv4
+// addresses by their /16 prefix, IPv6 addresses by their /32 prefix, or by
+// their ASN if an ASNLookup is available. All onion addresses are placed in a
+// single bucket of their own.
+type DiversityAttachment struct {
+	asnLookup ASNLookup
+}
+
+// NewDiversityAttachment creates a new instance of a DiversityAttachment
+// heuristic. If asnLookup is non-nil, it will be used to bucket IP addresses
+// by their ASN when known.
+func NewDiversityAttachment(asnLookup ASNLookup) *DiversityAttachment {
+	return &DiversityAttachment{
+		asnLookup: asnLookup,
+	}
+}
+
+// A compile time assertion to ensure DiversityAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*DiversityAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DiversityAttachment) Name() string {
+	return "diversity"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score given to each node is the fraction of its network buckets that
+// none of our existing channel peers are in. A node only found in new buckets
+// gets a score of 1.0, while a node only found in buckets we're already
+// connected to gets a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (d *DiversityAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// We'll go through the graph once, gathering the buckets of our
+	// existing peers, and the buckets of each candidate.
+	existingBuckets := make(map[string]struct{})
+	candidateBuckets := make(map[NodeID]map[string]struct{})
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+
+		if _, ok := existingPeers[nID]; ok {
+			for bucket := range d.buckets(n.Addrs()) {
+				existingBuckets[bucket] = struct{}{}
+			}
+			return nil
+		}
+
+		if _, ok := nodes[nID]; ok {
+			candidateBuckets[nID] = d.buckets(n.Addrs())
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID, buckets := range candidateBuckets {
+		if len(buckets) == 0 {
+			continue
+		}
+
+		var newBuckets int
+		for bucket := range buckets {
+			if _, ok := existingBuckets[bucket]; !ok {
+				newBuckets++
+			}
+		}
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if newBuckets == 0 {
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  float64(newBuckets) / float64(len(buckets)),
+		}
+	}
+
+	return candidates, nil
+}
+
+// buckets returns the set of network buckets the given addresses are in.
+func (d *DiversityAttachment) buckets(addrs []net.Addr) map[string]struct{} {
+	buckets := make(map[string]struct{})
+	for _, addr := range addrs {
+		var bucket string
+		switch a := addr.(type) {
+		case *tor.OnionAddr:
+			bucket = onionBucket
+
+		case *net.TCPAddr:
+			bucket = d.ipBucket(a.IP)
+
+		default:
+			continue
+		}
+
+		buckets[bucket] = struct{}{}
+	}
+
+	return buckets
+}
+
+// ipBucket returns the network bucket of the given IP address.
+func (d *DiversityAttachment) ipBucket(ip net.IP) string {
+	if d.asnLookup != nil {
+		if asn, ok := d.asnLookup(ip); ok {
+			return fmt.Sprintf("asn:%d", asn)
+		}
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(ipv4BucketPrefixLen, 8*net.IPv4len)
+		return fmt.Sprintf("ipv4:%v", ip4.Mask(mask))
+	}
+
+	mask := net.CIDRMask(ipv6BucketPrefixLen, 8*net.IPv6len)
+	return fmt.Sprintf("ipv6:%v", ip.Mask(mask))
+}
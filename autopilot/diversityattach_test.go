@@ -0,0 +1,98 @@
+package autopilot
+
+import (
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/tor"
+)
+
+// TestDiversityAttachment checks that the DiversityAttachment prefers nodes in
+// network buckets our existing channel peers are not in.
+func TestDiversityAttachment(t *testing.T) {
+	t.Parallel()
+
+	g := newMemChannelGraph()
+	keys, nIDs := genTestNodes(t, 6)
+
+	tcpAddr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 9735}
+	}
+	onionAddr := &tor.OnionAddr{
+		OnionService: "3g2upl4pq6kufc4m.onion",
+		Port:         9735,
+	}
+
+	// Node 0 is our existing peer, located in 10.1.0.0/16. The other nodes
+	// are candidates.
+	addrs := [][]net.Addr{
+		{tcpAddr("10.1.2.3")},
+		{tcpAddr("10.1.200.1")},
+		{tcpAddr("10.2.0.1")},
+		{tcpAddr("10.1.9.9"), onionAddr},
+		{tcpAddr("2001:db8::1")},
+		nil,
+	}
+	for i, key := range keys {
+		g.graph[nIDs[i]] = memNode{
+			pub:   key,
+			addrs: addrs[i],
+		}
+	}
+
+	chans := []Channel{{Node: nIDs[0]}}
+	nodes := nodeSet(nIDs...)
+
+	diversity := NewDiversityAttachment(nil)
+	scores, err := diversity.NodeScores(
+		g, chans, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// Node 1 shares our peer's /16 and node 5 has no addresses, so neither
+	// should be scored. Node 3 is half in a new bucket.
+	expected := map[NodeID]float64{
+		nIDs[2]: 1.0,
+		nIDs[3]: 0.5,
+		nIDs[4]: 1.0,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v, got %v", exp, s.Score)
+		}
+	}
+
+	// With an ASN lookup placing all 10.0.0.0/8 addresses in the same AS,
+	// node 2 should no longer be considered diverse.
+	_, tenNet, _ := net.ParseCIDR("10.0.0.0/8")
+	diversity = NewDiversityAttachment(func(ip net.IP) (uint32, bool) {
+		if tenNet.Contains(ip) {
+			return 64512, true
+		}
+		return 0, false
+	})
+	scores, err = diversity.NodeScores(
+		g, chans, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	if _, ok := scores[nIDs[2]]; ok {
+		t.Fatalf("expected node in same AS to not be scored")
+	}
+	if len(scores) != 2 {
+		t.Fatalf("expected 2 scores, got %d", len(scores))
+	}
+}
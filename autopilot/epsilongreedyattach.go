@@ -0,0 +1,231 @@
+package autopilot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	prand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// DefaultExploreScore is the score given to explored nodes if none is
+	// configured.
+	DefaultExploreScore = 0.1
+
+	// maxExploreScore is the maximum score that can be given to explored
+	// nodes, such that exploration never dominates the scores given by
+	// the wrapped heuristic.
+	maxExploreScore = 0.5
+)
+
+// EpsilonGreedyAttachmentConfig houses the parameters of an
+// EpsilonGreedyAttachment.
+type EpsilonGreedyAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores are used when not
+	// exploring.
+	Heuristic AttachmentHeuristic
+
+	// Epsilon is the probability, in the range [0, 1.0], that a scoring
+	// round explores low scoring nodes.
+	Epsilon float64
+
+	// NumExplore is the number of low scoring nodes that are boosted in
+	// an exploring round. If zero, a single node is boosted.
+	NumExplore int
+
+	// ExploreScore is the score explored nodes are boosted to. Only nodes
+	// scoring below it are eligible for exploration. It must not exceed
+	// 0.5. If zero, DefaultExploreScore is used.
+	ExploreScore float64
+
+	// Source is the source of randomness used to decide whether to
+	// explore, and which nodes to boost. If nil, a source seeded with the
+	// current time is used.
+	Source prand.Source
+}
+
+// EpsilonGreedyAttachment is an implementation of the AttachmentHeuristic
+// interface that wraps another heuristic, and with a configurable probability
+// boosts the scores of a few random low scoring nodes. A purely greedy agent
+// only ever opens channels to the nodes currently scoring the highest, and
+// thus never discovers good peers that are underrated by the heuristics.
+// Occasionally exploring other candidates mitigates this.
+type EpsilonGreedyAttachment struct {
+	cfg EpsilonGreedyAttachmentConfig
+
+	rand    *prand.Rand
+	randMtx sync.Mutex
+}
+
+// NewEpsilonGreedyAttachment creates a new instance of an
+// EpsilonGreedyAttachment heuristic.
+func NewEpsilonGreedyAttachment(cfg EpsilonGreedyAttachmentConfig) (
+	*EpsilonGreedyAttachment, error) {
+
+	if cfg.Epsilon < 0 || cfg.Epsilon > 1.0 {
+		return nil, fmt.Errorf("epsilon must be in the range "+
+			"[0, 1.0], was %v", cfg.Epsilon)
+	}
+	if cfg.NumExplore < 0 {
+		return nil, fmt.Errorf("number of explored nodes must not "+
+			"be negative, was %v", cfg.NumExplore)
+	}
+	if cfg.ExploreScore < 0 || cfg.ExploreScore > maxExploreScore {
+		return nil, fmt.Errorf("explore score must be in the range "+
+			"[0, %v], was %v", maxExploreScore, cfg.ExploreScore)
+	}
+
+	if cfg.NumExplore == 0 {
+		cfg.NumExplore = 1
+	}
+	if cfg.ExploreScore == 0 {
+		cfg.ExploreScore = DefaultExploreScore
+	}
+
+	source := cfg.Source
+	if source == nil {
+		source = prand.NewSource(time.Now().Unix())
+	}
+
+	return &EpsilonGreedyAttachment{
+		cfg:  cfg,
+		rand: prand.New(source),
+	}, nil
+}
+
+// A compile time assertion to ensure EpsilonGreedyAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*EpsilonGreedyAttachment)(nil)
+var _ ScoreSettable = (*EpsilonGreedyAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (e *EpsilonGreedyAttachment) Name() string {
+	return "epsilongreedy"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic. With probability
+// epsilon, a few random nodes scoring below the explore score are boosted to
+// it.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (e *EpsilonGreedyAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return e.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (e *EpsilonGreedyAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, e.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	explored := e.explore(chans, nodes, scores)
+	if len(explored) == 0 {
+		return scores, nil
+	}
+
+	// The wrapped heuristic might return a nil map, or one it keeps
+	// around, so we'll boost the explored nodes in a copy of it.
+	boosted := make(map[NodeID]*NodeScore, len(scores)+len(explored))
+	for nID, s := range scores {
+		boosted[nID] = s
+	}
+	for _, nID := range explored {
+		boosted[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  e.cfg.ExploreScore,
+			Reason: "exploration",
+		}
+	}
+
+	return boosted, nil
+}
+
+// explore decides whether this round should explore, and if so returns the
+// nodes to boost, picked at random among the nodes scoring below the explore
+// score. Our existing channel peers are never explored.
+func (e *EpsilonGreedyAttachment) explore(chans []Channel,
+	nodes map[NodeID]struct{}, scores map[NodeID]*NodeScore) []NodeID {
+
+	e.randMtx.Lock()
+	defer e.randMtx.Unlock()
+
+	if e.rand.Float64() >= e.cfg.Epsilon {
+		return nil
+	}
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// Sort the candidates, such that the explored nodes only depend on
+	// the state of the random source, and not on the iteration order of
+	// the map.
+	var candidates []NodeID
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+		if s, ok := scores[nID]; ok && s.Score >= e.cfg.ExploreScore {
+			continue
+		}
+		candidates = append(candidates, nID)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i][:], candidates[j][:]) < 0
+	})
+
+	if len(candidates) <= e.cfg.NumExplore {
+		return candidates
+	}
+
+	// We'll pick the nodes using a partial Fisher-Yates shuffle.
+	for i := 0; i < e.cfg.NumExplore; i++ {
+		j := i + e.rand.Intn(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+
+	return candidates[:e.cfg.NumExplore]
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (e *EpsilonGreedyAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(e.cfg.Heuristic, targetHeuristic, newScores)
+}
@@ -0,0 +1,184 @@
+package autopilot
+
+import (
+	"bytes"
+	prand "math/rand"
+	"sort"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestEpsilonGreedyAttachment checks that the EpsilonGreedyAttachment boosts
+// the expected low scoring nodes when using a seeded source, and leaves the
+// scores untouched when not exploring.
+func TestEpsilonGreedyAttachment(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numNodes   = 20
+		numExplore = 3
+		seed       = 42
+	)
+
+	// The first half of the nodes are given a high score, while the rest
+	// are either given a low score or not scored at all.
+	inner := &staticHeuristic{
+		name:   "inner",
+		scores: make(map[NodeID]float64),
+	}
+	var (
+		nIDs     []NodeID
+		lowNodes []NodeID
+	)
+	for i := 0; i < numNodes; i++ {
+		nID := testNodeID(byte(i))
+		nIDs = append(nIDs, nID)
+
+		switch {
+		case i < numNodes/2:
+			inner.scores[nID] = 0.8
+		case i%2 == 0:
+			inner.scores[nID] = 0.01
+			lowNodes = append(lowNodes, nID)
+		default:
+			lowNodes = append(lowNodes, nID)
+		}
+	}
+	nodes := nodeSet(nIDs...)
+
+	// One of the low scoring nodes is an existing peer, and should never
+	// be explored.
+	peer := lowNodes[0]
+	lowNodes = lowNodes[1:]
+	chans := []Channel{{Node: peer}}
+
+	// Using the same seed, we'll determine the nodes we expect to be
+	// boosted by doing the same draws as the heuristic.
+	sort.Slice(lowNodes, func(i, j int) bool {
+		return bytes.Compare(lowNodes[i][:], lowNodes[j][:]) < 0
+	})
+	r := prand.New(prand.NewSource(seed))
+	r.Float64()
+	for i := 0; i < numExplore; i++ {
+		j := i + r.Intn(len(lowNodes)-i)
+		lowNodes[i], lowNodes[j] = lowNodes[j], lowNodes[i]
+	}
+	expected := nodeSet(lowNodes[:numExplore]...)
+
+	e, err := NewEpsilonGreedyAttachment(EpsilonGreedyAttachmentConfig{
+		Heuristic:  inner,
+		Epsilon:    1.0,
+		NumExplore: numExplore,
+		Source:     prand.NewSource(seed),
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := e.NodeScores(
+		nil, chans, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	for _, nID := range nIDs {
+		var score float64
+		if s, ok := scores[nID]; ok {
+			score = s.Score
+		}
+
+		expectedScore := inner.scores[nID]
+		if _, ok := expected[nID]; ok {
+			expectedScore = DefaultExploreScore
+		}
+
+		if score != expectedScore {
+			t.Fatalf("node %x: expected score %v, got %v", nID[:],
+				expectedScore, score)
+		}
+	}
+
+	// With an epsilon of zero, the scores of the wrapped heuristic should
+	// be returned as is.
+	e, err = NewEpsilonGreedyAttachment(EpsilonGreedyAttachmentConfig{
+		Heuristic:  inner,
+		NumExplore: numExplore,
+		Source:     prand.NewSource(seed),
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err = e.NodeScores(nil, chans, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != len(inner.scores) {
+		t.Fatalf("expected %d scores, got %d", len(inner.scores),
+			len(scores))
+	}
+	for nID, s := range scores {
+		if s.Score != inner.scores[nID] {
+			t.Fatalf("expected score %v, got %v",
+				inner.scores[nID], s.Score)
+		}
+	}
+}
+
+// TestEpsilonGreedyAttachmentConfig checks that invalid configurations are
+// rejected.
+func TestEpsilonGreedyAttachmentConfig(t *testing.T) {
+	t.Parallel()
+
+	inner := &staticHeuristic{name: "inner"}
+
+	configs := []EpsilonGreedyAttachmentConfig{
+		{Heuristic: inner, Epsilon: -0.1},
+		{Heuristic: inner, Epsilon: 1.1},
+		{Heuristic: inner, NumExplore: -1},
+		{Heuristic: inner, ExploreScore: -0.1},
+		{Heuristic: inner, ExploreScore: maxExploreScore + 0.1},
+	}
+	for _, cfg := range configs {
+		if _, err := NewEpsilonGreedyAttachment(cfg); err == nil {
+			t.Fatalf("expected config %+v to be rejected", cfg)
+		}
+	}
+}
+
+// TestEpsilonGreedyAttachmentNilScores checks that nodes are explored when
+// the wrapped heuristic returns a nil map of scores.
+func TestEpsilonGreedyAttachmentNilScores(t *testing.T) {
+	t.Parallel()
+
+	// The capacity heuristic returns no scores when none of the nodes
+	// have any capacity, which is the case for an empty graph.
+	e, err := NewEpsilonGreedyAttachment(EpsilonGreedyAttachmentConfig{
+		Heuristic: NewCapacityAttachment(),
+		Epsilon:   1.0,
+		Source:    prand.NewSource(1),
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	nID := testNodeID(1)
+	scores, err := e.NodeScores(
+		newMemChannelGraph(), nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(nID),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	s, ok := scores[nID]
+	if !ok {
+		t.Fatalf("expected node to be explored")
+	}
+	if s.Score != DefaultExploreScore {
+		t.Fatalf("expected score %v, got %v", DefaultExploreScore,
+			s.Score)
+	}
+}
@@ -1,15 +1,40 @@
 package autopilot
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/btcsuite/btcutil"
 )
 
+// ErrScoresProvided is returned when setting the node scores of an
+// ExternalScoreAttachment that fetches its scores from a ScoreProvider, as the
+// set scores would never be used.
+var ErrScoresProvided = errors.New("node scores are fetched from a score " +
+	"provider and can't be set")
+
+// ScoreProvider is an interface that provides node scores computed by an
+// external scoring service, e.g. a machine learning model or a manually
+// curated list.
+type ScoreProvider interface {
+	// Scores returns the scores of the given nodes, which must be in the
+	// range [0, 1.0]. Nodes not present in the returned map are given a
+	// score of zero.
+	Scores(nodes []NodeID) (map[NodeID]float64, error)
+}
+
 // ExternalScoreAttachment is an implementation of the AttachmentHeuristic
 // interface that allows an external source to provide it with node scores.
+// The scores are either set through the ScoreSettable interface, or fetched
+// from a ScoreProvider on each scoring round.
 type ExternalScoreAttachment struct {
+	// provider, if set, is queried for the node scores on each scoring
+	// round, instead of using the scores set by the caller.
+	provider ScoreProvider
+
 	// TODO(halseth): persist across restarts.
 	nodeScores map[NodeID]float64
 
@@ -22,6 +47,18 @@ func NewExternalScoreAttachment() *ExternalScoreAttachment {
 	return &ExternalScoreAttachment{}
 }
 
+// NewExternalScoreProviderAttachment creates a new instance of an
+// ExternalScoreAttachment that fetches the node scores from the given
+// provider. Errors of the provider are returned, such that they're handled
+// according to the failure policy of a combining heuristic.
+func NewExternalScoreProviderAttachment(
+	provider ScoreProvider) *ExternalScoreAttachment {
+
+	return &ExternalScoreAttachment{
+		provider: provider,
+	}
+}
+
 // A compile time assertion to ensure ExternalScoreAttachment meets the
 // AttachmentHeuristic and ScoreSettable interfaces.
 var _ AttachmentHeuristic = (*ExternalScoreAttachment)(nil)
@@ -38,7 +75,8 @@ func (s *ExternalScoreAttachment) Name() string {
 // passed scores must be in the range [0, 1.0]. The fist parameter is the name
 // of the targeted heuristic, to allow recursively target specific
 // sub-heuristics. The returned boolean indicates whether the targeted
-// heuristic was found.
+// heuristic was found. If the scores are fetched from a score provider,
+// ErrScoresProvided is returned.
 //
 // NOTE: This is a part of the ScoreSettable interface.
 func (s *ExternalScoreAttachment) SetNodeScores(targetHeuristic string,
@@ -49,6 +87,10 @@ func (s *ExternalScoreAttachment) SetNodeScores(targetHeuristic string,
 		return false, nil
 	}
 
+	if s.provider != nil {
+		return false, ErrScoresProvided
+	}
+
 	// Since there's a requirement that all score are in the range [0,
 	// 1.0], we validate them before setting the internal list.
 	for nID, s := range newScores {
@@ -74,8 +116,8 @@ func (s *ExternalScoreAttachment) SetNodeScores(targetHeuristic string,
 // improvement in connectivity if a channel is opened to this node, while 1.0
 // is the maximum possible improvement in connectivity.
 //
-// The scores are determined by checking the internal node scores list. Nodes
-// not known will get a score of 0.
+// The scores are determined by checking the internal node scores list, or by
+// querying the score provider if set. Nodes not known will get a score of 0.
 //
 // NOTE: This is a part of the AttachmentHeuristic interface.
 func (s *ExternalScoreAttachment) NodeScores(g ChannelGraph, chans []Channel,
@@ -87,14 +129,16 @@ func (s *ExternalScoreAttachment) NodeScores(g ChannelGraph, chans []Channel,
 		existingPeers[c.Node] = struct{}{}
 	}
 
-	s.Lock()
-	defer s.Unlock()
+	nodeScores, err := s.currentScores(nodes, existingPeers)
+	if err != nil {
+		return nil, err
+	}
 
 	// Fill the map of candidates to return.
 	candidates := make(map[NodeID]*NodeScore)
 	for nID := range nodes {
 		var score float64
-		if nodeScore, ok := s.nodeScores[nID]; ok {
+		if nodeScore, ok := nodeScores[nID]; ok {
 			score = float64(nodeScore)
 		}
 
@@ -120,3 +164,50 @@ func (s *ExternalScoreAttachment) NodeScores(g ChannelGraph, chans []Channel,
 
 	return candidates, nil
 }
+
+// currentScores returns the scores of the given nodes, either from the
+// internal node scores list, or from the score provider if set. Our existing
+// peers aren't scored, so they aren't passed to the provider.
+func (s *ExternalScoreAttachment) currentScores(nodes map[NodeID]struct{},
+	existingPeers map[NodeID]struct{}) (map[NodeID]float64, error) {
+
+	if s.provider == nil {
+		s.Lock()
+		defer s.Unlock()
+
+		return s.nodeScores, nil
+	}
+
+	// The nodes are sorted, such that the provider is always queried in
+	// the same order for the same set of nodes.
+	candidates := make([]NodeID, 0, len(nodes))
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+		candidates = append(candidates, nID)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i][:], candidates[j][:]) < 0
+	})
+
+	scores, err := s.provider.Scores(candidates)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch scores from "+
+			"provider: %v", err)
+	}
+
+	// As with scores set by the caller, we'll make sure the provided
+	// scores are within the range [0, 1.0].
+	for nID, score := range scores {
+		if !(score >= 0 && score <= 1.0) {
+			return nil, fmt.Errorf("invalid score %v for "+
+				"nodeID %v from provider", score, nID)
+		}
+	}
+
+	return scores, nil
+}
@@ -1,6 +1,7 @@
 package autopilot_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -98,3 +99,141 @@ func TestSetNodeScores(t *testing.T) {
 	}
 
 }
+
+// mockScoreProvider is a ScoreProvider returning a fixed set of scores, and
+// recording the nodes it was queried for.
+type mockScoreProvider struct {
+	scores map[autopilot.NodeID]float64
+	err    error
+
+	queried []autopilot.NodeID
+}
+
+// Scores returns the scores of the given nodes.
+//
+// NOTE: This is a part of the ScoreProvider interface.
+func (m *mockScoreProvider) Scores(nodes []autopilot.NodeID) (
+	map[autopilot.NodeID]float64, error) {
+
+	m.queried = nodes
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	return m.scores, nil
+}
+
+// TestExternalScoreProvider tests that the ExternalScoreAttachment returns the
+// scores fetched from its provider, and that provider errors are handled
+// according to the failure policy of a combining heuristic.
+func TestExternalScoreProvider(t *testing.T) {
+	t.Parallel()
+
+	const numKeys = 4
+	var nodes []autopilot.NodeID
+	q := make(map[autopilot.NodeID]struct{})
+	for i := 0; i < numKeys; i++ {
+		k, err := randKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nID := autopilot.NewNodeID(k)
+		nodes = append(nodes, nID)
+		q[nID] = struct{}{}
+	}
+
+	// The provider only scores the first two nodes, one of which is our
+	// existing peer, and shouldn't be queried for.
+	provider := &mockScoreProvider{
+		scores: map[autopilot.NodeID]float64{
+			nodes[0]: 0.8,
+			nodes[1]: 0.4,
+		},
+	}
+	chans := []autopilot.Channel{{Node: nodes[1]}}
+
+	h := autopilot.NewExternalScoreProviderAttachment(provider)
+	resp, err := h.NodeScores(nil, chans, btcutil.SatoshiPerBitcoin, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp) != 1 {
+		t.Fatalf("expected 1 score, got %d", len(resp))
+	}
+	if s, ok := resp[nodes[0]]; !ok || s.Score != 0.8 {
+		t.Fatalf("expected score 0.8, got %v", s)
+	}
+
+	if len(provider.queried) != numKeys-1 {
+		t.Fatalf("expected provider to be queried for %d nodes, got "+
+			"%d", numKeys-1, len(provider.queried))
+	}
+	for _, nID := range provider.queried {
+		if nID == nodes[1] {
+			t.Fatalf("provider queried for existing peer")
+		}
+	}
+
+	// As the scores are fetched from the provider, setting them should
+	// fail rather than have them silently ignored.
+	found, err := h.SetNodeScores(h.Name(), provider.scores)
+	if err != autopilot.ErrScoresProvided {
+		t.Fatalf("expected ErrScoresProvided, got %v", err)
+	}
+	if found {
+		t.Fatalf("expected scores not to be set")
+	}
+
+	// Out of range scores from the provider should be rejected.
+	provider.scores[nodes[2]] = 1.5
+	_, err = h.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, q)
+	if err == nil {
+		t.Fatalf("expected out of range score to be rejected")
+	}
+	delete(provider.scores, nodes[2])
+
+	// A failing provider should fail a combination using the fail-fast
+	// policy, while its weight is redistributed under the best-effort
+	// policy.
+	provider.err = errors.New("scoring service unavailable")
+	constant, err := autopilot.NewConstantAttachment(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comb, err := autopilot.NewWeightedCombAttachment(
+		&autopilot.WeightedHeuristic{
+			Weight:              0.5,
+			AttachmentHeuristic: h,
+		},
+		&autopilot.WeightedHeuristic{
+			Weight:              0.5,
+			AttachmentHeuristic: constant,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = comb.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, q)
+	if err == nil {
+		t.Fatalf("expected provider error to fail the combination")
+	}
+
+	if err := comb.SetFailurePolicy(autopilot.BestEffort); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = comb.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != numKeys {
+		t.Fatalf("expected %d scores, got %d", numKeys, len(resp))
+	}
+	for _, s := range resp {
+		if s.Score != 0.5 {
+			t.Fatalf("expected score 0.5, got %v", s.Score)
+		}
+	}
+}
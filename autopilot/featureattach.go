@@ -0,0 +1,155 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// DefaultFeatureBaseScore is the score given to nodes supporting all required
+// features, but none of the preferred ones, if none is configured.
+const DefaultFeatureBaseScore = 0.5
+
+// FeatureAttachmentConfig houses the parameters of a FeatureAttachment. As
+// features are assigned in pairs, a feature is considered supported if a node
+// advertises either bit of its pair.
+type FeatureAttachmentConfig struct {
+	// Required is the set of features a node must support to be scored.
+	Required []lnwire.FeatureBit
+
+	// Preferred is the set of features increasing the score of a node
+	// supporting them.
+	Preferred []lnwire.FeatureBit
+
+	// BaseScore is the score, in the range (0, 1.0], given to nodes
+	// supporting all required features, but none of the preferred ones.
+	// Each supported preferred feature adds an equal share of the
+	// remaining range. If zero, DefaultFeatureBaseScore is used.
+	BaseScore float64
+}
+
+// FeatureAttachment is an implementation of the AttachmentHeuristic interface
+// that scores nodes by the features they advertise, such that channels are
+// preferably opened to peers supporting new protocol features.
+//
+// NOTE: The features can only be read from graphs whose nodes are
+// FeatureNodes. Nodes of other graphs are treated as advertising no features.
+type FeatureAttachment struct {
+	cfg FeatureAttachmentConfig
+}
+
+// NewFeatureAttachment creates a new instance of a FeatureAttachment
+// heuristic.
+func NewFeatureAttachment(cfg FeatureAttachmentConfig) (*FeatureAttachment,
+	error) {
+
+	if cfg.BaseScore < 0 || cfg.BaseScore > 1.0 {
+		return nil, fmt.Errorf("base score must be in the range "+
+			"(0, 1.0], was %v", cfg.BaseScore)
+	}
+
+	if cfg.BaseScore == 0 {
+		cfg.BaseScore = DefaultFeatureBaseScore
+	}
+
+	return &FeatureAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure FeatureAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*FeatureAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FeatureAttachment) Name() string {
+	return "features"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Nodes missing any of the required features are given a score of zero.
+// Otherwise, nodes are given the base score, increased by an equal share of
+// the remaining range for each preferred feature they support. If there are
+// no preferred features, all nodes supporting the required ones are given a
+// score of 1.0. Our existing peers are given a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FeatureAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	scores := make(map[NodeID]*NodeScore)
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+		if _, ok := nodes[nID]; !ok {
+			return nil
+		}
+		if _, ok := existingPeers[nID]; ok {
+			return nil
+		}
+
+		features := nodeFeatures(n)
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		for _, bit := range f.cfg.Required {
+			if !supportsFeature(features, bit) {
+				return nil
+			}
+		}
+
+		if len(f.cfg.Preferred) == 0 {
+			scores[nID] = &NodeScore{
+				NodeID: nID,
+				Score:  1.0,
+			}
+			return nil
+		}
+
+		var numPreferred int
+		for _, bit := range f.cfg.Preferred {
+			if supportsFeature(features, bit) {
+				numPreferred++
+			}
+		}
+
+		bonus := float64(numPreferred) / float64(len(f.cfg.Preferred))
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  f.cfg.BaseScore + bonus*(1.0-f.cfg.BaseScore),
+			Reason: fmt.Sprintf("%d/%d preferred features",
+				numPreferred, len(f.cfg.Preferred)),
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return scores, nil
+}
+
+// supportsFeature returns whether the given feature vector has either bit of
+// the pair of the given feature bit set.
+func supportsFeature(features *lnwire.FeatureVector,
+	bit lnwire.FeatureBit) bool {
+
+	if features == nil {
+		return false
+	}
+
+	return features.IsSet(bit) || features.IsSet(bit^1)
+}
@@ -0,0 +1,157 @@
+package autopilot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// TestFeatureAttachment checks that the FeatureAttachment only scores nodes
+// supporting all required features, and favors those supporting the preferred
+// ones.
+func TestFeatureAttachment(t *testing.T) {
+	t.Parallel()
+
+	// We'll use feature bits that aren't assigned to any actual feature.
+	const (
+		required   lnwire.FeatureBit = 100
+		preferred1 lnwire.FeatureBit = 102
+		preferred2 lnwire.FeatureBit = 104
+	)
+
+	g := newMemChannelGraph()
+	keys, nIDs := genTestNodes(t, 7)
+	for i := 1; i < len(keys); i++ {
+		_, _, err := g.addRandChannel(
+			keys[0], keys[i], btcutil.SatoshiPerBitcoin,
+		)
+		if err != nil {
+			t.Fatalf("unable to add channel: %v", err)
+		}
+	}
+
+	// Node1 lacks the required feature, while node2 supports it as an
+	// optional feature, and node3 and node4 additionally support one and
+	// both of the preferred features respectively. Node5 doesn't
+	// advertise any features, and node6 is our existing peer.
+	nodeFeatures := map[NodeID][]lnwire.FeatureBit{
+		nIDs[1]: {preferred1, preferred2},
+		nIDs[2]: {required + 1},
+		nIDs[3]: {required, preferred2 + 1},
+		nIDs[4]: {required, preferred1, preferred2},
+		nIDs[6]: {required, preferred1, preferred2},
+	}
+	for nID, bits := range nodeFeatures {
+		node := g.graph[nID]
+		node.features = lnwire.NewFeatureVector(
+			lnwire.NewRawFeatureVector(bits...), nil,
+		)
+		g.graph[nID] = node
+	}
+
+	nodes := nodeSet(nIDs[1:]...)
+	chans := []Channel{{Node: nIDs[6]}}
+
+	tests := []struct {
+		name     string
+		cfg      FeatureAttachmentConfig
+		expected map[NodeID]float64
+	}{
+		{
+			name: "required and preferred",
+			cfg: FeatureAttachmentConfig{
+				Required: []lnwire.FeatureBit{required},
+				Preferred: []lnwire.FeatureBit{
+					preferred1, preferred2,
+				},
+			},
+			expected: map[NodeID]float64{
+				nIDs[2]: 0.5,
+				nIDs[3]: 0.75,
+				nIDs[4]: 1.0,
+			},
+		},
+		{
+			name: "required only",
+			cfg: FeatureAttachmentConfig{
+				Required: []lnwire.FeatureBit{required},
+			},
+			expected: map[NodeID]float64{
+				nIDs[2]: 1.0,
+				nIDs[3]: 1.0,
+				nIDs[4]: 1.0,
+			},
+		},
+		{
+			name: "preferred only",
+			cfg: FeatureAttachmentConfig{
+				Preferred: []lnwire.FeatureBit{preferred1},
+				BaseScore: 0.2,
+			},
+			expected: map[NodeID]float64{
+				nIDs[1]: 1.0,
+				nIDs[2]: 0.2,
+				nIDs[3]: 0.2,
+				nIDs[4]: 1.0,
+				nIDs[5]: 0.2,
+			},
+		},
+	}
+
+	// The features should be read the same way from a copy of the graph.
+	snapshot, err := SnapshotGraph(
+		context.Background(), &unsnapshottableGraph{g},
+	)
+	if err != nil {
+		t.Fatalf("unable to take snapshot: %v", err)
+	}
+
+	for _, test := range tests {
+		h, err := NewFeatureAttachment(test.cfg)
+		if err != nil {
+			t.Fatalf("test %q: unable to create heuristic: %v",
+				test.name, err)
+		}
+
+		for _, graph := range []ChannelGraph{g, snapshot} {
+			scores, err := h.NodeScores(
+				graph, chans, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t.Fatalf("test %q: unable to get scores: %v",
+					test.name, err)
+			}
+
+			if len(scores) != len(test.expected) {
+				t.Fatalf("test %q: expected %d scores, got %d",
+					test.name, len(test.expected),
+					len(scores))
+			}
+			for nID, exp := range test.expected {
+				s, ok := scores[nID]
+				if !ok {
+					t.Fatalf("test %q: node %x not scored",
+						test.name, nID[:])
+				}
+				if !floatEq(s.Score, exp) {
+					t.Fatalf("test %q: expected score %v "+
+						"for node %x, got %v", test.name,
+						exp, nID[:], s.Score)
+				}
+			}
+		}
+	}
+
+	invalidCfgs := []FeatureAttachmentConfig{
+		{BaseScore: -0.1},
+		{BaseScore: 1.1},
+	}
+	for _, cfg := range invalidCfgs {
+		if _, err := NewFeatureAttachment(cfg); err == nil {
+			t.Fatalf("expected base score %v to be rejected",
+				cfg.BaseScore)
+		}
+	}
+}
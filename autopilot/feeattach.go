@@ -0,0 +1,200 @@
+package autopilot
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// FeeAttachmentConfig houses the parameters of a FeeAttachment.
+type FeeAttachmentConfig struct {
+	// BaseFeeWeight is the weight given to the base fee when combining it
+	// with the proportional fee, which is given the remaining weight. It
+	// must be in the range [0, 1.0].
+	BaseFeeWeight float64
+
+	// Window is the relative fee, as a multiple of the network's median
+	// fee, at which the score of a node reaches zero. Nodes charging at
+	// most the median fee are given the max score. It must be above 1.0.
+	Window float64
+
+	// NeutralScore is the score given to nodes that haven't advertised
+	// any routing policies. It must be in the range (0, 1.0].
+	NeutralScore float64
+}
+
+// FeeAttachment is an implementation of the AttachmentHeuristic interface
+// that scores nodes according to the fees they charge for forwarding
+// payments. A well-connected node charging exorbitant fees is a poor routing
+// partner, as payments will be routed around it, so nodes with high fees
+// relative to the rest of the network are penalized.
+type FeeAttachment struct {
+	cfg FeeAttachmentConfig
+}
+
+// NewFeeAttachment creates a new instance of a FeeAttachment heuristic.
+func NewFeeAttachment(cfg FeeAttachmentConfig) (*FeeAttachment, error) {
+	if cfg.BaseFeeWeight < 0 || cfg.BaseFeeWeight > 1.0 {
+		return nil, fmt.Errorf("base fee weight must be in the range "+
+			"[0, 1.0], was %v", cfg.BaseFeeWeight)
+	}
+
+	if cfg.Window <= 1.0 {
+		return nil, fmt.Errorf("window must be above 1.0, was %v",
+			cfg.Window)
+	}
+
+	if cfg.NeutralScore <= 0 || cfg.NeutralScore > 1.0 {
+		return nil, fmt.Errorf("neutral score must be in the range "+
+			"(0, 1.0], was %v", cfg.NeutralScore)
+	}
+
+	return &FeeAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure FeeAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*FeeAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FeeAttachment) Name() string {
+	return "fee"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The base and proportional fees of each policy are taken relative to the
+// respective median across all policies in the graph, and combined using the
+// configured weight. The fee of a node is the median of the combined fees of
+// its policies. Nodes with a fee at most the network median are given a score
+// of 1.0, falling linearly to zero at the end of the window.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FeeAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	// We'll gather the policies of the nodes we need to score, along with
+	// the fees of all policies in the graph.
+	var (
+		baseFees     []float64
+		propFees     []float64
+		nodePolicies = make(map[NodeID][]*RoutingPolicy)
+	)
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+		_, candidate := nodes[nID]
+
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			if e.Policy == nil {
+				return nil
+			}
+
+			baseFees = append(baseFees, float64(e.Policy.FeeBaseMSat))
+			propFees = append(
+				propFees,
+				float64(e.Policy.FeeProportionalMillionths),
+			)
+
+			if candidate {
+				nodePolicies[nID] = append(
+					nodePolicies[nID], e.Policy,
+				)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	medianBase := median(baseFees)
+	medianProp := median(propFees)
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		policies := nodePolicies[nID]
+		if len(policies) == 0 {
+			candidates[nID] = &NodeScore{
+				NodeID: nID,
+				Score:  f.cfg.NeutralScore,
+			}
+			continue
+		}
+
+		fees := make([]float64, 0, len(policies))
+		for _, p := range policies {
+			base := relativeFee(float64(p.FeeBaseMSat), medianBase)
+			prop := relativeFee(
+				float64(p.FeeProportionalMillionths),
+				medianProp,
+			)
+
+			fees = append(
+				fees, f.cfg.BaseFeeWeight*base+
+					(1-f.cfg.BaseFeeWeight)*prop,
+			)
+		}
+		fee := median(fees)
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if fee >= f.cfg.Window {
+			continue
+		}
+
+		score := 1.0
+		if fee > 1.0 {
+			score = 1.0 - (fee-1.0)/(f.cfg.Window-1.0)
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return candidates, nil
+}
+
+// relativeFee returns the given fee relative to the given median fee. One is
+// added to both, such that a median of zero can be handled.
+func relativeFee(fee, median float64) float64 {
+	return (fee + 1) / (median + 1)
+}
+
+// median returns the median of the given values, or zero if there are none.
+// The passed slice will be sorted.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sort.Float64s(values)
+
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+
+	return values[mid]
+}
@@ -0,0 +1,155 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// TestFeeAttachment checks that the FeeAttachment penalizes nodes charging
+// high fees relative to the rest of the network.
+func TestFeeAttachment(t *testing.T) {
+	t.Parallel()
+
+	g := newMemChannelGraph()
+
+	// Create a ring of six nodes, each having two channels.
+	const numNodes = 6
+	keys, nIDs := genTestNodes(t, numNodes)
+	for i := 0; i < numNodes; i++ {
+		_, _, err := g.addRandChannel(
+			keys[i], keys[(i+1)%numNodes],
+			btcutil.SatoshiPerBitcoin,
+		)
+		if err != nil {
+			t.Fatalf("unable to add channel: %v", err)
+		}
+	}
+
+	// Nodes 0-2 charge the median fees, node 3 twice the median (after
+	// adding one), node 4 three times the median, and node 5 hasn't
+	// advertised any policies.
+	policies := []*RoutingPolicy{
+		{FeeBaseMSat: 1000, FeeProportionalMillionths: 1},
+		{FeeBaseMSat: 1000, FeeProportionalMillionths: 1},
+		{FeeBaseMSat: 1000, FeeProportionalMillionths: 1},
+		{FeeBaseMSat: 2001, FeeProportionalMillionths: 3},
+		{FeeBaseMSat: 3003, FeeProportionalMillionths: 5},
+		nil,
+	}
+	for i, nID := range nIDs {
+		node := g.graph[nID]
+		for j := range node.chans {
+			node.chans[j].Policy = policies[i]
+		}
+	}
+
+	fee, err := NewFeeAttachment(FeeAttachmentConfig{
+		BaseFeeWeight: 0.5,
+		Window:        3.0,
+		NeutralScore:  0.7,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := fee.NodeScores(
+		g, nil, btcutil.SatoshiPerBitcoin, nodeSet(nIDs...),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// Node 4 is at the end of the window, and shouldn't be scored.
+	expected := map[int]float64{
+		0: 1.0,
+		1: 1.0,
+		2: 1.0,
+		3: 0.5,
+		5: 0.7,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for i, exp := range expected {
+		s, ok := scores[nIDs[i]]
+		if !ok {
+			t.Fatalf("node%d not scored", i)
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v for node%d, got %v", exp,
+				i, s.Score)
+		}
+	}
+
+	// When only considering the proportional fee, node 3 should be twice
+	// as expensive as the median.
+	fee, err = NewFeeAttachment(FeeAttachmentConfig{
+		BaseFeeWeight: 0,
+		Window:        5.0,
+		NeutralScore:  0.7,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err = fee.NodeScores(
+		g, nil, btcutil.SatoshiPerBitcoin, nodeSet(nIDs...),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if !floatEq(scores[nIDs[3]].Score, 0.75) {
+		t.Fatalf("expected score 0.75, got %v", scores[nIDs[3]].Score)
+	}
+	if !floatEq(scores[nIDs[4]].Score, 0.5) {
+		t.Fatalf("expected score 0.5, got %v", scores[nIDs[4]].Score)
+	}
+}
+
+// TestDatabaseGraphPolicies checks that the database backed graph exposes the
+// routing policies of the channels.
+func TestDatabaseGraphPolicies(t *testing.T) {
+	t.Parallel()
+
+	g, cleanup, err := newDiskChanGraph()
+	if err != nil {
+		t.Fatalf("unable to create graph: %v", err)
+	}
+	defer cleanup()
+
+	keys, _ := genTestNodes(t, 2)
+	_, _, err = g.addRandChannel(
+		keys[0], keys[1], btcutil.SatoshiPerBitcoin,
+	)
+	if err != nil {
+		t.Fatalf("unable to add channel: %v", err)
+	}
+
+	var numPolicies int
+	err = g.ForEachNode(func(n Node) error {
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			if e.Policy == nil {
+				t.Fatalf("expected policy to be set")
+			}
+
+			exp := lnwire.MilliSatoshi(10000)
+			if e.Policy.FeeProportionalMillionths != exp {
+				t.Fatalf("expected fee rate %v, got %v", exp,
+					e.Policy.FeeProportionalMillionths)
+			}
+
+			numPolicies++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("unable to iterate graph: %v", err)
+	}
+
+	if numPolicies != 2 {
+		t.Fatalf("expected 2 policies, got %d", numPolicies)
+	}
+}
@@ -0,0 +1,131 @@
+package autopilot
+
+import (
+	"context"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// FilteredAttachment is an implementation of the AttachmentHeuristic interface
+// that wraps another heuristic, and filters out any node found in its
+// blacklist from the scores returned by the wrapped heuristic. This can be
+// used to make sure the autopilot never attempts to open channels to nodes
+// known to be misbehaving.
+type FilteredAttachment struct {
+	heuristic AttachmentHeuristic
+
+	blacklist map[NodeID]struct{}
+	sync.Mutex
+}
+
+// NewFilteredAttachment creates a new instance of a FilteredAttachment
+// wrapping the given heuristic, that will filter out the nodes in the given
+// blacklist.
+func NewFilteredAttachment(h AttachmentHeuristic,
+	blacklist map[NodeID]struct{}) *FilteredAttachment {
+
+	f := &FilteredAttachment{
+		heuristic: h,
+	}
+	f.SetBlacklist(blacklist)
+
+	return f
+}
+
+// A compile time assertion to ensure FilteredAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*FilteredAttachment)(nil)
+var _ ScoreSettable = (*FilteredAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FilteredAttachment) Name() string {
+	return "filtered"
+}
+
+// SetBlacklist replaces the set of nodes that will be filtered out of the
+// returned scores. It is safe to call while the heuristic is in use.
+func (f *FilteredAttachment) SetBlacklist(blacklist map[NodeID]struct{}) {
+	// We copy the blacklist, such that the caller can't modify it without
+	// holding the mutex.
+	b := make(map[NodeID]struct{}, len(blacklist))
+	for nID := range blacklist {
+		b[nID] = struct{}{}
+	}
+
+	f.Lock()
+	f.blacklist = b
+	f.Unlock()
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, except that nodes
+// found in the blacklist are given a score of zero, and thus are not part of
+// the returned map.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FilteredAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return f.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (f *FilteredAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, f.heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	// Instead of setting the score of the blacklisted nodes to zero, we
+	// leave them out of the returned set altogether. The scores are
+	// copied, such that the wrapped heuristic's NodeScores aren't
+	// modified.
+	filtered := make(map[NodeID]*NodeScore, len(scores))
+	for nID, score := range scores {
+		if _, ok := f.blacklist[nID]; ok {
+			continue
+		}
+
+		s := *score
+		filtered[nID] = &s
+	}
+
+	return filtered, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (f *FilteredAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(f.heuristic, targetHeuristic, newScores)
+}
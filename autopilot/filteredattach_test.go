@@ -0,0 +1,90 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestFilteredAttachment checks that nodes in the FilteredAttachment's
+// blacklist never appear among the returned scores, even if the wrapped
+// heuristic gives them a high score, and that the blacklist can be updated.
+func TestFilteredAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.9,
+			node3: 0.1,
+		},
+	}
+
+	filtered := NewFilteredAttachment(inner, nodeSet(node1))
+	nodes := nodeSet(node1, node2, node3)
+
+	assertScored := func(expected ...NodeID) {
+		t.Helper()
+
+		scores, err := filtered.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+
+		for _, nID := range expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("node %x not scored", nID[:])
+			}
+
+			if s.Score != inner.scores[nID] {
+				t.Fatalf("expected score %v, got %v",
+					inner.scores[nID], s.Score)
+			}
+		}
+	}
+
+	// The highest scored node is blacklisted, so it should not be
+	// returned.
+	assertScored(node2, node3)
+
+	// Update the blacklist, now the first node should be returned, while
+	// the other two should not.
+	filtered.SetBlacklist(nodeSet(node2, node3))
+	assertScored(node1)
+
+	// Clearing the blacklist should return all nodes.
+	filtered.SetBlacklist(nil)
+	assertScored(node1, node2, node3)
+
+	// The scores of the wrapped heuristic must not be modified, as they
+	// might be shared with others.
+	innerScores, err := inner.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	filtered = NewFilteredAttachment(
+		&sharedScoresHeuristic{scores: innerScores}, nodeSet(node1),
+	)
+	_, err = filtered.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(innerScores) != 3 {
+		t.Fatalf("expected 3 inner scores, got %d", len(innerScores))
+	}
+}
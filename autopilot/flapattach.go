@@ -0,0 +1,161 @@
+package autopilot
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// FlapStats is an interface that provides statistics about how reliably nodes
+// have been online.
+type FlapStats interface {
+	// FlapStats returns the number of times the given node has flapped,
+	// meaning it went offline and came back online, and the last time it
+	// was seen online. The boolean is false if no statistics are known
+	// for the node.
+	FlapStats(NodeID) (int, time.Time, bool)
+}
+
+// FlapAttachmentConfig houses the parameters of a FlapAttachment.
+type FlapAttachmentConfig struct {
+	// Stats is the source of the per-node flap statistics.
+	Stats FlapStats
+
+	// FlapFactor is the factor the score of a node is multiplied with for
+	// each flap, and determines how quickly flaps reduce the score. It
+	// must be in the range (0, 1.0].
+	FlapFactor float64
+
+	// StaleAfter is the amount of time after which a node not seen online
+	// is considered stale. A zero value disables the staleness check.
+	StaleAfter time.Duration
+
+	// StaleFactor is the factor the score of a stale node is multiplied
+	// with. It must be in the range [0, 1.0].
+	StaleFactor float64
+
+	// NeutralScore is the score given to nodes we don't have any
+	// statistics for. It must be in the range (0, 1.0].
+	NeutralScore float64
+
+	// Clock is used to determine the current time. If nil, the default
+	// clock is used.
+	Clock clock.Clock
+}
+
+// FlapAttachment is an implementation of the AttachmentHeuristic interface
+// that scores nodes according to how reliably they've been online. Opening
+// channels to flaky nodes wastes on-chain fees, as they're likely to be
+// closed, so nodes that frequently flap or haven't been seen online recently
+// are penalized.
+type FlapAttachment struct {
+	cfg FlapAttachmentConfig
+}
+
+// NewFlapAttachment creates a new instance of a FlapAttachment heuristic.
+func NewFlapAttachment(cfg FlapAttachmentConfig) (*FlapAttachment, error) {
+	if cfg.Stats == nil {
+		return nil, fmt.Errorf("flap stats source must be set")
+	}
+
+	if cfg.FlapFactor <= 0 || cfg.FlapFactor > 1.0 {
+		return nil, fmt.Errorf("flap factor must be in the range "+
+			"(0, 1.0], was %v", cfg.FlapFactor)
+	}
+
+	if cfg.StaleFactor < 0 || cfg.StaleFactor > 1.0 {
+		return nil, fmt.Errorf("stale factor must be in the range "+
+			"[0, 1.0], was %v", cfg.StaleFactor)
+	}
+
+	if cfg.NeutralScore <= 0 || cfg.NeutralScore > 1.0 {
+		return nil, fmt.Errorf("neutral score must be in the range "+
+			"(0, 1.0], was %v", cfg.NeutralScore)
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewDefaultClock()
+	}
+
+	return &FlapAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure FlapAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*FlapAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FlapAttachment) Name() string {
+	return "flap"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// A node that never flapped is given a score of 1.0, which is multiplied by
+// the flap factor for each flap, and by the stale factor if the node hasn't
+// been seen online recently. Nodes without any statistics are given the
+// neutral score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (f *FlapAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	now := f.cfg.Clock.Now()
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		score := f.cfg.NeutralScore
+
+		flaps, lastSeen, ok := f.cfg.Stats.FlapStats(nID)
+		if ok {
+			// A negative flap count from a misbehaving source
+			// would boost the score, so it's treated as no flaps.
+			if flaps < 0 {
+				flaps = 0
+			}
+			score = math.Pow(f.cfg.FlapFactor, float64(flaps))
+
+			stale := f.cfg.StaleAfter > 0 &&
+				now.Sub(lastSeen) > f.cfg.StaleAfter
+			if stale {
+				score *= f.cfg.StaleFactor
+			}
+		}
+		score = clampScore(score)
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,103 @@
+package autopilot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// flapStat is the flap statistics of a single node.
+type flapStat struct {
+	flaps    int
+	lastSeen time.Time
+}
+
+// mockFlapStats is a FlapStats implementation backed by a map.
+type mockFlapStats map[NodeID]flapStat
+
+// FlapStats returns the flap statistics of the given node.
+func (m mockFlapStats) FlapStats(nID NodeID) (int, time.Time, bool) {
+	s, ok := m[nID]
+	return s.flaps, s.lastSeen, ok
+}
+
+// TestFlapAttachment checks that the FlapAttachment penalizes nodes according
+// to their flap count and last seen time.
+func TestFlapAttachment(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1000000, 0)
+	testClock := clock.NewTestClock(now)
+	nIDs := []NodeID{
+		testNodeID(1), testNodeID(2), testNodeID(3), testNodeID(4),
+		testNodeID(5), testNodeID(6),
+	}
+
+	// The nodes are respectively stable, flapped once, flapped three
+	// times, stale, without any statistics, and with an invalid negative
+	// flap count, which should be treated as no flaps.
+	stats := mockFlapStats{
+		nIDs[0]: {flaps: 0, lastSeen: now},
+		nIDs[1]: {flaps: 1, lastSeen: now},
+		nIDs[2]: {flaps: 3, lastSeen: now.Add(-time.Hour)},
+		nIDs[3]: {flaps: 0, lastSeen: now.Add(-48 * time.Hour)},
+		nIDs[5]: {flaps: -2, lastSeen: now},
+	}
+
+	flap, err := NewFlapAttachment(FlapAttachmentConfig{
+		Stats:        stats,
+		FlapFactor:   0.5,
+		StaleAfter:   24 * time.Hour,
+		StaleFactor:  0.1,
+		NeutralScore: 0.6,
+		Clock:        testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := flap.NodeScores(
+		newMemChannelGraph(), nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(nIDs...),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	expected := []float64{1.0, 0.5, 0.125, 0.1, 0.6, 1.0}
+	for i, exp := range expected {
+		s, ok := scores[nIDs[i]]
+		if !ok {
+			t.Fatalf("node %d not scored", i)
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("expected score %v for node %d, got %v", exp,
+				i, s.Score)
+		}
+	}
+
+	// Existing channel peers should not be scored.
+	chans := []Channel{{Node: nIDs[0]}}
+	scores, err = flap.NodeScores(
+		newMemChannelGraph(), chans, btcutil.SatoshiPerBitcoin,
+		nodeSet(nIDs...),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if _, ok := scores[nIDs[0]]; ok {
+		t.Fatalf("existing peer should not be scored")
+	}
+
+	// An invalid flap factor should be rejected.
+	_, err = NewFlapAttachment(FlapAttachmentConfig{
+		Stats:        stats,
+		FlapFactor:   0,
+		NeutralScore: 0.5,
+	})
+	if err == nil {
+		t.Fatalf("expected invalid flap factor to be rejected")
+	}
+}
@@ -35,8 +35,8 @@ type databaseChannelGraph struct {
 }
 
 // A compile time assertion to ensure databaseChannelGraph meets the
-// autopilot.ChannelGraph interface.
-var _ ChannelGraph = (*databaseChannelGraph)(nil)
+// autopilot.VersionedChannelGraph interface.
+var _ VersionedChannelGraph = (*databaseChannelGraph)(nil)
 
 // ChannelGraphFromDatabase returns an instance of the autopilot.ChannelGraph
 // backed by a live, open channeldb instance.
@@ -55,9 +55,9 @@ type dbNode struct {
 	node *channeldb.LightningNode
 }
 
-// A compile time assertion to ensure dbNode meets the autopilot.Node
+// A compile time assertion to ensure dbNode meets the autopilot.FeatureNode
 // interface.
-var _ Node = (*dbNode)(nil)
+var _ FeatureNode = (*dbNode)(nil)
 
 // PubKey is the identity public key of the node. This will be used to attempt
 // to target a node for channel opening by the main autopilot agent. The key
@@ -76,6 +76,13 @@ func (d dbNode) Addrs() []net.Addr {
 	return d.node.Addresses
 }
 
+// Features returns the features advertised by the node.
+//
+// NOTE: Part of the autopilot.FeatureNode interface.
+func (d dbNode) Features() *lnwire.FeatureVector {
+	return d.node.Features
+}
+
 // ForEachChannel is a higher-order function that will be used to iterate
 // through all edges emanating from/to the target node. For each active
 // channel, this function should be called with the populated ChannelEdge that
@@ -108,6 +115,10 @@ func (d dbNode) ForEachChannel(cb func(ChannelEdge) error) error {
 				tx:   tx,
 				node: ep.Node,
 			},
+			Policy: &RoutingPolicy{
+				FeeBaseMSat:               ep.FeeBaseMSat,
+				FeeProportionalMillionths: ep.FeeProportionalMillionths,
+			},
 		}
 
 		return cb(edge)
@@ -137,6 +148,19 @@ func (d *databaseChannelGraph) ForEachNode(cb func(Node) error) error {
 	})
 }
 
+// Version returns the current version of the graph, as tracked by the
+// database, which changes with every modification of the graph.
+//
+// NOTE: Part of the autopilot.VersionedChannelGraph interface.
+func (d *databaseChannelGraph) Version() uint64 {
+	version, err := d.db.Version()
+	if err != nil {
+		log.Errorf("Unable to read graph version: %v", err)
+	}
+
+	return version
+}
+
 // addRandChannel creates a new channel two target nodes. This function is
 // meant to aide in the generation of random graphs for use within test cases
 // the exercise the autopilot package.
@@ -165,6 +189,8 @@ func (d *databaseChannelGraph) addRandChannel(node1, node2 *btcec.PublicKey,
 				if err := d.db.AddLightningNode(graphNode); err != nil {
 					return nil, err
 				}
+
+				return graphNode, nil
 			case err != nil:
 				return nil, err
 			}
@@ -303,11 +329,17 @@ func (d *databaseChannelGraph) addRandNode() (*btcec.PublicKey, error) {
 // an in-memory graph.
 type memChannelGraph struct {
 	graph map[NodeID]memNode
+
+	// version is incremented each time the graph is modified through its
+	// methods.
+	version uint64
 }
 
 // A compile time assertion to ensure memChannelGraph meets the
-// autopilot.ChannelGraph interface.
-var _ ChannelGraph = (*memChannelGraph)(nil)
+// autopilot.VersionedChannelGraph and autopilot.SnapshottableChannelGraph
+// interfaces.
+var _ VersionedChannelGraph = (*memChannelGraph)(nil)
+var _ SnapshottableChannelGraph = (*memChannelGraph)(nil)
 
 // newMemChannelGraph creates a new blank in-memory channel graph
 // implementation.
@@ -332,6 +364,35 @@ func (m memChannelGraph) ForEachNode(cb func(Node) error) error {
 	return nil
 }
 
+// Version returns the current version of the graph.
+//
+// NOTE: Part of the autopilot.VersionedChannelGraph interface.
+func (m *memChannelGraph) Version() uint64 {
+	return m.version
+}
+
+// Snapshot returns a read-only snapshot of the current state of the graph.
+// Since the graph only ever replaces its nodes when modified, a copy of the map
+// of nodes is enough, without copying the nodes themselves.
+//
+// NOTE: Part of the autopilot.SnapshottableChannelGraph interface.
+func (m *memChannelGraph) Snapshot() (ChannelGraph, error) {
+	return m.snapshot(), nil
+}
+
+// snapshot returns a copy of the graph sharing its nodes.
+func (m *memChannelGraph) snapshot() *memChannelGraph {
+	graph := make(map[NodeID]memNode, len(m.graph))
+	for nID, node := range m.graph {
+		graph[nID] = node
+	}
+
+	return &memChannelGraph{
+		graph:   graph,
+		version: m.version,
+	}
+}
+
 // randChanID generates a new random channel ID.
 func randChanID() lnwire.ShortChannelID {
 	id := atomic.AddUint64(&chanIDCounter, 1)
@@ -432,6 +493,7 @@ func (m *memChannelGraph) addRandChannel(node1, node2 *btcec.PublicKey,
 
 	m.graph[NewNodeID(vertex1.pub)] = vertex1
 	m.graph[NewNodeID(vertex2.pub)] = vertex2
+	m.version++
 
 	return &edge1, &edge2, nil
 }
@@ -450,6 +512,7 @@ func (m *memChannelGraph) addRandNode() (*btcec.PublicKey, error) {
 		},
 	}
 	m.graph[NewNodeID(newPub)] = vertex
+	m.version++
 
 	return newPub, nil
 }
@@ -462,11 +525,13 @@ type memNode struct {
 	chans []ChannelEdge
 
 	addrs []net.Addr
+
+	features *lnwire.FeatureVector
 }
 
-// A compile time assertion to ensure memNode meets the autopilot.Node
+// A compile time assertion to ensure memNode meets the autopilot.FeatureNode
 // interface.
-var _ Node = (*memNode)(nil)
+var _ FeatureNode = (*memNode)(nil)
 
 // PubKey is the identity public key of the node. This will be used to attempt
 // to target a node for channel opening by the main autopilot agent.
@@ -487,6 +552,13 @@ func (m memNode) Addrs() []net.Addr {
 	return m.addrs
 }
 
+// Features returns the features advertised by the node.
+//
+// NOTE: Part of the autopilot.FeatureNode interface.
+func (m memNode) Features() *lnwire.FeatureVector {
+	return m.features
+}
+
 // ForEachChannel is a higher-order function that will be used to iterate
 // through all edges emanating from/to the target node. For each active
 // channel, this function should be called with the populated ChannelEdge that
@@ -521,3 +593,51 @@ func Median(vals []btcutil.Amount) btcutil.Amount {
 		return vals[num/2]
 	}
 }
+
+// nodeDegrees traverses the graph and returns the number of channels each node
+// in the graph has.
+func nodeDegrees(g ChannelGraph) (map[NodeID]int, error) {
+	degrees := make(map[NodeID]int)
+	err := g.ForEachNode(func(n Node) error {
+		var numChans int
+		err := n.ForEachChannel(func(_ ChannelEdge) error {
+			numChans++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		degrees[NodeID(n.PubKey())] = numChans
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return degrees, nil
+}
+
+// nodeCapacities traverses the graph and returns the total capacity of the
+// channels each node in the graph has.
+func nodeCapacities(g ChannelGraph) (map[NodeID]btcutil.Amount, error) {
+	capacities := make(map[NodeID]btcutil.Amount)
+	err := g.ForEachNode(func(n Node) error {
+		var capacity btcutil.Amount
+		err := n.ForEachChannel(func(e ChannelEdge) error {
+			capacity += e.Capacity
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		capacities[NodeID(n.PubKey())] = capacity
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return capacities, nil
+}
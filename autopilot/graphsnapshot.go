@@ -0,0 +1,207 @@
+package autopilot
+
+import (
+	"context"
+	"net"
+
+	"github.com/lightningnetwork/lnd/lnwire"
+)
+
+// graphSnapshot is an immutable, in-memory copy of a ChannelGraph. It allows
+// several heuristics to read the same topology concurrently, without racing
+// with updates to the source graph.
+type graphSnapshot struct {
+	nodes []*snapshotNode
+}
+
+// A compile time assertion to ensure graphSnapshot meets the ChannelGraph
+// interface.
+var _ ChannelGraph = (*graphSnapshot)(nil)
+
+// ForEachNode is a higher-order function that should be called once for each
+// connected node within the channel graph. If the passed callback returns an
+// error, then execution should be terminated.
+//
+// NOTE: Part of the ChannelGraph interface.
+func (s *graphSnapshot) ForEachNode(cb func(Node) error) error {
+	for _, node := range s.nodes {
+		if err := cb(node); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// versionedGraphSnapshot is a snapshot of a VersionedChannelGraph, reporting
+// the version of the source graph at the time the snapshot was taken.
+type versionedGraphSnapshot struct {
+	*graphSnapshot
+
+	version uint64
+}
+
+// A compile time assertion to ensure versionedGraphSnapshot meets the
+// VersionedChannelGraph interface.
+var _ VersionedChannelGraph = (*versionedGraphSnapshot)(nil)
+
+// Version returns the version of the source graph the snapshot was taken of.
+//
+// NOTE: Part of the VersionedChannelGraph interface.
+func (s *versionedGraphSnapshot) Version() uint64 {
+	return s.version
+}
+
+// snapshotNode is a node within a graphSnapshot.
+type snapshotNode struct {
+	pubKey   [33]byte
+	addrs    []net.Addr
+	features *lnwire.FeatureVector
+	chans    []ChannelEdge
+}
+
+// A compile time assertion to ensure snapshotNode meets the FeatureNode
+// interface.
+var _ FeatureNode = (*snapshotNode)(nil)
+
+// PubKey is the identity public key of the node.
+//
+// NOTE: Part of the Node interface.
+func (n *snapshotNode) PubKey() [33]byte {
+	return n.pubKey
+}
+
+// Addrs returns a slice of publicly reachable public TCP addresses that the
+// peer is known to be listening on.
+//
+// NOTE: Part of the Node interface.
+func (n *snapshotNode) Addrs() []net.Addr {
+	return n.addrs
+}
+
+// Features returns the features advertised by the node.
+//
+// NOTE: Part of the FeatureNode interface.
+func (n *snapshotNode) Features() *lnwire.FeatureVector {
+	return n.features
+}
+
+// ForEachChannel is a higher-order function that will be used to iterate
+// through all edges emanating from/to the target node.
+//
+// NOTE: Part of the Node interface.
+func (n *snapshotNode) ForEachChannel(cb func(ChannelEdge) error) error {
+	for _, edge := range n.chans {
+		if err := cb(edge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nodeFeatures returns the features advertised by the given node, or nil if
+// the node isn't a FeatureNode. Feature vectors are never modified once read
+// from the graph, so they can be shared with the source graph.
+func nodeFeatures(n Node) *lnwire.FeatureVector {
+	if fn, ok := n.(FeatureNode); ok {
+		return fn.Features()
+	}
+
+	return nil
+}
+
+// isGraphSnapshot returns whether the given graph is already a snapshot, in
+// which case there's no need to take another one.
+func isGraphSnapshot(g ChannelGraph) bool {
+	switch g.(type) {
+	case *graphSnapshot, *versionedGraphSnapshot:
+		return true
+	default:
+		return false
+	}
+}
+
+// SnapshotGraph takes a consistent, read-only snapshot of the given graph,
+// which can be safely read concurrently while the source graph is modified.
+// If the graph is a SnapshottableChannelGraph, its own snapshot is used.
+// Otherwise, the graph is copied into memory, in which case the snapshot is a
+// VersionedChannelGraph if the source graph is, reporting the version at the
+// time the snapshot was taken. If the context is cancelled, the context's
+// error is returned.
+//
+// NOTE: When copying, the source graph is read in a single pass, so it must
+// provide a consistent view during ForEachNode for the snapshot to be
+// consistent.
+func SnapshotGraph(ctx context.Context, g ChannelGraph) (ChannelGraph,
+	error) {
+
+	if isGraphSnapshot(g) {
+		return g, nil
+	}
+
+	if s, ok := g.(SnapshottableChannelGraph); ok {
+		return s.Snapshot()
+	}
+
+	// We'll read the version before traversing the graph. If the graph is
+	// modified during the traversal, the snapshot will report an outdated
+	// version, which at worst causes a needless recomputation.
+	version, versioned := graphVersion(g)
+
+	snapshot := &graphSnapshot{}
+	nodes := make(map[NodeID]*snapshotNode)
+	nodeFor := func(n Node) *snapshotNode {
+		nID := NodeID(n.PubKey())
+		if node, ok := nodes[nID]; ok {
+			return node
+		}
+
+		node := &snapshotNode{
+			pubKey:   nID,
+			addrs:    append([]net.Addr(nil), n.Addrs()...),
+			features: nodeFeatures(n),
+		}
+		nodes[nID] = node
+		return node
+	}
+
+	err := g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// The node may have been created from the peer of an edge
+		// already, so we'll make sure its features are the ones of
+		// the node itself.
+		node := nodeFor(n)
+		node.features = nodeFeatures(n)
+		snapshot.nodes = append(snapshot.nodes, node)
+
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			edge := ChannelEdge{
+				Channel: e.Channel,
+				Peer:    nodeFor(e.Peer),
+			}
+			if e.Policy != nil {
+				policy := *e.Policy
+				edge.Policy = &policy
+			}
+
+			node.chans = append(node.chans, edge)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if versioned {
+		return &versionedGraphSnapshot{
+			graphSnapshot: snapshot,
+			version:       version,
+		}, nil
+	}
+
+	return snapshot, nil
+}
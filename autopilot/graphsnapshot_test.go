@@ -0,0 +1,328 @@
+package autopilot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// graphStats returns the number of nodes and channel edges in the graph.
+func graphStats(t *testing.T, g ChannelGraph) (int, int) {
+	t.Helper()
+
+	var numNodes, numEdges int
+	err := g.ForEachNode(func(n Node) error {
+		numNodes++
+		return n.ForEachChannel(func(ChannelEdge) error {
+			numEdges++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("unable to traverse graph: %v", err)
+	}
+
+	return numNodes, numEdges
+}
+
+// unsnapshottableGraph hides the Snapshot method of the wrapped graph, such
+// that SnapshotGraph copies it.
+type unsnapshottableGraph struct {
+	VersionedChannelGraph
+}
+
+// graphObservingHeuristic is an AttachmentHeuristic that records the size of
+// the graph it is queried with, and optionally modifies a graph before doing
+// so.
+type graphObservingHeuristic struct {
+	t      *testing.T
+	name   string
+	mutate func()
+
+	numNodes []int
+}
+
+func (h *graphObservingHeuristic) Name() string {
+	return h.name
+}
+
+func (h *graphObservingHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	if h.mutate != nil {
+		h.mutate()
+	}
+
+	numNodes, _ := graphStats(h.t, g)
+	h.numNodes = append(h.numNodes, numNodes)
+
+	return nil, nil
+}
+
+var _ AttachmentHeuristic = (*graphObservingHeuristic)(nil)
+
+// TestSnapshotGraph checks that a copy of a graph isn't affected by later
+// modifications of the source graph, and preserves its version.
+func TestSnapshotGraph(t *testing.T) {
+	t.Parallel()
+
+	source := &versionedGraph{
+		memChannelGraph: newMemChannelGraph(),
+		version:         7,
+	}
+
+	key1, err := source.addRandNode()
+	if err != nil {
+		t.Fatalf("unable to add node: %v", err)
+	}
+	key2, err := source.addRandNode()
+	if err != nil {
+		t.Fatalf("unable to add node: %v", err)
+	}
+	_, _, err = source.addRandChannel(
+		key1, key2, btcutil.SatoshiPerBitcoin,
+	)
+	if err != nil {
+		t.Fatalf("unable to add channel: %v", err)
+	}
+
+	snapshot, err := SnapshotGraph(
+		context.Background(), &unsnapshottableGraph{source},
+	)
+	if err != nil {
+		t.Fatalf("unable to snapshot graph: %v", err)
+	}
+
+	// The snapshot should report the version of the source graph.
+	version, versioned := graphVersion(snapshot)
+	if !versioned || version != 7 {
+		t.Fatalf("expected snapshot version 7, got %v (versioned=%v)",
+			version, versioned)
+	}
+
+	// Snapshotting a snapshot should return it as is.
+	again, err := SnapshotGraph(context.Background(), snapshot)
+	if err != nil {
+		t.Fatalf("unable to snapshot graph: %v", err)
+	}
+	if again != snapshot {
+		t.Fatalf("expected snapshot to be reused")
+	}
+
+	// The peers of each edge should be part of the snapshot.
+	err = snapshot.ForEachNode(func(n Node) error {
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			if _, ok := e.Peer.(*snapshotNode); !ok {
+				t.Fatalf("edge peer not part of snapshot")
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("unable to traverse graph: %v", err)
+	}
+
+	// Now we'll modify the source graph, which shouldn't affect the
+	// snapshot.
+	_, _, err = source.addRandChannel(
+		key1, nil, btcutil.SatoshiPerBitcoin,
+	)
+	if err != nil {
+		t.Fatalf("unable to add channel: %v", err)
+	}
+	source.version++
+
+	numNodes, numEdges := graphStats(t, snapshot)
+	if numNodes != 2 || numEdges != 2 {
+		t.Fatalf("expected snapshot with 2 nodes and 2 edges, got "+
+			"%d nodes and %d edges", numNodes, numEdges)
+	}
+	numNodes, numEdges = graphStats(t, source)
+	if numNodes != 3 || numEdges != 4 {
+		t.Fatalf("expected source with 3 nodes and 4 edges, got "+
+			"%d nodes and %d edges", numNodes, numEdges)
+	}
+
+	if version, _ := graphVersion(snapshot); version != 7 {
+		t.Fatalf("expected snapshot version 7, got %v", version)
+	}
+}
+
+// TestWeightedCombAttachmentSnapshot checks that all sub-heuristics of a
+// WeightedCombAttachment see the same graph, even if the source graph is
+// modified while scoring.
+func TestWeightedCombAttachmentSnapshot(t *testing.T) {
+	t.Parallel()
+
+	source := newMemChannelGraph()
+	if _, err := source.addRandNode(); err != nil {
+		t.Fatalf("unable to add node: %v", err)
+	}
+
+	// The first heuristic adds a node to the source graph while scoring.
+	h1 := &graphObservingHeuristic{
+		t:    t,
+		name: "h1",
+		mutate: func() {
+			if _, err := source.addRandNode(); err != nil {
+				t.Fatalf("unable to add node: %v", err)
+			}
+		},
+	}
+	h2 := &graphObservingHeuristic{
+		t:    t,
+		name: "h2",
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	nodes := nodeSet(testNodeID(1))
+	for i := 1; i <= 3; i++ {
+		_, err := comb.NodeScores(
+			source, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		// Both heuristics should have seen the graph as it was at
+		// the start of the round, while the next round should see the
+		// modification.
+		if h1.numNodes[i-1] != i || h2.numNodes[i-1] != i {
+			t.Fatalf("round %d: expected both heuristics to see "+
+				"%d nodes, got %d and %d", i, i,
+				h1.numNodes[i-1], h2.numNodes[i-1])
+		}
+	}
+}
+
+// TestChannelGraphSnapshot checks that the snapshots of the channel graphs
+// aren't affected by later modifications of the graphs, and preserve their
+// version.
+func TestChannelGraphSnapshot(t *testing.T) {
+	t.Parallel()
+
+	for _, chanGraph := range chanGraphs {
+		graph, cleanup, err := chanGraph.genFunc()
+		if err != nil {
+			t.Fatalf("unable to create graph: %v", err)
+		}
+		if cleanup != nil {
+			defer cleanup()
+		}
+
+		addChan := func() {
+			_, _, err := graph.addRandChannel(
+				nil, nil, btcutil.SatoshiPerBitcoin,
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to add channel: %v",
+					chanGraph.name, err)
+			}
+		}
+		addChan()
+
+		snapshot, err := SnapshotGraph(context.Background(), graph)
+		if err != nil {
+			t.Fatalf("%v: unable to snapshot graph: %v",
+				chanGraph.name, err)
+		}
+		version, _ := graphVersion(snapshot)
+
+		// Modifying the graph shouldn't affect the snapshot.
+		addChan()
+
+		numNodes, numEdges := graphStats(t, snapshot)
+		if numNodes != 2 || numEdges != 2 {
+			t.Fatalf("%v: expected snapshot with 2 nodes and 2 "+
+				"edges, got %d nodes and %d edges",
+				chanGraph.name, numNodes, numEdges)
+		}
+		numNodes, numEdges = graphStats(t, graph)
+		if numNodes != 4 || numEdges != 4 {
+			t.Fatalf("%v: expected graph with 4 nodes and 4 "+
+				"edges, got %d nodes and %d edges",
+				chanGraph.name, numNodes, numEdges)
+		}
+
+		newVersion, _ := graphVersion(snapshot)
+		if newVersion != version {
+			t.Fatalf("%v: expected snapshot version %v, got %v",
+				chanGraph.name, version, newVersion)
+		}
+		if sourceVersion, _ := graphVersion(graph); sourceVersion ==
+			version {
+
+			t.Fatalf("%v: expected graph version to change",
+				chanGraph.name)
+		}
+	}
+}
+
+// TestWeightedCombAttachmentCopyGraph checks that a graph that can't take a
+// snapshot of itself is only copied for the sub-heuristics of a
+// WeightedCombAttachment if enabled.
+func TestWeightedCombAttachmentCopyGraph(t *testing.T) {
+	t.Parallel()
+
+	source := newMemChannelGraph()
+	if _, err := source.addRandNode(); err != nil {
+		t.Fatalf("unable to add node: %v", err)
+	}
+	g := &unsnapshottableGraph{source}
+
+	// The first heuristic adds a node to the source graph while scoring.
+	h1 := &graphObservingHeuristic{
+		t:    t,
+		name: "h1",
+		mutate: func() {
+			if _, err := source.addRandNode(); err != nil {
+				t.Fatalf("unable to add node: %v", err)
+			}
+		},
+	}
+	h2 := &graphObservingHeuristic{
+		t:    t,
+		name: "h2",
+	}
+
+	comb, err := NewWeightedCombAttachment(
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h1},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	// By default, the graph isn't copied, so the second heuristic should
+	// see the node added by the first one.
+	nodes := nodeSet(testNodeID(1))
+	_, err = comb.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if h1.numNodes[0] != 2 || h2.numNodes[0] != 2 {
+		t.Fatalf("expected both heuristics to see 2 nodes, got %d "+
+			"and %d", h1.numNodes[0], h2.numNodes[0])
+	}
+
+	// Once enabled, both heuristics should see the graph as it was at the
+	// start of the round.
+	comb.SetCopyGraph(true)
+	_, err = comb.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if h1.numNodes[1] != 2 || h2.numNodes[1] != 2 {
+		t.Fatalf("expected both heuristics to see 2 nodes, got %d "+
+			"and %d", h1.numNodes[1], h2.numNodes[1])
+	}
+}
@@ -0,0 +1,212 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// HarmonicCombAttachment is an implementation of the AttachmentHeuristic
+// interface that combines the scores given by several sub-heuristics into one
+// by taking their weighted harmonic mean.
+//
+// In contrast to the WeightedCombAttachment, which computes the weighted
+// arithmetic sum of the sub-scores, the harmonic mean is dominated by the
+// lowest of the sub-scores. A node will therefore only be given a high score
+// if every sub-heuristic gives it a high score, while a low score from any
+// single sub-heuristic drags the combined score down. A sub-score of zero
+// results in a combined score of zero.
+type HarmonicCombAttachment struct {
+	heuristics []*WeightedHeuristic
+
+	// subScorePolicy determines how sub-scores outside the range [0, 1.0]
+	// are handled.
+	subScorePolicy SubScorePolicy
+
+	// clock is used to wait in between retries of failing
+	// sub-heuristics.
+	clock clock.Clock
+
+	sync.Mutex
+}
+
+// NewHarmonicCombAttachment creates a new instance of a
+// HarmonicCombAttachment.
+func NewHarmonicCombAttachment(h ...*WeightedHeuristic) (
+	*HarmonicCombAttachment, error) {
+
+	// Penalties can't be expressed within a harmonic mean.
+	for _, w := range h {
+		if w.Penalty {
+			return nil, fmt.Errorf("penalty heuristic %v not "+
+				"supported", w.Name())
+		}
+	}
+
+	if err := validateWeights(h); err != nil {
+		return nil, err
+	}
+
+	return &HarmonicCombAttachment{
+		heuristics: h,
+		clock:      clock.NewDefaultClock(),
+	}, nil
+}
+
+// SetSubScorePolicy sets the policy used to handle sub-scores outside the
+// range [0, 1.0].
+func (c *HarmonicCombAttachment) SetSubScorePolicy(
+	policy SubScorePolicy) error {
+
+	switch policy {
+	case SubScoreReject, SubScoreClamp:
+	default:
+		return fmt.Errorf("unknown sub-score policy %v", policy)
+	}
+
+	c.Lock()
+	c.subScorePolicy = policy
+	c.Unlock()
+
+	return nil
+}
+
+// A compile time assertion to ensure HarmonicCombAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*HarmonicCombAttachment)(nil)
+var _ ScoreSettable = (*HarmonicCombAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *HarmonicCombAttachment) Name() string {
+	return "harmoniccomb"
+}
+
+// NodeScores is a method that given the current channel graph, current set of
+// local channels and funds available, scores the given nodes according to the
+// preference of opening a channel with them. The returned channel candidates
+// maps the NodeID to an attachment directive containing a score and a channel
+// size.
+//
+// The scores is determined by quering the set of sub-heuristics, then
+// combining these scores into a final score by computing their weighted
+// harmonic mean:
+//
+//	score = 1 / sum(weight_i / score_i)
+//
+// Since the weights sum to 1.0, the combined score will be in the range
+// [min(score_i), max(score_i)], and thus in the range [0, 1.0].
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (c *HarmonicCombAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return c.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the computation
+// if the passed context is cancelled. The context is passed along to the
+// sub-heuristics.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (c *HarmonicCombAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	c.Lock()
+	policy := c.subScorePolicy
+	c.Unlock()
+
+	// We now query each heuristic to determine the score they give to the
+	// nodes for the given channel size.
+	subScores, _, err := querySubScores(
+		ctx, c.heuristics, g, chans, chanSize, nodes, FailFast,
+		c.clock, nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		// We'll sum the sub-scores' weighted reciprocals. If any
+		// sub-heuristic gave the node a zero score, the reciprocal
+		// would be infinite and the harmonic mean zero, so we skip the
+		// node altogether.
+		var (
+			sum       float64
+			zeroScore bool
+		)
+		for i, h := range c.heuristics {
+			// A heuristic without any weight doesn't contribute to
+			// the mean.
+			if h.Weight == 0 {
+				continue
+			}
+
+			// Each sub-heuristic should have scored the node, if
+			// not it is implicitly given a zero score by that
+			// heuristic.
+			var subScore float64
+			if sub, ok := subScores[i][nID]; ok {
+				// A NaN or negative sub-score would corrupt
+				// the mean, so we'll make sure it is within
+				// range.
+				subScore, err = checkSubScore(
+					h.Name(), sub.Score, policy,
+				)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			subScore = h.transferScore(subScore)
+			if subScore == 0 {
+				zeroScore = true
+				break
+			}
+
+			sum += h.Weight / subScore
+		}
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if zeroScore || sum == 0 {
+			continue
+		}
+
+		// As the weights only sum to 1.0 within a small tolerance,
+		// rounding errors may push the score slightly out of range, so
+		// we'll clamp it.
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  clampScore(1.0 / sum),
+			Reason: combineReasons(c.heuristics, subScores, nID),
+		}
+	}
+
+	return scores, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will recursively
+// apply the scores to its sub-heuristics.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (c *HarmonicCombAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setSubNodeScores(c.heuristics, targetHeuristic, newScores)
+}
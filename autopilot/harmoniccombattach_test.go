@@ -0,0 +1,286 @@
+package autopilot
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// TestHarmonicCombAttachment checks that the HarmonicCombAttachment combines
+// its sub-scores using their weighted harmonic mean, and that a near-zero
+// sub-score drags the combined score down, in contrast to the weighted sum.
+func TestHarmonicCombAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+	node4 := testNodeID(4)
+
+	// The first heuristic likes all nodes, while the second one gives
+	// node2 a near-zero score, doesn't score node3 at all and gives node4
+	// an explicit zero score.
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 1.0,
+			node3: 1.0,
+			node4: 1.0,
+		},
+	}
+	h2 := &staticHeuristic{
+		name: "h2",
+		scores: map[NodeID]float64{
+			node1: 0.5,
+			node2: 0.001,
+			node4: 0,
+		},
+	}
+
+	weighted := []*WeightedHeuristic{
+		{Weight: 0.5, AttachmentHeuristic: h1},
+		{Weight: 0.5, AttachmentHeuristic: h2},
+	}
+
+	harmonic, err := NewHarmonicCombAttachment(weighted...)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	arithmetic, err := NewWeightedCombAttachment(weighted...)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	nodes := nodeSet(node1, node2, node3, node4)
+	scores, err := harmonic.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// Nodes given a zero score by any heuristic should be skipped.
+	if len(scores) != 2 {
+		t.Fatalf("expected 2 scores, got %d", len(scores))
+	}
+
+	// The weighted harmonic mean of 1.0 and 0.5 is 1/(0.5/1 + 0.5/0.5).
+	exp1 := 1.0 / (0.5/1.0 + 0.5/0.5)
+	if !floatEq(scores[node1].Score, exp1) {
+		t.Fatalf("expected score %v, got %v", exp1,
+			scores[node1].Score)
+	}
+
+	exp2 := 1.0 / (0.5/1.0 + 0.5/0.001)
+	if !floatEq(scores[node2].Score, exp2) {
+		t.Fatalf("expected score %v, got %v", exp2,
+			scores[node2].Score)
+	}
+
+	// The near-zero sub-score should drag the harmonic mean well below the
+	// arithmetic mean, which would still give the node a score of ~0.5.
+	arithScores, err := arithmetic.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	if arithScores[node2].Score < 0.5 {
+		t.Fatalf("expected arithmetic score of at least 0.5, got %v",
+			arithScores[node2].Score)
+	}
+	if scores[node2].Score > 0.01 {
+		t.Fatalf("expected harmonic score below 0.01, got %v",
+			scores[node2].Score)
+	}
+}
+
+// TestHarmonicCombAttachmentInvalidSubScores checks that NaN and negative
+// sub-scores are rejected by default, and treated as zero scores when
+// clamping.
+func TestHarmonicCombAttachmentInvalidSubScores(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	node3 := testNodeID(3)
+
+	h1 := &staticHeuristic{
+		name: "h1",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 1.0,
+			node3: 1.0,
+		},
+	}
+
+	testCases := []struct {
+		name  string
+		score float64
+	}{
+		{name: "nan", score: math.NaN()},
+		{name: "negative", score: -0.5},
+	}
+
+	for _, test := range testCases {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			h2 := &staticHeuristic{
+				name: "h2",
+				scores: map[NodeID]float64{
+					node1: 0.5,
+					node2: test.score,
+					node3: 1.0,
+				},
+			}
+
+			harmonic, err := NewHarmonicCombAttachment(
+				&WeightedHeuristic{
+					Weight:              0.5,
+					AttachmentHeuristic: h1,
+				},
+				&WeightedHeuristic{
+					Weight:              0.5,
+					AttachmentHeuristic: h2,
+				},
+			)
+			if err != nil {
+				t.Fatalf("unable to create heuristic: %v", err)
+			}
+
+			nodes := nodeSet(node1, node2, node3)
+			_, err = harmonic.NodeScores(
+				nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err == nil {
+				t.Fatalf("expected invalid sub-score to be " +
+					"rejected")
+			}
+
+			err = harmonic.SetSubScorePolicy(SubScoreClamp)
+			if err != nil {
+				t.Fatalf("unable to set policy: %v", err)
+			}
+
+			scores, err := harmonic.NodeScores(
+				nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t.Fatalf("unable to get scores: %v", err)
+			}
+
+			// The invalid sub-score is clamped to zero, so node2
+			// should be skipped.
+			if _, ok := scores[node2]; ok {
+				t.Fatalf("expected node2 to be skipped")
+			}
+			if len(scores) != 2 {
+				t.Fatalf("expected 2 scores, got %d",
+					len(scores))
+			}
+			for _, score := range scores {
+				if math.IsNaN(score.Score) || score.Score < 0 ||
+					score.Score > 1 {
+
+					t.Fatalf("invalid score %v",
+						score.Score)
+				}
+			}
+		})
+	}
+}
+
+// TestHarmonicCombAttachmentRetry checks that failing sub-heuristics are
+// retried after waiting on the combinator's clock.
+func TestHarmonicCombAttachmentRetry(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	nodes := nodeSet(node1)
+
+	flaky := &flakyHeuristic{
+		staticHeuristic: &staticHeuristic{
+			name:   "flaky",
+			scores: map[NodeID]float64{node1: 1.0},
+		},
+		failures: 2,
+	}
+	h2 := &staticHeuristic{
+		name:   "h2",
+		scores: map[NodeID]float64{node1: 0.5},
+	}
+
+	harmonic, err := NewHarmonicCombAttachment(
+		&WeightedHeuristic{
+			Weight: 0.5,
+			Retry: RetryPolicy{
+				MaxAttempts: 3,
+				BaseDelay:   time.Hour,
+			},
+			AttachmentHeuristic: flaky,
+		},
+		&WeightedHeuristic{Weight: 0.5, AttachmentHeuristic: h2},
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	testClock := clock.NewTestClock(time.Unix(1000, 0))
+	harmonic.clock = testClock
+
+	type result struct {
+		scores map[NodeID]*NodeScore
+		err    error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		scores, err := harmonic.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		resultChan <- result{scores, err}
+	}()
+
+	// The retries only happen once the test clock has advanced past the
+	// backoff delays. As we can't tell when the combinator starts
+	// waiting, we'll keep advancing the clock until the scores arrive.
+	var res result
+	timeout := time.After(10 * time.Second)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case res = <-resultChan:
+			break loop
+
+		case <-ticker.C:
+			testClock.Advance(time.Hour)
+
+		case <-timeout:
+			t.Fatalf("scores not received")
+		}
+	}
+
+	if res.err != nil {
+		t.Fatalf("unable to get scores: %v", res.err)
+	}
+
+	if flaky.calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", flaky.calls)
+	}
+
+	exp := 1.0 / (0.5/1.0 + 0.5/0.5)
+	if !floatEq(res.scores[node1].Score, exp) {
+		t.Fatalf("expected score %v, got %v", exp,
+			res.scores[node1].Score)
+	}
+}
@@ -0,0 +1,142 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// InboundAttachment is an implementation of the AttachmentHeuristic interface
+// that prefers well-connected nodes likely to route payments toward us, for
+// nodes mainly receiving payments, such as merchants.
+//
+// A node sending more payments than it receives ends up with the liquidity of
+// its channels on its peers' side. As channel balances aren't public, this is
+// estimated from the fee policies in both directions of its channels: the node
+// charges high fees on the channels it has little outbound liquidity left on,
+// while its peers charge low fees to drain the liquidity they accumulated
+// toward it. While the LiquidityAttachment with the receive intent only looks
+// at the policies of the node itself, this heuristic also accounts for the
+// policies of its peers, and for how well-connected the node is.
+type InboundAttachment struct {
+}
+
+// NewInboundAttachment creates a new instance of an InboundAttachment
+// heuristic.
+func NewInboundAttachment() *InboundAttachment {
+	return &InboundAttachment{}
+}
+
+// A compile time assertion to ensure InboundAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*InboundAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (i *InboundAttachment) Name() string {
+	return "inbound"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The liquidity hints of the policies of a node and of the policies of its
+// peers toward it are computed as by the LiquidityAttachment, giving the
+// outbound hint of the node and the inbound hint from its peers. Its net
+// sender hint is the inbound hint as a fraction of the sum of both, such that
+// it is 0.5 for balanced nodes, and nodes without any policies are considered
+// balanced. The score of a node is its net sender hint scaled by the total
+// capacity of its channels, relative to the highest capacity among the nodes
+// to score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (i *InboundAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// We'll gather the capacity of the nodes we need to score, along with
+	// their policies and the policies of their peers toward them. The
+	// fees of all policies in the graph are gathered as well.
+	var (
+		propFees    []float64
+		capacities  = make(map[NodeID]btcutil.Amount)
+		outPolicies = make(map[NodeID][]ChannelEdge)
+		inPolicies  = make(map[NodeID][]ChannelEdge)
+	)
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+		_, candidate := nodes[nID]
+		if _, ok := existingPeers[nID]; ok {
+			candidate = false
+		}
+
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			if candidate {
+				capacities[nID] += e.Capacity
+			}
+
+			if e.Policy == nil {
+				return nil
+			}
+
+			propFees = append(
+				propFees,
+				float64(e.Policy.FeeProportionalMillionths),
+			)
+
+			if candidate {
+				outPolicies[nID] = append(outPolicies[nID], e)
+			}
+
+			peer := NodeID(e.Peer.PubKey())
+			if _, ok := nodes[peer]; ok {
+				inPolicies[peer] = append(inPolicies[peer], e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	medianProp := median(propFees)
+
+	// The node with the highest capacity among the candidates will have
+	// its net sender hint unscaled.
+	var maxCapacity btcutil.Amount
+	for _, capacity := range capacities {
+		if capacity > maxCapacity {
+			maxCapacity = capacity
+		}
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID, capacity := range capacities {
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if capacity == 0 {
+			continue
+		}
+
+		outbound := outboundHint(outPolicies[nID], medianProp)
+		inbound := outboundHint(inPolicies[nID], medianProp)
+		sender := inbound / (inbound + outbound)
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score: sender * float64(capacity) /
+				float64(maxCapacity),
+			Reason: fmt.Sprintf("net sender hint %.2f", sender),
+		}
+	}
+
+	return candidates, nil
+}
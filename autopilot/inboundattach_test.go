@@ -0,0 +1,119 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestInboundAttachment checks that the InboundAttachment favors
+// well-connected nodes whose channels hint at them being net senders.
+func TestInboundAttachment(t *testing.T) {
+	t.Parallel()
+
+	g := newMemChannelGraph()
+
+	// The sender S and receiver R both have two channels, to A and B, and
+	// to C and D respectively. M also has two channels, to E and F.
+	const (
+		s = iota
+		a
+		b
+		r
+		c
+		d
+		m
+		e
+		f
+		numNodes
+	)
+	keys, nIDs := genTestNodes(t, numNodes)
+	edges := [][2]int{{s, a}, {s, b}, {r, c}, {r, d}, {m, e}, {m, f}}
+	for _, edge := range edges {
+		_, _, err := g.addRandChannel(
+			keys[edge[0]], keys[edge[1]],
+			btcutil.SatoshiPerBitcoin,
+		)
+		if err != nil {
+			t.Fatalf("unable to add channel: %v", err)
+		}
+	}
+
+	// S charges high fees, as its outbound liquidity is depleted, while A
+	// and B charge nothing to drain the liquidity they have toward it.
+	// The opposite goes for R, C and D. M, E and F haven't advertised any
+	// policies. This makes for a median fee of 16, such that a fee of 32
+	// gives a hint of 1/(1+33/17) = 17/50, and a fee of 0 a hint of
+	// 1/(1+1/17) = 17/18.
+	policies := map[int]*RoutingPolicy{
+		s: {FeeProportionalMillionths: 32},
+		a: {FeeProportionalMillionths: 0},
+		b: {FeeProportionalMillionths: 0},
+		r: {FeeProportionalMillionths: 0},
+		c: {FeeProportionalMillionths: 32},
+		d: {FeeProportionalMillionths: 32},
+	}
+	for i, policy := range policies {
+		node := g.graph[nIDs[i]]
+		for j := range node.chans {
+			node.chans[j].Policy = policy
+		}
+	}
+
+	h := NewInboundAttachment()
+	scores, err := h.NodeScores(
+		g, nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(nIDs[s], nIDs[r], nIDs[m], nIDs[a]),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// S and R have the highest capacity, so their scores are their net
+	// sender hints, while A only has half their capacity. A is a net
+	// receiver, as it charges nothing while S charges high fees toward
+	// it.
+	const high, low = 17.0 / 18, 17.0 / 50
+	expected := map[int]float64{
+		s: high / (high + low),
+		r: low / (high + low),
+		m: 0.5,
+		a: 0.5 * low / (high + low),
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for i, exp := range expected {
+		score, ok := scores[nIDs[i]]
+		if !ok {
+			t.Fatalf("node %d not scored", i)
+		}
+		if !floatEq(score.Score, exp) {
+			t.Fatalf("node %d: expected score %v, got %v", i, exp,
+				score.Score)
+		}
+	}
+
+	// The send-biased node should therefore be preferred over the
+	// balanced one, which itself should be preferred over the
+	// receive-biased one.
+	if scores[nIDs[s]].Score <= scores[nIDs[m]].Score ||
+		scores[nIDs[m]].Score <= scores[nIDs[r]].Score {
+
+		t.Fatalf("unexpected ranking: %v", scores)
+	}
+
+	// Existing peers shouldn't be scored.
+	chans := []Channel{{Node: nIDs[s]}}
+	scores, err = h.NodeScores(
+		g, chans, btcutil.SatoshiPerBitcoin, nodeSet(nIDs[s], nIDs[r]),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if _, ok := scores[nIDs[s]]; ok || len(scores) != 1 {
+		t.Fatalf("expected only node %d to be scored, got %v", r,
+			scores)
+	}
+}
@@ -1,6 +1,7 @@
 package autopilot
 
 import (
+	"context"
 	"net"
 
 	"github.com/btcsuite/btcd/btcec"
@@ -31,6 +32,16 @@ type Node interface {
 	ForEachChannel(func(ChannelEdge) error) error
 }
 
+// FeatureNode is a Node that is able to report the features it advertises in
+// its node announcement.
+type FeatureNode interface {
+	Node
+
+	// Features returns the features advertised by the node. It may be nil
+	// if the node hasn't advertised any.
+	Features() *lnwire.FeatureVector
+}
+
 // Channel is a simple struct which contains relevant details of a particular
 // channel within the channel graph. The fields in this struct may be used a
 // signals for various AttachmentHeuristic implementations.
@@ -66,6 +77,23 @@ type ChannelEdge struct {
 	// Peer is the peer that this channel creates an edge to in the channel
 	// graph.
 	Peer Node
+
+	// Policy is the routing policy advertised by the node for forwarding
+	// payments over this channel to the peer. It is nil if the policy is
+	// unknown.
+	Policy *RoutingPolicy
+}
+
+// RoutingPolicy describes the fees a node charges for forwarding payments
+// over one of its channels.
+type RoutingPolicy struct {
+	// FeeBaseMSat is the base fee charged for each forwarded HTLC,
+	// expressed in millisatoshi.
+	FeeBaseMSat lnwire.MilliSatoshi
+
+	// FeeProportionalMillionths is the rate charged for HTLCs for each
+	// millionth of a satoshi forwarded.
+	FeeProportionalMillionths lnwire.MilliSatoshi
 }
 
 // ChannelGraph in an interface that represents a traversable channel graph.
@@ -81,6 +109,42 @@ type ChannelGraph interface {
 	ForEachNode(func(Node) error) error
 }
 
+// VersionedChannelGraph is a ChannelGraph that is able to report a version
+// number for its current state. The version must change each time the graph is
+// modified, which allows heuristics to detect whether their previous
+// computations over the graph are still valid.
+type VersionedChannelGraph interface {
+	ChannelGraph
+
+	// Version returns the current version of the graph.
+	Version() uint64
+}
+
+// SnapshottableChannelGraph is a ChannelGraph that is able to provide a
+// consistent, read-only snapshot of itself, which can be read concurrently
+// while the graph is being modified. Implementations should make taking a
+// snapshot cheap, e.g. by using copy-on-write.
+type SnapshottableChannelGraph interface {
+	ChannelGraph
+
+	// Snapshot returns a read-only snapshot of the current state of the
+	// graph.
+	Snapshot() (ChannelGraph, error)
+}
+
+// ChannelGraphObserver is an interface that can be notified of changes to the
+// channel graph, allowing heuristics to incrementally update their
+// computations over the graph instead of recomputing them from scratch.
+type ChannelGraphObserver interface {
+	// ChannelAdded is called when a channel between the two given nodes
+	// is added to the graph.
+	ChannelAdded(node1, node2 NodeID)
+
+	// ChannelRemoved is called when a channel between the two given nodes
+	// is removed from the graph.
+	ChannelRemoved(node1, node2 NodeID)
+}
+
 // NodeScore is a tuple mapping a NodeID to a score indicating the preference
 // of opening a channel with it.
 type NodeScore struct {
@@ -91,6 +155,16 @@ type NodeScore struct {
 	// Score is the score given by the heuristic for opening a channel of
 	// the given size to this node.
 	Score float64
+
+	// Reason is an optional short human-readable explanation of the
+	// score, e.g. "45 channels". Heuristics are free to leave it empty.
+	Reason string
+
+	// ChanSize is an optional suggestion for the size of the channel to
+	// open to this node, e.g. a larger channel for a big routing hub. It
+	// should not exceed the channel size the node was scored for. Zero
+	// means no preference, in which case that channel size is used.
+	ChanSize btcutil.Amount
 }
 
 // AttachmentDirective describes a channel attachment proscribed by an
@@ -142,6 +216,132 @@ type AttachmentHeuristic interface {
 		map[NodeID]*NodeScore, error)
 }
 
+// ContextAttachmentHeuristic is an AttachmentHeuristic that is able to abort
+// the computation of its node scores if the passed context is cancelled. As
+// scoring can take a considerable amount of time on large graphs, heuristics
+// doing expensive computations should implement this interface, such that the
+// autopilot agent can stay responsive to shutdown requests.
+//
+// Heuristics only implementing the AttachmentHeuristic interface can still be
+// queried with a context using QueryNodeScores, but will only have the context
+// checked before the computation starts.
+type ContextAttachmentHeuristic interface {
+	AttachmentHeuristic
+
+	// NodeScoresContext is equivalent to NodeScores, but should return
+	// the context's error as soon as possible after the context is
+	// cancelled.
+	NodeScoresContext(ctx context.Context, g ChannelGraph, chans []Channel,
+		chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+		map[NodeID]*NodeScore, error)
+}
+
+// QueryNodeScores queries the given heuristic for the scores of the passed
+// nodes. If the heuristic is a ContextAttachmentHeuristic the context is
+// passed along, otherwise the regular NodeScores method is used after making
+// sure the context hasn't been cancelled already.
+func QueryNodeScores(ctx context.Context, h AttachmentHeuristic,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	if c, ok := h.(ContextAttachmentHeuristic); ok {
+		return c.NodeScoresContext(ctx, g, chans, chanSize, nodes)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return h.NodeScores(g, chans, chanSize, nodes)
+}
+
+// scorePreviewKey is the context key marking a scoring round as a preview.
+type scorePreviewKey struct{}
+
+// WithScorePreview returns a copy of the given context marking the scoring
+// round it is used for as a preview. Stateful heuristics compute their scores
+// as usual during a preview, but leave their internal state untouched, such
+// that the projected scores can be displayed without disturbing the agent.
+//
+// The following heuristics honor previews:
+//   - CachedAttachment neither stores nor evicts cached scores.
+//   - DecayingAttachment doesn't record the returned scores as the ones to
+//     blend into the next round.
+//   - PersistentAttachment neither persists scores nor starts refreshing
+//     them in the background.
+//
+// As the context is passed along to wrapped heuristics, previews also apply
+// to them.
+func WithScorePreview(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scorePreviewKey{}, true)
+}
+
+// IsScorePreview returns whether the scoring round the given context is used
+// for is a preview, in which case the heuristic must not update its internal
+// state.
+func IsScorePreview(ctx context.Context) bool {
+	preview, _ := ctx.Value(scorePreviewKey{}).(bool)
+	return preview
+}
+
+// PreviewNodeScores is equivalent to QueryNodeScores, but marks the scoring
+// round as a preview. See WithScorePreview for the heuristics honoring it.
+func PreviewNodeScores(ctx context.Context, h AttachmentHeuristic,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	return QueryNodeScores(
+		WithScorePreview(ctx), h, g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoreFunc is a callback receiving the score of a single node. Returning
+// an error aborts the computation of the remaining scores.
+type NodeScoreFunc func(*NodeScore) error
+
+// StreamingAttachmentHeuristic is a ContextAttachmentHeuristic that is able to
+// emit its node scores one at a time as they are computed, instead of
+// returning them all at once. This allows callers to process the scores of
+// very large candidate sets without buffering all of them.
+type StreamingAttachmentHeuristic interface {
+	ContextAttachmentHeuristic
+
+	// NodeScoresStream is equivalent to NodeScoresContext, but passes
+	// each score to the given callback instead of returning them. Nodes
+	// given a zero score are not emitted. If the callback returns an
+	// error, no more scores are emitted and the error is returned.
+	NodeScoresStream(ctx context.Context, g ChannelGraph, chans []Channel,
+		chanSize btcutil.Amount, nodes map[NodeID]struct{},
+		emit NodeScoreFunc) error
+}
+
+// StreamNodeScores queries the given heuristic for the scores of the passed
+// nodes, passing each of them to the given callback. If the heuristic is a
+// StreamingAttachmentHeuristic the scores are emitted as they are computed,
+// otherwise they are emitted after querying the heuristic using
+// QueryNodeScores.
+func StreamNodeScores(ctx context.Context, h AttachmentHeuristic,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}, emit NodeScoreFunc) error {
+
+	if s, ok := h.(StreamingAttachmentHeuristic); ok {
+		return s.NodeScoresStream(ctx, g, chans, chanSize, nodes, emit)
+	}
+
+	scores, err := QueryNodeScores(ctx, h, g, chans, chanSize, nodes)
+	if err != nil {
+		return err
+	}
+
+	for _, score := range scores {
+		if err := emit(score); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // ScoreSettable is an interface that indicates that the scores returned by the
 // heuristic can be mutated by an external caller. The ExternalScoreAttachment
 // currently implements this interface, and so should any heuristic that is
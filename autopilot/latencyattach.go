@@ -0,0 +1,143 @@
+package autopilot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// DefaultUnknownRTTScore is the score given to nodes without a round-trip time
+// estimate if none is configured.
+const DefaultUnknownRTTScore = 0.5
+
+// LatencySource is an interface that provides an estimate of the round-trip
+// time to a node, e.g. derived from the geolocation of its addresses or from
+// measured pings.
+type LatencySource interface {
+	// EstimatedRTT returns the estimated round-trip time to the given
+	// node. The boolean indicates whether an estimate is available.
+	EstimatedRTT(NodeID) (time.Duration, bool)
+}
+
+// LatencyAttachmentConfig houses the parameters of a LatencyAttachment.
+type LatencyAttachmentConfig struct {
+	// LatencySource provides the round-trip time estimates of the nodes.
+	LatencySource LatencySource
+
+	// MaxRTT is the round-trip time at which a node is given a zero score
+	// by the default curve.
+	MaxRTT time.Duration
+
+	// Curve is an optional function mapping the round-trip time of a
+	// node, as a fraction of the max RTT in the range [0, 1.0], to its
+	// score. Its result is clamped to the range [0, 1.0]. If nil, the
+	// score decreases linearly with the round-trip time.
+	Curve func(float64) float64
+
+	// UnknownRTTScore is the score given to nodes without a round-trip
+	// time estimate. It must be in the range [0, 1.0]. If zero,
+	// DefaultUnknownRTTScore is used.
+	UnknownRTTScore float64
+}
+
+// LatencyAttachment is an implementation of the AttachmentHeuristic interface
+// that prefers nodes with a low round-trip time, for latency-sensitive payment
+// routing. While the DiversityAttachment spreads our channels across network
+// locations, this heuristic favors the nearby ones.
+type LatencyAttachment struct {
+	cfg LatencyAttachmentConfig
+}
+
+// NewLatencyAttachment creates a new instance of a LatencyAttachment
+// heuristic.
+func NewLatencyAttachment(cfg LatencyAttachmentConfig) (*LatencyAttachment,
+	error) {
+
+	if cfg.LatencySource == nil {
+		return nil, fmt.Errorf("latency source must be set")
+	}
+	if cfg.MaxRTT <= 0 {
+		return nil, fmt.Errorf("max RTT must be positive, was %v",
+			cfg.MaxRTT)
+	}
+	if cfg.UnknownRTTScore < 0 || cfg.UnknownRTTScore > 1.0 {
+		return nil, fmt.Errorf("unknown RTT score must be in the "+
+			"range [0, 1.0], was %v", cfg.UnknownRTTScore)
+	}
+
+	if cfg.UnknownRTTScore == 0 {
+		cfg.UnknownRTTScore = DefaultUnknownRTTScore
+	}
+
+	return &LatencyAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure LatencyAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*LatencyAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (l *LatencyAttachment) Name() string {
+	return "latency"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score of a node is determined by its estimated round-trip time as a
+// fraction of the max RTT, mapped through the configured curve. Nodes at
+// least as far away as the max RTT are given a zero score by the default
+// linear curve, while nodes without an estimate are given the configured
+// neutral score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (l *LatencyAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		score := l.cfg.UnknownRTTScore
+		rtt, ok := l.cfg.LatencySource.EstimatedRTT(nID)
+		if ok {
+			score = l.rttScore(rtt)
+		}
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return scores, nil
+}
+
+// rttScore returns the score of a node with the given round-trip time.
+func (l *LatencyAttachment) rttScore(rtt time.Duration) float64 {
+	ratio := clampScore(float64(rtt) / float64(l.cfg.MaxRTT))
+	if l.cfg.Curve == nil {
+		return 1.0 - ratio
+	}
+
+	// A curve yielding NaN or an infinite value is treated as giving a
+	// zero score.
+	score := l.cfg.Curve(ratio)
+	if !isFinite(score) {
+		return 0
+	}
+
+	return clampScore(score)
+}
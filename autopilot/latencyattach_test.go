@@ -0,0 +1,156 @@
+package autopilot
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// staticLatencySource is a LatencySource returning a fixed set of estimates.
+type staticLatencySource map[NodeID]time.Duration
+
+func (s staticLatencySource) EstimatedRTT(nID NodeID) (time.Duration, bool) {
+	rtt, ok := s[nID]
+	return rtt, ok
+}
+
+var _ LatencySource = (staticLatencySource)(nil)
+
+// TestLatencyAttachment checks that the LatencyAttachment prefers nodes with a
+// lower round-trip time, according to the configured curve.
+func TestLatencyAttachment(t *testing.T) {
+	t.Parallel()
+
+	unknown := testNodeID(1)
+	local := testNodeID(2)
+	near := testNodeID(3)
+	far := testNodeID(4)
+	remote := testNodeID(5)
+	nodes := nodeSet(unknown, local, near, far, remote)
+
+	source := staticLatencySource{
+		local:  0,
+		near:   50 * time.Millisecond,
+		far:    150 * time.Millisecond,
+		remote: time.Second,
+	}
+
+	tests := []struct {
+		name     string
+		curve    func(float64) float64
+		unknown  float64
+		expected map[NodeID]float64
+		order    []NodeID
+	}{
+		{
+			name: "linear",
+			expected: map[NodeID]float64{
+				unknown: DefaultUnknownRTTScore,
+				local:   1.0,
+				near:    0.75,
+				far:     0.25,
+			},
+			order: []NodeID{local, near, unknown, far},
+		},
+		{
+			name: "square with custom unknown score",
+			curve: func(ratio float64) float64 {
+				return (1 - ratio) * (1 - ratio)
+			},
+			unknown: 0.1,
+			expected: map[NodeID]float64{
+				unknown: 0.1,
+				local:   1.0,
+				near:    0.5625,
+				far:     0.0625,
+			},
+			order: []NodeID{local, near, unknown, far},
+		},
+		{
+			name: "out of range curve",
+			curve: func(ratio float64) float64 {
+				return 2 * (1 - ratio)
+			},
+			expected: map[NodeID]float64{
+				unknown: DefaultUnknownRTTScore,
+				local:   1.0,
+				near:    1.0,
+				far:     0.5,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		h, err := NewLatencyAttachment(LatencyAttachmentConfig{
+			LatencySource:   source,
+			MaxRTT:          200 * time.Millisecond,
+			Curve:           test.curve,
+			UnknownRTTScore: test.unknown,
+		})
+		if err != nil {
+			t.Fatalf("test %q: unable to create heuristic: %v",
+				test.name, err)
+		}
+
+		scores, err := h.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to get scores: %v",
+				test.name, err)
+		}
+
+		if len(scores) != len(test.expected) {
+			t.Fatalf("test %q: expected %d scores, got %d",
+				test.name, len(test.expected), len(scores))
+		}
+		for nID, exp := range test.expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("test %q: node %x not scored",
+					test.name, nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("test %q: node %x: expected score "+
+					"%v, got %v", test.name, nID[:], exp,
+					s.Score)
+			}
+		}
+
+		if test.order == nil {
+			continue
+		}
+
+		// The nodes should be ordered from the lowest to the highest
+		// round-trip time, with the unknown node in the middle.
+		ranked := make([]NodeID, 0, len(scores))
+		for nID := range scores {
+			ranked = append(ranked, nID)
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			return scores[ranked[i]].Score > scores[ranked[j]].Score
+		})
+		for i, nID := range test.order {
+			if ranked[i] != nID {
+				t.Fatalf("test %q: expected node %x at rank "+
+					"%d, got %x", test.name, nID[:], i,
+					ranked[i][:])
+			}
+		}
+	}
+
+	// Invalid configurations should be rejected.
+	configs := []LatencyAttachmentConfig{
+		{MaxRTT: time.Second},
+		{LatencySource: source},
+		{LatencySource: source, MaxRTT: time.Second,
+			UnknownRTTScore: 1.1},
+	}
+	for _, cfg := range configs {
+		if _, err := NewLatencyAttachment(cfg); err == nil {
+			t.Fatalf("expected config to be rejected")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package autopilot
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// LiquidityIntent describes what the channels opened by the autopilot will
+// mainly be used for, which determines the liquidity we want our channel peers
+// to have.
+type LiquidityIntent uint8
+
+const (
+	// IntentRouting favors nodes whose liquidity seems balanced, such
+	// that payments can be forwarded in both directions. This is the
+	// default intent.
+	IntentRouting LiquidityIntent = iota
+
+	// IntentSend favors nodes that seem to have plenty of outbound
+	// liquidity, such that the payments we send through them can be
+	// forwarded further.
+	IntentSend
+
+	// IntentReceive favors nodes that seem to have plenty of inbound
+	// liquidity, such that payments to us can reach them.
+	IntentReceive
+)
+
+// String returns a human readable description of the intent.
+func (i LiquidityIntent) String() string {
+	switch i {
+	case IntentRouting:
+		return "routing"
+	case IntentSend:
+		return "send"
+	case IntentReceive:
+		return "receive"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(i))
+	}
+}
+
+// neutralOutboundHint is the outbound liquidity hint of nodes that haven't
+// advertised any routing policies.
+const neutralOutboundHint = 0.5
+
+// LiquidityAttachmentConfig houses the parameters of a LiquidityAttachment.
+type LiquidityAttachmentConfig struct {
+	// Intent is what the opened channels will mainly be used for.
+	Intent LiquidityIntent
+}
+
+// LiquidityAttachment is an implementation of the AttachmentHeuristic
+// interface that scores nodes according to the direction of their liquidity,
+// as hinted by the graph, and what we intend to use our channels for. This
+// makes the autopilot goal-aware, instead of purely connectivity-driven.
+//
+// As channel balances aren't public, the liquidity of a node is estimated from
+// its fee policies: nodes charge high fees on channels they have little
+// outbound liquidity left on, and low fees on channels they want to drain.
+type LiquidityAttachment struct {
+	cfg LiquidityAttachmentConfig
+}
+
+// NewLiquidityAttachment creates a new instance of a LiquidityAttachment
+// heuristic.
+func NewLiquidityAttachment(cfg LiquidityAttachmentConfig) (
+	*LiquidityAttachment, error) {
+
+	switch cfg.Intent {
+	case IntentRouting, IntentSend, IntentReceive:
+	default:
+		return nil, fmt.Errorf("unknown liquidity intent %v",
+			cfg.Intent)
+	}
+
+	return &LiquidityAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure LiquidityAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*LiquidityAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (l *LiquidityAttachment) Name() string {
+	return "liquidity"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Each policy of a node gives a hint of its outbound liquidity on the channel
+// of 1/(1+f), where f is its proportional fee relative to the network's
+// median, such that a node charging the median fee has a hint of 0.5. The
+// hints are averaged, weighted by channel capacity. With the send intent, the
+// score of a node is its outbound hint, with the receive intent its inbound
+// hint, while with the routing intent nodes with balanced liquidity are given
+// the highest score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (l *LiquidityAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	// We'll gather the policies of the nodes we need to score, along with
+	// the fees of all policies in the graph.
+	var (
+		propFees     []float64
+		nodePolicies = make(map[NodeID][]ChannelEdge)
+	)
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+		_, candidate := nodes[nID]
+
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			if e.Policy == nil {
+				return nil
+			}
+
+			propFees = append(
+				propFees,
+				float64(e.Policy.FeeProportionalMillionths),
+			)
+
+			if candidate {
+				nodePolicies[nID] = append(
+					nodePolicies[nID], e,
+				)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	medianProp := median(propFees)
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		outbound := outboundHint(nodePolicies[nID], medianProp)
+
+		var score float64
+		switch l.cfg.Intent {
+		case IntentSend:
+			score = outbound
+		case IntentReceive:
+			score = 1.0 - outbound
+		case IntentRouting:
+			score = 1.0 - math.Abs(2*outbound-1.0)
+		}
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score <= 0 {
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+			Reason: fmt.Sprintf("outbound liquidity hint %.2f",
+				outbound),
+		}
+	}
+
+	return candidates, nil
+}
+
+// outboundHint returns the capacity weighted average of the outbound liquidity
+// hints given by the policies of the passed channels. Channels without any
+// capacity are given a unit weight.
+func outboundHint(edges []ChannelEdge, medianProp float64) float64 {
+	if len(edges) == 0 {
+		return neutralOutboundHint
+	}
+
+	var sum, weights float64
+	for _, e := range edges {
+		fee := relativeFee(
+			float64(e.Policy.FeeProportionalMillionths), medianProp,
+		)
+
+		weight := math.Max(float64(e.Capacity), 1)
+		sum += weight / (1.0 + fee)
+		weights += weight
+	}
+
+	return sum / weights
+}
@@ -0,0 +1,115 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestLiquidityAttachment checks that the LiquidityAttachment favors nodes with
+// the liquidity matching the configured intent.
+func TestLiquidityAttachment(t *testing.T) {
+	t.Parallel()
+
+	g := newMemChannelGraph()
+
+	// Create a ring of seven nodes, each having two channels.
+	const numNodes = 7
+	keys, nIDs := genTestNodes(t, numNodes)
+	for i := 0; i < numNodes; i++ {
+		_, _, err := g.addRandChannel(
+			keys[i], keys[(i+1)%numNodes],
+			btcutil.SatoshiPerBitcoin,
+		)
+		if err != nil {
+			t.Fatalf("unable to add channel: %v", err)
+		}
+	}
+
+	// Nodes 0-2 charge the median fee of 10, giving them balanced
+	// liquidity hints of 0.5. Node 3 charges (32+1)/(10+1) = 3 times the
+	// median, giving an outbound hint of 1/4, while node 4 charges
+	// nothing, giving an outbound hint of 1/(1+1/11) = 11/12. Node 5
+	// hasn't advertised any policies, and node 6 is our existing peer.
+	policies := []*RoutingPolicy{
+		{FeeProportionalMillionths: 10},
+		{FeeProportionalMillionths: 10},
+		{FeeProportionalMillionths: 10},
+		{FeeProportionalMillionths: 32},
+		{FeeProportionalMillionths: 0},
+		nil,
+		{FeeProportionalMillionths: 10},
+	}
+	for i, nID := range nIDs {
+		node := g.graph[nID]
+		for j := range node.chans {
+			node.chans[j].Policy = policies[i]
+		}
+	}
+	chans := []Channel{{Node: nIDs[6]}}
+
+	tests := []struct {
+		intent   LiquidityIntent
+		expected []float64
+	}{
+		{
+			intent: IntentSend,
+			expected: []float64{
+				0.5, 0.5, 0.5, 0.25, 11.0 / 12, 0.5,
+			},
+		},
+		{
+			intent: IntentReceive,
+			expected: []float64{
+				0.5, 0.5, 0.5, 0.75, 1.0 / 12, 0.5,
+			},
+		},
+		{
+			intent: IntentRouting,
+			expected: []float64{
+				1.0, 1.0, 1.0, 0.5, 1.0 / 6, 1.0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		liquidity, err := NewLiquidityAttachment(
+			LiquidityAttachmentConfig{Intent: test.intent},
+		)
+		if err != nil {
+			t.Fatalf("unable to create heuristic: %v", err)
+		}
+
+		scores, err := liquidity.NodeScores(
+			g, chans, btcutil.SatoshiPerBitcoin, nodeSet(nIDs...),
+		)
+		if err != nil {
+			t.Fatalf("intent %v: unable to get scores: %v",
+				test.intent, err)
+		}
+
+		if _, ok := scores[nIDs[6]]; ok {
+			t.Fatalf("intent %v: existing peer scored", test.intent)
+		}
+		for i, exp := range test.expected {
+			s, ok := scores[nIDs[i]]
+			if !ok {
+				t.Fatalf("intent %v: node %d not scored",
+					test.intent, i)
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("intent %v: node %d: expected score "+
+					"%v, got %v", test.intent, i, exp,
+					s.Score)
+			}
+		}
+	}
+
+	// Unknown intents should be rejected.
+	_, err := NewLiquidityAttachment(
+		LiquidityAttachmentConfig{Intent: LiquidityIntent(99)},
+	)
+	if err == nil {
+		t.Fatalf("expected unknown intent to be rejected")
+	}
+}
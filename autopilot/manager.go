@@ -1,6 +1,7 @@
 package autopilot
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -337,8 +338,9 @@ func (m *Manager) queryHeuristics(nodes map[NodeID]struct{}, localState bool) (
 			continue
 		}
 
-		s, err := h.NodeScores(
-			m.cfg.PilotCfg.Graph, totalChans, chanSize, nodes,
+		s, err := QueryNodeScores(
+			context.Background(), h, m.cfg.PilotCfg.Graph,
+			totalChans, chanSize, nodes,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("unable to get sub score: %v",
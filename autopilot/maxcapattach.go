@@ -0,0 +1,156 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// MaxCapacityAttachmentConfig houses the parameters of a
+// MaxCapacityAttachment.
+type MaxCapacityAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be penalized.
+	Heuristic AttachmentHeuristic
+
+	// MaxCapacity is the total capacity a node may have in the graph to
+	// not be filtered out or penalized. Zero or negative disables the
+	// cap.
+	MaxCapacity btcutil.Amount
+
+	// PenaltySlope, if set, penalizes nodes exceeding MaxCapacity by
+	// scaling down their score linearly with their excess capacity,
+	// instead of filtering them out. The score is reduced by PenaltySlope
+	// times the excess as a fraction of MaxCapacity, such that with a
+	// slope of 1.0, a node having twice the max capacity is given a score
+	// of zero. It must not be negative.
+	PenaltySlope float64
+}
+
+// MaxCapacityAttachment is an implementation of the AttachmentHeuristic
+// interface that wraps another heuristic, and filters out or penalizes the
+// nodes whose total capacity in the graph exceeds an upper bound. This is the
+// counterpart of the MinChanAttachment: it avoids routing all of our liquidity
+// to the single largest hub, favoring strong but not dominant nodes instead.
+type MaxCapacityAttachment struct {
+	cfg MaxCapacityAttachmentConfig
+}
+
+// NewMaxCapacityAttachment creates a new instance of a MaxCapacityAttachment
+// heuristic.
+func NewMaxCapacityAttachment(cfg MaxCapacityAttachmentConfig) (
+	*MaxCapacityAttachment, error) {
+
+	if cfg.PenaltySlope < 0 {
+		return nil, fmt.Errorf("penalty slope must not be negative, "+
+			"was %v", cfg.PenaltySlope)
+	}
+
+	return &MaxCapacityAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure MaxCapacityAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*MaxCapacityAttachment)(nil)
+var _ ScoreSettable = (*MaxCapacityAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (m *MaxCapacityAttachment) Name() string {
+	return "maxcapacity"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, except for nodes
+// whose total capacity in the graph exceeds the max capacity. Those are either
+// given a zero score, or if a penalty slope is set, have their score scaled
+// down linearly with their excess capacity.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (m *MaxCapacityAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return m.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (m *MaxCapacityAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, m.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// If no cap is set, or no nodes were scored, there's nothing to
+	// penalize.
+	if m.cfg.MaxCapacity <= 0 || len(scores) == 0 {
+		return scores, nil
+	}
+
+	capacities, err := nodeCapacities(g)
+	if err != nil {
+		return nil, err
+	}
+
+	// The scores are copied, such that the wrapped heuristic's NodeScores
+	// aren't modified.
+	penalized := make(map[NodeID]*NodeScore, len(scores))
+	for nID, score := range scores {
+		s := *score
+		capacity := capacities[nID]
+
+		// The node doesn't exceed the cap, leave its score untouched.
+		if capacity <= m.cfg.MaxCapacity {
+			penalized[nID] = &s
+			continue
+		}
+
+		// Scale down the score of the node according to how far it
+		// exceeds the cap. Instead of setting the score of the node to
+		// zero, we leave it out of the returned set altogether.
+		excess := float64(capacity-m.cfg.MaxCapacity) /
+			float64(m.cfg.MaxCapacity)
+		factor := 1 - m.cfg.PenaltySlope*excess
+		if m.cfg.PenaltySlope == 0 || factor <= 0 {
+			continue
+		}
+
+		s.Score *= factor
+		penalized[nID] = &s
+	}
+
+	return penalized, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (m *MaxCapacityAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(m.cfg.Heuristic, targetHeuristic, newScores)
+}
@@ -0,0 +1,180 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestMaxCapacityAttachment checks that the MaxCapacityAttachment filters out
+// or penalizes nodes whose total capacity exceeds the configured cap.
+func TestMaxCapacityAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// Create a graph where the first node has a total
+			// capacity of three BTC, the second and third two, and
+			// the last one only one.
+			keys, nIDs := genTestNodes(t1, 4)
+			edges := [][2]int{{0, 1}, {0, 2}, {0, 3}, {1, 2}}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e[0]], keys[e[1]],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			inner := &staticHeuristic{
+				name:   "inner",
+				scores: make(map[NodeID]float64),
+			}
+			for _, nID := range nIDs {
+				inner.scores[nID] = 0.8
+			}
+			nodes := nodeSet(nIDs...)
+
+			tests := []struct {
+				name     string
+				maxCap   btcutil.Amount
+				slope    float64
+				expected []float64
+			}{
+				{
+					// Only the hub exceeds the cap, while
+					// nodes right at it are left as is.
+					name:     "hard filter",
+					maxCap:   2 * btcutil.SatoshiPerBitcoin,
+					expected: []float64{0, 0.8, 0.8, 0.8},
+				},
+				{
+					name:   "gentle slope",
+					maxCap: 2 * btcutil.SatoshiPerBitcoin,
+					slope:  1.0,
+					expected: []float64{
+						0.8 * 0.5, 0.8, 0.8, 0.8,
+					},
+				},
+				{
+					name:     "steep slope",
+					maxCap:   2 * btcutil.SatoshiPerBitcoin,
+					slope:    3.0,
+					expected: []float64{0, 0.8, 0.8, 0.8},
+				},
+				{
+					name: "lower cap",
+					maxCap: 3 * btcutil.SatoshiPerBitcoin /
+						2,
+					slope: 1.0,
+					expected: []float64{
+						0, 0.8 * 2 / 3, 0.8 * 2 / 3,
+						0.8,
+					},
+				},
+				{
+					name:     "disabled",
+					expected: []float64{0.8, 0.8, 0.8, 0.8},
+				},
+			}
+
+			for _, test := range tests {
+				maxCap, err := NewMaxCapacityAttachment(
+					MaxCapacityAttachmentConfig{
+						Heuristic:    inner,
+						MaxCapacity:  test.maxCap,
+						PenaltySlope: test.slope,
+					},
+				)
+				if err != nil {
+					t1.Fatalf("test %q: unable to create "+
+						"heuristic: %v", test.name, err)
+				}
+
+				scores, err := maxCap.NodeScores(
+					g, nil, btcutil.SatoshiPerBitcoin,
+					nodes,
+				)
+				if err != nil {
+					t1.Fatalf("test %q: unable to get "+
+						"scores: %v", test.name, err)
+				}
+
+				for i, exp := range test.expected {
+					var score float64
+					if s, ok := scores[nIDs[i]]; ok {
+						score = s.Score
+					}
+					if !floatEq(score, exp) {
+						t1.Fatalf("test %q: node %d: "+
+							"expected score %v, "+
+							"got %v", test.name, i,
+							exp, score)
+					}
+				}
+			}
+
+			// The scores of the wrapped heuristic must not be
+			// modified, as they might be shared with others.
+			innerScores, err := inner.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+			shared := &sharedScoresHeuristic{scores: innerScores}
+			const maxCapacity = 3 * btcutil.SatoshiPerBitcoin / 2
+			maxCap, err := NewMaxCapacityAttachment(
+				MaxCapacityAttachmentConfig{
+					Heuristic:    shared,
+					MaxCapacity:  maxCapacity,
+					PenaltySlope: 1.0,
+				},
+			)
+			if err != nil {
+				t1.Fatalf("unable to create heuristic: %v", err)
+			}
+			_, err = maxCap.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			if len(innerScores) != len(nIDs) {
+				t1.Fatalf("expected %d inner scores, got %d",
+					len(nIDs), len(innerScores))
+			}
+			for _, s := range innerScores {
+				if s.Score != 0.8 {
+					t1.Fatalf("expected inner score 0.8, "+
+						"got %v", s.Score)
+				}
+			}
+		})
+		if !success {
+			break
+		}
+	}
+
+	// A negative slope should be rejected.
+	_, err := NewMaxCapacityAttachment(MaxCapacityAttachmentConfig{
+		MaxCapacity:  btcutil.SatoshiPerBitcoin,
+		PenaltySlope: -1,
+	})
+	if err == nil {
+		t.Fatalf("expected negative slope to be rejected")
+	}
+}
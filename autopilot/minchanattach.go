@@ -0,0 +1,143 @@
+package autopilot
+
+import (
+	"context"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// MinChanAttachmentConfig houses the parameters of a MinChanAttachment.
+type MinChanAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be filtered.
+	Heuristic AttachmentHeuristic
+
+	// MinChannels is the number of channels a node must have in the graph
+	// to not be filtered out or penalized.
+	MinChannels int
+
+	// SoftPenalty, if set, penalizes nodes having fewer channels than
+	// MinChannels by scaling down their score proportionally to their
+	// number of channels, instead of giving them a score of zero.
+	SoftPenalty bool
+}
+
+// MinChanAttachment is an implementation of the AttachmentHeuristic interface
+// that wraps another heuristic, and filters out or penalizes the nodes that
+// have fewer than a minimum number of channels in the graph. New nodes with
+// only a few channels are often unreliable, so this can be used to avoid
+// opening channels to them.
+type MinChanAttachment struct {
+	cfg MinChanAttachmentConfig
+}
+
+// NewMinChanAttachment creates a new instance of a MinChanAttachment
+// heuristic.
+func NewMinChanAttachment(cfg MinChanAttachmentConfig) *MinChanAttachment {
+	return &MinChanAttachment{
+		cfg: cfg,
+	}
+}
+
+// A compile time assertion to ensure MinChanAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*MinChanAttachment)(nil)
+var _ ScoreSettable = (*MinChanAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (m *MinChanAttachment) Name() string {
+	return "minchans"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, except for nodes
+// having fewer than the minimum number of channels in the graph. Those are
+// either given a zero score, or if soft penalties are enabled, have their
+// score scaled by their fraction of the minimum number of channels.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (m *MinChanAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return m.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (m *MinChanAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, m.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// If no minimum is set, or no nodes were scored, there's nothing to
+	// filter.
+	if m.cfg.MinChannels <= 0 || len(scores) == 0 {
+		return scores, nil
+	}
+
+	degrees, err := nodeDegrees(g)
+	if err != nil {
+		return nil, err
+	}
+
+	// The scores are copied, such that the wrapped heuristic's NodeScores
+	// aren't modified.
+	filtered := make(map[NodeID]*NodeScore, len(scores))
+	for nID, score := range scores {
+		s := *score
+
+		numChans := degrees[nID]
+		switch {
+
+		// The node has enough channels, leave its score untouched.
+		case numChans >= m.cfg.MinChannels:
+
+		// Scale down the score of the node according to how far it is
+		// from the minimum.
+		case m.cfg.SoftPenalty && numChans > 0:
+			s.Score *= float64(numChans) /
+				float64(m.cfg.MinChannels)
+
+		// Instead of setting the score of the node to zero, we leave
+		// it out of the returned set altogether.
+		default:
+			continue
+		}
+
+		filtered[nID] = &s
+	}
+
+	return filtered, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (m *MinChanAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(m.cfg.Heuristic, targetHeuristic, newScores)
+}
@@ -0,0 +1,186 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcutil"
+)
+
+// genTestNodes generates the given number of random node keys, along with
+// their NodeIDs.
+func genTestNodes(t *testing.T, num int) ([]*btcec.PublicKey, []NodeID) {
+	t.Helper()
+
+	var (
+		keys []*btcec.PublicKey
+		nIDs []NodeID
+	)
+	for i := 0; i < num; i++ {
+		k, err := randKey()
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+
+		keys = append(keys, k)
+		nIDs = append(nIDs, NewNodeID(k))
+	}
+
+	return keys, nIDs
+}
+
+// sharedScoresHeuristic is an AttachmentHeuristic that returns the same
+// scores on every call, such that wrappers modifying them are detected.
+type sharedScoresHeuristic struct {
+	scores map[NodeID]*NodeScore
+}
+
+func (s *sharedScoresHeuristic) Name() string {
+	return "shared"
+}
+
+func (s *sharedScoresHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return s.scores, nil
+}
+
+var _ AttachmentHeuristic = (*sharedScoresHeuristic)(nil)
+
+// TestMinChanAttachment checks that the MinChanAttachment filters out or
+// penalizes nodes with fewer channels than the configured minimum.
+func TestMinChanAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// Create a graph where the first node has three
+			// channels, the second and third two, and the last one
+			// only one.
+			keys, nIDs := genTestNodes(t1, 4)
+			edges := [][2]int{{0, 1}, {0, 2}, {0, 3}, {1, 2}}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e[0]], keys[e[1]],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			inner := &staticHeuristic{
+				name:   "inner",
+				scores: make(map[NodeID]float64),
+			}
+			for _, nID := range nIDs {
+				inner.scores[nID] = 0.8
+			}
+			nodes := nodeSet(nIDs...)
+
+			// With a hard filter requiring two channels, only the
+			// last node should be filtered out.
+			minChans := NewMinChanAttachment(MinChanAttachmentConfig{
+				Heuristic:   inner,
+				MinChannels: 2,
+			})
+			scores, err := minChans.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			if len(scores) != 3 {
+				t1.Fatalf("expected 3 scores, got %d",
+					len(scores))
+			}
+			if _, ok := scores[nIDs[3]]; ok {
+				t1.Fatalf("expected low degree node to be " +
+					"filtered")
+			}
+			for _, s := range scores {
+				if s.Score != 0.8 {
+					t1.Fatalf("expected score 0.8, got %v",
+						s.Score)
+				}
+			}
+
+			// With soft penalties and a minimum of three channels,
+			// all nodes should be scored, but the scores of nodes
+			// below the minimum should be scaled down.
+			minChans = NewMinChanAttachment(MinChanAttachmentConfig{
+				Heuristic:   inner,
+				MinChannels: 3,
+				SoftPenalty: true,
+			})
+			scores, err = minChans.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			expected := []float64{0.8, 0.8 * 2 / 3, 0.8 * 2 / 3,
+				0.8 / 3}
+			for i, exp := range expected {
+				s, ok := scores[nIDs[i]]
+				if !ok {
+					t1.Fatalf("node %d not scored", i)
+				}
+				if !floatEq(s.Score, exp) {
+					t1.Fatalf("expected score %v for "+
+						"node %d, got %v", exp, i,
+						s.Score)
+				}
+			}
+
+			// The scores of the wrapped heuristic must not be
+			// modified, as they might be shared with others.
+			innerScores, err := inner.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+			minChans = NewMinChanAttachment(MinChanAttachmentConfig{
+				Heuristic: &sharedScoresHeuristic{
+					scores: innerScores,
+				},
+				MinChannels: 3,
+				SoftPenalty: true,
+			})
+			_, err = minChans.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin, nodes,
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			if len(innerScores) != len(nIDs) {
+				t1.Fatalf("expected %d inner scores, got %d",
+					len(nIDs), len(innerScores))
+			}
+			for _, s := range innerScores {
+				if s.Score != 0.8 {
+					t1.Fatalf("expected inner score 0.8, "+
+						"got %v", s.Score)
+				}
+			}
+		})
+		if !success {
+			break
+		}
+	}
+}
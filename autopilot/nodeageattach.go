@@ -0,0 +1,146 @@
+package autopilot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// DefaultUnknownAgeScore is the score given to nodes of unknown age if none is
+// configured.
+const DefaultUnknownAgeScore = 0.5
+
+// NodeAgeAttachmentConfig houses the parameters of a NodeAgeAttachment.
+type NodeAgeAttachmentConfig struct {
+	// FirstSeen returns the time the given node was first seen in the
+	// graph. The zero time indicates that it is unknown.
+	FirstSeen func(NodeID) time.Time
+
+	// MaturityAge is the age at which a node is given the full score.
+	MaturityAge time.Duration
+
+	// Curve is an optional function mapping the age of a node, as a
+	// fraction of the maturity age in the range [0, 1.0], to its score.
+	// Its result is clamped to the range [0, 1.0]. If nil, the score
+	// grows linearly with the age.
+	Curve func(float64) float64
+
+	// UnknownAgeScore is the score given to nodes whose age is unknown.
+	// It must be in the range [0, 1.0]. If zero, DefaultUnknownAgeScore
+	// is used.
+	UnknownAgeScore float64
+
+	// Clock is used to determine the current time. If nil, the default
+	// clock is used.
+	Clock clock.Clock
+}
+
+// NodeAgeAttachment is an implementation of the AttachmentHeuristic interface
+// that scores nodes by how long they've been present in the graph. Brand-new
+// nodes are riskier peers than established ones with a long history, so this
+// serves as a reliability signal, distinct from the connectivity of the
+// nodes.
+type NodeAgeAttachment struct {
+	cfg NodeAgeAttachmentConfig
+}
+
+// NewNodeAgeAttachment creates a new instance of a NodeAgeAttachment
+// heuristic.
+func NewNodeAgeAttachment(cfg NodeAgeAttachmentConfig) (*NodeAgeAttachment,
+	error) {
+
+	if cfg.FirstSeen == nil {
+		return nil, fmt.Errorf("first seen source must be set")
+	}
+	if cfg.MaturityAge <= 0 {
+		return nil, fmt.Errorf("maturity age must be positive, was %v",
+			cfg.MaturityAge)
+	}
+	if cfg.UnknownAgeScore < 0 || cfg.UnknownAgeScore > 1.0 {
+		return nil, fmt.Errorf("unknown age score must be in the "+
+			"range [0, 1.0], was %v", cfg.UnknownAgeScore)
+	}
+
+	if cfg.UnknownAgeScore == 0 {
+		cfg.UnknownAgeScore = DefaultUnknownAgeScore
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewDefaultClock()
+	}
+
+	return &NodeAgeAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure NodeAgeAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*NodeAgeAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (n *NodeAgeAttachment) Name() string {
+	return "nodeage"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score of a node is determined by its age as a fraction of the maturity
+// age, mapped through the configured curve. Nodes at least as old as the
+// maturity age are given a score of 1.0 by the default linear curve, while
+// nodes of unknown age are given the configured neutral score.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (n *NodeAgeAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	now := n.cfg.Clock.Now()
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		var score float64
+		firstSeen := n.cfg.FirstSeen(nID)
+		if firstSeen.IsZero() {
+			score = n.cfg.UnknownAgeScore
+		} else {
+			score = n.ageScore(now.Sub(firstSeen))
+		}
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return scores, nil
+}
+
+// ageScore returns the score of a node of the given age.
+func (n *NodeAgeAttachment) ageScore(age time.Duration) float64 {
+	ratio := clampScore(float64(age) / float64(n.cfg.MaturityAge))
+	if n.cfg.Curve == nil {
+		return ratio
+	}
+
+	// A curve yielding NaN or an infinite value is treated as giving a
+	// zero score.
+	score := n.cfg.Curve(ratio)
+	if !isFinite(score) {
+		return 0
+	}
+
+	return clampScore(score)
+}
@@ -0,0 +1,133 @@
+package autopilot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// TestNodeAgeAttachment checks that the NodeAgeAttachment scores nodes by
+// their age according to the configured curve.
+func TestNodeAgeAttachment(t *testing.T) {
+	t.Parallel()
+
+	const day = 24 * time.Hour
+
+	now := time.Unix(1000000000, 0)
+	testClock := clock.NewTestClock(now)
+
+	unknown := testNodeID(1)
+	brandNew := testNodeID(2)
+	young := testNodeID(3)
+	mature := testNodeID(4)
+	old := testNodeID(5)
+	future := testNodeID(6)
+	nodes := nodeSet(unknown, brandNew, young, mature, old, future)
+
+	firstSeen := map[NodeID]time.Time{
+		brandNew: now,
+		young:    now.Add(-7 * day),
+		mature:   now.Add(-28 * day),
+		old:      now.Add(-365 * day),
+		future:   now.Add(day),
+	}
+
+	tests := []struct {
+		name     string
+		curve    func(float64) float64
+		unknown  float64
+		expected map[NodeID]float64
+	}{
+		{
+			name: "linear",
+			expected: map[NodeID]float64{
+				unknown: DefaultUnknownAgeScore,
+				young:   0.25,
+				mature:  1.0,
+				old:     1.0,
+			},
+		},
+		{
+			name: "square with custom unknown score",
+			curve: func(ratio float64) float64 {
+				return ratio * ratio
+			},
+			unknown: 0.1,
+			expected: map[NodeID]float64{
+				unknown: 0.1,
+				young:   0.0625,
+				mature:  1.0,
+				old:     1.0,
+			},
+		},
+		{
+			name: "out of range curve",
+			curve: func(ratio float64) float64 {
+				return 2 * ratio
+			},
+			expected: map[NodeID]float64{
+				unknown: DefaultUnknownAgeScore,
+				young:   0.5,
+				mature:  1.0,
+				old:     1.0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		h, err := NewNodeAgeAttachment(NodeAgeAttachmentConfig{
+			FirstSeen: func(nID NodeID) time.Time {
+				return firstSeen[nID]
+			},
+			MaturityAge:     28 * day,
+			Curve:           test.curve,
+			UnknownAgeScore: test.unknown,
+			Clock:           testClock,
+		})
+		if err != nil {
+			t.Fatalf("test %q: unable to create heuristic: %v",
+				test.name, err)
+		}
+
+		scores, err := h.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to get scores: %v",
+				test.name, err)
+		}
+
+		if len(scores) != len(test.expected) {
+			t.Fatalf("test %q: expected %d scores, got %d",
+				test.name, len(test.expected), len(scores))
+		}
+		for nID, exp := range test.expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("test %q: node %x not scored",
+					test.name, nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("test %q: node %x: expected score "+
+					"%v, got %v", test.name, nID[:], exp,
+					s.Score)
+			}
+		}
+	}
+
+	// Invalid configurations should be rejected.
+	firstSeenFunc := func(NodeID) time.Time { return time.Time{} }
+	configs := []NodeAgeAttachmentConfig{
+		{MaturityAge: day},
+		{FirstSeen: firstSeenFunc},
+		{FirstSeen: firstSeenFunc, MaturityAge: day,
+			UnknownAgeScore: 1.1},
+	}
+	for _, cfg := range configs {
+		if _, err := NewNodeAgeAttachment(cfg); err == nil {
+			t.Fatalf("expected config to be rejected")
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package autopilot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// FeeRateSource is an interface that provides an estimate of the current
+// on-chain fee rate.
+type FeeRateSource interface {
+	// CurrentFeeRate returns the fee rate currently required to get a
+	// transaction confirmed in a timely manner.
+	CurrentFeeRate() btcutil.Amount
+}
+
+// OnChainFeeAttachmentConfig houses the parameters of an OnChainFeeAttachment.
+// The fee rates are expected to be in the same unit as the ones returned by
+// the FeeRateSource.
+type OnChainFeeAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be adjusted.
+	Heuristic AttachmentHeuristic
+
+	// FeeRateSource provides the current on-chain fee rate.
+	FeeRateSource FeeRateSource
+
+	// Threshold is the fee rate above which the scores are scaled down.
+	Threshold btcutil.Amount
+
+	// MaxFeeRate, if non-zero, is the fee rate at or above which no
+	// scores are returned at all. It must exceed the threshold.
+	MaxFeeRate btcutil.Amount
+}
+
+// OnChainFeeAttachment is an implementation of the AttachmentHeuristic
+// interface that wraps another heuristic, and scales down its scores when the
+// on-chain fees are high. Opening channels during fee spikes is wasteful, as
+// the same channels could be opened for a fraction of the cost once the fees
+// settle.
+type OnChainFeeAttachment struct {
+	cfg OnChainFeeAttachmentConfig
+}
+
+// NewOnChainFeeAttachment creates a new instance of an OnChainFeeAttachment
+// heuristic.
+func NewOnChainFeeAttachment(cfg OnChainFeeAttachmentConfig) (
+	*OnChainFeeAttachment, error) {
+
+	switch {
+	case cfg.Heuristic == nil:
+		return nil, errors.New("heuristic must be set")
+	case cfg.FeeRateSource == nil:
+		return nil, errors.New("fee rate source must be set")
+	case cfg.Threshold <= 0:
+		return nil, fmt.Errorf("threshold must be positive, was %v",
+			cfg.Threshold)
+	case cfg.MaxFeeRate != 0 && cfg.MaxFeeRate <= cfg.Threshold:
+		return nil, fmt.Errorf("max fee rate %v must exceed the "+
+			"threshold %v", cfg.MaxFeeRate, cfg.Threshold)
+	}
+
+	return &OnChainFeeAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure OnChainFeeAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*OnChainFeeAttachment)(nil)
+var _ ScoreSettable = (*OnChainFeeAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (o *OnChainFeeAttachment) Name() string {
+	return "onchainfee"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, as long as the
+// current fee rate doesn't exceed the threshold. Above it, all scores are
+// scaled down by the ratio of the threshold to the current fee rate. If the
+// fee rate reaches the max fee rate, no scores are returned.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (o *OnChainFeeAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return o.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (o *OnChainFeeAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	// If the fees are prohibitively high, we won't bother querying the
+	// wrapped heuristic.
+	feeRate := o.cfg.FeeRateSource.CurrentFeeRate()
+	if o.cfg.MaxFeeRate != 0 && feeRate >= o.cfg.MaxFeeRate {
+		return make(map[NodeID]*NodeScore), nil
+	}
+
+	scores, err := QueryNodeScores(
+		ctx, o.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// As long as the fees are low, the scores are left untouched.
+	if feeRate <= o.cfg.Threshold {
+		return scores, nil
+	}
+
+	// Otherwise, we'll scale down the scores the further the fees are
+	// above the threshold.
+	fraction := float64(o.cfg.Threshold) / float64(feeRate)
+	for _, score := range scores {
+		score.Score *= fraction
+	}
+
+	return scores, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (o *OnChainFeeAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(o.cfg.Heuristic, targetHeuristic, newScores)
+}
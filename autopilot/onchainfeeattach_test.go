@@ -0,0 +1,161 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// staticFeeRateSource is a FeeRateSource returning a fixed fee rate.
+type staticFeeRateSource struct {
+	feeRate btcutil.Amount
+}
+
+// CurrentFeeRate returns the current fee rate.
+//
+// NOTE: This is a part of the FeeRateSource interface.
+func (s *staticFeeRateSource) CurrentFeeRate() btcutil.Amount {
+	return s.feeRate
+}
+
+// TestOnChainFeeAttachment checks that the OnChainFeeAttachment leaves the
+// scores of the wrapped heuristic untouched at low fee rates, and scales them
+// down at high fee rates.
+func TestOnChainFeeAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			node1: 1.0,
+			node2: 0.5,
+		},
+	}
+
+	feeSource := &staticFeeRateSource{}
+	onChainFee, err := NewOnChainFeeAttachment(OnChainFeeAttachmentConfig{
+		Heuristic:     inner,
+		FeeRateSource: feeSource,
+		Threshold:     10,
+		MaxFeeRate:    100,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	const chanSize = btcutil.SatoshiPerBitcoin
+	assertScores := func(expected map[NodeID]float64) {
+		t.Helper()
+
+		scores, err := onChainFee.NodeScores(nil, nil, chanSize, nodes)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+		for nID, exp := range expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("node %x not scored", nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("expected score %v, got %v", exp,
+					s.Score)
+			}
+		}
+	}
+
+	// With low fees, up to and including the threshold, the scores
+	// should be left untouched.
+	feeSource.feeRate = 2
+	assertScores(map[NodeID]float64{node1: 1.0, node2: 0.5})
+
+	feeSource.feeRate = 10
+	assertScores(map[NodeID]float64{node1: 1.0, node2: 0.5})
+
+	// With fees at four times the threshold, the scores should be scaled
+	// down to a quarter.
+	feeSource.feeRate = 40
+	assertScores(map[NodeID]float64{node1: 0.25, node2: 0.125})
+
+	// Once the max fee rate is reached, no scores should be returned,
+	// without even querying the wrapped heuristic.
+	feeSource.feeRate = 100
+	calls := inner.calls
+	assertScores(nil)
+	if inner.calls != calls {
+		t.Fatalf("wrapped heuristic queried despite fee spike")
+	}
+}
+
+// TestOnChainFeeAttachmentConfig checks that invalid configs are rejected.
+func TestOnChainFeeAttachmentConfig(t *testing.T) {
+	t.Parallel()
+
+	inner := &staticHeuristic{name: "inner"}
+	feeSource := &staticFeeRateSource{}
+
+	tests := []struct {
+		name  string
+		cfg   OnChainFeeAttachmentConfig
+		valid bool
+	}{
+		{
+			name: "valid",
+			cfg: OnChainFeeAttachmentConfig{
+				Heuristic:     inner,
+				FeeRateSource: feeSource,
+				Threshold:     10,
+			},
+			valid: true,
+		},
+		{
+			name: "no heuristic",
+			cfg: OnChainFeeAttachmentConfig{
+				FeeRateSource: feeSource,
+				Threshold:     10,
+			},
+		},
+		{
+			name: "no fee rate source",
+			cfg: OnChainFeeAttachmentConfig{
+				Heuristic: inner,
+				Threshold: 10,
+			},
+		},
+		{
+			name: "zero threshold",
+			cfg: OnChainFeeAttachmentConfig{
+				Heuristic:     inner,
+				FeeRateSource: feeSource,
+			},
+		},
+		{
+			name: "max fee rate below threshold",
+			cfg: OnChainFeeAttachmentConfig{
+				Heuristic:     inner,
+				FeeRateSource: feeSource,
+				Threshold:     10,
+				MaxFeeRate:    5,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		_, err := NewOnChainFeeAttachment(test.cfg)
+		if test.valid && err != nil {
+			t.Fatalf("test %q: unexpected error: %v", test.name,
+				err)
+		}
+		if !test.valid && err == nil {
+			t.Fatalf("test %q: expected error", test.name)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// NeighborhoodOverlapConfig houses the parameters of a
+// NeighborhoodOverlapAttachment.
+type NeighborhoodOverlapConfig struct {
+	// Threshold is the neighborhood overlap, in the range [0, 1.0), up to
+	// which nodes are not penalized at all.
+	Threshold float64
+
+	// Penalty is an optional function mapping the overlap exceeding the
+	// threshold, rescaled to the range [0, 1.0], to the penalty
+	// subtracted from the full score. Its result is clamped to the range
+	// [0, 1.0]. If nil, the penalty grows linearly with the overlap.
+	Penalty func(float64) float64
+}
+
+// NeighborhoodOverlapAttachment is an implementation of the
+// AttachmentHeuristic interface that penalizes nodes sharing many neighbors
+// with our existing channel peers. A channel to such a node adds little new
+// reachability, as most of its neighbors are already close to us, so
+// preferring nodes with distinct neighborhoods improves our path diversity.
+//
+// The overlap of a candidate is the highest Jaccard index between its set of
+// neighbors and that of any of our existing peers, i.e. the number of shared
+// neighbors divided by the number of distinct neighbors of both.
+type NeighborhoodOverlapAttachment struct {
+	cfg NeighborhoodOverlapConfig
+}
+
+// NewNeighborhoodOverlapAttachment creates a new instance of a
+// NeighborhoodOverlapAttachment heuristic.
+func NewNeighborhoodOverlapAttachment(cfg NeighborhoodOverlapConfig) (
+	*NeighborhoodOverlapAttachment, error) {
+
+	if cfg.Threshold < 0 || cfg.Threshold >= 1.0 {
+		return nil, fmt.Errorf("threshold must be in the range "+
+			"[0, 1.0), was %v", cfg.Threshold)
+	}
+
+	return &NeighborhoodOverlapAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure NeighborhoodOverlapAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*NeighborhoodOverlapAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (o *NeighborhoodOverlapAttachment) Name() string {
+	return "overlap"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Nodes whose neighborhood overlap with our existing peers doesn't exceed the
+// threshold are given a score of 1.0. Beyond that, the configured penalty is
+// subtracted from the score, reaching zero by default for a node having the
+// exact same neighbors as one of our peers. Our existing peers themselves are
+// given a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (o *NeighborhoodOverlapAttachment) NodeScores(g ChannelGraph,
+	chans []Channel, chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// We'll go through the graph once, gathering the neighbors of our
+	// existing peers, and those of each candidate.
+	peerNeighbors := make(map[NodeID]map[NodeID]struct{})
+	candidateNeighbors := make(map[NodeID]map[NodeID]struct{})
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+
+		_, isPeer := existingPeers[nID]
+		_, isCandidate := nodes[nID]
+		if !isPeer && !isCandidate {
+			return nil
+		}
+
+		neighbors := make(map[NodeID]struct{})
+		err := n.ForEachChannel(func(e ChannelEdge) error {
+			neighbors[NodeID(e.Peer.PubKey())] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if isPeer {
+			peerNeighbors[nID] = neighbors
+		} else {
+			candidateNeighbors[nID] = neighbors
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID, neighbors := range candidateNeighbors {
+		var overlap float64
+		for _, peerNeighbors := range peerNeighbors {
+			j := jaccardIndex(neighbors, peerNeighbors)
+			if j > overlap {
+				overlap = j
+			}
+		}
+
+		score := 1.0 - o.penalty(overlap)
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+			Reason: fmt.Sprintf("%.0f%% neighborhood overlap",
+				100*overlap),
+		}
+	}
+
+	return scores, nil
+}
+
+// penalty returns the penalty for the given neighborhood overlap.
+func (o *NeighborhoodOverlapAttachment) penalty(overlap float64) float64 {
+	if overlap <= o.cfg.Threshold {
+		return 0
+	}
+
+	excess := (overlap - o.cfg.Threshold) / (1.0 - o.cfg.Threshold)
+	if o.cfg.Penalty == nil {
+		return clampScore(excess)
+	}
+
+	// A penalty function yielding NaN or an infinite value is treated as
+	// giving the full penalty.
+	penalty := o.cfg.Penalty(excess)
+	if !isFinite(penalty) {
+		return 1.0
+	}
+
+	return clampScore(penalty)
+}
+
+// jaccardIndex returns the number of elements in both of the given sets,
+// divided by the number of elements in either of them. Zero is returned if
+// both sets are empty.
+func jaccardIndex(a, b map[NodeID]struct{}) float64 {
+	var intersection int
+	for nID := range a {
+		if _, ok := b[nID]; ok {
+			intersection++
+		}
+	}
+
+	union := len(a) + len(b) - intersection
+	if union == 0 {
+		return 0
+	}
+
+	return float64(intersection) / float64(union)
+}
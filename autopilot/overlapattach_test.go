@@ -0,0 +1,153 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestNeighborhoodOverlapAttachment checks that the
+// NeighborhoodOverlapAttachment penalizes nodes sharing neighbors with our
+// existing peers, according to the configured threshold and penalty.
+func TestNeighborhoodOverlapAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// Node0 is our existing peer, with neighbors 1-3.
+			// Node4 has the exact same neighbors, node5 shares two
+			// of its three neighbors, while nodes 6 and 7 share
+			// none.
+			keys, nIDs := genTestNodes(t1, 8)
+			edges := [][2]int{
+				{0, 1}, {0, 2}, {0, 3},
+				{4, 1}, {4, 2}, {4, 3},
+				{5, 1}, {5, 2}, {5, 6},
+				{6, 7},
+			}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e[0]], keys[e[1]],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+			chans := []Channel{{Node: nIDs[0]}}
+			nodes := nodeSet(nIDs[0], nIDs[4], nIDs[5], nIDs[6],
+				nIDs[7])
+
+			tests := []struct {
+				name     string
+				cfg      NeighborhoodOverlapConfig
+				expected map[NodeID]float64
+			}{
+				{
+					// Node5 has an overlap of 2/4, which
+					// exceeds the threshold by a third of
+					// the remaining range.
+					name: "linear penalty",
+					cfg: NeighborhoodOverlapConfig{
+						Threshold: 0.25,
+					},
+					expected: map[NodeID]float64{
+						nIDs[5]: 2.0 / 3,
+						nIDs[6]: 1.0,
+						nIDs[7]: 1.0,
+					},
+				},
+				{
+					name: "overlap within threshold",
+					cfg: NeighborhoodOverlapConfig{
+						Threshold: 0.5,
+					},
+					expected: map[NodeID]float64{
+						nIDs[5]: 1.0,
+						nIDs[6]: 1.0,
+						nIDs[7]: 1.0,
+					},
+				},
+				{
+					name: "quadratic penalty",
+					cfg: NeighborhoodOverlapConfig{
+						Penalty: func(x float64) float64 {
+							return x * x
+						},
+					},
+					expected: map[NodeID]float64{
+						nIDs[5]: 0.75,
+						nIDs[6]: 1.0,
+						nIDs[7]: 1.0,
+					},
+				},
+			}
+
+			for _, test := range tests {
+				h, err := NewNeighborhoodOverlapAttachment(
+					test.cfg,
+				)
+				if err != nil {
+					t1.Fatalf("unable to create "+
+						"heuristic: %v", err)
+				}
+
+				scores, err := h.NodeScores(
+					g, chans, btcutil.SatoshiPerBitcoin,
+					nodes,
+				)
+				if err != nil {
+					t1.Fatalf("unable to get scores: %v",
+						err)
+				}
+
+				if len(scores) != len(test.expected) {
+					t1.Fatalf("test %q: expected %d "+
+						"scores, got %d", test.name,
+						len(test.expected), len(scores))
+				}
+				for nID, exp := range test.expected {
+					s, ok := scores[nID]
+					if !ok {
+						t1.Fatalf("test %q: node %x "+
+							"not scored", test.name,
+							nID[:])
+					}
+					if !floatEq(s.Score, exp) {
+						t1.Fatalf("test %q: expected "+
+							"score %v, got %v",
+							test.name, exp, s.Score)
+					}
+				}
+			}
+		})
+		if !success {
+			break
+		}
+	}
+}
+
+// TestNeighborhoodOverlapConfig checks that invalid thresholds are rejected.
+func TestNeighborhoodOverlapConfig(t *testing.T) {
+	t.Parallel()
+
+	for _, threshold := range []float64{-0.1, 1.0} {
+		_, err := NewNeighborhoodOverlapAttachment(
+			NeighborhoodOverlapConfig{Threshold: threshold},
+		)
+		if err == nil {
+			t.Fatalf("expected threshold %v to be rejected",
+				threshold)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// PageRankConfig houses the parameters of a PageRankAttachment.
+type PageRankConfig struct {
+	// Damping is the probability of following a channel rather than
+	// jumping to a random node in each step of the random walk. It must
+	// be in the range (0, 1.0). A common choice is 0.85.
+	Damping float64
+
+	// MaxIterations is the maximum number of iterations used to compute
+	// the ranks.
+	MaxIterations int
+
+	// Tolerance is the change in total rank between two iterations below
+	// which the ranks are considered converged.
+	Tolerance float64
+
+	// WeightByCapacity, if set, makes the random walk follow channels
+	// with a probability proportional to their capacity, instead of
+	// uniformly.
+	WeightByCapacity bool
+}
+
+// PageRankAttachment is an implementation of the AttachmentHeuristic
+// interface that scores nodes according to their PageRank in the channel
+// graph. While the degree and capacity of a node only reflect its immediate
+// neighborhood, the PageRank captures the standing of a node in the whole
+// topology.
+//
+// Since computing the ranks requires iterating over the whole graph, the
+// ranks are cached, and only recomputed when the version of the graph
+// changes, as reported by the database and in-memory graphs, as well as their
+// snapshots. For graphs that aren't a VersionedChannelGraph, the ranks are
+// recomputed on each query.
+type PageRankAttachment struct {
+	cfg PageRankConfig
+
+	ranks        map[NodeID]float64
+	graphVersion uint64
+	sync.Mutex
+}
+
+// NewPageRankAttachment creates a new instance of a PageRankAttachment
+// heuristic.
+func NewPageRankAttachment(cfg PageRankConfig) (*PageRankAttachment, error) {
+	if cfg.Damping <= 0 || cfg.Damping >= 1.0 {
+		return nil, fmt.Errorf("damping factor must be in the range "+
+			"(0, 1.0), was %v", cfg.Damping)
+	}
+
+	if cfg.MaxIterations <= 0 {
+		return nil, fmt.Errorf("max iterations must be positive, "+
+			"was %v", cfg.MaxIterations)
+	}
+
+	if cfg.Tolerance < 0 {
+		return nil, fmt.Errorf("tolerance must be non-negative, was %v",
+			cfg.Tolerance)
+	}
+
+	return &PageRankAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure PageRankAttachment meets the
+// ContextAttachmentHeuristic interface.
+var _ ContextAttachmentHeuristic = (*PageRankAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (p *PageRankAttachment) Name() string {
+	return "pagerank"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score given to each node is its PageRank, scaled such that the highest
+// ranked node among the nodes to score is given a score of 1.0.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (p *PageRankAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return p.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the computation if
+// the passed context is cancelled.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (p *PageRankAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	ranks, err := p.graphRanks(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// Find the highest rank among the candidates, as this will be given
+	// the max score.
+	var maxRank float64
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		if ranks[nID] > maxRank {
+			maxRank = ranks[nID]
+		}
+	}
+
+	if maxRank == 0 {
+		return nil, nil
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		rank := ranks[nID]
+
+		_, ok := existingPeers[nID]
+		switch {
+
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		case ok:
+			continue
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		case rank == 0:
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  rank / maxRank,
+		}
+	}
+
+	return candidates, nil
+}
+
+// graphRanks returns the PageRank of each node in the graph, using the cached
+// ranks if the graph hasn't changed since they were computed.
+func (p *PageRankAttachment) graphRanks(ctx context.Context,
+	g ChannelGraph) (map[NodeID]float64, error) {
+
+	p.Lock()
+	defer p.Unlock()
+
+	version, versioned := graphVersion(g)
+	if versioned && p.ranks != nil && version == p.graphVersion {
+		return p.ranks, nil
+	}
+
+	ranks, err := p.computeRanks(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+
+	// We only cache the ranks if we'll be able to tell whether they're
+	// still valid.
+	if versioned {
+		p.ranks = ranks
+		p.graphVersion = version
+	}
+
+	return ranks, nil
+}
+
+// computeRanks computes the PageRank of each node in the graph.
+func (p *PageRankAttachment) computeRanks(ctx context.Context,
+	g ChannelGraph) (map[NodeID]float64, error) {
+
+	// We'll start by creating a weighted adjacency list for the graph,
+	// with each node assigned an index.
+	type edge struct {
+		to     int
+		weight float64
+	}
+	var (
+		nodeIDs []NodeID
+		indexes = make(map[NodeID]int)
+		adj     [][]edge
+	)
+	indexOf := func(nID NodeID) int {
+		if i, ok := indexes[nID]; ok {
+			return i
+		}
+
+		i := len(nodeIDs)
+		indexes[nID] = i
+		nodeIDs = append(nodeIDs, nID)
+		adj = append(adj, nil)
+		return i
+	}
+
+	err := g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		i := indexOf(NodeID(n.PubKey()))
+		return n.ForEachChannel(func(e ChannelEdge) error {
+			weight := 1.0
+			if p.cfg.WeightByCapacity {
+				weight = float64(e.Capacity)
+			}
+			if weight <= 0 {
+				return nil
+			}
+
+			j := indexOf(NodeID(e.Peer.PubKey()))
+			adj[i] = append(adj[i], edge{to: j, weight: weight})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	numNodes := len(nodeIDs)
+	if numNodes == 0 {
+		return nil, nil
+	}
+
+	outWeights := make([]float64, numNodes)
+	for i, edges := range adj {
+		for _, e := range edges {
+			outWeights[i] += e.weight
+		}
+	}
+
+	n := float64(numNodes)
+	ranks := make([]float64, numNodes)
+	for i := range ranks {
+		ranks[i] = 1 / n
+	}
+
+	next := make([]float64, numNodes)
+	for iter := 0; iter < p.cfg.MaxIterations; iter++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// Nodes without any channels have nowhere to pass on their
+		// rank, so we'll spread it evenly across all nodes, like a
+		// random jump. This also ensures that the ranks in disconnected
+		// components stay comparable.
+		var dangling float64
+		for i := range ranks {
+			if outWeights[i] == 0 {
+				dangling += ranks[i]
+			}
+		}
+
+		base := (1-p.cfg.Damping)/n + p.cfg.Damping*dangling/n
+		for i := range next {
+			next[i] = base
+		}
+
+		for i, edges := range adj {
+			if outWeights[i] == 0 {
+				continue
+			}
+
+			share := p.cfg.Damping * ranks[i] / outWeights[i]
+			for _, e := range edges {
+				next[e.to] += share * e.weight
+			}
+		}
+
+		var diff float64
+		for i := range ranks {
+			diff += math.Abs(next[i] - ranks[i])
+		}
+		ranks, next = next, ranks
+
+		if diff < p.cfg.Tolerance {
+			break
+		}
+	}
+
+	result := make(map[NodeID]float64, numNodes)
+	for i, nID := range nodeIDs {
+		result[nID] = ranks[i]
+	}
+
+	return result, nil
+}
@@ -0,0 +1,242 @@
+package autopilot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestPageRankAttachment checks that the PageRankAttachment ranks the nodes of
+// a small graph in the expected order, also handling disconnected components.
+func TestPageRankAttachment(t *testing.T) {
+	t.Parallel()
+
+	for _, graph := range chanGraphs {
+		graph := graph
+		success := t.Run(graph.name, func(t1 *testing.T) {
+			g, cleanup, err := graph.genFunc()
+			if err != nil {
+				t1.Fatalf("unable to create graph: %v", err)
+			}
+			if cleanup != nil {
+				defer cleanup()
+			}
+
+			// Create a star around node0, with node3 extended by a
+			// tail to node4. Node5 and node6 form a separate
+			// component.
+			keys, nIDs := genTestNodes(t1, 7)
+			edges := [][2]int{{0, 1}, {0, 2}, {0, 3}, {3, 4}, {5, 6}}
+			for _, e := range edges {
+				_, _, err := g.addRandChannel(
+					keys[e[0]], keys[e[1]],
+					btcutil.SatoshiPerBitcoin,
+				)
+				if err != nil {
+					t1.Fatalf("unable to add channel: %v",
+						err)
+				}
+			}
+
+			pageRank, err := NewPageRankAttachment(PageRankConfig{
+				Damping:       0.85,
+				MaxIterations: 100,
+				Tolerance:     1e-12,
+			})
+			if err != nil {
+				t1.Fatalf("unable to create heuristic: %v", err)
+			}
+
+			scores, err := pageRank.NodeScores(
+				g, nil, btcutil.SatoshiPerBitcoin,
+				nodeSet(nIDs...),
+			)
+			if err != nil {
+				t1.Fatalf("unable to get scores: %v", err)
+			}
+
+			if len(scores) != len(nIDs) {
+				t1.Fatalf("expected %d scores, got %d",
+					len(nIDs), len(scores))
+			}
+			score := func(i int) float64 {
+				return scores[nIDs[i]].Score
+			}
+
+			// The hub should be given the max score, followed by
+			// node3, which is the only other node with more than
+			// one channel.
+			if score(0) != 1.0 {
+				t1.Fatalf("expected hub to get score 1.0, "+
+					"got %v", score(0))
+			}
+			for _, i := range []int{1, 2, 4, 5, 6} {
+				if score(3) <= score(i) {
+					t1.Fatalf("expected node3 to rank "+
+						"higher than node%d", i)
+				}
+			}
+
+			// The symmetric nodes should be ranked equally.
+			if !floatEq(score(1), score(2)) {
+				t1.Fatalf("expected node1 and node2 to rank " +
+					"equally")
+			}
+			if !floatEq(score(5), score(6)) {
+				t1.Fatalf("expected node5 and node6 to rank " +
+					"equally")
+			}
+		})
+		if !success {
+			break
+		}
+	}
+}
+
+// TestPageRankAttachmentCache checks that the PageRankAttachment only
+// recomputes the ranks when the version of the graph changes.
+func TestPageRankAttachmentCache(t *testing.T) {
+	t.Parallel()
+
+	g := &versionedGraph{
+		memChannelGraph: newMemChannelGraph(),
+		version:         1,
+	}
+
+	keys, nIDs := genTestNodes(t, 4)
+	addChan := func(a, b int) {
+		_, _, err := g.addRandChannel(
+			keys[a], keys[b], btcutil.SatoshiPerBitcoin,
+		)
+		if err != nil {
+			t.Fatalf("unable to add channel: %v", err)
+		}
+	}
+	addChan(0, 1)
+	addChan(0, 2)
+
+	pageRank, err := NewPageRankAttachment(PageRankConfig{
+		Damping:       0.85,
+		MaxIterations: 100,
+		Tolerance:     1e-12,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	query := func() map[NodeID]*NodeScore {
+		scores, err := pageRank.NodeScores(
+			g, nil, btcutil.SatoshiPerBitcoin, nodeSet(nIDs...),
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+		return scores
+	}
+
+	scores := query()
+	if _, ok := scores[nIDs[3]]; ok {
+		t.Fatalf("node without channels should not be ranked")
+	}
+
+	// Adding a channel without changing the graph version should return
+	// the cached ranks.
+	addChan(2, 3)
+	scores = query()
+	if _, ok := scores[nIDs[3]]; ok {
+		t.Fatalf("expected cached ranks to be used")
+	}
+
+	// After bumping the version, the ranks should be recomputed.
+	g.version++
+	scores = query()
+	if _, ok := scores[nIDs[3]]; !ok {
+		t.Fatalf("expected ranks to be recomputed")
+	}
+
+	_, err = NewPageRankAttachment(PageRankConfig{
+		Damping:       1.0,
+		MaxIterations: 100,
+	})
+	if err == nil {
+		t.Fatalf("expected invalid damping factor to be rejected")
+	}
+}
+
+// TestPageRankAttachmentGraphChange checks that the PageRankAttachment caches
+// the ranks of the channel graphs until they are modified.
+func TestPageRankAttachmentGraphChange(t *testing.T) {
+	t.Parallel()
+
+	for _, chanGraph := range chanGraphs {
+		graph, cleanup, err := chanGraph.genFunc()
+		if err != nil {
+			t.Fatalf("unable to create graph: %v", err)
+		}
+		if cleanup != nil {
+			defer cleanup()
+		}
+
+		pageRank, err := NewPageRankAttachment(PageRankConfig{
+			Damping:       0.85,
+			MaxIterations: 100,
+			Tolerance:     1e-12,
+		})
+		if err != nil {
+			t.Fatalf("unable to create heuristic: %v", err)
+		}
+
+		addChan := func() {
+			_, _, err := graph.addRandChannel(
+				nil, nil, btcutil.SatoshiPerBitcoin,
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to add channel: %v",
+					chanGraph.name, err)
+			}
+		}
+
+		// queryRanks queries the heuristic, and returns the ranks it
+		// used.
+		queryRanks := func() map[NodeID]float64 {
+			_, err := pageRank.NodeScores(
+				graph, nil, btcutil.SatoshiPerBitcoin,
+				nodeSet(),
+			)
+			if err != nil {
+				t.Fatalf("%v: unable to get scores: %v",
+					chanGraph.name, err)
+			}
+
+			pageRank.Lock()
+			defer pageRank.Unlock()
+			return pageRank.ranks
+		}
+
+		addChan()
+		ranks := queryRanks()
+		if len(ranks) != 2 {
+			t.Fatalf("%v: expected 2 ranked nodes, got %d",
+				chanGraph.name, len(ranks))
+		}
+
+		// As long as the graph isn't modified, the cached ranks should
+		// be used.
+		cached := queryRanks()
+		if reflect.ValueOf(cached).Pointer() !=
+			reflect.ValueOf(ranks).Pointer() {
+
+			t.Fatalf("%v: expected cached ranks to be used",
+				chanGraph.name)
+		}
+
+		// Once modified, the ranks should be recomputed.
+		addChan()
+		ranks = queryRanks()
+		if len(ranks) != 4 {
+			t.Fatalf("%v: expected 4 ranked nodes, got %d",
+				chanGraph.name, len(ranks))
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package autopilot
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// persistedScoresVersion is the version of the serialization format used to
+// persist scores.
+const persistedScoresVersion = 0
+
+// ScoreStore is an interface that abstracts the storage of persisted scores,
+// such that it can be backed by a database or a file.
+type ScoreStore interface {
+	// Save persists the given serialized scores, replacing any previously
+	// saved ones.
+	Save([]byte) error
+
+	// Load returns the last saved serialized scores. If no scores have
+	// been saved, nil should be returned.
+	Load() ([]byte, error)
+}
+
+// PersistentAttachmentConfig houses the parameters of a PersistentAttachment.
+type PersistentAttachmentConfig struct {
+	// Heuristic is the heuristic whose scores will be persisted.
+	Heuristic AttachmentHeuristic
+
+	// Store is where the scores will be persisted.
+	Store ScoreStore
+
+	// MaxAge is the maximum age of persisted scores for them to be used
+	// after a restart. A zero value means persisted scores are always
+	// used.
+	MaxAge time.Duration
+
+	// Clock is used to determine the current time. If nil, the default
+	// clock is used.
+	Clock clock.Clock
+}
+
+// persistedScores is a set of scores computed by the wrapped heuristic, along
+// with the time they were computed and the version of the graph they were
+// computed for.
+type persistedScores struct {
+	timestamp    time.Time
+	graphVersion uint64
+	scores       map[NodeID]float64
+}
+
+// PersistentAttachment is an implementation of the AttachmentHeuristic
+// interface that wraps another heuristic, and persists the scores it returns.
+// After a restart, the persisted scores are returned right away, while fresh
+// scores are computed in the background. This avoids having to wait for
+// expensive heuristics to recompute their scores from scratch each time lnd
+// is started.
+//
+// If the graph is a VersionedChannelGraph reporting the same version as the
+// persisted scores were computed for, the persisted scores are considered up
+// to date, and no fresh computation is started.
+//
+// Stop should be called once the heuristic is no longer used, to abort any
+// computation running in the background.
+type PersistentAttachment struct {
+	stopped uint32 // To be used atomically.
+
+	cfg PersistentAttachmentConfig
+
+	// persisted are the scores loaded from the store. It is set to nil
+	// once fresh scores have been computed.
+	persisted *persistedScores
+
+	// refreshing is true while fresh scores are being computed in the
+	// background.
+	refreshing bool
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+
+	sync.Mutex
+}
+
+// NewPersistentAttachment creates a new instance of a PersistentAttachment
+// heuristic, loading any previously persisted scores from the store.
+func NewPersistentAttachment(cfg PersistentAttachmentConfig) (
+	*PersistentAttachment, error) {
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewDefaultClock()
+	}
+
+	p := &PersistentAttachment{
+		cfg:  cfg,
+		quit: make(chan struct{}),
+	}
+
+	data, err := cfg.Store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load scores: %v", err)
+	}
+	if len(data) == 0 {
+		return p, nil
+	}
+
+	// Failing to decode the persisted scores shouldn't prevent us from
+	// starting, as we can always compute them again.
+	persisted, err := deserializePersistedScores(bytes.NewReader(data))
+	if err != nil {
+		log.Warnf("Unable to decode persisted scores: %v", err)
+		return p, nil
+	}
+
+	age := cfg.Clock.Now().Sub(persisted.timestamp)
+	if cfg.MaxAge > 0 && age > cfg.MaxAge {
+		log.Debugf("Ignoring persisted scores of age %v", age)
+		return p, nil
+	}
+
+	p.persisted = persisted
+
+	return p, nil
+}
+
+// A compile time assertion to ensure PersistentAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*PersistentAttachment)(nil)
+var _ ScoreSettable = (*PersistentAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (p *PersistentAttachment) Name() string {
+	return "persistent"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Until fresh scores have been computed by the wrapped heuristic, the
+// persisted scores are returned. Otherwise the scores are computed by the
+// wrapped heuristic and persisted.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (p *PersistentAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return p.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic. Fresh scores computed in the background outlive
+// the query, so they don't use the context, and are only aborted by Stop. If
+// the context marks a preview, no scores are persisted, and no background
+// computation is started.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (p *PersistentAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	preview := IsScorePreview(ctx)
+
+	p.Lock()
+	persisted := p.persisted
+	if persisted == nil {
+		p.Unlock()
+
+		scores, err := QueryNodeScores(
+			ctx, p.cfg.Heuristic, g, chans, chanSize, nodes,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		if !preview {
+			p.persist(g, scores)
+		}
+
+		return scores, nil
+	}
+
+	// If the graph hasn't changed since the scores were persisted, there
+	// is no need to compute fresh ones. Otherwise we'll start computing
+	// them in the background, unless already doing so.
+	version, versioned := graphVersion(g)
+	upToDate := versioned && version == persisted.graphVersion
+	stopped := atomic.LoadUint32(&p.stopped) == 1
+	if !upToDate && !p.refreshing && !preview && !stopped {
+		p.refreshing = true
+
+		p.wg.Add(1)
+		go p.refresh(g, chans, chanSize, nodes)
+	}
+	p.Unlock()
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+
+		score, ok := persisted.scores[nID]
+		if !ok || score == 0 {
+			continue
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return candidates, nil
+}
+
+// Stop aborts any computation of fresh scores running in the background, and
+// waits for it to exit.
+func (p *PersistentAttachment) Stop() {
+	// The quit channel is closed while holding the mutex, such that no
+	// new background computation can be started after waiting below.
+	p.Lock()
+	if !atomic.CompareAndSwapUint32(&p.stopped, 0, 1) {
+		p.Unlock()
+		return
+	}
+	close(p.quit)
+	p.Unlock()
+
+	p.wg.Wait()
+}
+
+// refresh computes fresh scores using the wrapped heuristic, and persists
+// them. Once computed, the persisted scores will no longer be returned.
+//
+// NOTE: This MUST be run as a goroutine.
+func (p *PersistentAttachment) refresh(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) {
+
+	defer p.wg.Done()
+
+	// The query that triggered the computation might return long before
+	// it is done, so we'll use a context of our own, cancelled on Stop.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	scores, err := QueryNodeScores(
+		ctx, p.cfg.Heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		log.Errorf("Unable to refresh persisted scores: %v", err)
+
+		// We'll try again on the next query.
+		p.Lock()
+		p.refreshing = false
+		p.Unlock()
+		return
+	}
+
+	// The fresh scores are returned from now on, so we'll stop returning
+	// the persisted ones before saving, which may take a while. This also
+	// makes saving the last step of the refresh.
+	p.Lock()
+	p.persisted = nil
+	p.refreshing = false
+	p.Unlock()
+
+	p.persist(g, scores)
+}
+
+// persist serializes the given scores, and saves them to the store. Since the
+// scores can always be recomputed, a failure is only logged.
+func (p *PersistentAttachment) persist(g ChannelGraph,
+	scores map[NodeID]*NodeScore) {
+
+	version, _ := graphVersion(g)
+	persisted := &persistedScores{
+		timestamp:    p.cfg.Clock.Now(),
+		graphVersion: version,
+		scores:       make(map[NodeID]float64, len(scores)),
+	}
+	for nID, s := range scores {
+		persisted.scores[nID] = s.Score
+	}
+
+	var b bytes.Buffer
+	if err := serializePersistedScores(&b, persisted); err != nil {
+		log.Errorf("Unable to serialize scores: %v", err)
+		return
+	}
+
+	if err := p.cfg.Store.Save(b.Bytes()); err != nil {
+		log.Errorf("Unable to persist scores: %v", err)
+	}
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic. If applied, the persisted scores won't be
+// returned anymore, as they no longer reflect the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (p *PersistentAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	applied, err := setInnerNodeScores(
+		p.cfg.Heuristic, targetHeuristic, newScores,
+	)
+	if err != nil || !applied {
+		return applied, err
+	}
+
+	p.Lock()
+	p.persisted = nil
+	p.Unlock()
+
+	return true, nil
+}
+
+// graphVersion returns the version of the graph if it is a
+// VersionedChannelGraph. The boolean is false otherwise.
+func graphVersion(g ChannelGraph) (uint64, bool) {
+	v, ok := g.(VersionedChannelGraph)
+	if !ok {
+		return 0, false
+	}
+
+	return v.Version(), true
+}
+
+// serializePersistedScores writes the persisted scores to the given writer.
+func serializePersistedScores(w io.Writer, p *persistedScores) error {
+	header := []interface{}{
+		uint8(persistedScoresVersion),
+		p.timestamp.UnixNano(),
+		p.graphVersion,
+		uint32(len(p.scores)),
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	for nID, score := range p.scores {
+		if _, err := w.Write(nID[:]); err != nil {
+			return err
+		}
+
+		err := binary.Write(
+			w, binary.BigEndian, math.Float64bits(score),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deserializePersistedScores reads persisted scores from the given reader.
+func deserializePersistedScores(r io.Reader) (*persistedScores, error) {
+	var (
+		version   uint8
+		timestamp int64
+		p         persistedScores
+		numScores uint32
+	)
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != persistedScoresVersion {
+		return nil, fmt.Errorf("unknown persisted scores version %d",
+			version)
+	}
+
+	header := []interface{}{&timestamp, &p.graphVersion, &numScores}
+	for _, v := range header {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	p.timestamp = time.Unix(0, timestamp)
+
+	p.scores = make(map[NodeID]float64)
+	for i := uint32(0); i < numScores; i++ {
+		var (
+			nID  NodeID
+			bits uint64
+		)
+		if _, err := io.ReadFull(r, nID[:]); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+
+		score := math.Float64frombits(bits)
+		if !(score >= 0 && score <= 1.0) {
+			return nil, fmt.Errorf("invalid score %v for node %x",
+				score, nID[:])
+		}
+
+		p.scores[nID] = score
+	}
+
+	return &p, nil
+}
@@ -0,0 +1,388 @@
+package autopilot
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// mockScoreStore is an in-memory ScoreStore, signalling each completed save.
+type mockScoreStore struct {
+	data  []byte
+	saved chan struct{}
+}
+
+func newMockScoreStore() *mockScoreStore {
+	return &mockScoreStore{
+		saved: make(chan struct{}, 10),
+	}
+}
+
+func (m *mockScoreStore) Save(data []byte) error {
+	m.data = append([]byte(nil), data...)
+	m.saved <- struct{}{}
+	return nil
+}
+
+func (m *mockScoreStore) Load() ([]byte, error) {
+	return m.data, nil
+}
+
+var _ ScoreStore = (*mockScoreStore)(nil)
+
+// blockingHeuristic is a staticHeuristic that blocks until released.
+type blockingHeuristic struct {
+	staticHeuristic
+	release chan struct{}
+}
+
+func (b *blockingHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	<-b.release
+	return b.staticHeuristic.NodeScores(g, chans, chanSize, nodes)
+}
+
+// contextBlockingHeuristic is a staticHeuristic that blocks until released,
+// or until the context of the query is cancelled.
+type contextBlockingHeuristic struct {
+	staticHeuristic
+	release chan struct{}
+}
+
+func (b *contextBlockingHeuristic) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return b.staticHeuristic.NodeScores(g, chans, chanSize, nodes)
+}
+
+var _ ContextAttachmentHeuristic = (*contextBlockingHeuristic)(nil)
+
+// TestPersistedScoresSerialization checks that persisted scores survive a
+// serialization round trip.
+func TestPersistedScoresSerialization(t *testing.T) {
+	t.Parallel()
+
+	p := &persistedScores{
+		timestamp:    time.Unix(1000000, 1234),
+		graphVersion: 42,
+		scores: map[NodeID]float64{
+			testNodeID(1): 0.25,
+			testNodeID(2): 1.0,
+		},
+	}
+
+	var b bytes.Buffer
+	if err := serializePersistedScores(&b, p); err != nil {
+		t.Fatalf("unable to serialize: %v", err)
+	}
+
+	p2, err := deserializePersistedScores(&b)
+	if err != nil {
+		t.Fatalf("unable to deserialize: %v", err)
+	}
+
+	if !p2.timestamp.Equal(p.timestamp) {
+		t.Fatalf("expected timestamp %v, got %v", p.timestamp,
+			p2.timestamp)
+	}
+	if p2.graphVersion != p.graphVersion {
+		t.Fatalf("expected graph version %v, got %v", p.graphVersion,
+			p2.graphVersion)
+	}
+	if len(p2.scores) != len(p.scores) {
+		t.Fatalf("expected %d scores, got %d", len(p.scores),
+			len(p2.scores))
+	}
+	for nID, score := range p.scores {
+		if p2.scores[nID] != score {
+			t.Fatalf("expected score %v, got %v", score,
+				p2.scores[nID])
+		}
+	}
+}
+
+// TestPersistentAttachment checks that the PersistentAttachment returns the
+// persisted scores after a restart until fresh scores are computed, and
+// ignores persisted scores that are too old.
+func TestPersistentAttachment(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	testClock := clock.NewTestClock(time.Unix(1000000, 0))
+
+	g := &versionedGraph{
+		memChannelGraph: newMemChannelGraph(),
+		version:         1,
+	}
+	store := newMockScoreStore()
+
+	assertScores := func(scores map[NodeID]*NodeScore,
+		expected map[NodeID]float64) {
+
+		t.Helper()
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+		for nID, exp := range expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("node %x not scored", nID[:])
+			}
+			if s.Score != exp {
+				t.Fatalf("expected score %v, got %v", exp,
+					s.Score)
+			}
+		}
+	}
+
+	// Without any persisted scores, the scores should be computed right
+	// away and persisted.
+	oldScores := map[NodeID]float64{node1: 0.5}
+	p, err := NewPersistentAttachment(PersistentAttachmentConfig{
+		Heuristic: &staticHeuristic{name: "inner", scores: oldScores},
+		Store:     store,
+		MaxAge:    time.Hour,
+		Clock:     testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := p.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	assertScores(scores, oldScores)
+	<-store.saved
+
+	// After a restart with an unchanged graph, the persisted scores are
+	// up to date, and should be returned without querying the wrapped
+	// heuristic.
+	newScores := map[NodeID]float64{node1: 0.1, node2: 0.9}
+	inner := &blockingHeuristic{
+		staticHeuristic: staticHeuristic{
+			name:   "inner",
+			scores: newScores,
+		},
+		release: make(chan struct{}),
+	}
+	p, err = NewPersistentAttachment(PersistentAttachmentConfig{
+		Heuristic: inner,
+		Store:     store,
+		MaxAge:    time.Hour,
+		Clock:     testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err = p.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	assertScores(scores, oldScores)
+
+	// Once the graph changes, the persisted scores should still be
+	// returned while fresh ones are computed in the background.
+	g.version++
+	scores, err = p.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	assertScores(scores, oldScores)
+
+	// Let the background computation finish, after which the fresh scores
+	// should be returned. Saving them is the last step of the
+	// computation, so the store signals its completion.
+	close(inner.release)
+	<-store.saved
+
+	scores, err = p.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	assertScores(scores, newScores)
+	<-store.saved
+
+	// Finally, after a restart where the persisted scores have become too
+	// old, they should be ignored.
+	testClock.Advance(2 * time.Hour)
+	latestScores := map[NodeID]float64{node2: 0.3}
+	p, err = NewPersistentAttachment(PersistentAttachmentConfig{
+		Heuristic: &staticHeuristic{
+			name:   "inner",
+			scores: latestScores,
+		},
+		Store:  store,
+		MaxAge: time.Hour,
+		Clock:  testClock,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err = p.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	assertScores(scores, latestScores)
+}
+
+// TestPersistentAttachmentRefreshContext checks that the background
+// computation of fresh scores isn't aborted when the context of the query
+// triggering it is cancelled, but is aborted by Stop.
+func TestPersistentAttachmentRefreshContext(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	nodes := nodeSet(node1)
+	g := newMemChannelGraph()
+
+	newPersistentAttachment := func(store *mockScoreStore) (
+		*PersistentAttachment, *contextBlockingHeuristic) {
+
+		inner := &contextBlockingHeuristic{
+			staticHeuristic: staticHeuristic{
+				name:   "inner",
+				scores: map[NodeID]float64{node1: 0.9},
+			},
+			release: make(chan struct{}),
+		}
+		p, err := NewPersistentAttachment(PersistentAttachmentConfig{
+			Heuristic: inner,
+			Store:     store,
+		})
+		if err != nil {
+			t.Fatalf("unable to create heuristic: %v", err)
+		}
+
+		return p, inner
+	}
+
+	// The scores are persisted for another version of the graph, such that
+	// fresh ones are computed in the background.
+	store := newMockScoreStore()
+	err := store.Save(persistedScoresBytes(t, &persistedScores{
+		graphVersion: g.Version() + 1,
+		scores:       map[NodeID]float64{node1: 0.5},
+	}))
+	if err != nil {
+		t.Fatalf("unable to save scores: %v", err)
+	}
+	<-store.saved
+
+	// Query the persisted scores, cancelling the context right after, as
+	// the agent does at the end of each round.
+	p, inner := newPersistentAttachment(store)
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = p.NodeScoresContext(
+		ctx, g, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	cancel()
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// The background computation should still complete, and persist the
+	// fresh scores.
+	close(inner.release)
+	select {
+	case <-store.saved:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("fresh scores not persisted")
+	}
+	p.Stop()
+
+	// Stopping the heuristic should abort an ongoing computation, without
+	// persisting anything.
+	p, _ = newPersistentAttachment(store)
+	_, err = p.NodeScores(g, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	p.Stop()
+
+	select {
+	case <-store.saved:
+		t.Fatalf("expected no scores to be persisted")
+	default:
+	}
+
+	p.Lock()
+	refreshing := p.refreshing
+	p.Unlock()
+	if refreshing {
+		t.Fatalf("expected background computation to be aborted")
+	}
+}
+
+// TestPersistentAttachmentInvalidScores checks that persisted scores outside
+// of the range [0, 1.0] are ignored.
+func TestPersistentAttachmentInvalidScores(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+
+	store := newMockScoreStore()
+	err := store.Save(persistedScoresBytes(t, &persistedScores{
+		scores: map[NodeID]float64{node1: 1.5},
+	}))
+	if err != nil {
+		t.Fatalf("unable to save scores: %v", err)
+	}
+	<-store.saved
+
+	p, err := NewPersistentAttachment(PersistentAttachmentConfig{
+		Heuristic: &staticHeuristic{
+			name:   "inner",
+			scores: map[NodeID]float64{node1: 0.2},
+		},
+		Store: store,
+	})
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	defer p.Stop()
+
+	scores, err := p.NodeScores(
+		newMemChannelGraph(), nil, btcutil.SatoshiPerBitcoin,
+		nodeSet(node1),
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if scores[node1] == nil || scores[node1].Score != 0.2 {
+		t.Fatalf("expected invalid persisted scores to be ignored, "+
+			"got %v", scores[node1])
+	}
+}
+
+// persistedScoresBytes returns the serialization of the given scores.
+func persistedScoresBytes(t *testing.T, p *persistedScores) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := serializePersistedScores(&b, p); err != nil {
+		t.Fatalf("unable to serialize: %v", err)
+	}
+
+	return b.Bytes()
+}
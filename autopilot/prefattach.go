@@ -1,6 +1,8 @@
 package autopilot
 
 import (
+	"context"
+	"fmt"
 	prand "math/rand"
 	"time"
 
@@ -35,8 +37,8 @@ func NewPrefAttachment() *PrefAttachment {
 }
 
 // A compile time assertion to ensure PrefAttachment meets the
-// AttachmentHeuristic interface.
-var _ AttachmentHeuristic = (*PrefAttachment)(nil)
+// ContextAttachmentHeuristic interface.
+var _ ContextAttachmentHeuristic = (*PrefAttachment)(nil)
 
 // NodeID is a simple type that holds an EC public key serialized in compressed
 // format.
@@ -82,6 +84,19 @@ func (p *PrefAttachment) NodeScores(g ChannelGraph, chans []Channel,
 	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
 	map[NodeID]*NodeScore, error) {
 
+	return p.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but aborts the traversal of
+// the graph if the passed context is cancelled.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (p *PrefAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
 	// We first run though the graph once in order to find the median
 	// channel size.
 	var (
@@ -89,6 +104,10 @@ func (p *PrefAttachment) NodeScores(g ChannelGraph, chans []Channel,
 		seenChans = make(map[uint64]struct{})
 	)
 	if err := g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		err := n.ForEachChannel(func(e ChannelEdge) error {
 			if _, ok := seenChans[e.ChanID.ToUint64()]; ok {
 				return nil
@@ -113,6 +132,10 @@ func (p *PrefAttachment) NodeScores(g ChannelGraph, chans []Channel,
 	var maxChans int
 	nodeChanNum := make(map[NodeID]int)
 	if err := g.ForEachNode(func(n Node) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		var nodeChans int
 		err := n.ForEachChannel(func(e ChannelEdge) error {
 			// Since connecting to nodes with a lot of small
@@ -193,6 +216,7 @@ func (p *PrefAttachment) NodeScores(g ChannelGraph, chans []Channel,
 		candidates[nID] = &NodeScore{
 			NodeID: nID,
 			Score:  score,
+			Reason: fmt.Sprintf("%d channels", nodeChans),
 		}
 	}
 
@@ -0,0 +1,147 @@
+package autopilot
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// DefaultRouteSuccessPrior is the success ratio assumed for nodes
+	// without any routing history if none is configured.
+	DefaultRouteSuccessPrior = 0.5
+
+	// DefaultRoutePriorWeight is the number of pseudo-attempts the prior
+	// success ratio counts as if none is configured. Together with the
+	// default prior, this amounts to Laplace smoothing, i.e. adding one
+	// success and one failure to the history of each node.
+	DefaultRoutePriorWeight = 2.0
+)
+
+// RouteStatsSource is an interface that provides the outcome of past payment
+// attempts routed through a node, e.g. as recorded by mission control.
+type RouteStatsSource interface {
+	// RouteStats returns the number of successful and failed payment
+	// attempts routed through the given node.
+	RouteStats(NodeID) (successes, failures int)
+}
+
+// RouteFeedbackAttachmentConfig houses the parameters of a
+// RouteFeedbackAttachment.
+type RouteFeedbackAttachmentConfig struct {
+	// RouteStats provides the routing history of the nodes.
+	RouteStats RouteStatsSource
+
+	// Prior is the success ratio assumed for nodes without any routing
+	// history. It must be in the range (0, 1.0]. If zero,
+	// DefaultRouteSuccessPrior is used.
+	Prior float64
+
+	// PriorWeight is the number of attempts the prior counts as when
+	// smoothing the success ratio of a node. The higher it is, the more
+	// history a node needs to move away from the prior. It must not be
+	// negative. If zero, DefaultRoutePriorWeight is used.
+	PriorWeight float64
+}
+
+// RouteFeedbackAttachment is an implementation of the AttachmentHeuristic
+// interface that prefers nodes through which past payments succeeded, closing
+// the loop between routing outcomes and channel selection.
+type RouteFeedbackAttachment struct {
+	cfg RouteFeedbackAttachmentConfig
+}
+
+// NewRouteFeedbackAttachment creates a new instance of a
+// RouteFeedbackAttachment heuristic.
+func NewRouteFeedbackAttachment(cfg RouteFeedbackAttachmentConfig) (
+	*RouteFeedbackAttachment, error) {
+
+	if cfg.RouteStats == nil {
+		return nil, fmt.Errorf("route stats source must be set")
+	}
+	if cfg.Prior < 0 || cfg.Prior > 1.0 {
+		return nil, fmt.Errorf("prior must be in the range (0, 1.0], "+
+			"was %v", cfg.Prior)
+	}
+	if cfg.PriorWeight < 0 {
+		return nil, fmt.Errorf("prior weight must not be negative, "+
+			"was %v", cfg.PriorWeight)
+	}
+
+	if cfg.Prior == 0 {
+		cfg.Prior = DefaultRouteSuccessPrior
+	}
+	if cfg.PriorWeight == 0 {
+		cfg.PriorWeight = DefaultRoutePriorWeight
+	}
+
+	return &RouteFeedbackAttachment{
+		cfg: cfg,
+	}, nil
+}
+
+// A compile time assertion to ensure RouteFeedbackAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*RouteFeedbackAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (r *RouteFeedbackAttachment) Name() string {
+	return "routefeedback"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The score of a node is its smoothed success ratio, i.e. its number of
+// successful payment attempts, plus the prior weighted by the prior weight,
+// divided by its number of attempts plus the prior weight. Nodes without any
+// history are therefore given the prior, and nodes with little history stay
+// close to it.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (r *RouteFeedbackAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	scores := make(map[NodeID]*NodeScore)
+	for nID := range nodes {
+		successes, failures := r.cfg.RouteStats.RouteStats(nID)
+		score := r.successRatio(successes, failures)
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			continue
+		}
+
+		scores[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+	}
+
+	return scores, nil
+}
+
+// successRatio returns the smoothed success ratio of a node with the given
+// number of successful and failed payment attempts. Negative counts are
+// treated as zero.
+func (r *RouteFeedbackAttachment) successRatio(successes,
+	failures int) float64 {
+
+	if successes < 0 {
+		successes = 0
+	}
+	if failures < 0 {
+		failures = 0
+	}
+
+	prior := r.cfg.Prior * r.cfg.PriorWeight
+	attempts := float64(successes+failures) + r.cfg.PriorWeight
+
+	return clampScore((float64(successes) + prior) / attempts)
+}
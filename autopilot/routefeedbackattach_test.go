@@ -0,0 +1,153 @@
+package autopilot
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// routeStats holds the number of successful and failed payment attempts
+// routed through a node.
+type routeStats struct {
+	successes int
+	failures  int
+}
+
+// staticRouteStatsSource is a RouteStatsSource returning a fixed routing
+// history.
+type staticRouteStatsSource map[NodeID]routeStats
+
+func (s staticRouteStatsSource) RouteStats(nID NodeID) (int, int) {
+	stats := s[nID]
+	return stats.successes, stats.failures
+}
+
+var _ RouteStatsSource = (staticRouteStatsSource)(nil)
+
+// TestRouteFeedbackAttachment checks that the RouteFeedbackAttachment prefers
+// nodes with a higher smoothed success ratio, and gives nodes without any
+// history the prior.
+func TestRouteFeedbackAttachment(t *testing.T) {
+	t.Parallel()
+
+	unknown := testNodeID(1)
+	reliable := testNodeID(2)
+	fresh := testNodeID(3)
+	flaky := testNodeID(4)
+	failing := testNodeID(5)
+	nodes := nodeSet(unknown, reliable, fresh, flaky, failing)
+
+	source := staticRouteStatsSource{
+		reliable: {successes: 9, failures: 1},
+		fresh:    {successes: 1},
+		flaky:    {successes: 1, failures: 9},
+		failing:  {failures: 8},
+	}
+
+	tests := []struct {
+		name        string
+		prior       float64
+		priorWeight float64
+		expected    map[NodeID]float64
+		order       []NodeID
+	}{
+		{
+			// With Laplace smoothing, a single success shouldn't
+			// rank a node above one with a long good history.
+			name: "laplace",
+			expected: map[NodeID]float64{
+				unknown:  0.5,
+				reliable: 10.0 / 12.0,
+				fresh:    2.0 / 3.0,
+				flaky:    2.0 / 12.0,
+				failing:  1.0 / 10.0,
+			},
+			order: []NodeID{
+				reliable, fresh, unknown, flaky, failing,
+			},
+		},
+		{
+			name:        "pessimistic strong prior",
+			prior:       0.2,
+			priorWeight: 10,
+			expected: map[NodeID]float64{
+				unknown:  0.2,
+				reliable: 11.0 / 20.0,
+				fresh:    3.0 / 11.0,
+				flaky:    3.0 / 20.0,
+				failing:  2.0 / 18.0,
+			},
+			order: []NodeID{
+				reliable, fresh, unknown, flaky, failing,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		h, err := NewRouteFeedbackAttachment(
+			RouteFeedbackAttachmentConfig{
+				RouteStats:  source,
+				Prior:       test.prior,
+				PriorWeight: test.priorWeight,
+			},
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to create heuristic: %v",
+				test.name, err)
+		}
+
+		scores, err := h.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("test %q: unable to get scores: %v",
+				test.name, err)
+		}
+
+		if len(scores) != len(test.expected) {
+			t.Fatalf("test %q: expected %d scores, got %d",
+				test.name, len(test.expected), len(scores))
+		}
+		for nID, exp := range test.expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("test %q: node %x not scored",
+					test.name, nID[:])
+			}
+			if !floatEq(s.Score, exp) {
+				t.Fatalf("test %q: node %x: expected score "+
+					"%v, got %v", test.name, nID[:], exp,
+					s.Score)
+			}
+		}
+
+		ranked := make([]NodeID, 0, len(scores))
+		for nID := range scores {
+			ranked = append(ranked, nID)
+		}
+		sort.Slice(ranked, func(i, j int) bool {
+			return scores[ranked[i]].Score > scores[ranked[j]].Score
+		})
+		for i, nID := range test.order {
+			if ranked[i] != nID {
+				t.Fatalf("test %q: expected node %x at rank "+
+					"%d, got %x", test.name, nID[:], i,
+					ranked[i][:])
+			}
+		}
+	}
+
+	// Invalid configurations should be rejected.
+	configs := []RouteFeedbackAttachmentConfig{
+		{},
+		{RouteStats: source, Prior: -0.1},
+		{RouteStats: source, Prior: 1.1},
+		{RouteStats: source, PriorWeight: -1},
+	}
+	for _, cfg := range configs {
+		if _, err := NewRouteFeedbackAttachment(cfg); err == nil {
+			t.Fatalf("expected config %+v to be rejected", cfg)
+		}
+	}
+}
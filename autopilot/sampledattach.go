@@ -0,0 +1,217 @@
+package autopilot
+
+import (
+	"bytes"
+	"context"
+	"math"
+	prand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// SampledAttachmentConfig houses the parameters of a SampledAttachment.
+type SampledAttachmentConfig struct {
+	// Heuristic is the heuristic that will score the sampled nodes.
+	Heuristic AttachmentHeuristic
+
+	// MaxNodes is the maximum number of nodes that will be passed to the
+	// wrapped heuristic. A zero value disables the sampling.
+	MaxNodes int
+
+	// WeightByCapacity, if set, samples the nodes with a probability
+	// proportional to the total capacity of their channels, instead of
+	// uniformly. Nodes without any capacity are only sampled if there
+	// aren't enough nodes with capacity.
+	WeightByCapacity bool
+
+	// Source is the source of randomness used for the sampling. If nil, a
+	// source seeded with the current time is used.
+	Source prand.Source
+}
+
+// SampledAttachment is an implementation of the AttachmentHeuristic interface
+// that wraps another heuristic, and only lets it score a bounded random
+// sample of the nodes to score. On large graphs this keeps the cost of
+// expensive heuristics manageable, at the expense of not considering all
+// candidates in each round.
+type SampledAttachment struct {
+	cfg SampledAttachmentConfig
+
+	rand    *prand.Rand
+	randMtx sync.Mutex
+}
+
+// NewSampledAttachment creates a new instance of a SampledAttachment
+// heuristic.
+func NewSampledAttachment(cfg SampledAttachmentConfig) *SampledAttachment {
+	source := cfg.Source
+	if source == nil {
+		source = prand.NewSource(time.Now().Unix())
+	}
+
+	return &SampledAttachment{
+		cfg:  cfg,
+		rand: prand.New(source),
+	}
+}
+
+// A compile time assertion to ensure SampledAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*SampledAttachment)(nil)
+var _ ScoreSettable = (*SampledAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (s *SampledAttachment) Name() string {
+	return "sampled"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// If there are more nodes to score than the configured maximum, a random
+// sample of them is scored by the wrapped heuristic, while the rest are given
+// a score of zero.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (s *SampledAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return s.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (s *SampledAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	sample, err := s.sample(g, chans, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return QueryNodeScores(
+		ctx, s.cfg.Heuristic, g, chans, chanSize, sample,
+	)
+}
+
+// sample returns at most the configured maximum number of nodes, sampled at
+// random from the given nodes. Our existing channel peers are never sampled,
+// as they wouldn't be given a score anyway.
+func (s *SampledAttachment) sample(g ChannelGraph, chans []Channel,
+	nodes map[NodeID]struct{}) (map[NodeID]struct{}, error) {
+
+	if s.cfg.MaxNodes <= 0 || len(nodes) <= s.cfg.MaxNodes {
+		return nodes, nil
+	}
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	// Sort the candidates, such that the sample only depends on the state
+	// of the random source, and not on the iteration order of the map.
+	candidates := make([]NodeID, 0, len(nodes))
+	for nID := range nodes {
+		if _, ok := existingPeers[nID]; ok {
+			continue
+		}
+		candidates = append(candidates, nID)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return bytes.Compare(candidates[i][:], candidates[j][:]) < 0
+	})
+
+	if len(candidates) > s.cfg.MaxNodes {
+		var err error
+		candidates, err = s.choose(g, candidates)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sample := make(map[NodeID]struct{}, len(candidates))
+	for _, nID := range candidates {
+		sample[nID] = struct{}{}
+	}
+
+	return sample, nil
+}
+
+// choose picks the configured maximum number of nodes from the candidates at
+// random.
+func (s *SampledAttachment) choose(g ChannelGraph, candidates []NodeID) (
+	[]NodeID, error) {
+
+	var capacities map[NodeID]btcutil.Amount
+	if s.cfg.WeightByCapacity {
+		var err error
+		capacities, err = nodeCapacities(g)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.randMtx.Lock()
+	defer s.randMtx.Unlock()
+
+	// For uniform sampling, we'll do a partial Fisher-Yates shuffle.
+	if !s.cfg.WeightByCapacity {
+		for i := 0; i < s.cfg.MaxNodes; i++ {
+			j := i + s.rand.Intn(len(candidates)-i)
+			candidates[i], candidates[j] = candidates[j],
+				candidates[i]
+		}
+
+		return candidates[:s.cfg.MaxNodes], nil
+	}
+
+	// For weighted sampling without replacement, we give each node a
+	// random key of -ln(u)/w, and pick the nodes having the lowest keys.
+	// Nodes without capacity get an infinite key, so they only get
+	// picked if there aren't enough nodes with capacity.
+	keys := make(map[NodeID]float64, len(candidates))
+	for _, nID := range candidates {
+		w := float64(capacities[nID])
+		if w <= 0 {
+			keys[nID] = math.Inf(1)
+			continue
+		}
+
+		keys[nID] = -math.Log(1-s.rand.Float64()) / w
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return keys[candidates[i]] < keys[candidates[j]]
+	})
+
+	return candidates[:s.cfg.MaxNodes], nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (s *SampledAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(s.cfg.Heuristic, targetHeuristic, newScores)
+}
@@ -0,0 +1,135 @@
+package autopilot
+
+import (
+	prand "math/rand"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestSampledAttachment checks that the SampledAttachment only lets the
+// wrapped heuristic score a bounded sample of the nodes, and that a seeded
+// source gives reproducible samples.
+func TestSampledAttachment(t *testing.T) {
+	t.Parallel()
+
+	const (
+		numNodes = 50
+		maxNodes = 10
+	)
+
+	inner := &staticHeuristic{
+		name:   "inner",
+		scores: make(map[NodeID]float64),
+	}
+	var nIDs []NodeID
+	for i := 0; i < numNodes; i++ {
+		nID := testNodeID(byte(i))
+		nIDs = append(nIDs, nID)
+		inner.scores[nID] = 1.0
+	}
+	nodes := nodeSet(nIDs...)
+
+	sampled := func(seed int64) map[NodeID]*NodeScore {
+		s := NewSampledAttachment(SampledAttachmentConfig{
+			Heuristic: inner,
+			MaxNodes:  maxNodes,
+			Source:    prand.NewSource(seed),
+		})
+
+		scores, err := s.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != maxNodes {
+			t.Fatalf("expected %d scores, got %d", maxNodes,
+				len(scores))
+		}
+
+		return scores
+	}
+
+	// Sampling twice using the same seed should give the same sample.
+	scores1 := sampled(1)
+	scores2 := sampled(1)
+	for nID := range scores1 {
+		if _, ok := scores2[nID]; !ok {
+			t.Fatalf("samples not reproducible")
+		}
+	}
+
+	// If there are fewer nodes than the maximum, all of them should be
+	// scored.
+	s := NewSampledAttachment(SampledAttachmentConfig{
+		Heuristic: inner,
+		MaxNodes:  numNodes,
+	})
+	scores, err := s.NodeScores(nil, nil, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != numNodes {
+		t.Fatalf("expected %d scores, got %d", numNodes, len(scores))
+	}
+}
+
+// TestSampledAttachmentWeighted checks that when sampling weighted by
+// capacity, nodes without any capacity are only sampled as a last resort.
+func TestSampledAttachmentWeighted(t *testing.T) {
+	t.Parallel()
+
+	g := newMemChannelGraph()
+
+	// Create four nodes with channels, along with a set of nodes without
+	// any.
+	keys, nIDs := genTestNodes(t, 4)
+	for i := 0; i < len(keys); i += 2 {
+		_, _, err := g.addRandChannel(
+			keys[i], keys[i+1], btcutil.SatoshiPerBitcoin,
+		)
+		if err != nil {
+			t.Fatalf("unable to add channel: %v", err)
+		}
+	}
+
+	inner := &staticHeuristic{
+		name:   "inner",
+		scores: make(map[NodeID]float64),
+	}
+	nodes := nodeSet(nIDs...)
+	for _, nID := range nIDs {
+		inner.scores[nID] = 1.0
+	}
+	for i := 0; i < 10; i++ {
+		nID := testNodeID(byte(i))
+		nodes[nID] = struct{}{}
+		inner.scores[nID] = 1.0
+	}
+
+	s := NewSampledAttachment(SampledAttachmentConfig{
+		Heuristic:        inner,
+		MaxNodes:         3,
+		WeightByCapacity: true,
+		Source:           prand.NewSource(1),
+	})
+
+	// We have a channel with the first node, so the remaining three
+	// nodes with capacity should be sampled.
+	chans := []Channel{{Node: nIDs[0]}}
+	scores, err := s.NodeScores(g, chans, btcutil.SatoshiPerBitcoin, nodes)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	if len(scores) != 3 {
+		t.Fatalf("expected 3 scores, got %d", len(scores))
+	}
+	for _, nID := range nIDs[1:] {
+		if _, ok := scores[nID]; !ok {
+			t.Fatalf("node with capacity not sampled")
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package autopilot
+
+import (
+	"context"
+	"crypto/sha256"
+	"reflect"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// scoreMemoKey identifies the scores given by a heuristic for a set of
+// inputs.
+type scoreMemoKey struct {
+	heuristic AttachmentHeuristic
+	inputs    [sha256.Size]byte
+}
+
+// scoreMemoEntry holds the scores given by a heuristic. The done channel is
+// closed once they have been computed.
+type scoreMemoEntry struct {
+	done   chan struct{}
+	scores map[NodeID]*NodeScore
+	err    error
+}
+
+// ScoreMemo memoizes the scores given by the sub-heuristics of combinators
+// during a single scoring round. When passed along through the context using
+// WithScoreMemo, a sub-heuristic shared by several combinators of a heuristic
+// tree is only queried once per round, as long as it is queried with the same
+// inputs.
+//
+// Heuristics are identified by their instance rather than their name, such
+// that distinct heuristics sharing a name, e.g. nested combinators, aren't
+// mixed up. Heuristics whose type isn't comparable, such as maps, are never
+// memoized.
+//
+// NOTE: A memo must not outlive a scoring round, as it never invalidates the
+// memoized scores. Use a CachedAttachment to reuse scores across rounds.
+type ScoreMemo struct {
+	entries map[scoreMemoKey]*scoreMemoEntry
+	sync.Mutex
+}
+
+// NewScoreMemo creates a new, empty ScoreMemo.
+func NewScoreMemo() *ScoreMemo {
+	return &ScoreMemo{
+		entries: make(map[scoreMemoKey]*scoreMemoEntry),
+	}
+}
+
+// scoreMemoCtxKey is the context key of the ScoreMemo of a scoring round.
+type scoreMemoCtxKey struct{}
+
+// WithScoreMemo returns a copy of the given context carrying the given memo,
+// which the combinators of the heuristic tree queried with the context will
+// share their sub-scores through.
+func WithScoreMemo(ctx context.Context, memo *ScoreMemo) context.Context {
+	return context.WithValue(ctx, scoreMemoCtxKey{}, memo)
+}
+
+// scoreMemoFromContext returns the memo carried by the given context, or nil
+// if there is none.
+func scoreMemoFromContext(ctx context.Context) *ScoreMemo {
+	memo, _ := ctx.Value(scoreMemoCtxKey{}).(*ScoreMemo)
+	return memo
+}
+
+// query returns the scores given by the heuristic for the given inputs if
+// they were memoized already, or computes them using the passed function
+// otherwise. If the heuristic is being queried by another caller, we'll wait
+// for its result. Failures aren't memoized, such that each caller can retry
+// according to its own policy. A nil memo always computes the scores.
+func (m *ScoreMemo) query(ctx context.Context, h AttachmentHeuristic,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{},
+	compute func() (map[NodeID]*NodeScore, error)) (
+	map[NodeID]*NodeScore, error) {
+
+	if m == nil || !reflect.TypeOf(h).Comparable() {
+		return compute()
+	}
+
+	key := scoreMemoKey{
+		heuristic: h,
+		inputs:    scoresCacheKey(g, chans, chanSize, nodes),
+	}
+
+	m.Lock()
+	entry, ok := m.entries[key]
+	if !ok {
+		entry = &scoreMemoEntry{
+			done: make(chan struct{}),
+		}
+		m.entries[key] = entry
+	}
+	m.Unlock()
+
+	if ok {
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if entry.err != nil {
+			return compute()
+		}
+		return copyScores(entry.scores), nil
+	}
+
+	scores, err := compute()
+	if err != nil {
+		m.Lock()
+		delete(m.entries, key)
+		m.Unlock()
+
+		entry.err = err
+		close(entry.done)
+
+		return nil, err
+	}
+
+	// The combinators may modify the returned scores, so we'll keep a
+	// copy of our own.
+	entry.scores = copyScores(scores)
+	close(entry.done)
+
+	return scores, nil
+}
@@ -0,0 +1,117 @@
+package autopilot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestScoreMemo checks that a sub-heuristic shared by two combinators is only
+// queried once per scoring round when the combinators share a ScoreMemo.
+func TestScoreMemo(t *testing.T) {
+	t.Parallel()
+
+	node1 := testNodeID(1)
+	node2 := testNodeID(2)
+	nodes := nodeSet(node1, node2)
+
+	shared := &staticHeuristic{
+		name: "shared",
+		scores: map[NodeID]float64{
+			node1: 0.8,
+			node2: 0.4,
+		},
+	}
+	a := &staticHeuristic{
+		name: "a",
+		scores: map[NodeID]float64{
+			node1: 0.2,
+		},
+	}
+	b := &staticHeuristic{
+		name: "b",
+		scores: map[NodeID]float64{
+			node2: 1.0,
+		},
+	}
+
+	newComb := func(heuristics ...AttachmentHeuristic) AttachmentHeuristic {
+		t.Helper()
+
+		var weighted []*WeightedHeuristic
+		for _, h := range heuristics {
+			weighted = append(weighted, &WeightedHeuristic{
+				Weight:              0.5,
+				AttachmentHeuristic: h,
+			})
+		}
+
+		comb, err := NewWeightedCombAttachment(weighted...)
+		if err != nil {
+			t.Fatalf("unable to create heuristic: %v", err)
+		}
+		return comb
+	}
+	root := newComb(newComb(shared, a), newComb(shared, b))
+
+	query := func(ctx context.Context,
+		nodes map[NodeID]struct{}) map[NodeID]*NodeScore {
+
+		t.Helper()
+
+		scores, err := QueryNodeScores(
+			ctx, root, nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+		return scores
+	}
+	assertCalls := func(expected int) {
+		t.Helper()
+
+		if shared.calls != expected {
+			t.Fatalf("expected shared heuristic to be queried %d "+
+				"times, was queried %d times", expected,
+				shared.calls)
+		}
+	}
+
+	// Without a memo, the shared heuristic is queried by both
+	// combinators.
+	expected := query(context.Background(), nodes)
+	assertCalls(2)
+
+	// With a memo, it should only be queried once, without affecting the
+	// combined scores.
+	memo := NewScoreMemo()
+	ctx := WithScoreMemo(context.Background(), memo)
+	scores := query(ctx, nodes)
+	assertCalls(3)
+
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp.Score) {
+			t.Fatalf("expected score %v for node %x, got %v",
+				exp.Score, nID[:], s.Score)
+		}
+	}
+
+	// Querying other nodes with the same memo should query the shared
+	// heuristic again, but only once.
+	query(ctx, nodeSet(node1))
+	assertCalls(4)
+
+	// The memo is only shared within a scoring round, so a new round
+	// with a fresh memo should query the heuristic again.
+	query(WithScoreMemo(context.Background(), NewScoreMemo()), nodes)
+	assertCalls(5)
+}
@@ -0,0 +1,90 @@
+package autopilot
+
+import (
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// HeuristicTiming is the time it took a sub-heuristic to score the candidates
+// during a scoring round.
+type HeuristicTiming struct {
+	// Name is the name of the sub-heuristic.
+	Name string
+
+	// Duration is the time it took the sub-heuristic to score the
+	// candidates. It is zero if the sub-heuristic wasn't queried.
+	Duration time.Duration
+}
+
+// ScoringSummary summarizes a single scoring round of a combined heuristic.
+type ScoringSummary struct {
+	// Duration is the time the scoring round took.
+	Duration time.Duration
+
+	// NumCandidates is the number of nodes that were considered for
+	// scoring.
+	NumCandidates int
+
+	// NumScored is the number of nodes that were given a non-zero score.
+	NumScored int
+
+	// MinScore, MaxScore and MeanScore describe the distribution of the
+	// non-zero scores. They are zero if no node was scored.
+	MinScore  float64
+	MaxScore  float64
+	MeanScore float64
+
+	// HeuristicTimings holds the time each sub-heuristic took, in the
+	// order of the sub-heuristics.
+	HeuristicTimings []HeuristicTiming
+}
+
+// ScoringObserver is a callback invoked with the summary of each completed
+// scoring round.
+type ScoringObserver func(*ScoringSummary)
+
+// addScore adds the given non-zero score to the distribution of scores in the
+// summary. The mean is updated incrementally, such that the scores don't need
+// to be kept around.
+func (s *ScoringSummary) addScore(score float64) {
+	s.NumScored++
+	if s.NumScored == 1 || score < s.MinScore {
+		s.MinScore = score
+	}
+	if score > s.MaxScore {
+		s.MaxScore = score
+	}
+	s.MeanScore += (score - s.MeanScore) / float64(s.NumScored)
+}
+
+// subScoreTimer records the time each sub-heuristic takes to score the
+// candidates.
+type subScoreTimer struct {
+	clock     clock.Clock
+	durations []time.Duration
+}
+
+// newSubScoreTimer creates a timer for the given number of sub-heuristics.
+func newSubScoreTimer(clock clock.Clock, numHeuristics int) *subScoreTimer {
+	return &subScoreTimer{
+		clock:     clock,
+		durations: make([]time.Duration, numHeuristics),
+	}
+}
+
+// timings returns the recorded durations along with the name of their
+// sub-heuristic.
+func (t *subScoreTimer) timings(
+	heuristics []*WeightedHeuristic) []HeuristicTiming {
+
+	timings := make([]HeuristicTiming, len(heuristics))
+	for i, h := range heuristics {
+		timings[i] = HeuristicTiming{
+			Name:     h.Name(),
+			Duration: t.durations[i],
+		}
+	}
+
+	return timings
+}
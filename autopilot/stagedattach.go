@@ -0,0 +1,154 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// StagedAttachment is an implementation of the AttachmentHeuristic interface
+// that scores nodes in two stages. A cheap filter heuristic is queried first,
+// and only the nodes it scores at or above the threshold are passed on to the
+// scoring heuristic, which determines the final scores. This avoids running
+// expensive heuristics, such as centrality computations, on candidates that
+// are obviously bad.
+type StagedAttachment struct {
+	filter AttachmentHeuristic
+	scorer AttachmentHeuristic
+
+	threshold float64
+	sync.Mutex
+}
+
+// NewStagedAttachment creates a new instance of a StagedAttachment, passing
+// the nodes the filter heuristic scores at or above the threshold, which must
+// be in the range [0, 1.0], on to the scoring heuristic.
+func NewStagedAttachment(filter, scorer AttachmentHeuristic,
+	threshold float64) (*StagedAttachment, error) {
+
+	s := &StagedAttachment{
+		filter: filter,
+		scorer: scorer,
+	}
+	if err := s.SetThreshold(threshold); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// A compile time assertion to ensure StagedAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*StagedAttachment)(nil)
+var _ ScoreSettable = (*StagedAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (s *StagedAttachment) Name() string {
+	return "staged"
+}
+
+// SetThreshold sets the minimum score the filter heuristic must give a node
+// for it to be passed on to the scoring heuristic. It must be in the range
+// [0, 1.0]. It is safe to call while the heuristic is in use.
+func (s *StagedAttachment) SetThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1.0 {
+		return fmt.Errorf("threshold must be in the range [0, 1.0], "+
+			"was %v", threshold)
+	}
+
+	s.Lock()
+	s.threshold = threshold
+	s.Unlock()
+
+	return nil
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the scoring heuristic to the nodes the
+// filter heuristic scored at or above the threshold. All other nodes are given
+// a score of zero, and thus are not part of the returned map.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (s *StagedAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return s.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to both stages.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (s *StagedAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	filterScores, err := QueryNodeScores(
+		ctx, s.filter, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get filter scores: %v", err)
+	}
+
+	s.Lock()
+	threshold := s.threshold
+	s.Unlock()
+
+	// Nodes not scored by the filter heuristic are implicitly given a
+	// zero score, and thus never make it to the second stage.
+	survivors := make(map[NodeID]struct{})
+	for nID, score := range filterScores {
+		if score.Score < threshold {
+			continue
+		}
+		if _, ok := nodes[nID]; ok {
+			survivors[nID] = struct{}{}
+		}
+	}
+
+	// If no node survived the first stage, there's no need to query the
+	// scoring heuristic.
+	if len(survivors) == 0 {
+		return make(map[NodeID]*NodeScore), nil
+	}
+
+	return QueryNodeScores(ctx, s.scorer, g, chans, chanSize, survivors)
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to both of its stages.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (s *StagedAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	found := false
+	for _, h := range []AttachmentHeuristic{s.filter, s.scorer} {
+		applied, err := setInnerNodeScores(
+			h, targetHeuristic, newScores,
+		)
+		if err != nil {
+			return false, err
+		}
+		found = found || applied
+	}
+
+	return found, nil
+}
@@ -0,0 +1,124 @@
+package autopilot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// nodeRecordingHeuristic is an AttachmentHeuristic wrapping a staticHeuristic,
+// recording the node set it was last queried with.
+type nodeRecordingHeuristic struct {
+	*staticHeuristic
+
+	queried map[NodeID]struct{}
+}
+
+func (n *nodeRecordingHeuristic) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	n.queried = nodes
+	return n.staticHeuristic.NodeScores(g, chans, chanSize, nodes)
+}
+
+var _ AttachmentHeuristic = (*nodeRecordingHeuristic)(nil)
+
+// TestStagedAttachment checks that the StagedAttachment only passes the nodes
+// scored at or above the threshold by the filter heuristic on to the scoring
+// heuristic, whose scores are returned.
+func TestStagedAttachment(t *testing.T) {
+	t.Parallel()
+
+	unscored := testNodeID(1)
+	below := testNodeID(2)
+	exact := testNodeID(3)
+	above := testNodeID(4)
+	nodes := nodeSet(unscored, below, exact, above)
+
+	filter := &staticHeuristic{
+		name: "filter",
+		scores: map[NodeID]float64{
+			below: 0.29,
+			exact: 0.3,
+			above: 0.9,
+		},
+	}
+	scorer := &nodeRecordingHeuristic{
+		staticHeuristic: &staticHeuristic{
+			name: "scorer",
+			scores: map[NodeID]float64{
+				unscored: 1.0,
+				below:    1.0,
+				exact:    0.2,
+				above:    0.7,
+			},
+		},
+	}
+
+	staged, err := NewStagedAttachment(filter, scorer, 0.3)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	scores, err := staged.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+
+	// The scoring heuristic should only have been given the nodes that
+	// survived the first stage, and its scores should be returned as is.
+	if !reflect.DeepEqual(scorer.queried, nodeSet(exact, above)) {
+		t.Fatalf("expected scoring heuristic to be queried with the "+
+			"filtered nodes, got %v", scorer.queried)
+	}
+
+	expected := map[NodeID]float64{
+		exact: 0.2,
+		above: 0.7,
+	}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %d scores, got %d", len(expected),
+			len(scores))
+	}
+	for nID, exp := range expected {
+		s, ok := scores[nID]
+		if !ok {
+			t.Fatalf("node %x not scored", nID[:])
+		}
+		if !floatEq(s.Score, exp) {
+			t.Fatalf("node %x: expected score %v, got %v", nID[:],
+				exp, s.Score)
+		}
+	}
+
+	// If no node survives the first stage, the scoring heuristic
+	// shouldn't be queried at all.
+	if err := staged.SetThreshold(1.0); err != nil {
+		t.Fatalf("unable to set threshold: %v", err)
+	}
+	calls := scorer.calls
+	scores, err = staged.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(scores) != 0 {
+		t.Fatalf("expected no scores, got %d", len(scores))
+	}
+	if scorer.calls != calls {
+		t.Fatalf("expected scoring heuristic not to be queried")
+	}
+
+	// An invalid threshold should be rejected.
+	if err := staged.SetThreshold(-0.1); err == nil {
+		t.Fatalf("expected invalid threshold to be rejected")
+	}
+	if _, err := NewStagedAttachment(filter, scorer, 1.1); err == nil {
+		t.Fatalf("expected invalid threshold to be rejected")
+	}
+}
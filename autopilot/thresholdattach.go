@@ -0,0 +1,134 @@
+package autopilot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// ThresholdAttachment is an implementation of the AttachmentHeuristic
+// interface that wraps another heuristic, and filters out the nodes scoring
+// below a minimum score. This prevents the autopilot from opening channels to
+// many mediocre candidates, when only a few nodes are really worth opening
+// channels to.
+type ThresholdAttachment struct {
+	heuristic AttachmentHeuristic
+
+	threshold float64
+	sync.Mutex
+}
+
+// NewThresholdAttachment creates a new instance of a ThresholdAttachment
+// wrapping the given heuristic. Nodes given a score below the threshold, which
+// must be in the range [0, 1.0], will be filtered out.
+func NewThresholdAttachment(h AttachmentHeuristic, threshold float64) (
+	*ThresholdAttachment, error) {
+
+	t := &ThresholdAttachment{
+		heuristic: h,
+	}
+	if err := t.SetThreshold(threshold); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// A compile time assertion to ensure ThresholdAttachment meets the
+// ContextAttachmentHeuristic and ScoreSettable interfaces.
+var _ ContextAttachmentHeuristic = (*ThresholdAttachment)(nil)
+var _ ScoreSettable = (*ThresholdAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (t *ThresholdAttachment) Name() string {
+	return "threshold"
+}
+
+// SetThreshold sets the minimum score a node must be given to not be filtered
+// out. It must be in the range [0, 1.0]. It is safe to call while the
+// heuristic is in use.
+func (t *ThresholdAttachment) SetThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1.0 {
+		return fmt.Errorf("threshold must be in the range [0, 1.0], "+
+			"was %v", threshold)
+	}
+
+	t.Lock()
+	t.threshold = threshold
+	t.Unlock()
+
+	return nil
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// The scores are the ones given by the wrapped heuristic, except that nodes
+// scoring below the threshold are given a score of zero, and thus are not
+// part of the returned map.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (t *ThresholdAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	return t.NodeScoresContext(
+		context.Background(), g, chans, chanSize, nodes,
+	)
+}
+
+// NodeScoresContext is equivalent to NodeScores, but passes the context along
+// to the wrapped heuristic.
+//
+// NOTE: This is a part of the ContextAttachmentHeuristic interface.
+func (t *ThresholdAttachment) NodeScoresContext(ctx context.Context,
+	g ChannelGraph, chans []Channel, chanSize btcutil.Amount,
+	nodes map[NodeID]struct{}) (map[NodeID]*NodeScore, error) {
+
+	scores, err := QueryNodeScores(
+		ctx, t.heuristic, g, chans, chanSize, nodes,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	threshold := t.threshold
+	t.Unlock()
+
+	// The scores are copied, such that the wrapped heuristic's NodeScores
+	// aren't modified.
+	filtered := make(map[NodeID]*NodeScore, len(scores))
+	for nID, score := range scores {
+		if score.Score < threshold {
+			continue
+		}
+
+		s := *score
+		filtered[nID] = &s
+	}
+
+	return filtered, nil
+}
+
+// SetNodeScores is used to set the internal map from NodeIDs to scores. The
+// passed scores must be in the range [0, 1.0]. The fist parameter is the name
+// of the targeted heuristic, to allow recursively target specific
+// sub-heuristics. The returned boolean indicates whether the targeted
+// heuristic was found.
+//
+// Since this heuristic doesn't keep any internal scores, it will apply the
+// scores to the wrapped heuristic.
+//
+// NOTE: This is a part of the ScoreSettable interface.
+func (t *ThresholdAttachment) SetNodeScores(targetHeuristic string,
+	newScores map[NodeID]float64) (bool, error) {
+
+	return setInnerNodeScores(t.heuristic, targetHeuristic, newScores)
+}
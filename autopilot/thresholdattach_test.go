@@ -0,0 +1,99 @@
+package autopilot
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+)
+
+// TestThresholdAttachment checks that the ThresholdAttachment filters out the
+// nodes scoring below the threshold, and that the threshold can be changed.
+func TestThresholdAttachment(t *testing.T) {
+	t.Parallel()
+
+	below := testNodeID(1)
+	exact := testNodeID(2)
+	above := testNodeID(3)
+	nodes := nodeSet(below, exact, above)
+
+	inner := &staticHeuristic{
+		name: "inner",
+		scores: map[NodeID]float64{
+			below: 0.5999,
+			exact: 0.6,
+			above: 0.6001,
+		},
+	}
+
+	threshold, err := NewThresholdAttachment(inner, 0.6)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+
+	assertScored := func(expected ...NodeID) {
+		t.Helper()
+
+		scores, err := threshold.NodeScores(
+			nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		if len(scores) != len(expected) {
+			t.Fatalf("expected %d scores, got %d", len(expected),
+				len(scores))
+		}
+		for _, nID := range expected {
+			s, ok := scores[nID]
+			if !ok {
+				t.Fatalf("node %x not scored", nID[:])
+			}
+			if s.Score != inner.scores[nID] {
+				t.Fatalf("expected score %v, got %v",
+					inner.scores[nID], s.Score)
+			}
+		}
+	}
+
+	// Only the node just below the threshold should be filtered out.
+	assertScored(exact, above)
+
+	// Raising the threshold slightly should also filter out the node
+	// exactly at the previous threshold.
+	if err := threshold.SetThreshold(0.60005); err != nil {
+		t.Fatalf("unable to set threshold: %v", err)
+	}
+	assertScored(above)
+
+	// An invalid threshold should be rejected, leaving the current one in
+	// place.
+	if err := threshold.SetThreshold(1.1); err == nil {
+		t.Fatalf("expected invalid threshold to be rejected")
+	}
+	assertScored(above)
+
+	// The scores of the wrapped heuristic must not be modified, as they
+	// might be shared with others.
+	innerScores, err := inner.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	threshold, err = NewThresholdAttachment(
+		&sharedScoresHeuristic{scores: innerScores}, 0.6,
+	)
+	if err != nil {
+		t.Fatalf("unable to create heuristic: %v", err)
+	}
+	_, err = threshold.NodeScores(
+		nil, nil, btcutil.SatoshiPerBitcoin, nodes,
+	)
+	if err != nil {
+		t.Fatalf("unable to get scores: %v", err)
+	}
+	if len(innerScores) != 3 {
+		t.Fatalf("expected 3 inner scores, got %d", len(innerScores))
+	}
+}
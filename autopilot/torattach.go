@@ -0,0 +1,180 @@
+package autopilot
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/tor"
+)
+
+// TorMode determines how the TorAttachment heuristic treats nodes depending on
+// whether they're reachable over Tor or clearnet.
+type TorMode uint8
+
+const (
+	// PreferTor gives nodes advertising an onion address the max score,
+	// while nodes only reachable over clearnet get a reduced score.
+	PreferTor TorMode = iota
+
+	// PreferClearnet gives nodes advertising a clearnet address the max
+	// score, while nodes only reachable over Tor get a reduced score.
+	PreferClearnet
+
+	// TorOnly only scores nodes advertising an onion address.
+	TorOnly
+
+	// ClearnetOnly only scores nodes advertising a clearnet address.
+	ClearnetOnly
+)
+
+// String returns a human readable representation of the TorMode.
+func (m TorMode) String() string {
+	switch m {
+	case PreferTor:
+		return "prefer_tor"
+	case PreferClearnet:
+		return "prefer_clearnet"
+	case TorOnly:
+		return "tor_only"
+	case ClearnetOnly:
+		return "clearnet_only"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(m))
+	}
+}
+
+// nonPreferredScore is the score given to nodes that are only reachable over
+// the non-preferred network when using the PreferTor or PreferClearnet mode.
+const nonPreferredScore = 0.5
+
+// TorAttachment is an implementation of the AttachmentHeuristic interface
+// that scores nodes according to whether they're reachable over Tor or
+// clearnet. Privacy-focused nodes can use it to prefer or require peers
+// reachable over Tor, while others can use it to avoid Tor-only peers, which
+// usually have a higher latency.
+type TorAttachment struct {
+	mode TorMode
+}
+
+// NewTorAttachment creates a new instance of a TorAttachment heuristic using
+// the given mode.
+func NewTorAttachment(mode TorMode) (*TorAttachment, error) {
+	switch mode {
+	case PreferTor, PreferClearnet, TorOnly, ClearnetOnly:
+	default:
+		return nil, fmt.Errorf("unknown tor mode %v", mode)
+	}
+
+	return &TorAttachment{
+		mode: mode,
+	}, nil
+}
+
+// A compile time assertion to ensure TorAttachment meets the
+// AttachmentHeuristic interface.
+var _ AttachmentHeuristic = (*TorAttachment)(nil)
+
+// Name returns the name of this heuristic.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (t *TorAttachment) Name() string {
+	return "tor"
+}
+
+// NodeScores is a method that given the current channel graph and current set
+// of local channels, scores the given nodes according to the preference of
+// opening a channel of the given size with them. The returned channel
+// candidates maps the NodeID to a NodeScore for the node.
+//
+// Nodes reachable over the preferred network are given a score of 1.0. Nodes
+// only reachable over the other network are given a reduced score, or are
+// skipped entirely when using the TorOnly or ClearnetOnly mode. Nodes not
+// advertising any addresses are never scored.
+//
+// NOTE: This is a part of the AttachmentHeuristic interface.
+func (t *TorAttachment) NodeScores(g ChannelGraph, chans []Channel,
+	chanSize btcutil.Amount, nodes map[NodeID]struct{}) (
+	map[NodeID]*NodeScore, error) {
+
+	existingPeers := make(map[NodeID]struct{})
+	for _, c := range chans {
+		existingPeers[c.Node] = struct{}{}
+	}
+
+	candidates := make(map[NodeID]*NodeScore)
+	err := g.ForEachNode(func(n Node) error {
+		nID := NodeID(n.PubKey())
+		if _, ok := nodes[nID]; !ok {
+			return nil
+		}
+
+		// If the node is among or existing channel peers, we don't
+		// need another channel.
+		if _, ok := existingPeers[nID]; ok {
+			return nil
+		}
+
+		score := t.score(n.Addrs())
+
+		// Instead of adding a node with score 0 to the returned set,
+		// we just skip it.
+		if score == 0 {
+			return nil
+		}
+
+		candidates[nID] = &NodeScore{
+			NodeID: nID,
+			Score:  score,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// score returns the score of a node advertising the given addresses.
+func (t *TorAttachment) score(addrs []net.Addr) float64 {
+	var onion, clearnet bool
+	for _, addr := range addrs {
+		switch addr.(type) {
+		case *tor.OnionAddr:
+			onion = true
+		case *net.TCPAddr:
+			clearnet = true
+		}
+	}
+
+	switch t.mode {
+	case PreferTor:
+		switch {
+		case onion:
+			return 1.0
+		case clearnet:
+			return nonPreferredScore
+		}
+
+	case PreferClearnet:
+		switch {
+		case clearnet:
+			return 1.0
+		case onion:
+			return nonPreferredScore
+		}
+
+	case TorOnly:
+		if onion {
+			return 1.0
+		}
+
+	case ClearnetOnly:
+		if clearnet {
+			return 1.0
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,92 @@
+package autopilot
+
+import (
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/lightningnetwork/lnd/tor"
+)
+
+// TestTorAttachment checks that the TorAttachment scores nodes advertising
+// different mixes of addresses according to the configured mode.
+func TestTorAttachment(t *testing.T) {
+	t.Parallel()
+
+	g := newMemChannelGraph()
+	keys, nIDs := genTestNodes(t, 4)
+
+	clearnetAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9735}
+	onionAddr := &tor.OnionAddr{
+		OnionService: "3g2upl4pq6kufc4m.onion",
+		Port:         9735,
+	}
+
+	// The nodes are respectively clearnet only, Tor only, reachable over
+	// both, and not advertising any addresses.
+	addrs := [][]net.Addr{
+		{clearnetAddr},
+		{onionAddr},
+		{clearnetAddr, onionAddr},
+		nil,
+	}
+	for i, key := range keys {
+		g.graph[nIDs[i]] = memNode{
+			pub:   key,
+			addrs: addrs[i],
+		}
+	}
+
+	testCases := []struct {
+		mode     TorMode
+		expected []float64
+	}{
+		{
+			mode:     PreferTor,
+			expected: []float64{nonPreferredScore, 1.0, 1.0, 0},
+		},
+		{
+			mode:     PreferClearnet,
+			expected: []float64{1.0, nonPreferredScore, 1.0, 0},
+		},
+		{
+			mode:     TorOnly,
+			expected: []float64{0, 1.0, 1.0, 0},
+		},
+		{
+			mode:     ClearnetOnly,
+			expected: []float64{1.0, 0, 1.0, 0},
+		},
+	}
+
+	for _, test := range testCases {
+		torAttach, err := NewTorAttachment(test.mode)
+		if err != nil {
+			t.Fatalf("unable to create heuristic: %v", err)
+		}
+
+		scores, err := torAttach.NodeScores(
+			g, nil, btcutil.SatoshiPerBitcoin, nodeSet(nIDs...),
+		)
+		if err != nil {
+			t.Fatalf("unable to get scores: %v", err)
+		}
+
+		for i, exp := range test.expected {
+			var score float64
+			if s, ok := scores[nIDs[i]]; ok {
+				score = s.Score
+			}
+
+			if score != exp {
+				t.Fatalf("mode %v: expected score %v for "+
+					"node %d, got %v", test.mode, exp, i,
+					score)
+			}
+		}
+	}
+
+	if _, err := NewTorAttachment(TorMode(99)); err == nil {
+		t.Fatalf("expected unknown mode to be rejected")
+	}
+}
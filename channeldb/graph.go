@@ -135,6 +135,11 @@ var (
 	// case we'll remove all entries from the prune log with a block height
 	// that no longer exists.
 	pruneLogBucket = []byte("prune-log")
+
+	// graphVersionKey is a key within the graphMetaBucket that stores the
+	// version of the graph, which is incremented each time the graph is
+	// modified.
+	graphVersionKey = []byte("graph-version")
 )
 
 const (
@@ -178,6 +183,55 @@ func (c *ChannelGraph) Database() *DB {
 	return c.db
 }
 
+// Version returns the current version of the graph, which is incremented each
+// time the graph is modified. Unlike the ID of the last database transaction,
+// it doesn't change with writes to the database unrelated to the graph. Zero is
+// returned if the graph was never modified.
+func (c *ChannelGraph) Version() (uint64, error) {
+	var version uint64
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		graphMeta := tx.Bucket(graphMetaBucket)
+		if graphMeta == nil {
+			return ErrGraphNotFound
+		}
+
+		if v := graphMeta.Get(graphVersionKey); len(v) == 8 {
+			version = byteOrder.Uint64(v)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// updateGraph executes the given function within a database transaction
+// modifying the graph, incrementing the version of the graph along with it.
+func (c *ChannelGraph) updateGraph(f func(tx *bbolt.Tx) error) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		if err := f(tx); err != nil {
+			return err
+		}
+
+		graphMeta, err := tx.CreateBucketIfNotExists(graphMetaBucket)
+		if err != nil {
+			return err
+		}
+
+		var version uint64
+		if v := graphMeta.Get(graphVersionKey); len(v) == 8 {
+			version = byteOrder.Uint64(v)
+		}
+
+		var b [8]byte
+		byteOrder.PutUint64(b[:], version+1)
+		return graphMeta.Put(graphVersionKey, b[:])
+	})
+}
+
 // ForEachChannel iterates through all the channel edges stored within the
 // graph and invokes the passed callback for each edge. The callback takes two
 // edges as since this is a directed graph, both the in/out edges are visited.
@@ -345,7 +399,7 @@ func (c *ChannelGraph) sourceNode(nodes *bbolt.Bucket) (*LightningNode, error) {
 func (c *ChannelGraph) SetSourceNode(node *LightningNode) error {
 	nodePubBytes := node.PubKeyBytes[:]
 
-	return c.db.Update(func(tx *bbolt.Tx) error {
+	return c.updateGraph(func(tx *bbolt.Tx) error {
 		// First grab the nodes bucket which stores the mapping from
 		// pubKey to node information.
 		nodes, err := tx.CreateBucketIfNotExists(nodeBucket)
@@ -374,7 +428,7 @@ func (c *ChannelGraph) SetSourceNode(node *LightningNode) error {
 //
 // TODO(roasbeef): also need sig of announcement
 func (c *ChannelGraph) AddLightningNode(node *LightningNode) error {
-	return c.db.Update(func(tx *bbolt.Tx) error {
+	return c.updateGraph(func(tx *bbolt.Tx) error {
 		return addLightningNode(tx, node)
 	})
 }
@@ -438,7 +492,7 @@ func (c *ChannelGraph) LookupAlias(pub *btcec.PublicKey) (string, error) {
 // from the database according to the node's public key.
 func (c *ChannelGraph) DeleteLightningNode(nodePub *btcec.PublicKey) error {
 	// TODO(roasbeef): ensure dangling edges are removed...
-	return c.db.Update(func(tx *bbolt.Tx) error {
+	return c.updateGraph(func(tx *bbolt.Tx) error {
 		nodes := tx.Bucket(nodeBucket)
 		if nodes == nil {
 			return ErrGraphNodeNotFound
@@ -505,7 +559,7 @@ func (c *ChannelGraph) AddChannelEdge(edge *ChannelEdgeInfo) error {
 	c.cacheMu.Lock()
 	defer c.cacheMu.Unlock()
 
-	err := c.db.Update(func(tx *bbolt.Tx) error {
+	err := c.updateGraph(func(tx *bbolt.Tx) error {
 		return c.addChannelEdge(tx, edge)
 	})
 	if err != nil {
@@ -732,7 +786,7 @@ func (c *ChannelGraph) UpdateChannelEdge(edge *ChannelEdgeInfo) error {
 	var chanKey [8]byte
 	binary.BigEndian.PutUint64(chanKey[:], edge.ChannelID)
 
-	return c.db.Update(func(tx *bbolt.Tx) error {
+	return c.updateGraph(func(tx *bbolt.Tx) error {
 		edges := tx.Bucket(edgeBucket)
 		if edge == nil {
 			return ErrEdgeNotFound
@@ -775,7 +829,7 @@ func (c *ChannelGraph) PruneGraph(spentOutputs []*wire.OutPoint,
 
 	var chansClosed []*ChannelEdgeInfo
 
-	err := c.db.Update(func(tx *bbolt.Tx) error {
+	err := c.updateGraph(func(tx *bbolt.Tx) error {
 		// First grab the edges bucket which houses the information
 		// we'd like to delete
 		edges, err := tx.CreateBucketIfNotExists(edgeBucket)
@@ -889,7 +943,7 @@ func (c *ChannelGraph) PruneGraph(spentOutputs []*wire.OutPoint,
 // that we only maintain a graph of reachable nodes. In the event that a pruned
 // node gains more channels, it will be re-added back to the graph.
 func (c *ChannelGraph) PruneGraphNodes() error {
-	return c.db.Update(func(tx *bbolt.Tx) error {
+	return c.updateGraph(func(tx *bbolt.Tx) error {
 		nodes := tx.Bucket(nodeBucket)
 		if nodes == nil {
 			return ErrGraphNodesNotFound
@@ -1037,7 +1091,7 @@ func (c *ChannelGraph) DisconnectBlockAtHeight(height uint32) ([]*ChannelEdgeInf
 	// Keep track of the channels that are removed from the graph.
 	var removedChans []*ChannelEdgeInfo
 
-	if err := c.db.Update(func(tx *bbolt.Tx) error {
+	if err := c.updateGraph(func(tx *bbolt.Tx) error {
 		edges, err := tx.CreateBucketIfNotExists(edgeBucket)
 		if err != nil {
 			return err
@@ -1176,7 +1230,7 @@ func (c *ChannelGraph) DeleteChannelEdge(chanPoint *wire.OutPoint) error {
 	defer c.cacheMu.Unlock()
 
 	var chanID uint64
-	err := c.db.Update(func(tx *bbolt.Tx) error {
+	err := c.updateGraph(func(tx *bbolt.Tx) error {
 		var err error
 		chanID, err = getChanID(tx, chanPoint)
 		if err != nil {
@@ -1839,7 +1893,7 @@ func (c *ChannelGraph) UpdateEdgePolicy(edge *ChannelEdgePolicy) error {
 	defer c.cacheMu.Unlock()
 
 	var isUpdate1 bool
-	err := c.db.Update(func(tx *bbolt.Tx) error {
+	err := c.updateGraph(func(tx *bbolt.Tx) error {
 		var err error
 		isUpdate1, err = updateEdgePolicy(tx, edge)
 		return err
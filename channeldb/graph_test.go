@@ -3005,3 +3005,80 @@ func compareEdgePolicies(a, b *ChannelEdgePolicy) error {
 	}
 	return nil
 }
+
+// TestGraphVersion tests that the version of the graph is incremented by each
+// modification of the graph, but not by failed modifications or unrelated
+// writes to the database.
+func TestGraphVersion(t *testing.T) {
+	t.Parallel()
+
+	db, cleanUp, err := makeTestDB()
+	defer cleanUp()
+	if err != nil {
+		t.Fatalf("unable to make test database: %v", err)
+	}
+
+	graph := db.ChannelGraph()
+
+	assertVersion := func(expected uint64) {
+		t.Helper()
+
+		version, err := graph.Version()
+		if err != nil {
+			t.Fatalf("unable to get graph version: %v", err)
+		}
+		if version != expected {
+			t.Fatalf("expected version %v, got %v", expected,
+				version)
+		}
+	}
+
+	// A fresh graph was never modified.
+	assertVersion(0)
+
+	node, err := createTestVertex(db)
+	if err != nil {
+		t.Fatalf("unable to create test node: %v", err)
+	}
+	if err := graph.AddLightningNode(node); err != nil {
+		t.Fatalf("unable to add node: %v", err)
+	}
+	assertVersion(1)
+
+	// Writes to the database outside of the graph shouldn't change the
+	// version.
+	err = db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("unrelated"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	})
+	if err != nil {
+		t.Fatalf("unable to write to database: %v", err)
+	}
+	assertVersion(1)
+
+	// Neither should failed modifications of the graph.
+	otherNode, err := createTestVertex(db)
+	if err != nil {
+		t.Fatalf("unable to create test node: %v", err)
+	}
+	otherPub, err := otherNode.PubKey()
+	if err != nil {
+		t.Fatalf("unable to get public key: %v", err)
+	}
+	if err := graph.DeleteLightningNode(otherPub); err == nil {
+		t.Fatalf("expected deleting unknown node to fail")
+	}
+	assertVersion(1)
+
+	nodePub, err := node.PubKey()
+	if err != nil {
+		t.Fatalf("unable to get public key: %v", err)
+	}
+	if err := graph.DeleteLightningNode(nodePub); err != nil {
+		t.Fatalf("unable to delete node: %v", err)
+	}
+	assertVersion(2)
+}
@@ -0,0 +1,17 @@
+package clock
+
+import (
+	"time"
+)
+
+// Clock is an interface that provides the time functions used by the lnd
+// packages. This is useful during testing, when a controllable time reference
+// is needed.
+type Clock interface {
+	// Now returns the current local time (as defined by the Clock).
+	Now() time.Time
+
+	// After returns a channel that will receive the current time after
+	// the specified duration has passed by the Clock.
+	After(d time.Duration) <-chan time.Time
+}
@@ -0,0 +1,83 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// TestClock can be used in tests to mock time. Its current time only changes
+// when it is explicitly set, at which point all expired timers fire.
+type TestClock struct {
+	currentTime time.Time
+	timers      []testTimer
+	mu          sync.Mutex
+}
+
+// testTimer is a timer created by After, that fires once the clock reaches its
+// deadline.
+type testTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewTestClock returns a new test clock starting at the given time.
+func NewTestClock(startTime time.Time) *TestClock {
+	return &TestClock{
+		currentTime: startTime,
+	}
+}
+
+// Now returns the current time of the test clock.
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.currentTime
+}
+
+// After returns a channel that will receive the current time of the test clock
+// once it has been advanced by at least the specified duration.
+func (c *TestClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The channel is buffered, such that firing the timer never blocks,
+	// even if nobody is listening anymore.
+	timer := testTimer{
+		deadline: c.currentTime.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		timer.c <- c.currentTime
+		return timer.c
+	}
+
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+// SetTime sets the current time of the test clock, firing all timers whose
+// deadline has been reached.
+func (c *TestClock) SetTime(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.currentTime = now
+
+	remaining := c.timers[:0]
+	for _, timer := range c.timers {
+		if now.Before(timer.deadline) {
+			remaining = append(remaining, timer)
+			continue
+		}
+
+		timer.c <- now
+	}
+	c.timers = remaining
+}
+
+// Advance moves the current time of the test clock forward by the given
+// duration, firing all timers whose deadline has been reached.
+func (c *TestClock) Advance(d time.Duration) {
+	c.SetTime(c.Now().Add(d))
+}
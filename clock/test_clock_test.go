@@ -0,0 +1,66 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2009, time.January, 3, 18, 15, 5, 0, time.UTC)
+
+// TestNow ensures that the test clock only changes its time when set.
+func TestNow(t *testing.T) {
+	c := NewTestClock(testTime)
+	if !c.Now().Equal(testTime) {
+		t.Fatalf("expected time %v, got %v", testTime, c.Now())
+	}
+
+	now := testTime.Add(time.Hour)
+	c.SetTime(now)
+	if !c.Now().Equal(now) {
+		t.Fatalf("expected time %v, got %v", now, c.Now())
+	}
+
+	c.Advance(time.Minute)
+	if !c.Now().Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected time %v, got %v", now.Add(time.Minute),
+			c.Now())
+	}
+}
+
+// TestAfter ensures that the channels returned by After only fire once the
+// test clock reaches their deadline.
+func TestAfter(t *testing.T) {
+	c := NewTestClock(testTime)
+
+	short := c.After(time.Minute)
+	long := c.After(time.Hour)
+
+	assertFired := func(ch <-chan time.Time, fired bool) {
+		t.Helper()
+
+		select {
+		case <-ch:
+			if !fired {
+				t.Fatalf("timer fired unexpectedly")
+			}
+		default:
+			if fired {
+				t.Fatalf("expected timer to fire")
+			}
+		}
+	}
+
+	c.Advance(time.Second)
+	assertFired(short, false)
+	assertFired(long, false)
+
+	c.Advance(time.Minute)
+	assertFired(short, true)
+	assertFired(long, false)
+
+	c.SetTime(testTime.Add(time.Hour))
+	assertFired(long, true)
+
+	// A non-positive duration should fire immediately.
+	assertFired(c.After(0), true)
+}
@@ -1,19 +1,32 @@
 package tor
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/textproto"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
 )
 
 const (
@@ -21,6 +34,40 @@ const (
 	// request.
 	success = 250
 
+	// resourceExhausted is the Tor Control response code indicating that
+	// the Tor server temporarily ran out of resources.
+	resourceExhausted = 451
+
+	// internalError is the Tor Control response code indicating an
+	// internal error of the Tor server.
+	internalError = 551
+
+	// asyncEvent is the Tor Control response code of asynchronous event
+	// notifications.
+	asyncEvent = 650
+
+	// DefaultAuthChallengeRetries is the number of times the AUTHCHALLENGE
+	// command is retried by default after a transient failure.
+	DefaultAuthChallengeRetries = 2
+
+	// DefaultStopTimeout is the default maximum amount of time Stop waits
+	// for an in-flight command to complete.
+	DefaultStopTimeout = 5 * time.Second
+
+	// DefaultCookieReadTimeout is the default maximum amount of time
+	// reading the authentication cookie file may take.
+	DefaultCookieReadTimeout = 10 * time.Second
+
+	// DefaultEventBufferSize is the default number of events buffered for
+	// the subscriber of the event stream.
+	DefaultEventBufferSize = 100
+
+	// DefaultMaxReplySize is the default maximum size in bytes of a reply
+	// from the Tor server. It is generous enough for the largest replies
+	// in normal use, such as GETINFO md/all listing all microdescriptors
+	// known to the Tor server.
+	DefaultMaxReplySize = 64 * 1024 * 1024
+
 	// nonceLen is the length of a nonce generated by either the controller
 	// or the Tor server
 	nonceLen = 32
@@ -28,6 +75,11 @@ const (
 	// cookieLen is the length of the authentication cookie.
 	cookieLen = 32
 
+	// DefaultControlPort is the port the Tor server listens on for
+	// controller connections by default. It is used if no port is given
+	// as part of the control address.
+	DefaultControlPort = 9051
+
 	// ProtocolInfoVersion is the `protocolinfo` version currently supported
 	// by the Tor server.
 	ProtocolInfoVersion = 1
@@ -48,20 +100,139 @@ var (
 	// message from the controller.
 	controllerKey = []byte("Tor safe cookie authentication " +
 		"controller-to-server hash")
+
+	// ErrNotAuthenticated is returned when a command is sent before the
+	// connection to the Tor server has been successfully authenticated.
+	ErrNotAuthenticated = errors.New("connection to Tor server is not " +
+		"authenticated")
+
+	// ErrControllerStopping is returned when a command is sent while the
+	// controller is being stopped, or after it has been stopped.
+	ErrControllerStopping = errors.New("tor controller stopping")
+
+	// ErrUnknownVersion is returned when a v3 onion service is requested
+	// from a Tor server that didn't advertise its version, in which case
+	// its support for v3 onion services can't be verified.
+	ErrUnknownVersion = errors.New("Tor version unknown, can't verify " +
+		"v3 onion service support")
+
+	// ErrCookieAuthDisabled is returned when authenticating with a Tor
+	// server that supports neither the SAFECOOKIE nor the NULL
+	// authentication method, in which case CookieAuthentication should be
+	// enabled in its configuration.
+	ErrCookieAuthDisabled = errors.New("the Tor server is currently not " +
+		"configured for cookie or null authentication")
+
+	// ErrCookieFileUnreadable is matched by the CookieFileError returned
+	// when the authentication cookie file of the Tor server can't be read,
+	// usually due to its permissions.
+	ErrCookieFileUnreadable = errors.New("unable to read authentication " +
+		"cookie file")
 )
 
+// ControlError is returned when the Tor server replies to a command with an
+// unexpected status code, or an unexpected reply.
+type ControlError struct {
+	// Code is the status code of the reply.
+	Code int
+
+	// Reply is the text of the reply, with each line separated by a
+	// newline.
+	Reply string
+}
+
+// Error returns a human readable description of the error.
+func (e *ControlError) Error() string {
+	return fmt.Sprintf("unexpected reply from Tor server (code %d): %v",
+		e.Code, e.Reply)
+}
+
+// ConnectionError is returned when a command couldn't be sent to the Tor
+// server, or its reply couldn't be read, due to a failure of the underlying
+// connection.
+type ConnectionError struct {
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a human readable description of the error.
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("connection to Tor server failed: %v", e.Err)
+}
+
+// CookieFileError is returned when the authentication cookie file of the Tor
+// server can't be read. It matches ErrCookieFileUnreadable through errors.Is.
+type CookieFileError struct {
+	// Path is the path of the cookie file.
+	Path string
+
+	// Err is the underlying error returned by the OS.
+	Err error
+
+	// mode is the mode of the cookie file, if it could be retrieved.
+	mode string
+}
+
+// Error returns a human readable description of the error. Tor doesn't expose
+// the cookie through the control port, so if the file can't be read due to its
+// permissions, it also includes the mode of the file and how to fix it.
+func (e *CookieFileError) Error() string {
+	if !os.IsPermission(e.Err) {
+		return fmt.Sprintf("%v %v: %v", ErrCookieFileUnreadable, e.Path,
+			e.Err)
+	}
+
+	return fmt.Sprintf("%v %v with mode %v: permission denied, make sure "+
+		"it is readable by lnd, e.g. by setting "+
+		"CookieAuthFileGroupReadable in the Tor configuration and "+
+		"adding lnd's user to Tor's group", ErrCookieFileUnreadable,
+		e.Path, e.mode)
+}
+
+// Unwrap returns the underlying error returned by the OS.
+func (e *CookieFileError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns whether the target is ErrCookieFileUnreadable.
+func (e *CookieFileError) Is(target error) bool {
+	return target == ErrCookieFileUnreadable
+}
+
+// ReplyTooLargeError is returned when a reply from the Tor server exceeds the
+// maximum reply size. As the remainder of the reply can't be told apart from
+// the replies that follow it, the connection is closed, and any further command
+// fails with a ConnectionError.
+type ReplyTooLargeError struct {
+	// MaxSize is the maximum reply size in bytes that was exceeded.
+	MaxSize int
+}
+
+// Error returns a human readable description of the error.
+func (e *ReplyTooLargeError) Error() string {
+	return fmt.Sprintf("reply from Tor server exceeds maximum size of %d "+
+		"bytes", e.MaxSize)
+}
+
 // Controller is an implementation of the Tor Control protocol. This is used in
 // order to communicate with a Tor server. Its only supported method of
 // authentication is the SAFECOOKIE method.
 //
+// Commands may be sent concurrently, but are serialized on the connection,
+// such that each reply is matched to its command. Asynchronous event replies
+// from the server are delivered through SubscribeEvents.
+//
 // NOTE: The connection to the Tor server must be authenticated before
-// proceeding to send commands. Otherwise, the connection will be closed.
+// proceeding to send commands. Otherwise, ErrNotAuthenticated is returned.
 //
 // TODO:
-//   * if adding support for more commands, extend this with a command queue?
 //   * place under sub-package?
-//   * support async replies from the server
 type Controller struct {
+	// droppedEvents is used atomically, and counts the events dropped as
+	// the subscriber of the event stream didn't keep up. It must be kept
+	// first in the struct to ensure 64-bit alignment.
+	droppedEvents uint64
+
 	// started is used atomically in order to prevent multiple calls to
 	// Start.
 	started int32
@@ -70,245 +241,1565 @@ type Controller struct {
 	// Stop.
 	stopped int32
 
+	// authenticated is used atomically, and is set once the connection to
+	// the Tor server has been successfully authenticated.
+	authenticated int32
+
+	// connClosed is used atomically, and is set once the connection to
+	// the Tor server has been closed, either by Stop or after a reply
+	// exceeded the maximum size.
+	connClosed int32
+
 	// conn is the underlying connection between the controller and the
 	// Tor server. It provides read and write methods to simplify the
 	// text-based messages within the connection.
 	conn *textproto.Conn
 
-	// controlAddr is the host:port the Tor server is listening locally for
-	// controller connections on.
-	controlAddr string
+	// controlAddrs are the host:port addresses of the Tor servers
+	// listening for controller connections, in the order they are tried
+	// when connecting.
+	controlAddrs []string
 
 	// version is the current version of the Tor server.
 	version string
+
+	// cmdMtx ensures only a single command is sent to the Tor server at a
+	// time, such that each reply is read by the sender of its command.
+	cmdMtx sync.Mutex
+
+	// authChallengeRetries is the number of times the AUTHCHALLENGE
+	// command is retried after a transient failure.
+	authChallengeRetries int
+
+	// cookieReadTimeout is the maximum amount of time reading the
+	// authentication cookie may take. Zero means no timeout.
+	cookieReadTimeout time.Duration
+
+	// clock is used to time out operations on the Tor server.
+	clock clock.Clock
+
+	// stopTimeout is the maximum amount of time Stop waits for an
+	// in-flight command to complete before closing the connection.
+	stopTimeout time.Duration
+
+	// cookieFilePath, if set, is the path of the authentication cookie
+	// file used instead of the one reported by the Tor server.
+	cookieFilePath string
+
+	// onionObserver, if set, is notified of the lifecycle of the onion
+	// services managed by the controller.
+	onionObserver OnionObserver
+
+	// hsDescs holds the status of the descriptor uploads of each onion
+	// service, keyed by service ID, as reported by the HS_DESC events
+	// received.
+	hsDescs map[string]HSDescStatus
+
+	// hsDescMtx guards hsDescs.
+	hsDescMtx sync.Mutex
+
+	// randSource is the source of randomness used to generate the client
+	// nonces. If nil, crypto/rand.Reader is used.
+	randSource io.Reader
+
+	// eventBufferSize is the number of events buffered for the subscriber
+	// of the event stream before the oldest ones are dropped.
+	eventBufferSize int
+
+	// maxReplySize is the maximum size in bytes of a reply from the Tor
+	// server. Zero or negative means unlimited.
+	maxReplySize int
+
+	// skipV3Check, if true, disables checking whether the version of the
+	// Tor server supports v3 onion services before requesting one.
+	skipV3Check bool
+
+	// stream, if set, is the event stream reading all replies from the
+	// Tor server once events have been subscribed to. It is guarded by
+	// cmdMtx.
+	stream *eventStream
+}
+
+// OnionObserver is an interface that is notified of the lifecycle of the onion
+// services managed by a Controller, e.g. for monitoring purposes. The service
+// IDs are given without the onion suffix.
+type OnionObserver interface {
+	// OnCreated is called when a new onion service was created.
+	OnCreated(serviceID string, onionType OnionType)
+
+	// OnRestored is called when an onion service was restored from its
+	// private key.
+	OnRestored(serviceID string, onionType OnionType)
+
+	// OnDeleted is called when an onion service was deleted.
+	OnDeleted(serviceID string, onionType OnionType)
 }
 
 // NewController returns a new Tor controller that will be able to interact with
-// a Tor server.
-func NewController(controlAddr string) *Controller {
-	return &Controller{controlAddr: controlAddr}
+// a Tor server. If several control addresses are given, e.g. of clustered Tor
+// instances, the controller uses the first one it can connect to and
+// authenticate with.
+func NewController(controlAddrs ...string) *Controller {
+	return &Controller{
+		controlAddrs:         controlAddrs,
+		authChallengeRetries: DefaultAuthChallengeRetries,
+		cookieReadTimeout:    DefaultCookieReadTimeout,
+		clock:                clock.NewDefaultClock(),
+		stopTimeout:          DefaultStopTimeout,
+		randSource:           rand.Reader,
+		eventBufferSize:      DefaultEventBufferSize,
+		maxReplySize:         DefaultMaxReplySize,
+	}
+}
+
+// SetAuthChallengeRetries sets the number of times the AUTHCHALLENGE command
+// is retried with a fresh nonce after a transient failure of the Tor server.
+// It must be called before Start.
+func (c *Controller) SetAuthChallengeRetries(retries int) {
+	c.authChallengeRetries = retries
+}
+
+// SetCookieReadTimeout sets the maximum amount of time reading the
+// authentication cookie file may take, such that a stalled filesystem results
+// in an error instead of blocking Start indefinitely. Zero disables the
+// timeout. It must be called before Start.
+func (c *Controller) SetCookieReadTimeout(timeout time.Duration) {
+	c.cookieReadTimeout = timeout
+}
+
+// SetClock sets the clock used to time out operations, such as reading the
+// authentication cookie. This should only be used to control the passage of
+// time in tests. It must be called before Start.
+func (c *Controller) SetClock(clk clock.Clock) {
+	c.clock = clk
+}
+
+// SetStopTimeout sets the maximum amount of time Stop waits for an in-flight
+// command to complete before closing the connection, which aborts the
+// command. Zero means the connection is closed right away. It must be called
+// before Start.
+func (c *Controller) SetStopTimeout(timeout time.Duration) {
+	c.stopTimeout = timeout
+}
+
+// SetCookieFilePath sets the path of the authentication cookie file, to be used
+// instead of the path reported by the Tor server. This is needed if the Tor
+// server runs in a different container or chroot, such that the file is
+// visible to us at a different path. It must be called before Start.
+func (c *Controller) SetCookieFilePath(path string) {
+	c.cookieFilePath = path
+}
+
+// SetRandSource sets the source of randomness used to generate the client
+// nonces during authentication. This should only be used to make the
+// authentication deterministic in tests, as the nonces must otherwise be
+// unpredictable. Passing nil restores the default, crypto/rand.Reader. It must
+// be called before Start.
+func (c *Controller) SetRandSource(randSource io.Reader) {
+	c.randSource = randSource
+}
+
+// SetEventBufferSize sets the number of events buffered for the subscriber of
+// the event stream. Once the buffer is full, the oldest events are dropped,
+// such that a slow subscriber never stalls the replies to commands. A size
+// below one uses DefaultEventBufferSize. It must be called before Start.
+func (c *Controller) SetEventBufferSize(size int) {
+	c.eventBufferSize = size
+}
+
+// SetMaxReplySize sets the maximum size in bytes of a reply from the Tor
+// server, such that a misbehaving server can't make us buffer an unbounded
+// amount of data. Exceeding it results in a ReplyTooLargeError. Zero or
+// negative disables the limit. It must be called before Start.
+func (c *Controller) SetMaxReplySize(size int) {
+	c.maxReplySize = size
+}
+
+// SetSkipV3Check disables checking whether the version of the Tor server
+// supports v3 onion services before requesting one, leaving it to the server
+// to reject the request if it can't create them. This is an escape hatch for
+// non-standard Tor builds whose versions are missing or can't be parsed. It
+// must be called before Start.
+func (c *Controller) SetSkipV3Check(skip bool) {
+	c.skipV3Check = skip
+}
+
+// SetOnionObserver sets the observer notified when an onion service is
+// created, restored or deleted. It must be called before Start.
+func (c *Controller) SetOnionObserver(observer OnionObserver) {
+	c.onionObserver = observer
 }
 
 // Start establishes and authenticates the connection between the controller and
 // a Tor server. Once done, the controller will be able to send commands and
-// expect responses.
+// expect responses. If establishing or authenticating the connection fails,
+// Start may be called again to retry.
 func (c *Controller) Start() error {
 	if !atomic.CompareAndSwapInt32(&c.started, 0, 1) {
 		return nil
 	}
 
-	conn, err := textproto.Dial("tcp", c.controlAddr)
-	if err != nil {
-		return fmt.Errorf("unable to connect to Tor server: %v", err)
+	if err := c.connect(); err != nil {
+		// We'll reset the started flag, such that a failed attempt
+		// doesn't prevent a later one from being made.
+		atomic.StoreInt32(&c.started, 0)
+		return err
 	}
 
-	c.conn = conn
+	atomic.StoreInt32(&c.authenticated, 1)
 
-	return c.authenticate()
+	return nil
 }
 
-// Stop closes the connection between the controller and the Tor server.
-func (c *Controller) Stop() error {
-	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
-		return nil
+// connect establishes and authenticates the connection between the controller
+// and a Tor server, trying each of the control addresses in order until one
+// succeeds. If all of them fail, the returned error includes the reason for
+// each address.
+func (c *Controller) connect() error {
+	if len(c.controlAddrs) == 0 {
+		return errors.New("no control address given")
 	}
 
-	return c.conn.Close()
+	var errs []string
+	for _, controlAddr := range c.controlAddrs {
+		err := c.connectAddr(controlAddr)
+		if err == nil {
+			return nil
+		}
+
+		// If there's only a single address, we'll return its error as
+		// is.
+		if len(c.controlAddrs) == 1 {
+			return err
+		}
+
+		errs = append(errs, fmt.Sprintf("%v: %v", controlAddr, err))
+	}
+
+	return fmt.Errorf("unable to connect to any Tor server: %v",
+		strings.Join(errs, "; "))
 }
 
-// sendCommand sends a command to the Tor server and returns its response, as a
-// single space-delimited string, and code.
-func (c *Controller) sendCommand(command string) (int, string, error) {
-	if err := c.conn.Writer.PrintfLine(command); err != nil {
-		return 0, "", err
+// connectAddr establishes and authenticates the connection between the
+// controller and the Tor server listening on the given address. If
+// authentication fails, the connection is closed.
+func (c *Controller) connectAddr(addr string) error {
+	controlAddr, err := normalizeControlAddr(addr)
+	if err != nil {
+		return err
 	}
 
-	// We'll use ReadResponse as it has built-in support for multi-line
-	// text protocol responses.
-	code, reply, err := c.conn.Reader.ReadResponse(success)
+	conn, err := textproto.Dial("tcp", controlAddr)
 	if err != nil {
-		return code, reply, err
+		return fmt.Errorf("unable to connect to Tor server: %v", err)
 	}
 
-	return code, reply, nil
+	c.conn = conn
+
+	if err := c.authenticate(); err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+
+	return nil
 }
 
-// parseTorReply parses the reply from the Tor server after receiving a command
-// from a controller. This will parse the relevant reply parameters into a map
-// of keys and values.
-func parseTorReply(reply string) map[string]string {
-	params := make(map[string]string)
+// normalizeControlAddr validates the given control address, returning it in the
+// host:port format expected when dialing. The address may also consist of
+// only a host, in which case DefaultControlPort is used, or of only a port, in
+// which case localhost is used. IPv6 literals may be given with or without
+// brackets if no port is included.
+func normalizeControlAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("control address must not be empty")
+	}
 
-	// Replies can either span single or multiple lines, so we'll default
-	// to stripping whitespace and newlines in order to retrieve the
-	// individual contents of it. The -1 indicates that we want this to span
-	// across all instances of a newline.
-	contents := strings.Split(strings.Replace(reply, "\n", " ", -1), " ")
-	for _, content := range contents {
-		// Each parameter within the reply should be of the form
-		// "KEY=VALUE". If the parameter doesn't contain "=", then we
-		// can assume it does not provide any other relevant information
-		// already known.
-		keyValue := strings.SplitN(content, "=", 2)
-		if len(keyValue) != 2 {
-			continue
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// If the address can't be split, we'll assume it's missing
+		// its port, unless it is a port on its own.
+		host, port = addr, strconv.Itoa(DefaultControlPort)
+		if _, err := strconv.Atoi(addr); err == nil {
+			host, port = "localhost", addr
 		}
 
-		key := keyValue[0]
-		value := keyValue[1]
-		params[key] = value
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
 	}
 
-	return params
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid control address %v: invalid "+
+			"port %v", addr, port)
+	}
+	if err := validatePort(portNum); err != nil {
+		return "", fmt.Errorf("invalid control address %v: %v", addr,
+			err)
+	}
+
+	// Any host containing a colon must be an IPv6 literal.
+	switch {
+	case host == "":
+		return "", fmt.Errorf("invalid control address %v: missing "+
+			"host", addr)
+
+	case strings.ContainsAny(host, "[]/ "),
+		strings.Contains(host, ":") && net.ParseIP(host) == nil:
+
+		return "", fmt.Errorf("invalid control address %v: invalid "+
+			"host %v", addr, host)
+	}
+
+	return net.JoinHostPort(host, port), nil
 }
 
-// authenticate authenticates the connection between the controller and the
-// Tor server using the SAFECOOKIE or NULL authentication method.
-func (c *Controller) authenticate() error {
-	// Before proceeding to authenticate the connection, we'll retrieve
-	// the authentication cookie of the Tor server. This will be used
-	// throughout the authentication routine. We do this before as once the
-	// authentication routine has begun, it is not possible to retrieve it
-	// mid-way.
-	cookie, err := c.getAuthCookie()
-	if err != nil {
-		return fmt.Errorf("unable to retrieve authentication cookie: "+
-			"%v", err)
+// Stop closes the connection between the controller and the Tor server. Any
+// command in flight is given up to the stop timeout to complete before the
+// connection is closed, while commands sent once stopping has begun fail with
+// ErrControllerStopping.
+func (c *Controller) Stop() error {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return nil
 	}
 
-	// If cookie is empty and there's no error, we have a NULL
-	// authentication method that we should use instead.
-	if len(cookie) == 0 {
-		_, _, err := c.sendCommand("AUTHENTICATE")
+	// If the controller was never successfully started, there's no
+	// connection to close.
+	if c.conn == nil {
+		return nil
+	}
+
+	// Acquiring the command mutex ensures no command is in flight. Any
+	// command waiting to be sent after us will see that we're stopping.
+	acquired := make(chan struct{})
+	go func() {
+		c.cmdMtx.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		defer c.cmdMtx.Unlock()
+		return c.closeConn()
+
+	// If the command doesn't complete in time, we'll close the connection
+	// anyway, which aborts it.
+	case <-c.clock.After(c.stopTimeout):
+		err := c.closeConn()
+
+		<-acquired
+		c.cmdMtx.Unlock()
+
 		return err
 	}
+}
 
-	// Authenticating using the SAFECOOKIE authentication method is a two
-	// step process. We'll kick off the authentication routine by sending
-	// the AUTHCHALLENGE command followed by a hex-encoded 32-byte nonce.
-	clientNonce := make([]byte, nonceLen)
-	if _, err := rand.Read(clientNonce); err != nil {
-		return fmt.Errorf("unable to generate client nonce: %v", err)
+// closeConn closes the connection to the Tor server, unless it was already
+// closed.
+func (c *Controller) closeConn() error {
+	if !atomic.CompareAndSwapInt32(&c.connClosed, 0, 1) {
+		return nil
 	}
 
-	cmd := fmt.Sprintf("AUTHCHALLENGE SAFECOOKIE %x", clientNonce)
-	_, reply, err := c.sendCommand(cmd)
+	return c.conn.Close()
+}
+
+// Ping checks whether the connection to the Tor server is still alive and
+// authenticated, by sending a side-effect free GETINFO command. A
+// ConnectionError is returned if the connection failed, in which case the
+// controller needs to reconnect.
+func (c *Controller) Ping() error {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return ErrNotAuthenticated
+	}
+
+	code, reply, err := c.sendCommand("GETINFO version")
 	if err != nil {
 		return err
 	}
 
-	// If successful, the reply from the server should be of the following
-	// format:
-	//
-	//	"250 AUTHCHALLENGE"
-	//		SP "SERVERHASH=" ServerHash
-	//		SP "SERVERNONCE=" ServerNonce
-	//		CRLF
-	//
-	// We're interested in retrieving the SERVERHASH and SERVERNONCE
-	// parameters, so we'll parse our reply to do so.
-	replyParams := parseTorReply(reply)
+	return checkOK(code, reply)
+}
 
-	// Once retrieved, we'll ensure these values are of proper length when
-	// decoded.
-	serverHash, ok := replyParams["SERVERHASH"]
-	if !ok {
-		return errors.New("server hash not found in reply")
-	}
-	decodedServerHash, err := hex.DecodeString(serverHash)
-	if err != nil {
-		return fmt.Errorf("unable to decode server hash: %v", err)
+// RawCommand sends an arbitrary command to the Tor server, and returns the code
+// and text of its reply, with each line separated by a newline. This allows
+// using features of the control protocol this package doesn't wrap yet. The
+// command is serialized with all other commands, such that it is safe to call
+// concurrently. If the server replies with a code other than success, the code
+// and reply are returned along with a ControlError.
+//
+// NOTE: The caller is responsible for parsing the reply. Commands spanning
+// multiple lines aren't supported, and commands altering the state of the
+// connection, such as SETEVENTS or QUIT, may interfere with the controller.
+func (c *Controller) RawCommand(cmd string) (int, string, error) {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return 0, "", ErrNotAuthenticated
 	}
-	if len(decodedServerHash) != sha256.Size {
-		return errors.New("invalid server hash length")
+
+	// A line break would make the Tor server read several commands, whose
+	// replies would then be mistaken for the replies to later commands.
+	if strings.ContainsAny(cmd, "\r\n") {
+		return 0, "", fmt.Errorf("command must not contain line " +
+			"breaks")
 	}
 
-	serverNonce, ok := replyParams["SERVERNONCE"]
-	if !ok {
-		return errors.New("server nonce not found in reply")
+	return c.sendCommand(cmd)
+}
+
+// TakeOwnership ties the lifetime of the Tor server to the control connection,
+// such that it exits once the connection is closed, e.g. when lnd launched the
+// Tor server itself and shouldn't leave it running after crashing. As the Tor
+// server then no longer needs to watch the process given by its
+// __OwningControllerProcess option, if any, the option is reset.
+func (c *Controller) TakeOwnership() error {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return ErrNotAuthenticated
 	}
-	decodedServerNonce, err := hex.DecodeString(serverNonce)
+
+	code, reply, err := c.sendCommand("TAKEOWNERSHIP")
 	if err != nil {
-		return fmt.Errorf("unable to decode server nonce: %v", err)
+		return err
 	}
-	if len(decodedServerNonce) != nonceLen {
-		return errors.New("invalid server nonce length")
+	if err := checkOK(code, reply); err != nil {
+		return err
 	}
 
-	// The server hash above was constructed by computing the HMAC-SHA256
-	// of the message composed of the cookie, client nonce, and server
-	// nonce. We'll redo this computation ourselves to ensure the integrity
-	// and authentication of the message.
-	hmacMessage := bytes.Join(
-		[][]byte{cookie, clientNonce, decodedServerNonce}, []byte{},
+	code, reply, err = c.sendCommand(
+		"RESETCONF __OwningControllerProcess",
 	)
-	computedServerHash := computeHMAC256(serverKey, hmacMessage)
-	if !hmac.Equal(computedServerHash, decodedServerHash) {
-		return fmt.Errorf("expected server hash %x, got %x",
-			decodedServerHash, computedServerHash)
+	if err != nil {
+		return err
 	}
 
-	// If the MAC check was successful, we'll proceed with the last step of
-	// the authentication routine. We'll now send the AUTHENTICATE command
-	// followed by a hex-encoded client hash constructed by computing the
-	// HMAC-SHA256 of the same message, but this time using the controller's
-	// key.
-	clientHash := computeHMAC256(controllerKey, hmacMessage)
-	if len(clientHash) != sha256.Size {
-		return errors.New("invalid client hash length")
-	}
+	return checkOK(code, reply)
+}
 
-	cmd = fmt.Sprintf("AUTHENTICATE %x", clientHash)
-	if _, _, err := c.sendCommand(cmd); err != nil {
-		return err
+// ListOnions returns the service IDs of the onion services currently served by
+// the Tor server. These include the onion services created by this control
+// connection, followed by the detached onion services, which outlive the
+// control connection that created them.
+func (c *Controller) ListOnions() ([]string, error) {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return nil, ErrNotAuthenticated
 	}
 
-	return nil
-}
+	current, err := c.getInfoList("onions/current")
+	if err != nil {
+		return nil, err
+	}
 
-// getAuthCookie retrieves the authentication cookie in bytes from the Tor
-// server. Cookie authentication must be enabled for this to work. The boolean
-func (c *Controller) getAuthCookie() ([]byte, error) {
-	// Retrieve the authentication methods currently supported by the Tor
-	// server.
-	authMethods, cookieFilePath, version, err := c.ProtocolInfo()
+	detached, err := c.getInfoList("onions/detached")
 	if err != nil {
 		return nil, err
 	}
 
-	// With the version retrieved, we'll cache it now in case it needs to be
-	// used later on.
-	c.version = version
+	return append(current, detached...), nil
+}
+
+// getInfoList queries the Tor server for the given GETINFO keyword, whose
+// value is a list of newline separated entries, and returns the entries.
+func (c *Controller) getInfoList(keyword string) ([]string, error) {
+	code, reply, err := c.sendCommand("GETINFO " + keyword)
+	if err != nil {
+		// The Tor server replies with an error if there are no onion
+		// services of the requested type.
+		if controlErr, ok := err.(*ControlError); ok &&
+			controlErr.Code == internalError &&
+			strings.Contains(controlErr.Reply, "No onion services") {
 
-	// Ensure that the Tor server supports the SAFECOOKIE authentication
-	// method or the NULL method. If NULL, we don't need the cookie info
-	// below this loop, so we just return.
-	safeCookieSupport := false
-	for _, authMethod := range authMethods {
-		if authMethod == "SAFECOOKIE" {
-			safeCookieSupport = true
-		}
-		if authMethod == "NULL" {
 			return nil, nil
 		}
+
+		return nil, err
+	}
+	if err := checkOK(code, reply); err != nil {
+		return nil, err
+	}
+
+	return parseGetInfoList(reply, keyword)
+}
+
+// parseGetInfoList extracts the entries of the list value of the given GETINFO
+// keyword from a reply. The value is either given on the keyword line itself
+// if it has a single entry, or in a data block following it otherwise.
+func parseGetInfoList(reply, keyword string) ([]string, error) {
+	lines := strings.Split(reply, "\n")
+
+	prefix := strings.ToUpper(keyword) + "="
+	for i, line := range lines {
+		if !strings.HasPrefix(strings.ToUpper(line), prefix) {
+			continue
+		}
+
+		var entries []string
+		if value := line[len(prefix):]; value != "" {
+			entries = append(entries, value)
+		}
+
+		// The data block, if any, spans the lines up to the final OK
+		// line, as we only query a single keyword.
+		for _, entry := range lines[i+1 : len(lines)-1] {
+			if entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+
+		return entries, nil
+	}
+
+	return nil, fmt.Errorf("reply doesn't contain %v: %v", keyword, reply)
+}
+
+// maxCircuitIDLen is the maximum length of a circuit ID.
+const maxCircuitIDLen = 16
+
+// ExtendCircuit extends the circuit with the given ID through the relays of
+// the given path, which are identified by their fingerprints, and returns the
+// ID of the circuit. If the circuit ID is empty or "0", a new circuit is built
+// instead, in which case the Tor server picks the path itself if none is
+// given.
+func (c *Controller) ExtendCircuit(circID string, path []string) (string,
+	error) {
+
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return "", ErrNotAuthenticated
+	}
+
+	if circID == "" {
+		circID = "0"
+	}
+	if err := validateCircuitID(circID); err != nil {
+		return "", err
+	}
+
+	cmd := "EXTENDCIRCUIT " + circID
+	if len(path) > 0 {
+		for _, fingerprint := range path {
+			if err := validateFingerprint(fingerprint); err != nil {
+				return "", err
+			}
+		}
+		cmd += " " + strings.Join(path, ",")
+	}
+
+	code, reply, err := c.sendCommand(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	// If successful, the reply from the server should be of the following
+	// format:
+	//
+	//	C: EXTENDCIRCUIT 0 $fingerprint1,$fingerprint2
+	//	S: 250 EXTENDED 12
+	//
+	// We're interested in retrieving the ID of the circuit.
+	fields := strings.Fields(reply)
+	if len(fields) != 2 || fields[0] != "EXTENDED" {
+		return "", &ControlError{Code: code, Reply: reply}
+	}
+	if err := validateCircuitID(fields[1]); err != nil {
+		return "", fmt.Errorf("invalid circuit id in reply: %v", err)
+	}
+
+	return fields[1], nil
+}
+
+// CloseCircuit closes the circuit with the given ID.
+func (c *Controller) CloseCircuit(circID string) error {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return ErrNotAuthenticated
+	}
+
+	if err := validateCircuitID(circID); err != nil {
+		return err
+	}
+
+	code, reply, err := c.sendCommand("CLOSECIRCUIT " + circID)
+	if err != nil {
+		return err
+	}
+
+	return checkOK(code, reply)
+}
+
+// validateCircuitID ensures the given circuit ID consists of 1 to 16
+// alphanumeric characters, as required by the control protocol.
+func validateCircuitID(circID string) error {
+	if len(circID) == 0 || len(circID) > maxCircuitIDLen {
+		return fmt.Errorf("circuit id %q must be between 1 and %d "+
+			"characters long", circID, maxCircuitIDLen)
+	}
+
+	for _, r := range circID {
+		isAlnum := (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') ||
+			(r >= 'A' && r <= 'Z')
+		if !isAlnum {
+			return fmt.Errorf("circuit id %q contains invalid "+
+				"character %q", circID, r)
+		}
+	}
+
+	return nil
+}
+
+// validateFingerprint ensures the given relay fingerprint consists of 40 hex
+// characters, optionally prefixed by a dollar sign.
+func validateFingerprint(fingerprint string) error {
+	fp := strings.TrimPrefix(fingerprint, "$")
+	if len(fp) != 2*sha1.Size {
+		return fmt.Errorf("invalid relay fingerprint %q", fingerprint)
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return fmt.Errorf("invalid relay fingerprint %q", fingerprint)
+	}
+
+	return nil
+}
+
+// sendCommand sends a command to the Tor server and returns its response, as a
+// single space-delimited string, and code. If the server replies with a code
+// other than success, a ControlError is returned, while failures of the
+// connection itself are returned as a ConnectionError. It is safe to call
+// concurrently.
+func (c *Controller) sendCommand(command string) (int, string, error) {
+	c.cmdMtx.Lock()
+	defer c.cmdMtx.Unlock()
+
+	if atomic.LoadInt32(&c.stopped) == 1 {
+		return 0, "", ErrControllerStopping
+	}
+
+	return c.roundTrip(command)
+}
+
+// roundTrip sends a command to the Tor server and reads its reply, converting
+// any failure into either a ControlError or a ConnectionError. The caller must
+// hold cmdMtx.
+func (c *Controller) roundTrip(command string) (int, string, error) {
+	if err := c.conn.Writer.PrintfLine("%s", command); err != nil {
+		return 0, "", &ConnectionError{Err: err}
+	}
+
+	// Once subscribed to events, all replies are read by the event
+	// stream, which hands us the replies to our commands.
+	var (
+		code  int
+		reply string
+		err   error
+	)
+	if c.stream != nil {
+		code, reply, err = c.stream.readReply()
+	} else {
+		code, reply, err = readReply(&c.conn.Reader, c.maxReplySize)
+	}
+	if err != nil {
+		return code, reply, c.replyError(err)
+	}
+
+	// Although readReply should have checked the code, we'll make sure we
+	// never proceed with an unsuccessful reply.
+	if code != success {
+		return code, reply, &ControlError{Code: code, Reply: reply}
+	}
+
+	return code, reply, nil
+}
+
+// replyError converts an error returned by readReply into our typed errors. An
+// unexpected code is reported as a textproto.Error, which is converted into a
+// ControlError, while any other error is a failure of the connection. If the
+// reply was too large, the connection is closed, as the rest of the reply left
+// unread would otherwise be mistaken for the reply to the next command.
+func (c *Controller) replyError(err error) error {
+	switch e := err.(type) {
+	case *textproto.Error:
+		return &ControlError{
+			Code:  e.Code,
+			Reply: e.Msg,
+		}
+
+	case *ReplyTooLargeError:
+		c.closeConn()
+		return e
+
+	default:
+		return &ConnectionError{Err: err}
+	}
+}
+
+// eventReply is a reply read from the Tor server while subscribed to
+// asynchronous events.
+type eventReply struct {
+	code  int
+	reply string
+	err   error
+}
+
+// eventWaiter is a private subscription to a type of asynchronous events,
+// waiting for an event matching a condition.
+type eventWaiter struct {
+	// eventType is the type of events the waiter is subscribed to.
+	eventType string
+
+	// match returns whether the given event is the one waited for.
+	match func(event string) bool
+
+	// matched is closed once a matching event was received.
+	matched chan struct{}
+}
+
+// waitForEvent subscribes to the given type of asynchronous events, and waits
+// until an event for which match returns true is received, or the context
+// expires. The subscription is private to the caller, and is removed before
+// returning. Other commands can be sent in the meantime, and the events are
+// only delivered to the subscriber of the event stream if it subscribed to
+// their type.
+func (c *Controller) waitForEvent(ctx context.Context, eventType string,
+	match func(event string) bool) error {
+
+	w := &eventWaiter{
+		eventType: eventType,
+		match:     match,
+		matched:   make(chan struct{}),
+	}
+	stream, err := c.addEventWaiter(w)
+	if err != nil {
+		return err
+	}
+
+	var waitErr error
+	select {
+	case <-w.matched:
+
+	// If the connection fails, there's no subscription left to remove.
+	case <-stream.quit:
+		return c.replyError(stream.err)
+
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
+
+	if err := c.removeEventWaiter(w); err != nil {
+		return err
+	}
+
+	return waitErr
+}
+
+// addEventWaiter registers the given waiter with the event stream, starting
+// it if needed, and subscribes to the waiter's type of events. The event
+// stream is returned.
+func (c *Controller) addEventWaiter(w *eventWaiter) (*eventStream, error) {
+	c.cmdMtx.Lock()
+	defer c.cmdMtx.Unlock()
+
+	if atomic.LoadInt32(&c.stopped) == 1 {
+		return nil, ErrControllerStopping
+	}
+
+	// The waiter is registered before subscribing, such that no event
+	// sent right after the subscription is missed.
+	c.startEventStream()
+	c.stream.addWaiter(w)
+	if err := c.setEvents(); err != nil {
+		c.stream.removeWaiter(w)
+		return nil, err
+	}
+
+	return c.stream, nil
+}
+
+// removeEventWaiter removes the given waiter from the event stream, and
+// unsubscribes from its type of events unless still needed by others.
+func (c *Controller) removeEventWaiter(w *eventWaiter) error {
+	c.cmdMtx.Lock()
+	defer c.cmdMtx.Unlock()
+
+	c.stream.removeWaiter(w)
+
+	// Once stopping, the connection is closed anyway.
+	if atomic.LoadInt32(&c.stopped) == 1 {
+		return nil
+	}
+
+	return c.setEvents()
+}
+
+// startEventStream starts reading all replies from the Tor server through the
+// event stream, unless already done. The caller must hold cmdMtx.
+func (c *Controller) startEventStream() {
+	if c.stream != nil {
+		return
+	}
+
+	c.stream = newEventStream(
+		c.eventBufferSize, &c.droppedEvents, c.recordEvent,
+	)
+	go c.stream.readLoop(&c.conn.Reader, c.maxReplySize)
+}
+
+// setEvents subscribes to the types of events needed by the subscriber of the
+// event stream and the event waiters, replacing the previous subscription. As
+// the Tor server only keeps a single set of events per connection, it must be
+// called whenever either changes. The caller must hold cmdMtx.
+func (c *Controller) setEvents() error {
+	eventTypes := c.stream.eventTypes()
+	cmd := strings.TrimSpace("SETEVENTS " + strings.Join(eventTypes, " "))
+	code, reply, err := c.roundTrip(cmd)
+	if err != nil {
+		return err
+	}
+
+	return checkOK(code, reply)
+}
+
+// eventStream reads all replies from the Tor server once events have been
+// subscribed to, passing the events to the subscriber, and the replies to
+// commands to the sender of the command.
+type eventStream struct {
+	// events holds the events not yet received by the subscriber. It is
+	// closed once the connection fails.
+	events chan string
+
+	// replies holds the reply to the command in flight. It is closed once
+	// the connection fails, after which err is set.
+	replies chan eventReply
+
+	// err is the error the connection failed with.
+	err error
+
+	// dropped counts the events dropped as the buffer was full.
+	dropped *uint64
+
+	// onEvent, if set, is called with each event as it is read, before
+	// it is buffered.
+	onEvent func(event string)
+
+	// quit is closed once the connection fails, after which err is set.
+	quit chan struct{}
+
+	// subscribed holds the types of events the subscriber subscribed to.
+	// Only events of these types are buffered.
+	subscribed []string
+
+	// waiters holds the private subscriptions waiting for an event.
+	waiters map[*eventWaiter]struct{}
+
+	// mtx guards subscribed and waiters.
+	mtx sync.Mutex
+}
+
+// newEventStream creates a new event stream buffering up to bufferSize events,
+// counting the dropped events in dropped. If onEvent is non-nil, it is called
+// with each event as it is read.
+func newEventStream(bufferSize int, dropped *uint64,
+	onEvent func(event string)) *eventStream {
+
+	if bufferSize < 1 {
+		bufferSize = DefaultEventBufferSize
+	}
+
+	return &eventStream{
+		events:  make(chan string, bufferSize),
+		replies: make(chan eventReply, 1),
+		dropped: dropped,
+		onEvent: onEvent,
+		quit:    make(chan struct{}),
+		waiters: make(map[*eventWaiter]struct{}),
+	}
+}
+
+// readLoop reads replies of at most maxSize bytes from the given reader until
+// it fails. Events are dispatched to the waiters and the buffer, while
+// anything else is the reply to the command in flight. It must be run as a
+// goroutine.
+func (s *eventStream) readLoop(r *textproto.Reader, maxSize int) {
+	defer close(s.quit)
+	defer close(s.events)
+	defer close(s.replies)
+
+	for {
+		code, reply, err := readReply(r, maxSize)
+		switch {
+		case code == asyncEvent:
+			if s.onEvent != nil {
+				s.onEvent(reply)
+			}
+			s.dispatch(reply)
+
+		// A textproto.Error is an unsuccessful reply to a command,
+		// while any other error is a failure of the connection, after
+		// which there's nothing left to read.
+		case err != nil:
+			if _, ok := err.(*textproto.Error); !ok {
+				s.err = err
+				return
+			}
+			fallthrough
+
+		default:
+			s.replies <- eventReply{code: code, reply: reply, err: err}
+		}
+	}
+}
+
+// dispatch notifies the waiters the given event matches, and pushes it to the
+// buffer if the subscriber subscribed to its type.
+func (s *eventStream) dispatch(event string) {
+	var eventType string
+	if fields := strings.Fields(event); len(fields) > 0 {
+		eventType = fields[0]
+	}
+
+	s.mtx.Lock()
+	for w := range s.waiters {
+		if w.eventType == eventType && w.match(event) {
+			close(w.matched)
+			delete(s.waiters, w)
+		}
+	}
+
+	var subscribed bool
+	for _, t := range s.subscribed {
+		if t == eventType {
+			subscribed = true
+			break
+		}
+	}
+	s.mtx.Unlock()
+
+	if subscribed {
+		s.push(event)
+	}
+}
+
+// setSubscribed replaces the types of events the subscriber subscribed to,
+// returning the previous ones.
+func (s *eventStream) setSubscribed(eventTypes []string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	prev := s.subscribed
+	s.subscribed = eventTypes
+	return prev
+}
+
+// addWaiter registers the given waiter, such that it is notified of the
+// first event it matches.
+func (s *eventStream) addWaiter(w *eventWaiter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.waiters[w] = struct{}{}
+}
+
+// removeWaiter removes the given waiter, if it wasn't notified yet.
+func (s *eventStream) removeWaiter(w *eventWaiter) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.waiters, w)
+}
+
+// eventTypes returns the types of events needed by the subscriber and the
+// waiters, in the order the subscriber gave them, followed by those only
+// needed by the waiters.
+func (s *eventStream) eventTypes() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	seen := make(map[string]struct{})
+	var eventTypes []string
+	for _, t := range s.subscribed {
+		seen[t] = struct{}{}
+		eventTypes = append(eventTypes, t)
+	}
+
+	var waiterTypes []string
+	for w := range s.waiters {
+		if _, ok := seen[w.eventType]; ok {
+			continue
+		}
+		seen[w.eventType] = struct{}{}
+		waiterTypes = append(waiterTypes, w.eventType)
+	}
+	sort.Strings(waiterTypes)
+
+	return append(eventTypes, waiterTypes...)
+}
+
+// push adds an event to the buffer. If the buffer is full, the oldest event is
+// dropped to make room for it, such that reading the replies to commands never
+// stalls on a slow subscriber.
+func (s *eventStream) push(event string) {
+	for {
+		select {
+		case s.events <- event:
+			return
+		default:
+		}
+
+		// The subscriber may have received an event in the meantime,
+		// in which case there's no need to drop one.
+		select {
+		case <-s.events:
+			atomic.AddUint64(s.dropped, 1)
+		default:
+		}
+	}
+}
+
+// readReply returns the reply to the command in flight, as returned by the
+// package-level readReply.
+func (s *eventStream) readReply() (int, string, error) {
+	r, ok := <-s.replies
+	if !ok {
+		return 0, "", s.err
+	}
+
+	return r.code, r.reply, r.err
+}
+
+// SubscribeEvents subscribes to the given types of asynchronous events, e.g.
+// "HS_DESC", replacing any previous subscription, and returns the channel the
+// events are delivered on, each as the lines of the event joined by newlines.
+// Commands can still be sent while subscribed, and WaitForOnion can be used
+// alongside, as its own subscription is kept separate. The same channel is
+// returned for every subscription of the connection, and is closed once the
+// connection fails or the controller is stopped. Passing no event types
+// removes the subscription.
+//
+// If the subscriber doesn't keep up, the oldest buffered events are dropped,
+// which is reflected by DroppedEvents.
+func (c *Controller) SubscribeEvents(eventTypes ...string) (<-chan string,
+	error) {
+
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return nil, ErrNotAuthenticated
+	}
+
+	// We'll make sure the event types are keywords before sending them,
+	// such that they can't alter the command.
+	for _, eventType := range eventTypes {
+		if !isKeyword(eventType) {
+			return nil, fmt.Errorf("invalid event type %q",
+				eventType)
+		}
+	}
+
+	c.cmdMtx.Lock()
+	defer c.cmdMtx.Unlock()
+
+	if atomic.LoadInt32(&c.stopped) == 1 {
+		return nil, ErrControllerStopping
+	}
+
+	// Once subscribed for the first time, the Tor server may send events
+	// at any time, so from now on all replies are read by the stream. The
+	// event types are updated before subscribing, such that no event sent
+	// right after the subscription is missed.
+	c.startEventStream()
+	prev := c.stream.setSubscribed(eventTypes)
+	if err := c.setEvents(); err != nil {
+		c.stream.setSubscribed(prev)
+		return nil, err
+	}
+
+	return c.stream.events, nil
+}
+
+// DroppedEvents returns the number of events dropped since the controller was
+// created, as the subscriber of the event stream didn't keep up.
+func (c *Controller) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&c.droppedEvents)
+}
+
+// isKeyword returns whether the given string is a non-empty keyword of the
+// control protocol, consisting of uppercase letters, digits and underscores.
+func isKeyword(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// readReply reads a reply from the Tor server, which may span multiple lines,
+// and returns its code along with the lines of the reply joined by newlines.
+// Besides the mid reply lines handled by textproto's ReadResponse, Tor also
+// sends data reply lines of the form "250+keyword=", which are followed by a
+// dot-encoded data block. The lines of the data block are included in the
+// returned reply following their keyword line. If the code is not success, a
+// textproto.Error is returned. If the reply exceeds maxSize bytes, a
+// ReplyTooLargeError is returned. Zero or negative means unlimited.
+func readReply(r *textproto.Reader, maxSize int) (int, string, error) {
+	var (
+		code  int
+		lines []string
+	)
+	rr := &replyReader{r: r.R, maxSize: maxSize}
+	for {
+		line, err := rr.readLine()
+		if err != nil {
+			return 0, "", err
+		}
+
+		if len(line) < 4 {
+			return 0, "", textproto.ProtocolError(
+				"short response: " + line,
+			)
+		}
+
+		lineCode, err := strconv.Atoi(line[:3])
+		if err != nil || (code != 0 && lineCode != code) {
+			return 0, "", textproto.ProtocolError(
+				"invalid response code: " + line,
+			)
+		}
+		code = lineCode
+		lines = append(lines, line[4:])
+
+		switch line[3] {
+		// A space indicates the final line of the reply.
+		case ' ':
+			reply := strings.Join(lines, "\n")
+			if code != success {
+				return code, reply, &textproto.Error{
+					Code: code,
+					Msg:  reply,
+				}
+			}
+
+			return code, reply, nil
+
+		// A dash indicates a mid reply line.
+		case '-':
+
+		// A plus indicates a data reply line, followed by a data
+		// block terminated by a single dot.
+		case '+':
+			data, err := rr.readDotLines()
+			if err != nil {
+				return 0, "", err
+			}
+			lines = append(lines, data...)
+
+		default:
+			return 0, "", textproto.ProtocolError(
+				"invalid response: " + line,
+			)
+		}
+	}
+}
+
+// replyReader reads the lines of a single reply from the Tor server, keeping
+// track of the size of the reply. Unlike textproto's reader, it fails as soon
+// as the reply exceeds the maximum size, even in the middle of a line, such
+// that a misbehaving server can't make us buffer an unbounded amount of data.
+type replyReader struct {
+	r *bufio.Reader
+
+	// maxSize is the maximum size of the reply in bytes. Zero or negative
+	// means unlimited.
+	maxSize int
+
+	// size is the number of bytes of the reply read so far.
+	size int
+}
+
+// readLine reads a single line, without its trailing line break.
+func (rr *replyReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := rr.r.ReadSlice('\n')
+		rr.size += len(chunk)
+		if rr.maxSize > 0 && rr.size > rr.maxSize {
+			return "", &ReplyTooLargeError{MaxSize: rr.maxSize}
+		}
+		line = append(line, chunk...)
+
+		// The line doesn't fit in the buffer of the reader, so we'll
+		// keep reading until we reach its end.
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		return string(line), nil
+	}
+}
+
+// readDotLines reads a dot-encoded data block, as textproto's ReadDotLines,
+// returning its lines without the terminating dot line. Leading dots escaped
+// by doubling them are unescaped.
+func (rr *replyReader) readDotLines() ([]string, error) {
+	var lines []string
+	for {
+		line, err := rr.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "." {
+			return lines, nil
+		}
+		lines = append(lines, strings.TrimPrefix(line, "."))
+	}
+}
+
+// checkOK ensures that the reply to a command ends with an "OK" line, as
+// expected for commands that don't reply with any values on their final line.
+// Otherwise, the reply is returned as a ControlError.
+func checkOK(code int, reply string) error {
+	lines := strings.Split(reply, "\n")
+	if lines[len(lines)-1] != "OK" {
+		return &ControlError{Code: code, Reply: reply}
+	}
+
+	return nil
+}
+
+// parseTorReply parses the reply from the Tor server after receiving a command
+// from a controller. This will parse the relevant reply parameters into a map
+// of keys and values. As keywords are case-insensitive, the keys are
+// normalized to uppercase.
+func parseTorReply(reply string) map[string]string {
+	params := make(map[string]string)
+
+	// Replies can either span single or multiple lines, so we'll default
+	// to stripping whitespace and newlines in order to retrieve the
+	// individual contents of it. The -1 indicates that we want this to span
+	// across all instances of a newline.
+	contents := strings.Split(strings.Replace(reply, "\n", " ", -1), " ")
+	for _, content := range contents {
+		// Each parameter within the reply should be of the form
+		// "KEY=VALUE". If the parameter doesn't contain "=", then we
+		// can assume it does not provide any other relevant information
+		// already known.
+		keyValue := strings.SplitN(content, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+
+		key := strings.ToUpper(keyValue[0])
+		value := keyValue[1]
+		params[key] = value
+	}
+
+	return params
+}
+
+// authenticate authenticates the connection between the controller and the
+// Tor server using the SAFECOOKIE or NULL authentication method.
+func (c *Controller) authenticate() error {
+	// Before proceeding to authenticate the connection, we'll retrieve
+	// the authentication cookie of the Tor server. This will be used
+	// throughout the authentication routine. We do this before as once the
+	// authentication routine has begun, it is not possible to retrieve it
+	// mid-way.
+	//
+	// Errors caused by the configuration of the Tor server or the
+	// permissions of its cookie file are returned as is, such that callers
+	// can tell them apart.
+	cookie, err := c.getAuthCookie()
+	if _, ok := err.(*CookieFileError); ok || err == ErrCookieAuthDisabled {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("unable to retrieve authentication cookie: "+
+			"%v", err)
+	}
+
+	// If cookie is empty and there's no error, we have a NULL
+	// authentication method that we should use instead.
+	if len(cookie) == 0 {
+		code, reply, err := c.sendCommand("AUTHENTICATE")
+		if err != nil {
+			return err
+		}
+
+		return checkOK(code, reply)
+	}
+
+	// Authenticating using the SAFECOOKIE authentication method is a two
+	// step process. We'll kick off the authentication routine by sending
+	// the AUTHCHALLENGE command followed by a hex-encoded 32-byte nonce.
+	// Transient failures are retried with a fresh nonce.
+	var (
+		clientNonce []byte
+		reply       string
+	)
+	for attempt := 0; ; attempt++ {
+		clientNonce, reply, err = c.authChallenge()
+		if err == nil {
+			break
+		}
+
+		if attempt >= c.authChallengeRetries || !isTransientError(err) {
+			return err
+		}
+	}
+
+	// If successful, the reply from the server should be of the following
+	// format:
+	//
+	//	"250 AUTHCHALLENGE"
+	//		SP "SERVERHASH=" ServerHash
+	//		SP "SERVERNONCE=" ServerNonce
+	//		CRLF
+	//
+	// We're interested in retrieving the SERVERHASH and SERVERNONCE
+	// parameters, so we'll parse our reply to do so.
+	replyParams := parseTorReply(reply)
+
+	// Once retrieved, we'll ensure these values are of proper length when
+	// decoded.
+	serverHash, ok := replyParams["SERVERHASH"]
+	if !ok {
+		return errors.New("server hash not found in reply")
+	}
+	decodedServerHash, err := hex.DecodeString(serverHash)
+	if err != nil {
+		return fmt.Errorf("unable to decode server hash: %v", err)
+	}
+	if len(decodedServerHash) != sha256.Size {
+		return errors.New("invalid server hash length")
+	}
+
+	serverNonce, ok := replyParams["SERVERNONCE"]
+	if !ok {
+		return errors.New("server nonce not found in reply")
+	}
+	decodedServerNonce, err := hex.DecodeString(serverNonce)
+	if err != nil {
+		return fmt.Errorf("unable to decode server nonce: %v", err)
+	}
+	if len(decodedServerNonce) != nonceLen {
+		return errors.New("invalid server nonce length")
+	}
+
+	// The server hash above was constructed by computing the HMAC-SHA256
+	// of the message composed of the cookie, client nonce, and server
+	// nonce. We'll redo this computation ourselves to ensure the integrity
+	// and authentication of the message.
+	hmacMessage := bytes.Join(
+		[][]byte{cookie, clientNonce, decodedServerNonce}, []byte{},
+	)
+	if !verifyHMAC256(serverKey, hmacMessage, decodedServerHash) {
+		return fmt.Errorf("server hash %x doesn't match the expected "+
+			"hash", decodedServerHash)
+	}
+
+	// If the MAC check was successful, we'll proceed with the last step of
+	// the authentication routine. We'll now send the AUTHENTICATE command
+	// followed by a hex-encoded client hash constructed by computing the
+	// HMAC-SHA256 of the same message, but this time using the controller's
+	// key.
+	clientHash := computeHMAC256(controllerKey, hmacMessage)
+	if len(clientHash) != sha256.Size {
+		return errors.New("invalid client hash length")
 	}
 
-	if !safeCookieSupport {
-		return nil, errors.New("the Tor server is currently not " +
-			"configured for cookie or null authentication")
+	cmd := fmt.Sprintf("AUTHENTICATE %x", clientHash)
+	code, reply, err := c.sendCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	return checkOK(code, reply)
+}
+
+// authChallenge sends the AUTHCHALLENGE command to the Tor server, along with a
+// freshly generated client nonce. The nonce and the reply are returned.
+func (c *Controller) authChallenge() ([]byte, string, error) {
+	randSource := c.randSource
+	if randSource == nil {
+		randSource = rand.Reader
+	}
+
+	clientNonce := make([]byte, nonceLen)
+	if _, err := io.ReadFull(randSource, clientNonce); err != nil {
+		return nil, "", fmt.Errorf("unable to generate client nonce: "+
+			"%v", err)
+	}
+
+	cmd := fmt.Sprintf("AUTHCHALLENGE SAFECOOKIE %x", clientNonce)
+	code, reply, err := c.sendCommand(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.HasPrefix(strings.ToUpper(reply), "AUTHCHALLENGE ") {
+		return nil, "", &ControlError{Code: code, Reply: reply}
+	}
+
+	return clientNonce, reply, nil
+}
+
+// isTransientError returns whether the given error returned when sending a
+// command might not occur again when retrying. This is only the case for
+// clean replies indicating a temporary failure of the Tor server. Connection
+// errors aren't retried, as the connection may have been left in the middle
+// of a reply, which would desync any following replies from their requests.
+func isTransientError(err error) bool {
+	controlErr, ok := err.(*ControlError)
+	if !ok {
+		return false
 	}
 
-	// Read the cookie from the file and ensure it has the correct length.
-	cookie, err := ioutil.ReadFile(cookieFilePath)
+	return controlErr.Code == resourceExhausted ||
+		controlErr.Code == internalError
+}
+
+// getAuthCookie retrieves the authentication cookie in bytes from the Tor
+// server. Cookie authentication must be enabled for this to work. The boolean
+func (c *Controller) getAuthCookie() ([]byte, error) {
+	// Retrieve the authentication methods currently supported by the Tor
+	// server.
+	authMethods, cookieFilePath, version, err := c.ProtocolInfo()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(cookie) != cookieLen {
-		return nil, errors.New("invalid authentication cookie length")
+	// With the version retrieved, we'll cache it now in case it needs to be
+	// used later on. It may be empty if the Tor server didn't advertise
+	// it, which is only an issue once a v3 onion service is requested.
+	c.version = version
+
+	// Ensure that the Tor server supports the SAFECOOKIE authentication
+	// method or the NULL method. If NULL, we don't need the cookie info
+	// below this loop, so we just return.
+	safeCookieSupport := false
+	for _, authMethod := range authMethods {
+		if authMethod == "SAFECOOKIE" {
+			safeCookieSupport = true
+		}
+		if authMethod == "NULL" {
+			return nil, nil
+		}
+	}
+
+	if !safeCookieSupport {
+		return nil, ErrCookieAuthDisabled
+	}
+
+	// The path reported by the Tor server might not be the one the file is
+	// visible at to us, in which case it can be overridden.
+	if c.cookieFilePath != "" {
+		cookieFilePath = c.cookieFilePath
+	}
+
+	return readAuthCookie(c.clock, cookieFilePath, c.cookieReadTimeout)
+}
+
+// readAuthCookie reads the authentication cookie from the given file and
+// ensures it has the correct length. If the file can't be read within the
+// given timeout, as measured by the given clock, an error is returned. Zero
+// means no timeout.
+func readAuthCookie(clk clock.Clock, path string,
+	timeout time.Duration) ([]byte, error) {
+
+	contents, err := readFileTimeout(clk, ioutil.ReadFile, path, timeout)
+	if err != nil {
+		return nil, cookieFileError(path, err)
+	}
+
+	return decodeAuthCookie(contents)
+}
+
+// readFileTimeout reads the file at the given path using the given function,
+// giving up once the timeout expires according to the given clock. Zero means
+// no timeout. As a read blocked on a stalled filesystem can't be interrupted,
+// it is left to complete in the background.
+func readFileTimeout(clk clock.Clock, readFile func(string) ([]byte, error),
+	path string, timeout time.Duration) ([]byte, error) {
+
+	if timeout <= 0 {
+		return readFile(path)
+	}
+
+	type result struct {
+		contents []byte
+		err      error
+	}
+
+	// The channel is buffered, such that the goroutine can exit even if
+	// we've given up on the read.
+	resultChan := make(chan result, 1)
+	go func() {
+		contents, err := readFile(path)
+		resultChan <- result{contents, err}
+	}()
+
+	select {
+	case r := <-resultChan:
+		return r.contents, r.err
+
+	case <-clk.After(timeout):
+		return nil, fmt.Errorf("read timed out after %v", timeout)
+	}
+}
+
+// decodeAuthCookie returns the authentication cookie stored in the contents of
+// a cookie file. Tor stores the raw cookie, but some deployments store it hex
+// or base64 encoded instead. As the encoded forms are longer than the raw
+// cookie, the raw form is tried first, followed by hex and base64.
+func decodeAuthCookie(contents []byte) ([]byte, error) {
+	if len(contents) == cookieLen {
+		return contents, nil
+	}
+
+	// Encoded cookies may be followed by a newline.
+	encoded := strings.TrimSpace(string(contents))
+
+	if cookie, err := hex.DecodeString(encoded); err == nil &&
+		len(cookie) == cookieLen {
+
+		return cookie, nil
+	}
+
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+	} {
+		cookie, err := encoding.DecodeString(encoded)
+		if err == nil && len(cookie) == cookieLen {
+			return cookie, nil
+		}
+	}
+
+	return nil, errors.New("invalid authentication cookie length")
+}
+
+// cookieFileError wraps an error encountered while reading the authentication
+// cookie file in a CookieFileError. If the file can't be read due to its
+// permissions, its mode is also retrieved.
+func cookieFileError(path string, err error) error {
+	cookieErr := &CookieFileError{
+		Path: path,
+		Err:  err,
+		mode: "unknown",
+	}
+	if !os.IsPermission(err) {
+		return cookieErr
+	}
+
+	if info, statErr := os.Stat(path); statErr == nil {
+		cookieErr.mode = info.Mode().String()
 	}
 
-	return cookie, nil
+	return cookieErr
 }
 
 // computeHMAC256 computes the HMAC-SHA256 of a key and message.
@@ -318,6 +1809,17 @@ func computeHMAC256(key, message []byte) []byte {
 	return mac.Sum(nil)
 }
 
+// verifyHMAC256 returns whether the expected MAC is the HMAC-SHA256 of the key
+// and message. The comparison is done in constant time, such that it doesn't
+// leak how much of the expected MAC matches.
+func verifyHMAC256(key, message, expected []byte) bool {
+	if len(expected) != sha256.Size {
+		return false
+	}
+
+	return hmac.Equal(computeHMAC256(key, message), expected)
+}
+
 // supportsV3 is a helper function that parses the current version of the Tor
 // server and determines whether it supports creationg v3 onion services through
 // Tor's control port. The version string should be of the format:
@@ -350,146 +1852,641 @@ func supportsV3(version string) error {
 			return err
 		}
 
-		if n < requiredN {
-			return fmt.Errorf("version %v below minimum version "+
-				"supported %v", version, MinTorVersion)
-		}
+		if n < requiredN {
+			return fmt.Errorf("version %v below minimum version "+
+				"supported %v", version, MinTorVersion)
+		}
+	}
+
+	return nil
+}
+
+// ProtocolInfo returns the different authentication methods supported by the
+// Tor server and the version of the Tor server. Unlike other commands, it can
+// be sent before the connection has been authenticated. As some stripped-down
+// Tor builds don't advertise their version, the returned version may be empty.
+func (c *Controller) ProtocolInfo() ([]string, string, string, error) {
+	// We'll start off by sending the "PROTOCOLINFO" command to the Tor
+	// server. We should receive a reply of the following format:
+	//
+	//	PROTOCOLINFO 1
+	//	AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/home/user/.tor/control_auth_cookie"
+	//	VERSION Tor="0.3.2.10"
+	//	OK
+	//
+	// We're interested in retrieving all of these fields, so we'll parse
+	// our reply to do so.
+	cmd := fmt.Sprintf("PROTOCOLINFO %d", ProtocolInfoVersion)
+	code, reply, err := c.sendCommand(cmd)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := checkOK(code, reply); err != nil {
+		return nil, "", "", err
+	}
+
+	info, err := parseProtocolInfo(reply)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return info.authMethods, info.cookieFile, info.version, nil
+}
+
+// protocolInfo holds the fields of a PROTOCOLINFO reply.
+type protocolInfo struct {
+	// authMethods are the authentication methods supported by the Tor
+	// server.
+	authMethods []string
+
+	// cookieFile is the path of the authentication cookie file. It is
+	// only required if the NULL authentication method isn't supported.
+	cookieFile string
+
+	// version is the version of the Tor server. It is empty if the Tor
+	// server didn't advertise it.
+	version string
+}
+
+// parseProtocolInfo parses the reply to a PROTOCOLINFO command line by line.
+// Lines other than the AUTH and VERSION lines are ignored, such that future
+// additions to the reply don't break the parsing. A missing VERSION line isn't
+// an error, as some stripped-down Tor builds omit it.
+func parseProtocolInfo(reply string) (*protocolInfo, error) {
+	var (
+		info         protocolInfo
+		foundMethods bool
+	)
+	for _, line := range strings.Split(reply, "\n") {
+		keyword := line
+		var rest string
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			keyword, rest = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(keyword) {
+		case "AUTH":
+			params, err := parseKeyValues(rest)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse AUTH "+
+					"line: %v", err)
+			}
+
+			methods, ok := params["METHODS"]
+			if !ok {
+				continue
+			}
+			info.authMethods = strings.Split(
+				strings.ToUpper(methods), ",",
+			)
+			info.cookieFile = params["COOKIEFILE"]
+			foundMethods = true
+
+		case "VERSION":
+			params, err := parseKeyValues(rest)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse "+
+					"VERSION line: %v", err)
+			}
+
+			info.version = params["TOR"]
+		}
+	}
+
+	if !foundMethods {
+		return nil, errors.New("auth methods not found in reply")
+	}
+
+	nullAuth := false
+	for _, method := range info.authMethods {
+		if method == "NULL" {
+			nullAuth = true
+		}
+	}
+	if info.cookieFile == "" && !nullAuth {
+		return nil, errors.New("cookie file path not found in reply")
+	}
+
+	return &info, nil
+}
+
+// parseKeyValues parses a space-delimited sequence of KEY=VALUE pairs, where
+// each value is either a plain string, or a quoted string which may contain
+// spaces and backslash-escaped characters. As keywords are case-insensitive,
+// the keys are normalized to uppercase.
+func parseKeyValues(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return params, nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			// Parameters without a value are flags we're not
+			// interested in.
+			if i := strings.IndexByte(s, ' '); i >= 0 {
+				s = s[i:]
+				continue
+			}
+			return params, nil
+		}
+
+		key := strings.ToUpper(s[:eq])
+		s = s[eq+1:]
+
+		// Plain values extend until the next space.
+		if !strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			params[key] = s[:end]
+			s = s[end:]
+			continue
+		}
+
+		// Quoted values extend until the next unescaped quote.
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return nil, fmt.Errorf("unterminated quoted value for "+
+				"%v", key)
+		}
+
+		value, err := unquoteControlString(s[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted value for "+
+				"%v: %v", key, err)
+		}
+
+		params[key] = value
+		s = s[end+1:]
+	}
+}
+
+// unquoteControlString is the inverse of escapeControlString, returning the
+// contents of the given quoted string with its escaped characters restored.
+// Besides the escapes produced by escapeControlString, the Tor server escapes
+// tabs as \t, and any other non-printable or non-ASCII byte, e.g. those of a
+// UTF-8 encoded path, as up to three octal digits.
+func unquoteControlString(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", fmt.Errorf("%q is not a quoted string", s)
+	}
+	quoted := s[1 : len(s)-1]
+
+	var b bytes.Buffer
+	b.Grow(len(quoted))
+	for i := 0; i < len(quoted); i++ {
+		c := quoted[i]
+		switch {
+		case c == '"':
+			return "", fmt.Errorf("unescaped quote in %v", s)
+
+		case c != '\\':
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(quoted) {
+			return "", fmt.Errorf("unterminated escape in %v", s)
+		}
+
+		if !isOctalDigit(quoted[i]) {
+			b.WriteByte(unescapeByte(quoted[i]))
+			continue
+		}
+
+		// Octal escapes consist of up to three digits, and must fit in
+		// a single byte.
+		var v int
+		j := i
+		for j < len(quoted) && j < i+3 && isOctalDigit(quoted[j]) {
+			v = v*8 + int(quoted[j]-'0')
+			j++
+		}
+		if v > 0xff {
+			return "", fmt.Errorf("invalid octal escape \\%v in %v",
+				quoted[i:j], s)
+		}
+
+		b.WriteByte(byte(v))
+		i = j - 1
+	}
+
+	return b.String(), nil
+}
+
+// isOctalDigit returns whether the given character is an octal digit.
+func isOctalDigit(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// escapeControlString returns the given string as a quoted string, as used by
+// the control protocol for values that may contain spaces or special
+// characters, such as paths and passwords. Backslashes and double quotes are
+// escaped with a backslash, while carriage returns and line feeds are escaped
+// as in C, such that they can't terminate the command.
+func escapeControlString(s string) string {
+	var b bytes.Buffer
+	b.Grow(len(s) + 2)
+
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\n':
+			b.WriteString(`\n`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// unescapeByte returns the character represented by the given byte following
+// a backslash in a quoted string.
+func unescapeByte(c byte) byte {
+	switch c {
+	case 'r':
+		return '\r'
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	default:
+		return c
+	}
+}
+
+// OnionType denotes the type of the onion service.
+type OnionType int
+
+const (
+	// V2 denotes that the onion service is V2.
+	V2 OnionType = iota
+
+	// V3 denotes that the onion service is V3.
+	V3
+)
+
+// String returns a human readable description of the onion service type.
+func (t OnionType) String() string {
+	switch t {
+	case V2:
+		return "v2"
+	case V3:
+		return "v3"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+const (
+	// rsa1024KeyBits is the size in bits of the RSA private keys of v2
+	// onion services.
+	rsa1024KeyBits = 1024
+
+	// ed25519ExpandedKeyLen is the length in bytes of the expanded ed25519
+	// secret keys of v3 onion services.
+	ed25519ExpandedKeyLen = 64
+)
+
+// AddOnionConfig houses all of the required paramaters in order to succesfully
+// create a new onion service or restore an existing one.
+type AddOnionConfig struct {
+	// Type denotes the type of the onion service that should be created.
+	Type OnionType
+
+	// VirtualPort is the externally reachable port of the onion address.
+	VirtualPort int
+
+	// TargetPorts is the set of ports that the service will be listening on
+	// locally. The Tor server will use choose a random port from this set
+	// to forward the traffic from the virtual port.
+	//
+	// NOTE: If nil/empty, the virtual port will be used as the only target
+	// port.
+	TargetPorts []int
+
+	// PrivateKeyPath is the full path to where the onion service's private
+	// key is stored. This can be used to restore an existing onion service.
+	//
+	// NOTE: If empty, and no PrivateKey is set, an ephemeral onion service
+	// will be created, whose private key is discarded.
+	PrivateKeyPath string
+
+	// CorruptKeyPolicy determines how a file at PrivateKeyPath that
+	// doesn't hold a well formed private key is handled, e.g. an empty
+	// file left behind by a crash while writing it. By default, an error
+	// is returned.
+	CorruptKeyPolicy CorruptKeyPolicy
+
+	// PrivateKey is the private key of an existing onion service, in the
+	// format returned by the Tor server, e.g. "ED25519-V3:<blob>". This
+	// can be used to restore an existing onion service from a key held in
+	// memory. If set, it takes precedence over PrivateKeyPath, which is
+	// neither read from nor written to.
+	PrivateKey OnionPrivateKey
+
+	// ClientAuth is the set of clients authorized to access the onion
+	// service using basic authorization. If non-empty, only these clients
+	// will be able to connect to the onion service.
+	//
+	// NOTE: This is only supported for v2 onion services.
+	ClientAuth []OnionClientAuth
+}
+
+// CorruptKeyPolicy determines how AddOnion handles a private key file that
+// doesn't hold a well formed private key.
+type CorruptKeyPolicy uint8
+
+const (
+	// CorruptKeyFail returns an error describing the problem with the
+	// private key file, leaving it to the user to fix or remove it. This
+	// is the default policy.
+	CorruptKeyFail CorruptKeyPolicy = iota
+
+	// CorruptKeyRecreate creates a new onion service instead, whose
+	// private key replaces the corrupt file. As the onion address of the
+	// service changes, this should only be used if the address doesn't
+	// need to be stable.
+	//
+	// NOTE: A well formed private key of the wrong onion type is never
+	// replaced, as it is more likely the result of a misconfiguration
+	// than of a corrupt file.
+	CorruptKeyRecreate
+)
+
+// maxClientNameLen is the maximum length of the name of a client authorized to
+// access an onion service.
+const maxClientNameLen = 16
+
+// OnionClientAuth is a client authorized to access a v2 onion service using
+// basic authorization.
+type OnionClientAuth struct {
+	// Name is the name of the client. It must consist of 1 to 16
+	// alphanumeric characters, '+', '-' or '_'.
+	Name string
+
+	// Cookie is the base64 encoded authorization cookie of the client.
+	// If empty, the Tor server will generate one.
+	Cookie string
+}
+
+// validate ensures the client can be safely included in the ADD_ONION command.
+func (a OnionClientAuth) validate() error {
+	if len(a.Name) == 0 || len(a.Name) > maxClientNameLen {
+		return fmt.Errorf("client name %q must be between 1 and %d "+
+			"characters", a.Name, maxClientNameLen)
+	}
+
+	for _, r := range a.Name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '+', r == '-', r == '_':
+
+		default:
+			return fmt.Errorf("client name %q contains invalid "+
+				"character %q", a.Name, r)
+		}
+	}
+
+	// We don't include the cookie in the error, as it is a secret.
+	if strings.ContainsAny(a.Cookie, " \t\r\n") {
+		return fmt.Errorf("authorization cookie of client %v must "+
+			"not contain whitespace", a.Name)
+	}
+
+	return nil
+}
+
+// Command returns the ADD_ONION command that AddOnion would send to the Tor
+// server for this config, performing the same validation. If the private key
+// of an existing onion service is used, it is included in the command, so the
+// command must be handled with care.
+func (cfg AddOnionConfig) Command() (string, error) {
+	// We'll start by building the mapping from the virtual port to each
+	// target port, which also ensures all ports are valid.
+	portParam, err := onionPortParam(cfg.VirtualPort, cfg.TargetPorts)
+	if err != nil {
+		return "", err
+	}
+
+	keyParam, flags, err := cfg.keyParams()
+	if err != nil {
+		return "", err
+	}
+
+	clientAuthParam, err := cfg.clientAuthParam()
+	if err != nil {
+		return "", err
+	}
+	if clientAuthParam != "" {
+		flags = append(flags, "BasicAuth")
+	}
+
+	var flagsParam string
+	if len(flags) > 0 {
+		flagsParam = "Flags=" + strings.Join(flags, ",") + " "
 	}
 
-	return nil
+	return fmt.Sprintf(
+		"ADD_ONION %s %s%s%s", keyParam, flagsParam, portParam,
+		clientAuthParam,
+	), nil
 }
 
-// ProtocolInfo returns the different authentication methods supported by the
-// Tor server and the version of the Tor server.
-func (c *Controller) ProtocolInfo() ([]string, string, string, error) {
-	// We'll start off by sending the "PROTOCOLINFO" command to the Tor
-	// server. We should receive a reply of the following format:
-	//
-	//	METHODS=COOKIE,SAFECOOKIE
-	//	COOKIEFILE="/home/user/.tor/control_auth_cookie"
-	//	VERSION Tor="0.3.2.10"
-	//
-	// We're interested in retrieving all of these fields, so we'll parse
-	// our reply to do so.
-	cmd := fmt.Sprintf("PROTOCOLINFO %d", ProtocolInfoVersion)
-	_, reply, err := c.sendCommand(cmd)
-	if err != nil {
-		return nil, "", "", err
+// clientAuthParam returns the ClientAuth parameters of the ADD_ONION command
+// for this config, each including a trailing space. Client authorization is
+// only supported for v2 onion services.
+func (cfg AddOnionConfig) clientAuthParam() (string, error) {
+	if len(cfg.ClientAuth) == 0 {
+		return "", nil
 	}
 
-	info := parseTorReply(reply)
-	methods, ok := info["METHODS"]
-	if !ok {
-		return nil, "", "", errors.New("auth methods not found in " +
-			"reply")
+	if cfg.Type != V2 {
+		return "", errors.New("client authorization is only " +
+			"supported for v2 onion services")
 	}
 
-	cookieFile, ok := info["COOKIEFILE"]
-	if !ok && !strings.Contains(methods, "NULL") {
-		return nil, "", "", errors.New("cookie file path not found " +
-			"in reply")
+	var param string
+	seen := make(map[string]struct{}, len(cfg.ClientAuth))
+	for _, auth := range cfg.ClientAuth {
+		if err := auth.validate(); err != nil {
+			return "", err
+		}
+
+		if _, ok := seen[auth.Name]; ok {
+			return "", fmt.Errorf("duplicate client %v", auth.Name)
+		}
+		seen[auth.Name] = struct{}{}
+
+		param += "ClientAuth=" + auth.Name
+		if auth.Cookie != "" {
+			param += ":" + auth.Cookie
+		}
+		param += " "
 	}
 
-	version, ok := info["Tor"]
-	if !ok {
-		return nil, "", "", errors.New("Tor version not found in reply")
+	return param, nil
+}
+
+// keyParams returns the key parameter of the ADD_ONION command for this
+// config, along with the flags required by the choice of key.
+func (cfg AddOnionConfig) keyParams() (string, []string, error) {
+	var newKeyParam string
+	switch cfg.Type {
+	case V2:
+		newKeyParam = "NEW:RSA1024"
+	case V3:
+		newKeyParam = "NEW:ED25519-V3"
+	default:
+		return "", nil, fmt.Errorf("unknown onion type %d", cfg.Type)
 	}
 
-	// Finally, we'll clean up the results before returning them.
-	authMethods := strings.Split(methods, ",")
-	cookieFilePath := strings.Trim(cookieFile, "\"")
-	torVersion := strings.Trim(version, "\"")
+	// If the private key was given directly, we'll use it as is to
+	// restore the onion service, without touching the disk. As with a key
+	// read from disk, we'll make sure it is well formed and of the
+	// expected type first.
+	if cfg.PrivateKey != "" {
+		if err := validatePrivateKey(cfg.PrivateKey); err != nil {
+			return "", nil, err
+		}
+		err := validateKeyBlob(cfg.Type, cfg.PrivateKey)
+		if err != nil {
+			return "", nil, err
+		}
 
-	return authMethods, cookieFilePath, torVersion, nil
-}
+		return string(cfg.PrivateKey), nil, nil
+	}
 
-// OnionType denotes the type of the onion service.
-type OnionType int
+	// If no private key path was specified, the onion service is
+	// ephemeral, so we'll request a new one and ask the server to discard
+	// its private key.
+	if cfg.PrivateKeyPath == "" {
+		return newKeyParam, []string{"DiscardPK"}, nil
+	}
 
-const (
-	// V2 denotes that the onion service is V2.
-	V2 OnionType = iota
+	// Otherwise, we'll check if the file containing the private key
+	// exists. If it does not, then we should request the server to create
+	// a new onion service and return its private key. If it does, we'll
+	// request the server to recreate the onion service from our private
+	// key.
+	privateKey, err := ioutil.ReadFile(cfg.PrivateKeyPath)
+	switch {
+	case os.IsNotExist(err):
+		return newKeyParam, nil, nil
 
-	// V3 denotes that the onion service is V3.
-	V3
-)
+	case err != nil:
+		return "", nil, err
+	}
 
-// AddOnionConfig houses all of the required paramaters in order to succesfully
-// create a new onion service or restore an existing one.
-type AddOnionConfig struct {
-	// Type denotes the type of the onion service that should be created.
-	Type OnionType
+	// Since the private key file may have been corrupted or truncated,
+	// we'll make sure it holds a well formed key of the expected type, as
+	// the server would otherwise reject it with an unhelpful error. An
+	// empty file is usually left behind by a crash while writing the key
+	// of a new onion service.
+	var (
+		key    = OnionPrivateKey(privateKey)
+		keyErr error
+	)
+	if len(bytes.TrimSpace(privateKey)) == 0 {
+		keyErr = fmt.Errorf("private key file %v is empty",
+			cfg.PrivateKeyPath)
+	} else if err := validatePrivateKey(key); err != nil {
+		keyErr = fmt.Errorf("invalid private key in %v: %v",
+			cfg.PrivateKeyPath, err)
+	} else if err := validateKeyBlob(cfg.Type, key); err != nil {
+		keyErr = fmt.Errorf("corrupt private key in %v: %v",
+			cfg.PrivateKeyPath, err)
+	}
+	if keyErr == nil {
+		return string(privateKey), nil, nil
+	}
 
-	// VirtualPort is the externally reachable port of the onion address.
-	VirtualPort int
+	// If allowed, a corrupt key is replaced by the key of a new onion
+	// service once created, but a valid key of the wrong type is kept.
+	if cfg.CorruptKeyPolicy == CorruptKeyRecreate && !wellFormedKey(key) {
+		return newKeyParam, nil, nil
+	}
 
-	// TargetPorts is the set of ports that the service will be listening on
-	// locally. The Tor server will use choose a random port from this set
-	// to forward the traffic from the virtual port.
-	//
-	// NOTE: If nil/empty, the virtual port will be used as the only target
-	// port.
-	TargetPorts []int
+	return "", nil, keyErr
+}
 
-	// PrivateKeyPath is the full path to where the onion service's private
-	// key is stored. This can be used to restore an existing onion service.
-	PrivateKeyPath string
+// wellFormedKey returns whether the given private key holds a well formed key
+// blob for an onion service of any type.
+func wellFormedKey(key OnionPrivateKey) bool {
+	return validateKeyBlob(V2, key) == nil ||
+		validateKeyBlob(V3, key) == nil
 }
 
 // AddOnion creates an onion service and returns its onion address. Once
 // created, the new onion service will remain active until the connection
-// between the controller and the Tor server is closed.
+// between the controller and the Tor server is closed. If a new onion service
+// was created, the returned address also holds its private key.
 func (c *Controller) AddOnion(cfg AddOnionConfig) (*OnionAddr, error) {
-	// Before sending the request to create an onion service to the Tor
-	// server, we'll make sure that it supports V3 onion services if that
-	// was the type requested.
-	if cfg.Type == V3 {
-		if err := supportsV3(c.version); err != nil {
-			return nil, err
-		}
+	return c.AddOnionContext(context.Background(), cfg)
+}
+
+// AddOnionContext is equivalent to AddOnion, but gives up writing the private
+// key of a new onion service to disk once the passed context expires, in which
+// case no key file is left behind. If the key can't be written, the onion
+// service is deleted again, as it couldn't be recreated later on.
+func (c *Controller) AddOnionContext(ctx context.Context,
+	cfg AddOnionConfig) (*OnionAddr, error) {
+
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return nil, ErrNotAuthenticated
 	}
 
-	// We'll start off by checking if the file containing the private key
-	// exists. If it does not, then we should request the server to create
-	// a new onion service and return its private key. Otherwise, we'll
-	// request the server to recreate the onion server from our private key.
-	var keyParam string
-	if _, err := os.Stat(cfg.PrivateKeyPath); os.IsNotExist(err) {
-		switch cfg.Type {
-		case V2:
-			keyParam = "NEW:RSA1024"
-		case V3:
-			keyParam = "NEW:ED25519-V3"
-		}
-	} else {
-		privateKey, err := ioutil.ReadFile(cfg.PrivateKeyPath)
-		if err != nil {
-			return nil, err
-		}
-		keyParam = string(privateKey)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	// Now, we'll create a mapping from the virtual port to each target
-	// port. If no target ports were specified, we'll use the virtual port
-	// to provide a one-to-one mapping.
-	var portParam string
-	if len(cfg.TargetPorts) == 0 {
-		portParam += fmt.Sprintf("Port=%d,%d ", cfg.VirtualPort,
-			cfg.VirtualPort)
-	} else {
-		for _, targetPort := range cfg.TargetPorts {
-			portParam += fmt.Sprintf("Port=%d,%d ", cfg.VirtualPort,
-				targetPort)
+	// We'll start by building the command to create the onion service,
+	// which also ensures the config is valid.
+	cmd, err := cfg.Command()
+	if err != nil {
+		return nil, err
+	}
+
+	// Before sending the request to create an onion service to the Tor
+	// server, we'll make sure that it supports V3 onion services if that
+	// was the type requested, unless the check was disabled. If the Tor
+	// server didn't advertise its version, we can't tell, so we won't
+	// attempt it.
+	if cfg.Type == V3 && !c.skipV3Check {
+		if c.version == "" {
+			return nil, ErrUnknownVersion
+		}
+		if err := supportsV3(c.version); err != nil {
+			return nil, err
 		}
 	}
 
 	// Send the command to create the onion service to the Tor server and
 	// await its response.
-	cmd := fmt.Sprintf("ADD_ONION %s %s", keyParam, portParam)
-	_, reply, err := c.sendCommand(cmd)
+	code, reply, err := c.sendCommand(cmd)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkOK(code, reply); err != nil {
+		return nil, err
+	}
 
 	// If successful, the reply from the server should be of the following
 	// format, depending on whether a private key has been requested:
@@ -506,29 +2503,521 @@ func (c *Controller) AddOnion(cfg AddOnionConfig) (*OnionAddr, error) {
 	// We're interested in retrieving the service ID, which is the public
 	// name of the service, and the private key if requested.
 	replyParams := parseTorReply(reply)
-	serviceID, ok := replyParams["ServiceID"]
+	serviceID, ok := replyParams["SERVICEID"]
 	if !ok {
 		return nil, errors.New("service id not found in reply")
 	}
 
 	// If a new onion service was created, we'll write its private key to
 	// disk under strict permissions in the event that it needs to be
-	// recreated later on.
-	if privateKey, ok := replyParams["PrivateKey"]; ok {
-		err := ioutil.WriteFile(
-			cfg.PrivateKeyPath, []byte(privateKey), 0600,
+	// recreated later on. Ephemeral onion services don't have a private
+	// key path, so their key is never written.
+	privateKey, ok := replyParams["PRIVATEKEY"]
+	if ok && cfg.PrivateKeyPath != "" && cfg.PrivateKey == "" {
+		_, err := writeFileContext(
+			ctx, writeData, cfg.PrivateKeyPath,
+			[]byte(privateKey), 0600,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("unable to write private key "+
-				"to file: %v", err)
+			err = fmt.Errorf("unable to write private key to "+
+				"file: %v", err)
+
+			// Without its private key, the onion service can't be
+			// recreated later on, so we'll delete it rather than
+			// leave it running.
+			if _, delErr := c.delOnion(serviceID); delErr != nil {
+				return nil, fmt.Errorf("%v (unable to delete "+
+					"onion service: %v)", err, delErr)
+			}
+
+			return nil, err
+		}
+	}
+
+	// Tor doesn't report which target port it forwards each stream to, as
+	// it picks one at random, so we'll return the mappings we requested.
+	// These have already been validated while building the command.
+	portMappings, err := onionPortMappings(
+		cfg.VirtualPort, cfg.TargetPorts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new onion service was requested if the command doesn't carry a
+	// private key.
+	if c.onionObserver != nil {
+		if strings.HasPrefix(cmd, "ADD_ONION NEW:") {
+			c.onionObserver.OnCreated(serviceID, cfg.Type)
+		} else {
+			c.onionObserver.OnRestored(serviceID, cfg.Type)
 		}
 	}
 
 	// Finally, we'll return the onion address composed of the service ID,
-	// along with the onion suffix, and the port this onion service can be
-	// reached at externally.
+	// both with and without the onion suffix, and the port this onion
+	// service can be reached at externally. The private key is only known
+	// if a new onion service was created.
 	return &OnionAddr{
-		OnionService: serviceID + ".onion",
+		OnionService: serviceID + OnionSuffix,
+		ServiceID:    OnionServiceID(serviceID),
 		Port:         cfg.VirtualPort,
+		PrivateKey:   OnionPrivateKey(privateKey),
+		PortMappings: portMappings,
 	}, nil
 }
+
+// WaitForOnion waits until the descriptor of the onion service with the given
+// service ID, with or without the onion suffix, has been uploaded to a hidden
+// service directory, such that the service is reachable, or until the context
+// expires. As the descriptor is published asynchronously after the onion
+// service is created, connections made right after AddOnion returns may fail
+// otherwise.
+//
+// NOTE: This should be called right after AddOnion, as uploads that happened
+// before are not detected.
+func (c *Controller) WaitForOnion(ctx context.Context, serviceID string) error {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return ErrNotAuthenticated
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The events are of the following format, where the address is the
+	// service ID without the onion suffix:
+	//
+	//	S: 650 HS_DESC UPLOADED <address> <auth type> <hs dir> ...
+	serviceID = strings.TrimSuffix(serviceID, ".onion")
+	return c.waitForEvent(ctx, "HS_DESC", func(event string) bool {
+		fields := strings.Fields(event)
+		return len(fields) >= 3 && fields[0] == "HS_DESC" &&
+			fields[1] == "UPLOADED" && fields[2] == serviceID
+	})
+}
+
+// HSDescState is the state of the upload of an onion service's descriptor to a
+// hidden service directory.
+type HSDescState uint8
+
+const (
+	// HSDescPending indicates that the descriptor is being uploaded.
+	HSDescPending HSDescState = iota
+
+	// HSDescUploaded indicates that the descriptor was uploaded.
+	HSDescUploaded
+
+	// HSDescFailed indicates that the upload of the descriptor failed.
+	HSDescFailed
+)
+
+// String returns a human readable description of the upload state.
+func (s HSDescState) String() string {
+	switch s {
+	case HSDescPending:
+		return "pending"
+	case HSDescUploaded:
+		return "uploaded"
+	case HSDescFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// HSDirStatus is the status of the upload of an onion service's descriptor to
+// a single hidden service directory.
+type HSDirStatus struct {
+	// State is the state of the upload.
+	State HSDescState
+
+	// Reason is the reason given by the Tor server for a failed upload,
+	// if any.
+	Reason string
+}
+
+// HSDescStatus is the status of the uploads of the current descriptor of an
+// onion service, keyed by the fingerprint of each hidden service directory.
+type HSDescStatus map[string]HSDirStatus
+
+// Uploaded returns whether the descriptor was uploaded to at least one hidden
+// service directory, such that the onion service is reachable.
+func (s HSDescStatus) Uploaded() bool {
+	for _, status := range s {
+		if status.State == HSDescUploaded {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OnionStatus returns the status of the uploads of the current descriptor of
+// the onion service with the given service ID, with or without the onion
+// suffix, to each hidden service directory. As the Tor server only reports
+// these through HS_DESC events, the status is built from the events received
+// while subscribed to them through SubscribeEvents, or while waiting in
+// WaitForOnion. An empty status is returned if no upload has been reported
+// for the onion service.
+func (c *Controller) OnionStatus(serviceID string) (HSDescStatus, error) {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return nil, ErrNotAuthenticated
+	}
+
+	serviceID = strings.TrimSuffix(serviceID, OnionSuffix)
+	if _, err := serviceIDType(serviceID); err != nil {
+		return nil, err
+	}
+
+	c.hsDescMtx.Lock()
+	defer c.hsDescMtx.Unlock()
+
+	// We'll return a copy, such that it isn't modified by any subsequent
+	// events.
+	status := make(HSDescStatus, len(c.hsDescs[serviceID]))
+	for hsDir, dirStatus := range c.hsDescs[serviceID] {
+		status[hsDir] = dirStatus
+	}
+
+	return status, nil
+}
+
+// recordEvent updates the status of the descriptor uploads of an onion service
+// if the given event is an HS_DESC event reporting on an upload. Events are of
+// the following format, where the address is the service ID without the onion
+// suffix, and the hidden service directory is given by its fingerprint,
+// optionally followed by its nickname:
+//
+//	S: 650 HS_DESC <action> <address> <auth type> <hs dir> [REASON=...]
+//
+// A CREATED action resets the status, as any previous uploads were of a
+// previous descriptor.
+func (c *Controller) recordEvent(event string) {
+	fields := strings.Fields(event)
+	if len(fields) < 5 || fields[0] != "HS_DESC" {
+		return
+	}
+	action, serviceID, hsDir := fields[1], fields[2], fields[4]
+
+	// We'll key the status by the fingerprint of the directory alone.
+	hsDir = strings.TrimPrefix(hsDir, "$")
+	if i := strings.IndexAny(hsDir, "~="); i >= 0 {
+		hsDir = hsDir[:i]
+	}
+
+	var dirStatus HSDirStatus
+	switch action {
+	case "CREATED":
+		c.hsDescMtx.Lock()
+		delete(c.hsDescs, serviceID)
+		c.hsDescMtx.Unlock()
+		return
+
+	case "UPLOAD":
+		dirStatus.State = HSDescPending
+
+	case "UPLOADED":
+		dirStatus.State = HSDescUploaded
+
+	case "FAILED":
+		dirStatus.State = HSDescFailed
+		for _, field := range fields[5:] {
+			if strings.HasPrefix(field, "REASON=") {
+				dirStatus.Reason = strings.TrimPrefix(
+					field, "REASON=",
+				)
+			}
+		}
+
+	default:
+		return
+	}
+
+	c.hsDescMtx.Lock()
+	defer c.hsDescMtx.Unlock()
+
+	if c.hsDescs == nil {
+		c.hsDescs = make(map[string]HSDescStatus)
+	}
+	if c.hsDescs[serviceID] == nil {
+		c.hsDescs[serviceID] = make(HSDescStatus)
+	}
+	c.hsDescs[serviceID][hsDir] = dirStatus
+}
+
+// DelOnion deletes the onion service with the given service ID, with or
+// without the onion suffix. Only onion services created by this control
+// connection, or detached ones, can be deleted.
+func (c *Controller) DelOnion(serviceID string) error {
+	if atomic.LoadInt32(&c.authenticated) == 0 {
+		return ErrNotAuthenticated
+	}
+
+	serviceID = strings.TrimSuffix(serviceID, OnionSuffix)
+	onionType, err := c.delOnion(serviceID)
+	if err != nil {
+		return err
+	}
+
+	if c.onionObserver != nil {
+		c.onionObserver.OnDeleted(serviceID, onionType)
+	}
+
+	return nil
+}
+
+// delOnion deletes the onion service with the given service ID, without the
+// onion suffix, and returns its type. Unlike DelOnion, the onion observer
+// isn't notified.
+func (c *Controller) delOnion(serviceID string) (OnionType, error) {
+	// We'll make sure the service ID is valid before sending it, such
+	// that it can't alter the command.
+	onionType, err := serviceIDType(serviceID)
+	if err != nil {
+		return 0, err
+	}
+	if strings.Trim(serviceID, base32Alphabet) != "" {
+		return 0, fmt.Errorf("invalid service id %q", serviceID)
+	}
+
+	code, reply, err := c.sendCommand("DEL_ONION " + serviceID)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkOK(code, reply); err != nil {
+		return 0, err
+	}
+
+	return onionType, nil
+}
+
+// writeFileContext writes the given data to the file at the given path using
+// the given function, giving up once the context expires. The data is first
+// written to a uniquely named temporary file in the same directory, which is
+// only synced to disk and renamed to the given path once complete, such that a
+// failed or abandoned write never leaves a truncated file behind. As a write
+// blocked on a stalled filesystem can't be interrupted, the temporary file is
+// removed in the background once it completes. The returned channel is closed
+// once the temporary file is gone.
+func writeFileContext(ctx context.Context,
+	write func(f *os.File, data []byte) error, path string, data []byte,
+	perm os.FileMode) (<-chan struct{}, error) {
+
+	cleanedUp := make(chan struct{})
+
+	tmpFile, err := ioutil.TempFile(
+		filepath.Dir(path), filepath.Base(path)+".tmp",
+	)
+	if err != nil {
+		close(cleanedUp)
+		return cleanedUp, err
+	}
+	tmpPath := tmpFile.Name()
+
+	// The channel is buffered, such that the goroutine can exit even if
+	// we've given up on the write.
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- syncFile(tmpFile, write, data, perm)
+	}()
+
+	select {
+	case err := <-errChan:
+		defer close(cleanedUp)
+
+		if err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return cleanedUp, err
+		}
+
+		return cleanedUp, nil
+
+	case <-ctx.Done():
+		go func() {
+			<-errChan
+			os.Remove(tmpPath)
+			close(cleanedUp)
+		}()
+
+		return cleanedUp, fmt.Errorf("write timed out: %v", ctx.Err())
+	}
+}
+
+// syncFile writes the given data to the given file using the given function,
+// sets its permissions, and syncs it to disk before closing it.
+func syncFile(f *os.File, write func(f *os.File, data []byte) error,
+	data []byte, perm os.FileMode) error {
+
+	err := write(f, data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// writeData writes the given data to the given file.
+func writeData(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+// onionPortMappings creates the mapping from the virtual port to each target
+// port. If no target ports were specified, the virtual port is used to provide
+// a one-to-one mapping. Duplicate target ports are only mapped once,
+// preserving their order. An error is returned if any of the ports is out of
+// range.
+func onionPortMappings(virtualPort int, targetPorts []int) ([]PortMapping,
+	error) {
+
+	// A zero virtual port is most likely the result of forgetting to set
+	// it, so we'll point that out explicitly.
+	if virtualPort == 0 {
+		return nil, errors.New("virtual port must be set")
+	}
+	if err := validatePort(virtualPort); err != nil {
+		return nil, fmt.Errorf("invalid virtual port: %v", err)
+	}
+
+	if len(targetPorts) == 0 {
+		targetPorts = []int{virtualPort}
+	}
+
+	mappings := make([]PortMapping, 0, len(targetPorts))
+	seen := make(map[int]struct{}, len(targetPorts))
+	for _, targetPort := range targetPorts {
+		if err := validatePort(targetPort); err != nil {
+			return nil, fmt.Errorf("invalid target port: %v", err)
+		}
+
+		if _, ok := seen[targetPort]; ok {
+			continue
+		}
+		seen[targetPort] = struct{}{}
+
+		mappings = append(mappings, PortMapping{
+			VirtualPort: virtualPort,
+			TargetPort:  targetPort,
+		})
+	}
+
+	return mappings, nil
+}
+
+// onionPortParam creates the mapping from the virtual port to each target port
+// in the format expected by the ADD_ONION command, as described by
+// onionPortMappings.
+func onionPortParam(virtualPort int, targetPorts []int) (string, error) {
+	mappings, err := onionPortMappings(virtualPort, targetPorts)
+	if err != nil {
+		return "", err
+	}
+
+	var portParam string
+	for _, mapping := range mappings {
+		portParam += fmt.Sprintf(
+			"Port=%d,%d ", mapping.VirtualPort, mapping.TargetPort,
+		)
+	}
+
+	return portParam, nil
+}
+
+// validatePrivateKey ensures the given private key of an onion service has a
+// key type prefix recognized by the ADD_ONION command, and can be safely sent
+// as a single parameter.
+func validatePrivateKey(key OnionPrivateKey) error {
+	var blob string
+	switch {
+	case strings.HasPrefix(string(key), "RSA1024:"):
+		blob = strings.TrimPrefix(string(key), "RSA1024:")
+	case strings.HasPrefix(string(key), "ED25519-V3:"):
+		blob = strings.TrimPrefix(string(key), "ED25519-V3:")
+	default:
+		return errors.New("private key has an unrecognized key type")
+	}
+
+	// We don't include the key in the error, as it should never end up in
+	// the logs.
+	if blob == "" || strings.ContainsAny(blob, " \t\r\n") {
+		return errors.New("private key has an invalid key blob")
+	}
+
+	return nil
+}
+
+// validateKeyBlob ensures the given private key holds a well formed key blob
+// for an onion service of the given type: a base64 encoded expanded ed25519
+// secret key for v3 onion services, or a base64 encoded PKCS#1 1024-bit RSA
+// private key for v2 onion services.
+func validateKeyBlob(onionType OnionType, key OnionPrivateKey) error {
+	var prefix string
+	switch onionType {
+	case V2:
+		prefix = "RSA1024:"
+	case V3:
+		prefix = "ED25519-V3:"
+	default:
+		return fmt.Errorf("unknown onion type %d", onionType)
+	}
+
+	if !strings.HasPrefix(string(key), prefix) {
+		return fmt.Errorf("expected %v private key with type %v",
+			onionType, strings.TrimSuffix(prefix, ":"))
+	}
+
+	// Tor pads the base64 encoded key blobs it returns, although it also
+	// accepts them unpadded, so we'll do the same.
+	encoded := strings.TrimPrefix(string(key), prefix)
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		blob, err = base64.RawStdEncoding.DecodeString(encoded)
+	}
+
+	// As with validatePrivateKey, neither the key nor the decoding error,
+	// which may include parts of it, are included in the errors.
+	if err != nil {
+		return errors.New("private key blob is not valid base64")
+	}
+
+	switch onionType {
+	case V2:
+		rsaKey, err := x509.ParsePKCS1PrivateKey(blob)
+		if err != nil {
+			return errors.New("private key blob is not a valid " +
+				"RSA private key")
+		}
+		if rsaKey.N.BitLen() != rsa1024KeyBits {
+			return fmt.Errorf("expected %d-bit RSA private key, "+
+				"got %d bits", rsa1024KeyBits, rsaKey.N.BitLen())
+		}
+
+	case V3:
+		if len(blob) != ed25519ExpandedKeyLen {
+			return fmt.Errorf("expected %d byte ed25519 private "+
+				"key, got %d bytes", ed25519ExpandedKeyLen,
+				len(blob))
+		}
+	}
+
+	return nil
+}
+
+// validatePort ensures the given port is in the range [1, 65535].
+func validatePort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d out of range [1, 65535]", port)
+	}
+
+	return nil
+}
@@ -1,6 +1,134 @@
 package tor
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/clock"
+)
+
+// testV3PrivateKey is a well formed private key of a v3 onion service.
+const testV3PrivateKey = "ED25519-V3:AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaG" +
+	"xwdHh8gISIjJCUmJygpKissLS4vMDEyMzQ1Njc4OTo7PD0+Pw=="
+
+// newTestV2PrivateKey generates a well formed private key of a v2 onion
+// service.
+func newTestV2PrivateKey(t *testing.T) string {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unable to generate rsa key: %v", err)
+	}
+
+	return "RSA1024:" + base64.StdEncoding.EncodeToString(
+		x509.MarshalPKCS1PrivateKey(rsaKey),
+	)
+}
+
+// mockTorServer is a mock Tor server that replies to the commands sent by a
+// controller using a handler, and records the commands it received.
+type mockTorServer struct {
+	conn    *textproto.Conn
+	handler func(cmd string) string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// newMockController returns a controller connected to a mock Tor server
+// running the given version. The handler returns the raw reply to each
+// command, including the trailing CRLF of each line.
+func newMockController(t *testing.T, version string,
+	handler func(cmd string) string) (*Controller, *mockTorServer) {
+
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	server := &mockTorServer{
+		conn:    textproto.NewConn(serverConn),
+		handler: handler,
+	}
+	go server.serve()
+
+	c := &Controller{
+		conn:          textproto.NewConn(clientConn),
+		version:       version,
+		authenticated: 1,
+		clock:         clock.NewDefaultClock(),
+	}
+
+	return c, server
+}
+
+// serve reads commands from the connection until it is closed, replying to
+// each one using the handler.
+func (m *mockTorServer) serve() {
+	for {
+		cmd, err := m.conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		m.mu.Lock()
+		m.commands = append(m.commands, cmd)
+		m.mu.Unlock()
+
+		if _, err := m.conn.W.WriteString(m.handler(cmd)); err != nil {
+			return
+		}
+		if err := m.conn.W.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// lastCommand returns the last command received by the server.
+func (m *mockTorServer) lastCommand() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.commands) == 0 {
+		return ""
+	}
+	return m.commands[len(m.commands)-1]
+}
+
+// addOnionHandler returns a handler replying to ADD_ONION commands with the
+// given service ID, and a private key if a new one was requested and not
+// discarded.
+func addOnionHandler(serviceID, privateKey string) func(string) string {
+	return func(cmd string) string {
+		reply := "250-ServiceID=" + serviceID + "\r\n"
+		if strings.Contains(cmd, "NEW:") &&
+			!strings.Contains(cmd, "DiscardPK") {
+
+			reply += "250-PrivateKey=" + privateKey + "\r\n"
+		}
+		return reply + "250 OK\r\n"
+	}
+}
 
 // TestParseTorVersion is a series of tests for different version strings that
 // check the correctness of determining whether they support creating v3 onion
@@ -66,3 +194,3521 @@ func TestParseTorVersion(t *testing.T) {
 		}
 	}
 }
+
+// TestOnionPortParam ensures that the port mapping of an ADD_ONION command is
+// deduplicated, and that out of range ports are rejected.
+func TestOnionPortParam(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		virtualPort int
+		targetPorts []int
+		param       string
+		valid       bool
+	}{
+		{
+			name:        "no target ports",
+			virtualPort: 9735,
+			param:       "Port=9735,9735 ",
+			valid:       true,
+		},
+		{
+			name:        "distinct target ports",
+			virtualPort: 80,
+			targetPorts: []int{8080, 8081},
+			param:       "Port=80,8080 Port=80,8081 ",
+			valid:       true,
+		},
+		{
+			name:        "duplicate target ports",
+			virtualPort: 80,
+			targetPorts: []int{8081, 8080, 8081, 8080},
+			param:       "Port=80,8081 Port=80,8080 ",
+			valid:       true,
+		},
+		{
+			name:        "virtual port out of range",
+			virtualPort: 0,
+			targetPorts: []int{8080},
+			valid:       false,
+		},
+		{
+			name:        "target port out of range",
+			virtualPort: 80,
+			targetPorts: []int{8080, 65536},
+			valid:       false,
+		},
+		{
+			name:        "negative target port",
+			virtualPort: 80,
+			targetPorts: []int{-1},
+			valid:       false,
+		},
+	}
+
+	for _, test := range tests {
+		param, err := onionPortParam(test.virtualPort, test.targetPorts)
+		if test.valid != (err == nil) {
+			t.Fatalf("test %q: unexpected error: %v", test.name,
+				err)
+		}
+
+		if param != test.param {
+			t.Fatalf("test %q: expected param %q, got %q",
+				test.name, test.param, param)
+		}
+	}
+}
+
+// TestAddOnionInvalidPorts ensures that AddOnion rejects invalid ports with a
+// descriptive error, without sending any command to the Tor server.
+func TestAddOnionInvalidPorts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		virtualPort int
+		targetPorts []int
+		errStr      string
+	}{
+		{
+			name:        "zero virtual port",
+			virtualPort: 0,
+			errStr:      "virtual port must be set",
+		},
+		{
+			name:        "virtual port out of range",
+			virtualPort: 65536,
+			errStr:      "invalid virtual port",
+		},
+		{
+			name:        "negative virtual port",
+			virtualPort: -80,
+			errStr:      "invalid virtual port",
+		},
+		{
+			name:        "negative target port",
+			virtualPort: 80,
+			targetPorts: []int{-8080},
+			errStr:      "invalid target port",
+		},
+	}
+
+	for _, test := range tests {
+		c, server := newMockController(
+			t, MinTorVersion, addOnionHandler("service", "key"),
+		)
+
+		_, err := c.AddOnion(AddOnionConfig{
+			Type:        V3,
+			VirtualPort: test.virtualPort,
+			TargetPorts: test.targetPorts,
+		})
+		c.conn.Close()
+		if err == nil || !strings.Contains(err.Error(), test.errStr) {
+			t.Fatalf("test %q: expected error containing %q, "+
+				"got: %v", test.name, test.errStr, err)
+		}
+
+		if cmd := server.lastCommand(); cmd != "" {
+			t.Fatalf("test %q: expected no command to be sent, "+
+				"got %q", test.name, cmd)
+		}
+	}
+}
+
+// TestAddOnionEphemeral ensures that an onion service can be created without
+// a private key path, in which case its private key is discarded.
+func TestAddOnionEphemeral(t *testing.T) {
+	t.Parallel()
+
+	c, server := newMockController(
+		t, MinTorVersion, addOnionHandler("ephemeral", "ED25519-V3:key"),
+	)
+	defer c.conn.Close()
+
+	addr, err := c.AddOnion(AddOnionConfig{
+		Type:        V3,
+		VirtualPort: 9735,
+	})
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+
+	if addr.OnionService != "ephemeral.onion" {
+		t.Fatalf("unexpected onion service %v", addr.OnionService)
+	}
+
+	// The bare service ID should be available as well, along with its
+	// onion hostname.
+	if addr.ServiceID != "ephemeral" {
+		t.Fatalf("unexpected service id %v", string(addr.ServiceID))
+	}
+	if addr.ServiceID.String() != "ephemeral.onion" {
+		t.Fatalf("unexpected onion hostname %v", addr.ServiceID)
+	}
+	if addr.String() != "ephemeral.onion:9735" {
+		t.Fatalf("unexpected onion address %v", addr)
+	}
+
+	cmd := server.lastCommand()
+	if !strings.Contains(cmd, "NEW:ED25519-V3") ||
+		!strings.Contains(cmd, "Flags=DiscardPK") {
+
+		t.Fatalf("expected ephemeral onion service request, got %q",
+			cmd)
+	}
+}
+
+// TestAddOnionPrivateKeyFile ensures that the private key of a new onion
+// service is written to the private key path, and used to restore it.
+func TestAddOnionPrivateKeyFile(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const privateKey = testV3PrivateKey
+	keyPath := filepath.Join(tempDir, "onion_key")
+
+	c, server := newMockController(
+		t, MinTorVersion, addOnionHandler("persistent", privateKey),
+	)
+	defer c.conn.Close()
+
+	cfg := AddOnionConfig{
+		Type:           V3,
+		VirtualPort:    9735,
+		PrivateKeyPath: keyPath,
+	}
+	addr, err := c.AddOnion(cfg)
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("unable to read private key: %v", err)
+	}
+	if string(key) != privateKey {
+		t.Fatalf("expected private key %v, got %v", privateKey,
+			string(key))
+	}
+
+	// The private key should also be returned along with the address,
+	// without leaking when formatted.
+	if addr.PrivateKey != privateKey {
+		t.Fatalf("expected private key to be returned")
+	}
+	formatted := fmt.Sprintf("%v %+v %#v", addr.PrivateKey, *addr, *addr)
+	if strings.Contains(formatted, privateKey) {
+		t.Fatalf("private key leaked when formatted: %v", formatted)
+	}
+
+	// Adding the onion service again should restore it from the private
+	// key, in which case no private key is returned.
+	addr, err = c.AddOnion(cfg)
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+	if addr.PrivateKey != "" {
+		t.Fatalf("expected no private key for restored service")
+	}
+
+	cmd := server.lastCommand()
+	if !strings.HasPrefix(cmd, "ADD_ONION "+privateKey+" ") {
+		t.Fatalf("expected onion service to be restored, got %q", cmd)
+	}
+}
+
+// TestAddOnionKeyWriteFailure ensures that a new onion service is deleted if
+// its private key can't be written to disk, as it couldn't be recreated later
+// on.
+func TestAddOnionKeyWriteFailure(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	serviceID := strings.Repeat("a", 56)
+	addOnion := addOnionHandler(serviceID, testV3PrivateKey)
+	c, server := newMockController(
+		t, MinTorVersion, func(cmd string) string {
+			if strings.HasPrefix(cmd, "DEL_ONION ") {
+				return "250 OK\r\n"
+			}
+			return addOnion(cmd)
+		},
+	)
+	defer c.conn.Close()
+
+	// The key can't be written, as its directory doesn't exist.
+	_, err = c.AddOnion(AddOnionConfig{
+		Type:           V3,
+		VirtualPort:    9735,
+		PrivateKeyPath: filepath.Join(tempDir, "missing", "onion_key"),
+	})
+	if err == nil {
+		t.Fatalf("expected key write to fail")
+	}
+
+	if cmd := server.lastCommand(); cmd != "DEL_ONION "+serviceID {
+		t.Fatalf("expected onion service to be deleted, got %q", cmd)
+	}
+}
+
+// TestCookieFileError ensures that an error reading the authentication cookie
+// file due to its permissions includes the path and mode of the file.
+func TestCookieFileError(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	err = ioutil.WriteFile(cookiePath, make([]byte, cookieLen), 0600)
+	if err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+	if err := os.Chmod(cookiePath, 0); err != nil {
+		t.Fatalf("unable to change cookie mode: %v", err)
+	}
+
+	// We'll simulate the permission error, as reading the file would
+	// succeed when running the tests as root.
+	permErr := &os.PathError{
+		Op:   "open",
+		Path: cookiePath,
+		Err:  os.ErrPermission,
+	}
+	errStr := cookieFileError(cookiePath, permErr).Error()
+	if !strings.Contains(errStr, cookiePath) {
+		t.Fatalf("expected error to contain path: %v", errStr)
+	}
+	if !strings.Contains(errStr, "----------") {
+		t.Fatalf("expected error to contain mode: %v", errStr)
+	}
+	if !strings.Contains(errStr, "permission denied") {
+		t.Fatalf("expected error to mention permissions: %v", errStr)
+	}
+
+	// When not running as root, reading the file should also fail with
+	// the descriptive error.
+	if os.Geteuid() != 0 {
+		_, err := readAuthCookie(
+			clock.NewDefaultClock(), cookiePath,
+			DefaultCookieReadTimeout,
+		)
+		if err == nil || !strings.Contains(err.Error(), "----------") {
+			t.Fatalf("expected descriptive error, got: %v", err)
+		}
+	}
+
+	// Other errors should still include the path.
+	missingPath := filepath.Join(tempDir, "missing")
+	_, err = readAuthCookie(
+		clock.NewDefaultClock(), missingPath, DefaultCookieReadTimeout,
+	)
+	if err == nil || !strings.Contains(err.Error(), missingPath) {
+		t.Fatalf("expected error to contain path, got: %v", err)
+	}
+}
+
+// TestReadAuthCookie ensures that authentication cookies are read from files
+// storing them either raw, hex or base64 encoded.
+func TestReadAuthCookie(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookie := make([]byte, cookieLen)
+	for i := range cookie {
+		cookie[i] = byte(i * 7)
+	}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		valid    bool
+	}{
+		{
+			name:     "raw",
+			contents: cookie,
+			valid:    true,
+		},
+		{
+			name:     "hex",
+			contents: []byte(hex.EncodeToString(cookie)),
+			valid:    true,
+		},
+		{
+			name: "uppercase hex with newline",
+			contents: []byte(strings.ToUpper(
+				hex.EncodeToString(cookie),
+			) + "\n"),
+			valid: true,
+		},
+		{
+			name: "base64",
+			contents: []byte(
+				base64.StdEncoding.EncodeToString(cookie),
+			),
+			valid: true,
+		},
+		{
+			name: "unpadded base64",
+			contents: []byte(
+				base64.RawStdEncoding.EncodeToString(cookie),
+			),
+			valid: true,
+		},
+		{
+			name:     "short raw",
+			contents: cookie[:cookieLen-1],
+		},
+		{
+			name:     "short hex",
+			contents: []byte(hex.EncodeToString(cookie[1:])),
+		},
+		{
+			name:     "garbage",
+			contents: bytes.Repeat([]byte("z"), 2*cookieLen),
+		},
+	}
+
+	for _, test := range tests {
+		cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+		err := ioutil.WriteFile(cookiePath, test.contents, 0600)
+		if err != nil {
+			t.Fatalf("unable to write cookie: %v", err)
+		}
+
+		readCookie, err := readAuthCookie(
+			clock.NewDefaultClock(), cookiePath,
+			DefaultCookieReadTimeout,
+		)
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("test %q: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %q: unable to read cookie: %v",
+				test.name, err)
+		}
+
+		if !bytes.Equal(readCookie, cookie) {
+			t.Fatalf("test %q: expected cookie %x, got %x",
+				test.name, cookie, readCookie)
+		}
+	}
+}
+
+// TestReadFileTimeout ensures that a blocking read of the authentication
+// cookie file results in an error once the timeout expires.
+func TestReadFileTimeout(t *testing.T) {
+	t.Parallel()
+
+	cookie := bytes.Repeat([]byte{0x01}, cookieLen)
+
+	// The read of a stalled filesystem is simulated by blocking until the
+	// test is done.
+	unblock := make(chan struct{})
+	defer close(unblock)
+	blockingRead := func(string) ([]byte, error) {
+		<-unblock
+		return cookie, nil
+	}
+
+	// The read should only time out once the clock reaches the timeout.
+	// As we can't tell when the timer is started, we'll keep advancing
+	// the clock until it fires.
+	const timeout = time.Minute
+	testClock := clock.NewTestClock(time.Unix(0, 0))
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := readFileTimeout(
+			testClock, blockingRead, "control_auth_cookie", timeout,
+		)
+		errChan <- err
+	}()
+
+	var err error
+wait:
+	for {
+		select {
+		case err = <-errChan:
+			break wait
+
+		case <-time.After(10 * time.Millisecond):
+			testClock.Advance(timeout)
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+
+	// Reads completing within the timeout should succeed.
+	read := func(string) ([]byte, error) {
+		return cookie, nil
+	}
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		contents, err := readFileTimeout(
+			testClock, read, "control_auth_cookie", timeout,
+		)
+		if err != nil {
+			t.Fatalf("unable to read file: %v", err)
+		}
+		if !bytes.Equal(contents, cookie) {
+			t.Fatalf("expected contents %x, got %x", cookie,
+				contents)
+		}
+	}
+}
+
+// TestWriteFileContext ensures that failed or timed out writes don't leave a
+// partially written file behind.
+func TestWriteFileContext(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "tor-write")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "onion_key")
+	key := []byte("ED25519-V3:" + strings.Repeat("a", 88))
+
+	assertFiles := func(expected []byte) {
+		t.Helper()
+
+		contents, err := ioutil.ReadFile(path)
+		switch {
+		case expected == nil && !os.IsNotExist(err):
+			t.Fatalf("expected no key file, got %q (err=%v)",
+				contents, err)
+		case expected != nil && !bytes.Equal(contents, expected):
+			t.Fatalf("expected key file %q, got %q (err=%v)",
+				expected, contents, err)
+		}
+
+		// No temporary file should be left behind.
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("unable to read dir: %v", err)
+		}
+		for _, f := range files {
+			if f.Name() != filepath.Base(path) {
+				t.Fatalf("unexpected file %v", f.Name())
+			}
+		}
+	}
+
+	// A write failing midway should leave no file behind.
+	failingWrite := func(f *os.File, data []byte) error {
+		if _, err := f.Write(data[:len(data)/2]); err != nil {
+			return err
+		}
+		return errors.New("disk full")
+	}
+	_, err = writeFileContext(
+		context.Background(), failingWrite, path, key, 0600,
+	)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected write error, got: %v", err)
+	}
+	assertFiles(nil)
+
+	// A successful write should produce the complete file, with the given
+	// permissions.
+	_, err = writeFileContext(
+		context.Background(), writeData, path, key, 0600,
+	)
+	if err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	assertFiles(key)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unable to stat file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	// A write stalling past the deadline should be abandoned, leaving the
+	// existing file untouched, and the partially written temporary file
+	// should be removed once the write completes.
+	unblock := make(chan struct{})
+	stallingWrite := func(f *os.File, data []byte) error {
+		if _, err := f.Write(data[:len(data)/2]); err != nil {
+			return err
+		}
+		<-unblock
+		return errors.New("write aborted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	newKey := []byte("ED25519-V3:" + strings.Repeat("b", 88))
+	cleanedUp, err := writeFileContext(
+		ctx, stallingWrite, path, newKey, 0600,
+	)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got: %v", err)
+	}
+
+	close(unblock)
+	<-cleanedUp
+	assertFiles(key)
+}
+
+// TestControlErrors ensures that unsuccessful replies from the Tor server are
+// returned as a ControlError.
+func TestControlErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		reply string
+		code  int
+	}{
+		{
+			name:  "unexpected code",
+			reply: "251 Resource exhausted\r\n",
+			code:  251,
+		},
+		{
+			name:  "syntax error",
+			reply: "512 Invalid argument\r\n",
+			code:  512,
+		},
+		{
+			name:  "unrecognized entity",
+			reply: "552 Unrecognized key type\r\n",
+			code:  552,
+		},
+		{
+			name:  "not ok",
+			reply: "250-ServiceID=onion\r\n250 Not OK\r\n",
+			code:  250,
+		},
+	}
+
+	for _, test := range tests {
+		reply := test.reply
+		c, _ := newMockController(
+			t, MinTorVersion, func(string) string {
+				return reply
+			},
+		)
+
+		_, err := c.AddOnion(AddOnionConfig{
+			Type:        V3,
+			VirtualPort: 9735,
+		})
+		c.conn.Close()
+
+		controlErr, ok := err.(*ControlError)
+		if !ok {
+			t.Fatalf("test %q: expected ControlError, got %v",
+				test.name, err)
+		}
+		if controlErr.Code != test.code {
+			t.Fatalf("test %q: expected code %d, got %d",
+				test.name, test.code, controlErr.Code)
+		}
+	}
+}
+
+// TestAuthenticateNotOK ensures that authentication fails if the Tor server
+// doesn't acknowledge the AUTHENTICATE command.
+func TestAuthenticateNotOK(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newMockController(t, "", func(cmd string) string {
+		if strings.HasPrefix(cmd, "PROTOCOLINFO") {
+			return "250-PROTOCOLINFO 1\r\n" +
+				"250-AUTH METHODS=NULL\r\n" +
+				"250-VERSION Tor=\"0.3.3.6\"\r\n" +
+				"250 OK\r\n"
+		}
+
+		return "250 Not authenticated\r\n"
+	})
+	defer c.conn.Close()
+
+	err := c.authenticate()
+	if _, ok := err.(*ControlError); !ok {
+		t.Fatalf("expected ControlError, got %v", err)
+	}
+}
+
+// TestEscapeControlString ensures that strings containing special characters
+// are quoted and escaped according to the control protocol, and that they're
+// parsed back unchanged.
+func TestEscapeControlString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{
+			name:     "plain",
+			value:    "/var/lib/tor/hidden_service",
+			expected: `"/var/lib/tor/hidden_service"`,
+		},
+		{
+			name:     "empty",
+			value:    "",
+			expected: `""`,
+		},
+		{
+			name:     "space",
+			value:    "/home/user/My Services/lnd",
+			expected: `"/home/user/My Services/lnd"`,
+		},
+		{
+			name:     "backslash",
+			value:    `C:\Tor\hs`,
+			expected: `"C:\\Tor\\hs"`,
+		},
+		{
+			name:     "double quote",
+			value:    `pass"word`,
+			expected: `"pass\"word"`,
+		},
+		{
+			name:     "carriage return",
+			value:    "pass\rword",
+			expected: `"pass\rword"`,
+		},
+		{
+			name:     "line feed",
+			value:    "pass\nSIGNAL HALT",
+			expected: `"pass\nSIGNAL HALT"`,
+		},
+		{
+			name:     "all",
+			value:    "\\\"\r\n",
+			expected: `"\\\"\r\n"`,
+		},
+	}
+
+	for _, test := range tests {
+		escaped := escapeControlString(test.value)
+		if escaped != test.expected {
+			t.Fatalf("test %q: expected %s, got %s", test.name,
+				test.expected, escaped)
+		}
+
+		// The escaped value must never span multiple lines, as it
+		// would terminate the command.
+		if strings.ContainsAny(escaped, "\r\n") {
+			t.Fatalf("test %q: escaped value %q contains a line "+
+				"break", test.name, escaped)
+		}
+
+		params, err := parseKeyValues("KEY=" + escaped)
+		if err != nil {
+			t.Fatalf("test %q: unable to parse escaped value: %v",
+				test.name, err)
+		}
+		if params["KEY"] != test.value {
+			t.Fatalf("test %q: expected parsed value %q, got %q",
+				test.name, test.value, params["KEY"])
+		}
+	}
+}
+
+// TestParseProtocolInfo ensures that PROTOCOLINFO replies are parsed
+// correctly, including quoted values and lines we don't know about.
+func TestParseProtocolInfo(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		reply      string
+		methods    []string
+		cookieFile string
+		version    string
+		valid      bool
+	}{
+		{
+			name: "cookie auth",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=COOKIE,SAFECOOKIE " +
+				"COOKIEFILE=\"/var/run/tor/control.authcookie\"\n" +
+				"VERSION Tor=\"0.3.2.10\"\n" +
+				"OK",
+			methods:    []string{"COOKIE", "SAFECOOKIE"},
+			cookieFile: "/var/run/tor/control.authcookie",
+			version:    "0.3.2.10",
+			valid:      true,
+		},
+		{
+			name: "null auth without cookie file",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=NULL\n" +
+				"VERSION Tor=\"0.4.8.9\"\n" +
+				"OK",
+			methods: []string{"NULL"},
+			version: "0.4.8.9",
+			valid:   true,
+		},
+		{
+			name: "cookie file with spaces and escapes",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=COOKIE,SAFECOOKIE,HASHEDPASSWORD " +
+				"COOKIEFILE=\"C:\\\\Tor Browser\\\\Data\\\\" +
+				"\\\"cookie\\\"\"\n" +
+				"VERSION Tor=\"0.4.7.13 (git-7c1601fb6edd780f)\"\n" +
+				"OK",
+			methods: []string{
+				"COOKIE", "SAFECOOKIE", "HASHEDPASSWORD",
+			},
+			cookieFile: `C:\Tor Browser\Data\"cookie"`,
+			version:    "0.4.7.13 (git-7c1601fb6edd780f)",
+			valid:      true,
+		},
+		{
+			name: "cookie file with octal escapes",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=COOKIE,SAFECOOKIE " +
+				"COOKIEFILE=\"/home/Jos\\303\\251/Tor Data/" +
+				"\\tcookie\\1\"\n" +
+				"VERSION Tor=\"0.4.8.9\"\n" +
+				"OK",
+			methods:    []string{"COOKIE", "SAFECOOKIE"},
+			cookieFile: "/home/Jos\u00e9/Tor Data/\tcookie\x01",
+			version:    "0.4.8.9",
+			valid:      true,
+		},
+		{
+			name: "extra lines and fields",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=SAFECOOKIE " +
+				"COOKIEFILE=\"/tmp/cookie\" EXTRA=\"a b\" FLAG\n" +
+				"VERSION Tor=\"0.3.3.6\" Other=1\n" +
+				"FUTURE Field=\"value with spaces\"\n" +
+				"OK",
+			methods:    []string{"SAFECOOKIE"},
+			cookieFile: "/tmp/cookie",
+			version:    "0.3.3.6",
+			valid:      true,
+		},
+		{
+			name: "missing version",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=NULL\n" +
+				"OK",
+			methods: []string{"NULL"},
+			valid:   true,
+		},
+		{
+			name: "missing cookie file",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=COOKIE\n" +
+				"VERSION Tor=\"0.3.3.6\"\n" +
+				"OK",
+			valid: false,
+		},
+		{
+			name: "octal escape out of range",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=COOKIE " +
+				"COOKIEFILE=\"/tmp/\\400\"\n" +
+				"VERSION Tor=\"0.3.3.6\"\n" +
+				"OK",
+			valid: false,
+		},
+		{
+			name: "unterminated quote",
+			reply: "PROTOCOLINFO 1\n" +
+				"AUTH METHODS=COOKIE COOKIEFILE=\"/tmp/cookie\n" +
+				"VERSION Tor=\"0.3.3.6\"\n" +
+				"OK",
+			valid: false,
+		},
+	}
+
+	for _, test := range tests {
+		info, err := parseProtocolInfo(test.reply)
+		if test.valid != (err == nil) {
+			t.Fatalf("test %q: unexpected error: %v", test.name,
+				err)
+		}
+		if !test.valid {
+			continue
+		}
+
+		if !reflect.DeepEqual(info.authMethods, test.methods) {
+			t.Fatalf("test %q: expected methods %v, got %v",
+				test.name, test.methods, info.authMethods)
+		}
+		if info.cookieFile != test.cookieFile {
+			t.Fatalf("test %q: expected cookie file %q, got %q",
+				test.name, test.cookieFile, info.cookieFile)
+		}
+		if info.version != test.version {
+			t.Fatalf("test %q: expected version %q, got %q",
+				test.name, test.version, info.version)
+		}
+	}
+}
+
+// TestAddOnionNotAuthenticated ensures that commands can't be sent before the
+// connection to the Tor server has been authenticated.
+func TestAddOnionNotAuthenticated(t *testing.T) {
+	t.Parallel()
+
+	c := NewController("127.0.0.1:9051")
+	_, err := c.AddOnion(AddOnionConfig{
+		Type:        V3,
+		VirtualPort: 9735,
+	})
+	if err != ErrNotAuthenticated {
+		t.Fatalf("expected ErrNotAuthenticated, got %v", err)
+	}
+}
+
+// TestAddOnionPrivateKey ensures that an onion service can be restored from a
+// private key held in memory, without touching the private key path.
+func TestAddOnionPrivateKey(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const privateKey = testV3PrivateKey
+	keyPath := filepath.Join(tempDir, "onion_key")
+
+	c, server := newMockController(
+		t, MinTorVersion, addOnionHandler("restored", "unused"),
+	)
+	defer c.conn.Close()
+
+	addr, err := c.AddOnion(AddOnionConfig{
+		Type:           V3,
+		VirtualPort:    9735,
+		PrivateKeyPath: keyPath,
+		PrivateKey:     privateKey,
+	})
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+	if addr.OnionService != "restored.onion" {
+		t.Fatalf("unexpected onion service %v", addr.OnionService)
+	}
+
+	cmd := server.lastCommand()
+	if !strings.HasPrefix(cmd, "ADD_ONION "+privateKey+" ") {
+		t.Fatalf("expected onion service to be restored, got %q", cmd)
+	}
+
+	// The private key path should have been ignored.
+	if _, err := os.Stat(keyPath); !os.IsNotExist(err) {
+		t.Fatalf("expected private key path to be untouched")
+	}
+
+	// Keys without a recognized key type, or with an invalid blob, should
+	// be rejected before being sent.
+	invalidKeys := []OnionPrivateKey{
+		"inmemorykey",
+		"NEW:ED25519-V3",
+		"ED25519-V3:",
+		"ED25519-V3:inmemorykey",
+		"RSA1024:key Port=80",
+		OnionPrivateKey(newTestV2PrivateKey(t)),
+	}
+	for _, key := range invalidKeys {
+		_, err := c.AddOnion(AddOnionConfig{
+			Type:        V3,
+			VirtualPort: 9735,
+			PrivateKey:  key,
+		})
+		if err == nil {
+			t.Fatalf("expected key %q to be rejected", string(key))
+		}
+	}
+}
+
+// TestStartRetry ensures that a failed call to Start doesn't prevent a later
+// call from retrying to establish an authenticated connection.
+func TestStartRetry(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// The first connection will fail to authenticate, while any later one
+	// will succeed.
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			authReply := "250 OK\r\n"
+			if i == 0 {
+				authReply = "515 Authentication failed\r\n"
+			}
+
+			server := &mockTorServer{
+				conn: textproto.NewConn(conn),
+				handler: func(cmd string) string {
+					if !strings.HasPrefix(
+						cmd, "PROTOCOLINFO",
+					) {
+						return authReply
+					}
+
+					return "250-PROTOCOLINFO 1\r\n" +
+						"250-AUTH METHODS=NULL\r\n" +
+						"250-VERSION " +
+						"Tor=\"0.3.3.6\"\r\n" +
+						"250 OK\r\n"
+				},
+			}
+			go server.serve()
+		}
+	}()
+
+	c := NewController(listener.Addr().String())
+	if err := c.Start(); err == nil {
+		t.Fatalf("expected first attempt to fail")
+	}
+
+	// The controller shouldn't be usable after the failed attempt.
+	_, err = c.AddOnion(AddOnionConfig{Type: V3, VirtualPort: 9735})
+	if err != ErrNotAuthenticated {
+		t.Fatalf("expected ErrNotAuthenticated, got %v", err)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatalf("unable to start controller: %v", err)
+	}
+	defer c.Stop()
+
+	if atomic.LoadInt32(&c.authenticated) != 1 {
+		t.Fatalf("expected controller to be authenticated")
+	}
+}
+
+// TestStartFailover ensures that the controller tries each of its control
+// addresses in order, using the first one it can connect to.
+func TestStartFailover(t *testing.T) {
+	t.Parallel()
+
+	// We'll obtain addresses nothing is listening on by closing
+	// listeners right away.
+	var refusingAddrs []string
+	for i := 0; i < 2; i++ {
+		refusing, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		refusingAddrs = append(refusingAddrs, refusing.Addr().String())
+		refusing.Close()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server := &mockTorServer{
+				conn: textproto.NewConn(conn),
+				handler: func(cmd string) string {
+					if !strings.HasPrefix(
+						cmd, "PROTOCOLINFO",
+					) {
+						return "250 OK\r\n"
+					}
+
+					return "250-PROTOCOLINFO 1\r\n" +
+						"250-AUTH METHODS=NULL\r\n" +
+						"250-VERSION " +
+						"Tor=\"0.3.3.6\"\r\n" +
+						"250 OK\r\n"
+				},
+			}
+			go server.serve()
+		}
+	}()
+
+	// If none of the addresses can be connected to, the error should
+	// mention each of them.
+	c := NewController(refusingAddrs...)
+	err = c.Start()
+	if err == nil {
+		t.Fatalf("expected start to fail")
+	}
+	for _, addr := range refusingAddrs {
+		if !strings.Contains(err.Error(), addr) {
+			t.Fatalf("expected error to mention %v: %v", addr, err)
+		}
+	}
+
+	c = NewController(refusingAddrs[0], listener.Addr().String())
+	if err := c.Start(); err != nil {
+		t.Fatalf("unable to start controller: %v", err)
+	}
+	defer c.Stop()
+
+	if c.version != "0.3.3.6" {
+		t.Fatalf("expected version 0.3.3.6, got %v", c.version)
+	}
+}
+
+// TestAddOnionCommand ensures that the ADD_ONION command is built correctly for
+// the different combinations of onion types, keys and ports.
+func TestAddOnionCommand(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	keyPath := filepath.Join(tempDir, "onion_key")
+	err = ioutil.WriteFile(keyPath, []byte(testV3PrivateKey), 0600)
+	if err != nil {
+		t.Fatalf("unable to write private key: %v", err)
+	}
+	v2Key := newTestV2PrivateKey(t)
+
+	invalidKeyPath := filepath.Join(tempDir, "invalid_key")
+	err = ioutil.WriteFile(invalidKeyPath, []byte("invalid"), 0600)
+	if err != nil {
+		t.Fatalf("unable to write private key: %v", err)
+	}
+	missingKeyPath := filepath.Join(tempDir, "missing_key")
+
+	tests := []struct {
+		name  string
+		cfg   AddOnionConfig
+		cmd   string
+		valid bool
+	}{
+		{
+			name: "ephemeral v2",
+			cfg: AddOnionConfig{
+				Type:        V2,
+				VirtualPort: 9735,
+			},
+			cmd: "ADD_ONION NEW:RSA1024 Flags=DiscardPK " +
+				"Port=9735,9735 ",
+			valid: true,
+		},
+		{
+			name: "ephemeral v3 with target ports",
+			cfg: AddOnionConfig{
+				Type:        V3,
+				VirtualPort: 80,
+				TargetPorts: []int{8080, 8081, 8080},
+			},
+			cmd: "ADD_ONION NEW:ED25519-V3 Flags=DiscardPK " +
+				"Port=80,8080 Port=80,8081 ",
+			valid: true,
+		},
+		{
+			name: "new persistent v3",
+			cfg: AddOnionConfig{
+				Type:           V3,
+				VirtualPort:    9735,
+				PrivateKeyPath: missingKeyPath,
+			},
+			cmd:   "ADD_ONION NEW:ED25519-V3 Port=9735,9735 ",
+			valid: true,
+		},
+		{
+			name: "restored from file",
+			cfg: AddOnionConfig{
+				Type:           V3,
+				VirtualPort:    9735,
+				PrivateKeyPath: keyPath,
+			},
+			cmd:   "ADD_ONION " + testV3PrivateKey + " Port=9735,9735 ",
+			valid: true,
+		},
+		{
+			name: "restored from memory",
+			cfg: AddOnionConfig{
+				Type:           V2,
+				VirtualPort:    9735,
+				PrivateKeyPath: keyPath,
+				PrivateKey:     OnionPrivateKey(v2Key),
+			},
+			cmd:   "ADD_ONION " + v2Key + " Port=9735,9735 ",
+			valid: true,
+		},
+		{
+			name: "invalid key in file",
+			cfg: AddOnionConfig{
+				Type:           V3,
+				VirtualPort:    9735,
+				PrivateKeyPath: invalidKeyPath,
+			},
+			valid: false,
+		},
+		{
+			name: "invalid key in memory",
+			cfg: AddOnionConfig{
+				Type:        V3,
+				VirtualPort: 9735,
+				PrivateKey:  "memkey",
+			},
+			valid: false,
+		},
+		{
+			name: "wrong key type in memory",
+			cfg: AddOnionConfig{
+				Type:        V3,
+				VirtualPort: 9735,
+				PrivateKey:  OnionPrivateKey(v2Key),
+			},
+			valid: false,
+		},
+		{
+			name: "corrupt key in memory",
+			cfg: AddOnionConfig{
+				Type:        V3,
+				VirtualPort: 9735,
+				PrivateKey:  "ED25519-V3:memkey",
+			},
+			valid: false,
+		},
+		{
+			name: "invalid port",
+			cfg: AddOnionConfig{
+				Type:        V3,
+				VirtualPort: 9735,
+				TargetPorts: []int{70000},
+			},
+			valid: false,
+		},
+		{
+			name: "unknown type",
+			cfg: AddOnionConfig{
+				Type:        OnionType(99),
+				VirtualPort: 9735,
+			},
+			valid: false,
+		},
+		{
+			name: "ephemeral v2 with client auth",
+			cfg: AddOnionConfig{
+				Type:        V2,
+				VirtualPort: 9735,
+				ClientAuth: []OnionClientAuth{
+					{Name: "alice"},
+					{
+						Name:   "bob",
+						Cookie: "dGVzdGNvb2tpZWJsb2I",
+					},
+				},
+			},
+			cmd: "ADD_ONION NEW:RSA1024 " +
+				"Flags=DiscardPK,BasicAuth Port=9735,9735 " +
+				"ClientAuth=alice " +
+				"ClientAuth=bob:dGVzdGNvb2tpZWJsb2I ",
+			valid: true,
+		},
+		{
+			name: "restored v2 with client auth",
+			cfg: AddOnionConfig{
+				Type:        V2,
+				VirtualPort: 9735,
+				PrivateKey:  OnionPrivateKey(v2Key),
+				ClientAuth: []OnionClientAuth{
+					{Name: "alice"},
+				},
+			},
+			cmd: "ADD_ONION " + v2Key + " Flags=BasicAuth " +
+				"Port=9735,9735 ClientAuth=alice ",
+			valid: true,
+		},
+		{
+			name: "v3 with client auth",
+			cfg: AddOnionConfig{
+				Type:        V3,
+				VirtualPort: 9735,
+				ClientAuth: []OnionClientAuth{
+					{Name: "alice"},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "invalid client name",
+			cfg: AddOnionConfig{
+				Type:        V2,
+				VirtualPort: 9735,
+				ClientAuth: []OnionClientAuth{
+					{Name: "alice:bob"},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "duplicate client",
+			cfg: AddOnionConfig{
+				Type:        V2,
+				VirtualPort: 9735,
+				ClientAuth: []OnionClientAuth{
+					{Name: "alice"},
+					{Name: "alice"},
+				},
+			},
+			valid: false,
+		},
+	}
+
+	for _, test := range tests {
+		cmd, err := test.cfg.Command()
+		if test.valid != (err == nil) {
+			t.Fatalf("test %q: unexpected error: %v", test.name,
+				err)
+		}
+
+		if cmd != test.cmd {
+			t.Fatalf("test %q: expected command %q, got %q",
+				test.name, test.cmd, cmd)
+		}
+	}
+}
+
+// TestAddOnionPortMappings ensures that the port mappings of a created onion
+// service are returned along with its address.
+func TestAddOnionPortMappings(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newMockController(
+		t, MinTorVersion, addOnionHandler("mapped", "ED25519-V3:key"),
+	)
+	defer c.conn.Close()
+
+	addr, err := c.AddOnion(AddOnionConfig{
+		Type:        V3,
+		VirtualPort: 80,
+		TargetPorts: []int{8080, 8081, 8080},
+	})
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+
+	expected := []PortMapping{
+		{VirtualPort: 80, TargetPort: 8080},
+		{VirtualPort: 80, TargetPort: 8081},
+	}
+	if !reflect.DeepEqual(addr.PortMappings, expected) {
+		t.Fatalf("expected port mappings %v, got %v", expected,
+			addr.PortMappings)
+	}
+}
+
+// TestPing ensures that Ping succeeds while the connection to the Tor server is
+// alive, and reports a ConnectionError once it has been closed.
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	c, server := newMockController(t, MinTorVersion, func(string) string {
+		return "250-version=" + MinTorVersion + "\r\n250 OK\r\n"
+	})
+	defer c.conn.Close()
+
+	// Concurrent pings should all be answered by their own reply.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Ping()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unable to ping: %v", err)
+		}
+	}
+	if cmd := server.lastCommand(); cmd != "GETINFO version" {
+		t.Fatalf("unexpected command %q", cmd)
+	}
+
+	// Once the server closes the connection, pinging should fail.
+	server.conn.Close()
+
+	err := c.Ping()
+	if _, ok := err.(*ConnectionError); !ok {
+		t.Fatalf("expected ConnectionError, got %v", err)
+	}
+}
+
+// TestNormalizeControlAddr ensures that control addresses are validated and
+// normalized to the host:port format before dialing.
+func TestNormalizeControlAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr       string
+		normalized string
+		valid      bool
+	}{
+		{
+			addr:       "127.0.0.1:9051",
+			normalized: "127.0.0.1:9051",
+			valid:      true,
+		},
+		{
+			addr:       "127.0.0.1",
+			normalized: "127.0.0.1:9051",
+			valid:      true,
+		},
+		{
+			addr:       "[::1]:9051",
+			normalized: "[::1]:9051",
+			valid:      true,
+		},
+		{
+			addr:       "::1",
+			normalized: "[::1]:9051",
+			valid:      true,
+		},
+		{
+			addr:       "[fe80::1]",
+			normalized: "[fe80::1]:9051",
+			valid:      true,
+		},
+		{
+			addr:       "localhost",
+			normalized: "localhost:9051",
+			valid:      true,
+		},
+		{
+			addr:       "tor.example.com:9151",
+			normalized: "tor.example.com:9151",
+			valid:      true,
+		},
+		{
+			addr:       "9151",
+			normalized: "localhost:9151",
+			valid:      true,
+		},
+		{
+			addr:  "",
+			valid: false,
+		},
+		{
+			addr:  ":9051",
+			valid: false,
+		},
+		{
+			addr:  "127.0.0.1:port",
+			valid: false,
+		},
+		{
+			addr:  "127.0.0.1:70000",
+			valid: false,
+		},
+		{
+			addr:  "[::1",
+			valid: false,
+		},
+		{
+			addr:  "host:9051:9051",
+			valid: false,
+		},
+	}
+
+	for _, test := range tests {
+		normalized, err := normalizeControlAddr(test.addr)
+		if test.valid != (err == nil) {
+			t.Fatalf("address %q: unexpected error: %v", test.addr,
+				err)
+		}
+
+		if normalized != test.normalized {
+			t.Fatalf("address %q: expected %q, got %q", test.addr,
+				test.normalized, normalized)
+		}
+	}
+}
+
+// safeCookieHandler returns a handler implementing the SAFECOOKIE
+// authentication flow for the given cookie file, using keywords in the given
+// case.
+func safeCookieHandler(cookie []byte, cookiePath string,
+	keywordCase func(string) string) func(string) string {
+
+	serverNonce := bytes.Repeat([]byte{0x02}, nonceLen)
+	var hmacMessage []byte
+
+	return func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "PROTOCOLINFO"):
+			return fmt.Sprintf("250-%s 1\r\n"+
+				"250-%s %s=%s %s=\"%s\"\r\n"+
+				"250-%s %s=\"0.3.3.6\"\r\n"+
+				"250 OK\r\n",
+				keywordCase("PROTOCOLINFO"), keywordCase("AUTH"),
+				keywordCase("METHODS"),
+				keywordCase("COOKIE,SAFECOOKIE"),
+				keywordCase("COOKIEFILE"), cookiePath,
+				keywordCase("VERSION"), keywordCase("Tor"))
+
+		case strings.HasPrefix(cmd, "AUTHCHALLENGE SAFECOOKIE "):
+			clientNonce, err := hex.DecodeString(strings.TrimPrefix(
+				cmd, "AUTHCHALLENGE SAFECOOKIE ",
+			))
+			if err != nil {
+				return "513 Invalid nonce\r\n"
+			}
+
+			hmacMessage = bytes.Join(
+				[][]byte{cookie, clientNonce, serverNonce}, nil,
+			)
+			serverHash := computeHMAC256(serverKey, hmacMessage)
+
+			return fmt.Sprintf("250 %s %s=%x %s=%x\r\n",
+				keywordCase("AUTHCHALLENGE"),
+				keywordCase("SERVERHASH"), serverHash,
+				keywordCase("SERVERNONCE"), serverNonce)
+
+		case strings.HasPrefix(cmd, "AUTHENTICATE "):
+			clientHash := computeHMAC256(controllerKey, hmacMessage)
+			if cmd != fmt.Sprintf("AUTHENTICATE %x", clientHash) {
+				return "515 Authentication failed\r\n"
+			}
+			return "250 OK\r\n"
+
+		default:
+			return "510 Unrecognized command\r\n"
+		}
+	}
+}
+
+// TestAuthenticateKeywordCase ensures that authentication succeeds regardless
+// of the case of the keywords used by the Tor server.
+func TestAuthenticateKeywordCase(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookie := bytes.Repeat([]byte{0x01}, cookieLen)
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	if err := ioutil.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		keywordCase func(string) string
+	}{
+		{
+			name:        "uppercase",
+			keywordCase: strings.ToUpper,
+		},
+		{
+			name:        "lowercase",
+			keywordCase: strings.ToLower,
+		},
+		{
+			name: "mixed case",
+			keywordCase: func(s string) string {
+				if len(s) < 2 {
+					return s
+				}
+				return strings.ToLower(s[:1]) +
+					strings.ToUpper(s[1:2]) +
+					strings.ToLower(s[2:])
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c, _ := newMockController(
+			t, "", safeCookieHandler(
+				cookie, cookiePath, test.keywordCase,
+			),
+		)
+
+		err := c.authenticate()
+		c.conn.Close()
+		if err != nil {
+			t.Fatalf("test %q: unable to authenticate: %v",
+				test.name, err)
+		}
+
+		if c.version != "0.3.3.6" {
+			t.Fatalf("test %q: expected version 0.3.3.6, got %v",
+				test.name, c.version)
+		}
+	}
+}
+
+// TestAuthChallengeRetry ensures that the AUTHCHALLENGE command is retried
+// with a fresh nonce after a transient failure, and that permanent failures
+// are not retried.
+func TestAuthChallengeRetry(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookie := bytes.Repeat([]byte{0x01}, cookieLen)
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	if err := ioutil.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		failureReply  string
+		failures      int
+		retries       int
+		expectedTries int
+		expectErr     bool
+	}{
+		{
+			name:          "transient failure retried",
+			failureReply:  "551 Internal error\r\n",
+			failures:      1,
+			retries:       DefaultAuthChallengeRetries,
+			expectedTries: 2,
+		},
+		{
+			name:          "retries exhausted",
+			failureReply:  "451 Resource exhausted\r\n",
+			failures:      3,
+			retries:       DefaultAuthChallengeRetries,
+			expectedTries: 3,
+			expectErr:     true,
+		},
+		{
+			name:          "retries disabled",
+			failureReply:  "551 Internal error\r\n",
+			failures:      1,
+			retries:       0,
+			expectedTries: 1,
+			expectErr:     true,
+		},
+		{
+			name:          "permanent failure",
+			failureReply:  "513 Invalid nonce\r\n",
+			failures:      1,
+			retries:       DefaultAuthChallengeRetries,
+			expectedTries: 1,
+			expectErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		handler := safeCookieHandler(cookie, cookiePath, strings.ToUpper)
+		failures := test.failures
+
+		c, server := newMockController(t, "", func(cmd string) string {
+			if strings.HasPrefix(cmd, "AUTHCHALLENGE") && failures > 0 {
+				failures--
+				return test.failureReply
+			}
+			return handler(cmd)
+		})
+		c.SetAuthChallengeRetries(test.retries)
+
+		err := c.authenticate()
+		c.conn.Close()
+		switch {
+		case test.expectErr && err == nil:
+			t.Fatalf("test %q: expected error", test.name)
+		case !test.expectErr && err != nil:
+			t.Fatalf("test %q: unable to authenticate: %v",
+				test.name, err)
+		}
+
+		server.mu.Lock()
+		nonces := make(map[string]struct{})
+		for _, cmd := range server.commands {
+			if strings.HasPrefix(cmd, "AUTHCHALLENGE") {
+				nonces[cmd] = struct{}{}
+			}
+		}
+		server.mu.Unlock()
+
+		if len(nonces) != test.expectedTries {
+			t.Fatalf("test %q: expected %d AUTHCHALLENGE commands "+
+				"with distinct nonces, got %d", test.name,
+				test.expectedTries, len(nonces))
+		}
+	}
+}
+
+// timeoutError is a net.Error indicating a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// TestIsTransientError ensures that only clean replies indicating a temporary
+// failure of the Tor server are considered transient, as retrying after a
+// connection error could desync replies from their requests.
+func TestIsTransientError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{
+			name:      "resource exhausted",
+			err:       &ControlError{Code: resourceExhausted},
+			transient: true,
+		},
+		{
+			name:      "internal error",
+			err:       &ControlError{Code: internalError},
+			transient: true,
+		},
+		{
+			name: "permanent failure",
+			err:  &ControlError{Code: 513},
+		},
+		{
+			name: "connection timeout",
+			err:  &ConnectionError{Err: timeoutError{}},
+		},
+		{
+			name: "connection closed",
+			err:  &ConnectionError{Err: io.EOF},
+		},
+		{
+			name: "other error",
+			err:  errors.New("other"),
+		},
+	}
+
+	for _, test := range tests {
+		if isTransientError(test.err) != test.transient {
+			t.Fatalf("test %q: expected transient=%v", test.name,
+				test.transient)
+		}
+	}
+}
+
+// TestListOnions ensures that the onion services currently served by the Tor
+// server are listed, parsing both single-line and data block replies.
+func TestListOnions(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		current  string
+		detached string
+		expected []string
+	}{
+		{
+			name: "current and detached",
+			current: "250+onions/current=\r\n" +
+				"service1\r\n" +
+				"service2\r\n" +
+				"service3\r\n" +
+				".\r\n" +
+				"250 OK\r\n",
+			detached: "250-onions/detached=detached1\r\n" +
+				"250 OK\r\n",
+			expected: []string{
+				"service1", "service2", "service3",
+				"detached1",
+			},
+		},
+		{
+			name: "none detached",
+			current: "250-onions/current=service1\r\n" +
+				"250 OK\r\n",
+			detached: "551 No onion services of the specified " +
+				"type.\r\n",
+			expected: []string{"service1"},
+		},
+		{
+			name: "none at all",
+			current: "551 No onion services of the specified " +
+				"type.\r\n",
+			detached: "551 No onion services of the specified " +
+				"type.\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		c, _ := newMockController(t, "", func(cmd string) string {
+			switch cmd {
+			case "GETINFO onions/current":
+				return test.current
+			case "GETINFO onions/detached":
+				return test.detached
+			default:
+				return "510 Unrecognized command\r\n"
+			}
+		})
+
+		onions, err := c.ListOnions()
+		c.conn.Close()
+		if err != nil {
+			t.Fatalf("test %q: unable to list onions: %v",
+				test.name, err)
+		}
+
+		if !reflect.DeepEqual(onions, test.expected) {
+			t.Fatalf("test %q: expected onions %v, got %v",
+				test.name, test.expected, onions)
+		}
+	}
+
+	// Other errors should be returned as is.
+	c, _ := newMockController(t, "", func(cmd string) string {
+		return "552 Unrecognized key\r\n"
+	})
+	defer c.conn.Close()
+
+	_, err := c.ListOnions()
+	if controlErr, ok := err.(*ControlError); !ok ||
+		controlErr.Code != 552 {
+
+		t.Fatalf("expected ControlError with code 552, got %v", err)
+	}
+}
+
+// TestVerifyHMAC256 ensures that only the HMAC-SHA256 of the key and message is
+// accepted as a valid MAC.
+func TestVerifyHMAC256(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("key")
+	message := []byte("message")
+	mac := computeHMAC256(key, message)
+
+	if !verifyHMAC256(key, message, mac) {
+		t.Fatalf("expected matching MAC to be valid")
+	}
+
+	tampered := append([]byte(nil), mac...)
+	tampered[0] ^= 0x01
+
+	tests := []struct {
+		name     string
+		key      []byte
+		message  []byte
+		expected []byte
+	}{
+		{
+			name:     "tampered mac",
+			key:      key,
+			message:  message,
+			expected: tampered,
+		},
+		{
+			name:     "wrong key",
+			key:      []byte("other key"),
+			message:  message,
+			expected: mac,
+		},
+		{
+			name:     "wrong message",
+			key:      key,
+			message:  []byte("other message"),
+			expected: mac,
+		},
+		{
+			name:     "truncated mac",
+			key:      key,
+			message:  message,
+			expected: mac[:len(mac)-1],
+		},
+		{
+			name:    "empty mac",
+			key:     key,
+			message: message,
+		},
+	}
+
+	for _, test := range tests {
+		if verifyHMAC256(test.key, test.message, test.expected) {
+			t.Fatalf("test %q: expected MAC to be invalid",
+				test.name)
+		}
+	}
+}
+
+// TestStopInFlightCommand ensures that Stop waits for an in-flight command to
+// complete, or aborts it once the stop timeout expires, and that commands sent
+// afterwards are rejected.
+func TestStopInFlightCommand(t *testing.T) {
+	t.Parallel()
+
+	const stopTimeout = time.Minute
+
+	tests := []struct {
+		name     string
+		complete bool
+	}{
+		{
+			name:     "command completes",
+			complete: true,
+		},
+		{
+			name:     "command aborted",
+			complete: false,
+		},
+	}
+
+	for _, test := range tests {
+		received := make(chan struct{})
+		release := make(chan struct{})
+		c, _ := newMockController(t, "", func(cmd string) string {
+			close(received)
+			<-release
+			return "250-version=0.3.3.6\r\n250 OK\r\n"
+		})
+		testClock := clock.NewTestClock(time.Unix(0, 0))
+		c.SetClock(testClock)
+		c.SetStopTimeout(stopTimeout)
+
+		pingErr := make(chan error, 1)
+		go func() {
+			pingErr <- c.Ping()
+		}()
+		<-received
+
+		stopped := make(chan struct{})
+		go func() {
+			c.Stop()
+			close(stopped)
+		}()
+
+		// Stop shouldn't return while the command is still in flight
+		// and the stop timeout hasn't expired.
+		select {
+		case <-stopped:
+			t.Fatalf("test %q: stopped with command in flight",
+				test.name)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if test.complete {
+			close(release)
+
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("test %q: stop timed out", test.name)
+			}
+		} else {
+			// Once the stop timeout expires, the connection
+			// should be closed regardless. As we can't tell when
+			// the timer is started, we'll keep advancing the
+			// clock until Stop returns.
+			timeout := time.After(5 * time.Second)
+		wait:
+			for {
+				select {
+				case <-stopped:
+					break wait
+
+				case <-time.After(10 * time.Millisecond):
+					testClock.Advance(stopTimeout)
+
+				case <-timeout:
+					t.Fatalf("test %q: stop timed out",
+						test.name)
+				}
+			}
+		}
+
+		err := <-pingErr
+		if test.complete && err != nil {
+			t.Fatalf("test %q: unable to ping: %v", test.name, err)
+		}
+		if _, ok := err.(*ConnectionError); !test.complete && !ok {
+			t.Fatalf("test %q: expected ConnectionError, got %v",
+				test.name, err)
+		}
+
+		if err := c.Ping(); err != ErrControllerStopping {
+			t.Fatalf("test %q: expected ErrControllerStopping, "+
+				"got %v", test.name, err)
+		}
+
+		if !test.complete {
+			close(release)
+		}
+	}
+}
+
+// TestCookieFilePathOverride ensures that the authentication cookie is read
+// from the overridden path instead of the one reported by the Tor server.
+func TestCookieFilePathOverride(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookie := bytes.Repeat([]byte{0x01}, cookieLen)
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	if err := ioutil.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+
+	// The Tor server reports the path of the cookie file as seen from
+	// within its own container, which doesn't exist for us.
+	reportedPath := "/var/lib/tor/control_auth_cookie"
+	handler := safeCookieHandler(cookie, reportedPath, strings.ToUpper)
+
+	c, _ := newMockController(t, "", handler)
+	err = c.authenticate()
+	c.conn.Close()
+	if err == nil {
+		t.Fatalf("expected authentication without override to fail")
+	}
+
+	c, _ = newMockController(t, "", handler)
+	defer c.conn.Close()
+
+	c.SetCookieFilePath(cookiePath)
+	if err := c.authenticate(); err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+}
+
+// TestExtendCircuit ensures that the EXTENDCIRCUIT command is built from the
+// given circuit ID and path, and that the ID of the circuit is parsed from the
+// reply.
+func TestExtendCircuit(t *testing.T) {
+	t.Parallel()
+
+	fp1 := "$" + strings.Repeat("ab", 20)
+	fp2 := strings.Repeat("CD", 20)
+
+	tests := []struct {
+		name        string
+		circID      string
+		path        []string
+		reply       string
+		expectedCmd string
+		expectedID  string
+		expectErr   bool
+	}{
+		{
+			name:        "new circuit",
+			path:        []string{fp1, fp2},
+			reply:       "250 EXTENDED 12\r\n",
+			expectedCmd: "EXTENDCIRCUIT 0 " + fp1 + "," + fp2,
+			expectedID:  "12",
+		},
+		{
+			name:        "new circuit without path",
+			circID:      "0",
+			reply:       "250 EXTENDED 13\r\n",
+			expectedCmd: "EXTENDCIRCUIT 0",
+			expectedID:  "13",
+		},
+		{
+			name:        "existing circuit",
+			circID:      "7",
+			path:        []string{fp2},
+			reply:       "250 EXTENDED 7\r\n",
+			expectedCmd: "EXTENDCIRCUIT 7 " + fp2,
+			expectedID:  "7",
+		},
+		{
+			name:      "short fingerprint",
+			path:      []string{fp1[:20]},
+			expectErr: true,
+		},
+		{
+			name:      "non-hex fingerprint",
+			path:      []string{strings.Repeat("zz", 20)},
+			expectErr: true,
+		},
+		{
+			name:      "nickname",
+			path:      []string{"relay1"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid circuit id",
+			circID:    "1 2",
+			expectErr: true,
+		},
+		{
+			name:        "unknown circuit",
+			circID:      "8",
+			reply:       "552 Unknown circuit \"8\"\r\n",
+			expectedCmd: "EXTENDCIRCUIT 8",
+			expectErr:   true,
+		},
+		{
+			name:        "malformed reply",
+			reply:       "250 OK\r\n",
+			expectedCmd: "EXTENDCIRCUIT 0",
+			expectErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		c, server := newMockController(t, "", func(cmd string) string {
+			return test.reply
+		})
+
+		circID, err := c.ExtendCircuit(test.circID, test.path)
+		c.conn.Close()
+		switch {
+		case test.expectErr && err == nil:
+			t.Fatalf("test %q: expected error", test.name)
+		case !test.expectErr && err != nil:
+			t.Fatalf("test %q: unable to extend circuit: %v",
+				test.name, err)
+		}
+
+		if circID != test.expectedID {
+			t.Fatalf("test %q: expected circuit id %q, got %q",
+				test.name, test.expectedID, circID)
+		}
+
+		// Invalid arguments should be rejected before sending any
+		// command.
+		server.mu.Lock()
+		commands := server.commands
+		server.mu.Unlock()
+
+		var expectedCmds []string
+		if test.expectedCmd != "" {
+			expectedCmds = []string{test.expectedCmd}
+		}
+		if !reflect.DeepEqual(commands, expectedCmds) {
+			t.Fatalf("test %q: expected commands %v, got %v",
+				test.name, expectedCmds, commands)
+		}
+	}
+}
+
+// TestCloseCircuit ensures that the CLOSECIRCUIT command is sent for valid
+// circuit IDs, and that errors from the Tor server are returned.
+func TestCloseCircuit(t *testing.T) {
+	t.Parallel()
+
+	c, server := newMockController(t, "", func(cmd string) string {
+		if cmd == "CLOSECIRCUIT 12" {
+			return "250 OK\r\n"
+		}
+		return "552 Unknown circuit\r\n"
+	})
+	defer c.conn.Close()
+
+	if err := c.CloseCircuit("12"); err != nil {
+		t.Fatalf("unable to close circuit: %v", err)
+	}
+
+	err := c.CloseCircuit("13")
+	if controlErr, ok := err.(*ControlError); !ok ||
+		controlErr.Code != 552 {
+
+		t.Fatalf("expected ControlError with code 552, got %v", err)
+	}
+
+	if err := c.CloseCircuit(""); err == nil {
+		t.Fatalf("expected empty circuit id to be rejected")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	expected := []string{"CLOSECIRCUIT 12", "CLOSECIRCUIT 13"}
+	if !reflect.DeepEqual(server.commands, expected) {
+		t.Fatalf("expected commands %v, got %v", expected,
+			server.commands)
+	}
+}
+
+// TestWaitForOnion ensures that WaitForOnion returns once the descriptor of the
+// given onion service has been uploaded, or the context expires, and that the
+// event subscription is removed in both cases.
+func TestWaitForOnion(t *testing.T) {
+	t.Parallel()
+
+	const (
+		serviceID = "testonion1234567"
+		hsDir     = "$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	)
+
+	tests := []struct {
+		name      string
+		events    string
+		expectErr error
+	}{
+		{
+			name: "uploaded",
+			events: "650 HS_DESC UPLOAD " + serviceID +
+				" UNKNOWN " + hsDir + "\r\n" +
+				"650 HS_DESC UPLOADED otheronion123456 " +
+				"UNKNOWN " + hsDir + "\r\n" +
+				"650 HS_DESC FAILED " + serviceID +
+				" UNKNOWN " + hsDir + "\r\n" +
+				"650 HS_DESC UPLOADED " + serviceID +
+				" UNKNOWN " + hsDir + "\r\n",
+		},
+		{
+			name: "not uploaded",
+			events: "650 HS_DESC UPLOAD " + serviceID +
+				" UNKNOWN " + hsDir + "\r\n",
+			expectErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		c, server := newMockController(t, "", func(cmd string) string {
+			switch cmd {
+			case "SETEVENTS HS_DESC":
+				return "250 OK\r\n" + test.events
+
+			// Events sent before the subscription is removed
+			// should be skipped.
+			case "SETEVENTS":
+				return "650 HS_DESC UPLOADED " + serviceID +
+					" UNKNOWN " + hsDir + "\r\n" +
+					"250 OK\r\n"
+
+			case "GETINFO version":
+				return "250-version=0.3.3.6\r\n250 OK\r\n"
+
+			default:
+				return "510 Unrecognized command\r\n"
+			}
+		})
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 100*time.Millisecond,
+		)
+		err := c.WaitForOnion(ctx, serviceID+".onion")
+		cancel()
+		if err != test.expectErr {
+			c.conn.Close()
+			t.Fatalf("test %q: expected error %v, got %v",
+				test.name, test.expectErr, err)
+		}
+
+		// The connection should still be usable afterwards.
+		err = c.Ping()
+		c.conn.Close()
+		if err != nil {
+			t.Fatalf("test %q: unable to ping: %v", test.name, err)
+		}
+
+		server.mu.Lock()
+		commands := server.commands
+		server.mu.Unlock()
+
+		expected := []string{
+			"SETEVENTS HS_DESC", "SETEVENTS", "GETINFO version",
+		}
+		if !reflect.DeepEqual(commands, expected) {
+			t.Fatalf("test %q: expected commands %v, got %v",
+				test.name, expected, commands)
+		}
+	}
+
+	// A failure to subscribe should be returned as is.
+	c, _ := newMockController(t, "", func(cmd string) string {
+		return "552 Unrecognized event\r\n"
+	})
+	defer c.conn.Close()
+
+	err := c.WaitForOnion(context.Background(), serviceID)
+	if controlErr, ok := err.(*ControlError); !ok ||
+		controlErr.Code != 552 {
+
+		t.Fatalf("expected ControlError with code 552, got %v", err)
+	}
+}
+
+// TestWaitForOnionSubscribed ensures that other commands can be sent while
+// waiting for an onion service, and that waiting works alongside an event
+// stream subscription, without delivering the waited for events on it.
+func TestWaitForOnionSubscribed(t *testing.T) {
+	t.Parallel()
+
+	const (
+		serviceID = "testonion1234567"
+		hsDir     = "$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	)
+
+	waiting := make(chan struct{})
+	c, server := newMockController(t, "", func(cmd string) string {
+		switch cmd {
+		case "SETEVENTS CIRC":
+			return "250 OK\r\n"
+
+		case "SETEVENTS CIRC HS_DESC":
+			close(waiting)
+			return "250 OK\r\n"
+
+		case "GETINFO version":
+			return "650 CIRC 1 BUILT\r\n" +
+				"650 HS_DESC UPLOADED " + serviceID +
+				" UNKNOWN " + hsDir + "\r\n" +
+				"250-version=0.4.8.9\r\n250 OK\r\n"
+
+		default:
+			return "510 Unrecognized command\r\n"
+		}
+	})
+	defer c.conn.Close()
+
+	events, err := c.SubscribeEvents("CIRC")
+	if err != nil {
+		t.Fatalf("unable to subscribe to events: %v", err)
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- c.WaitForOnion(context.Background(), serviceID)
+	}()
+
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not subscribed to HS_DESC events")
+	}
+
+	// Commands shouldn't be blocked while waiting. The events preceding
+	// the reply complete the wait.
+	if err := c.Ping(); err != nil {
+		t.Fatalf("unable to ping: %v", err)
+	}
+
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("unable to wait for onion: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait for onion didn't complete")
+	}
+
+	// The subscriber should only receive the events it subscribed to.
+	if event := <-events; event != "CIRC 1 BUILT" {
+		t.Fatalf("expected CIRC event, got %q", event)
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %q", event)
+	default:
+	}
+
+	server.mu.Lock()
+	commands := server.commands
+	server.mu.Unlock()
+
+	expected := []string{
+		"SETEVENTS CIRC", "SETEVENTS CIRC HS_DESC", "GETINFO version",
+		"SETEVENTS CIRC",
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands %v, got %v", expected, commands)
+	}
+}
+
+// TestOnionAddrType ensures that the type of an onion service is derived from
+// the length of its service ID.
+func TestOnionAddrType(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		service   string
+		expected  OnionType
+		expectErr bool
+	}{
+		{
+			name:     "v2",
+			service:  strings.Repeat("a", 16) + OnionSuffix,
+			expected: V2,
+		},
+		{
+			name:     "v3",
+			service:  strings.Repeat("a", 56) + OnionSuffix,
+			expected: V3,
+		},
+		{
+			name:     "v3 without suffix",
+			service:  strings.Repeat("a", 56),
+			expected: V3,
+		},
+		{
+			name:      "unknown length",
+			service:   "restored.onion",
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		addr := &OnionAddr{OnionService: test.service, Port: 9735}
+
+		onionType, err := addr.Type()
+		switch {
+		case test.expectErr && err == nil:
+			t.Fatalf("test %q: expected error", test.name)
+		case !test.expectErr && err != nil:
+			t.Fatalf("test %q: unexpected error: %v", test.name,
+				err)
+		case onionType != test.expected:
+			t.Fatalf("test %q: expected type %v, got %v",
+				test.name, test.expected, onionType)
+		}
+	}
+}
+
+// recordingOnionObserver is an OnionObserver recording the events it was
+// notified of.
+type recordingOnionObserver struct {
+	events []string
+}
+
+func (r *recordingOnionObserver) record(event, serviceID string,
+	onionType OnionType) {
+
+	r.events = append(
+		r.events, fmt.Sprintf("%v %v %v", event, serviceID, onionType),
+	)
+}
+
+func (r *recordingOnionObserver) OnCreated(serviceID string,
+	onionType OnionType) {
+
+	r.record("created", serviceID, onionType)
+}
+
+func (r *recordingOnionObserver) OnRestored(serviceID string,
+	onionType OnionType) {
+
+	r.record("restored", serviceID, onionType)
+}
+
+func (r *recordingOnionObserver) OnDeleted(serviceID string,
+	onionType OnionType) {
+
+	r.record("deleted", serviceID, onionType)
+}
+
+var _ OnionObserver = (*recordingOnionObserver)(nil)
+
+// TestOnionObserver ensures that the onion observer is notified with the
+// correct service ID when onion services are created, restored and deleted.
+func TestOnionObserver(t *testing.T) {
+	t.Parallel()
+
+	serviceID := strings.Repeat("a", 56)
+	unknownID := strings.Repeat("b", 56)
+
+	addHandler := addOnionHandler(serviceID, "ED25519-V3:newkey")
+	c, server := newMockController(t, MinTorVersion, func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "ADD_ONION"):
+			return addHandler(cmd)
+		case cmd == "DEL_ONION "+serviceID:
+			return "250 OK\r\n"
+		default:
+			return "552 Unknown Onion Service id\r\n"
+		}
+	})
+	defer c.conn.Close()
+
+	observer := &recordingOnionObserver{}
+	c.SetOnionObserver(observer)
+
+	_, err := c.AddOnion(AddOnionConfig{Type: V3, VirtualPort: 9735})
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+
+	_, err = c.AddOnion(AddOnionConfig{
+		Type:        V3,
+		VirtualPort: 9735,
+		PrivateKey:  testV3PrivateKey,
+	})
+	if err != nil {
+		t.Fatalf("unable to restore onion: %v", err)
+	}
+
+	if err := c.DelOnion(serviceID + OnionSuffix); err != nil {
+		t.Fatalf("unable to delete onion: %v", err)
+	}
+
+	// Failing to delete an onion service shouldn't notify the observer.
+	err = c.DelOnion(unknownID)
+	if controlErr, ok := err.(*ControlError); !ok ||
+		controlErr.Code != 552 {
+
+		t.Fatalf("expected ControlError with code 552, got %v", err)
+	}
+
+	// Invalid service IDs should be rejected before being sent.
+	server.mu.Lock()
+	numCommands := len(server.commands)
+	server.mu.Unlock()
+
+	invalidIDs := []string{
+		"", "short", serviceID + "\r\nSIGNAL HALT",
+		strings.Repeat("A", 56),
+	}
+	for _, id := range invalidIDs {
+		if err := c.DelOnion(id); err == nil {
+			t.Fatalf("expected service id %q to be rejected", id)
+		}
+	}
+
+	server.mu.Lock()
+	if len(server.commands) != numCommands {
+		t.Fatalf("expected invalid service ids not to be sent, got "+
+			"%v", server.commands[numCommands:])
+	}
+	server.mu.Unlock()
+
+	expected := []string{
+		"created " + serviceID + " v3",
+		"restored " + serviceID + " v3",
+		"deleted " + serviceID + " v3",
+	}
+	if !reflect.DeepEqual(observer.events, expected) {
+		t.Fatalf("expected events %v, got %v", expected,
+			observer.events)
+	}
+}
+
+// TestAddOnionPrivateKeyFileValidation ensures that private keys restored from
+// a file are validated before being sent to the server, and that corrupt ones
+// are reported along with the path of the file.
+func TestAddOnionPrivateKeyFileValidation(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unable to generate rsa key: %v", err)
+	}
+	rsaBlob := x509.MarshalPKCS1PrivateKey(rsaKey)
+	v2Key := "RSA1024:" + base64.StdEncoding.EncodeToString(rsaBlob)
+
+	largeRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate rsa key: %v", err)
+	}
+	largeV2Key := "RSA1024:" + base64.StdEncoding.EncodeToString(
+		x509.MarshalPKCS1PrivateKey(largeRSAKey),
+	)
+
+	ed25519Blob := bytes.Repeat([]byte{0x01}, 64)
+	v3Key := "ED25519-V3:" + base64.StdEncoding.EncodeToString(ed25519Blob)
+
+	tests := []struct {
+		name      string
+		onionType OnionType
+		key       string
+		errStr    string
+	}{
+		{
+			name:      "valid v2",
+			onionType: V2,
+			key:       v2Key,
+		},
+		{
+			name:      "valid v3",
+			onionType: V3,
+			key:       v3Key,
+		},
+		{
+			name:      "valid unpadded v3",
+			onionType: V3,
+			key:       strings.TrimRight(v3Key, "="),
+		},
+		{
+			name:      "v2 key for v3 service",
+			onionType: V3,
+			key:       v2Key,
+			errStr:    "expected v3 private key",
+		},
+		{
+			name:      "v3 key for v2 service",
+			onionType: V2,
+			key:       v3Key,
+			errStr:    "expected v2 private key",
+		},
+		{
+			name:      "truncated v3",
+			onionType: V3,
+			key: "ED25519-V3:" + base64.StdEncoding.EncodeToString(
+				ed25519Blob[:32],
+			),
+			errStr: "expected 64 byte ed25519 private key",
+		},
+		{
+			name:      "invalid base64 v3",
+			onionType: V3,
+			key:       "ED25519-V3:" + strings.Repeat("*", 88),
+			errStr:    "not valid base64",
+		},
+		{
+			name:      "truncated v2",
+			onionType: V2,
+			key: "RSA1024:" + base64.StdEncoding.EncodeToString(
+				rsaBlob[:len(rsaBlob)/2],
+			),
+			errStr: "not a valid RSA private key",
+		},
+		{
+			name:      "oversized v2",
+			onionType: V2,
+			key:       largeV2Key,
+			errStr:    "expected 1024-bit RSA private key",
+		},
+	}
+
+	for _, test := range tests {
+		keyPath := filepath.Join(tempDir, "onion_key")
+		err := ioutil.WriteFile(keyPath, []byte(test.key), 0600)
+		if err != nil {
+			t.Fatalf("test %q: unable to write private key: %v",
+				test.name, err)
+		}
+
+		c, server := newMockController(
+			t, MinTorVersion, addOnionHandler("restored", ""),
+		)
+		_, err = c.AddOnion(AddOnionConfig{
+			Type:           test.onionType,
+			VirtualPort:    9735,
+			PrivateKeyPath: keyPath,
+		})
+		c.conn.Close()
+
+		cmd := server.lastCommand()
+		if test.errStr == "" {
+			if err != nil {
+				t.Fatalf("test %q: unable to add onion: %v",
+					test.name, err)
+			}
+			if !strings.HasPrefix(cmd, "ADD_ONION "+test.key+" ") {
+				t.Fatalf("test %q: expected onion service to "+
+					"be restored, got %q", test.name, cmd)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), test.errStr) ||
+			!strings.Contains(err.Error(), keyPath) {
+
+			t.Fatalf("test %q: expected error containing %q and "+
+				"the key path, got: %v", test.name, test.errStr,
+				err)
+		}
+
+		// The key itself should never be included in the error.
+		if strings.Contains(err.Error(), test.key) {
+			t.Fatalf("test %q: private key leaked in error: %v",
+				test.name, err)
+		}
+
+		if cmd != "" {
+			t.Fatalf("test %q: expected no command to be sent, "+
+				"got %q", test.name, cmd)
+		}
+	}
+}
+
+// TestUnknownVersion ensures that a Tor server not advertising its version can
+// still be authenticated with, and that only v3 onion services are refused,
+// as their support can't be verified.
+func TestUnknownVersion(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookie := bytes.Repeat([]byte{0x01}, cookieLen)
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	if err := ioutil.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+
+	// The PROTOCOLINFO reply of the server won't include the VERSION
+	// line.
+	authHandler := safeCookieHandler(cookie, cookiePath, strings.ToUpper)
+	addHandler := addOnionHandler("service", "")
+	c, server := newMockController(t, "", func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "PROTOCOLINFO"):
+			var reply string
+			for _, line := range strings.SplitAfter(
+				authHandler(cmd), "\r\n",
+			) {
+				if !strings.HasPrefix(line, "250-VERSION") {
+					reply += line
+				}
+			}
+			return reply
+
+		case strings.HasPrefix(cmd, "ADD_ONION"):
+			return addHandler(cmd)
+
+		default:
+			return authHandler(cmd)
+		}
+	})
+	defer c.conn.Close()
+
+	if err := c.authenticate(); err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if c.version != "" {
+		t.Fatalf("expected unknown version, got %v", c.version)
+	}
+
+	server.mu.Lock()
+	numCommands := len(server.commands)
+	server.mu.Unlock()
+
+	_, err = c.AddOnion(AddOnionConfig{Type: V3, VirtualPort: 9735})
+	if err != ErrUnknownVersion {
+		t.Fatalf("expected ErrUnknownVersion, got %v", err)
+	}
+
+	server.mu.Lock()
+	if len(server.commands) != numCommands {
+		t.Fatalf("expected no command to be sent, got %v",
+			server.commands[numCommands:])
+	}
+	server.mu.Unlock()
+
+	// V2 onion services don't depend on the version, so they can still be
+	// created.
+	addr, err := c.AddOnion(AddOnionConfig{Type: V2, VirtualPort: 9735})
+	if err != nil {
+		t.Fatalf("unable to add onion: %v", err)
+	}
+	if addr.OnionService != "service.onion" {
+		t.Fatalf("unexpected onion service %v", addr.OnionService)
+	}
+}
+
+// TestDeterministicAuthentication ensures that the client nonce is read from
+// the configured source of randomness, such that the exact commands sent
+// during the SAFECOOKIE authentication can be reproduced.
+func TestDeterministicAuthentication(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookie := bytes.Repeat([]byte{0x01}, cookieLen)
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	if err := ioutil.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatalf("unable to write cookie: %v", err)
+	}
+
+	// The mock server always uses the same server nonce, so with a fixed
+	// client nonce, the client hash can be computed in advance.
+	clientNonce := bytes.Repeat([]byte{0x03}, nonceLen)
+	serverNonce := bytes.Repeat([]byte{0x02}, nonceLen)
+
+	mac := hmac.New(sha256.New, []byte("Tor safe cookie authentication "+
+		"controller-to-server hash"))
+	mac.Write(cookie)
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	clientHash := mac.Sum(nil)
+
+	c, server := newMockController(
+		t, "", safeCookieHandler(cookie, cookiePath, strings.ToUpper),
+	)
+	defer c.conn.Close()
+
+	c.SetRandSource(bytes.NewReader(clientNonce))
+	if err := c.authenticate(); err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+
+	server.mu.Lock()
+	commands := server.commands
+	server.mu.Unlock()
+
+	expected := []string{
+		fmt.Sprintf("PROTOCOLINFO %d", ProtocolInfoVersion),
+		fmt.Sprintf("AUTHCHALLENGE SAFECOOKIE %x", clientNonce),
+		fmt.Sprintf("AUTHENTICATE %x", clientHash),
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("expected commands %v, got %v", expected, commands)
+	}
+
+	// A source of randomness unable to provide a full nonce should result
+	// in an error, rather than a partially random nonce.
+	c, _ = newMockController(
+		t, "", safeCookieHandler(cookie, cookiePath, strings.ToUpper),
+	)
+	defer c.conn.Close()
+
+	c.SetRandSource(bytes.NewReader(clientNonce[:nonceLen-1]))
+	err = c.authenticate()
+	if err == nil || !strings.Contains(err.Error(), "client nonce") {
+		t.Fatalf("expected client nonce error, got %v", err)
+	}
+}
+
+// TestTakeOwnership ensures that TakeOwnership takes ownership of the Tor
+// server and resets its owning controller process, and that a failure to take
+// ownership is reported as a ControlError.
+func TestTakeOwnership(t *testing.T) {
+	t.Parallel()
+
+	c, server := newMockController(t, "", func(cmd string) string {
+		switch cmd {
+		case "TAKEOWNERSHIP", "RESETCONF __OwningControllerProcess":
+			return "250 OK\r\n"
+		default:
+			return "510 Unrecognized command\r\n"
+		}
+	})
+	defer c.conn.Close()
+
+	if err := c.TakeOwnership(); err != nil {
+		t.Fatalf("unable to take ownership: %v", err)
+	}
+
+	server.mu.Lock()
+	expected := []string{
+		"TAKEOWNERSHIP", "RESETCONF __OwningControllerProcess",
+	}
+	if !reflect.DeepEqual(server.commands, expected) {
+		t.Fatalf("expected commands %v, got %v", expected,
+			server.commands)
+	}
+	server.mu.Unlock()
+
+	// If the Tor server refuses, the option shouldn't be reset.
+	c, server = newMockController(t, "", func(cmd string) string {
+		return "510 Unrecognized command\r\n"
+	})
+	defer c.conn.Close()
+
+	err := c.TakeOwnership()
+	if controlErr, ok := err.(*ControlError); !ok ||
+		controlErr.Code != 510 {
+
+		t.Fatalf("expected ControlError with code 510, got %v", err)
+	}
+	if cmd := server.lastCommand(); cmd != "TAKEOWNERSHIP" {
+		t.Fatalf("expected no command after TAKEOWNERSHIP, got %q", cmd)
+	}
+}
+
+// TestSubscribeEventsStalledConsumer ensures that commands still complete
+// while the subscriber of the event stream doesn't receive any events, in
+// which case the oldest events are dropped and counted.
+func TestSubscribeEventsStalledConsumer(t *testing.T) {
+	t.Parallel()
+
+	// Each GETINFO command is preceded by a burst of events.
+	var numEvents int
+	c, server := newMockController(t, "", func(cmd string) string {
+		switch cmd {
+		case "SETEVENTS HS_DESC":
+			return "250 OK\r\n"
+
+		case "GETINFO version":
+			var reply string
+			for i := 0; i < 5; i++ {
+				numEvents++
+				reply += fmt.Sprintf("650 HS_DESC UPLOADED "+
+					"service%d\r\n", numEvents)
+			}
+			return reply + "250-version=0.4.8.9\r\n250 OK\r\n"
+
+		default:
+			return "510 Unrecognized command\r\n"
+		}
+	})
+	defer c.conn.Close()
+
+	c.SetEventBufferSize(2)
+
+	if _, err := c.SubscribeEvents("HS_DESC; SIGNAL HALT"); err == nil {
+		t.Fatalf("expected invalid event type to be rejected")
+	}
+
+	events, err := c.SubscribeEvents("HS_DESC")
+	if err != nil {
+		t.Fatalf("unable to subscribe to events: %v", err)
+	}
+
+	// Even though no events are received, the commands shouldn't stall.
+	for i := 0; i < 3; i++ {
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- c.Ping()
+		}()
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				t.Fatalf("unable to ping: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command stalled by event subscriber")
+		}
+	}
+
+	// Only the two most recent events should have been kept.
+	if dropped := c.DroppedEvents(); dropped != 13 {
+		t.Fatalf("expected 13 dropped events, got %d", dropped)
+	}
+	for _, expected := range []string{
+		"HS_DESC UPLOADED service14", "HS_DESC UPLOADED service15",
+	} {
+		if event := <-events; event != expected {
+			t.Fatalf("expected event %q, got %q", expected, event)
+		}
+	}
+
+	// Replies to failed commands should still be delivered as such.
+	_, err = c.SubscribeEvents("CIRC")
+	if controlErr, ok := err.(*ControlError); !ok ||
+		controlErr.Code != 510 {
+
+		t.Fatalf("expected ControlError with code 510, got %v", err)
+	}
+
+	// Once the connection is closed, the events channel should be closed
+	// as well, and any command should fail.
+	server.conn.Close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatalf("expected no more events")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("events channel not closed")
+	}
+
+	if _, ok := c.Ping().(*ConnectionError); !ok {
+		t.Fatalf("expected ConnectionError after connection closed")
+	}
+}
+
+// TestSkipV3Check ensures that v3 onion services are requested from Tor
+// servers with unparseable or missing versions once the v3 check is disabled,
+// leaving it to the server to reject them.
+func TestSkipV3Check(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []string{"0.4.8-custom-fork", ""} {
+		c, server := newMockController(
+			t, version, addOnionHandler("service", ""),
+		)
+
+		// By default, the request shouldn't even be sent.
+		cfg := AddOnionConfig{Type: V3, VirtualPort: 9735}
+		if _, err := c.AddOnion(cfg); err == nil {
+			t.Fatalf("version %q: expected v3 check to fail",
+				version)
+		}
+		if cmd := server.lastCommand(); cmd != "" {
+			t.Fatalf("version %q: expected no command to be "+
+				"sent, got %q", version, cmd)
+		}
+
+		c.SetSkipV3Check(true)
+		addr, err := c.AddOnion(cfg)
+		c.conn.Close()
+		if err != nil {
+			t.Fatalf("version %q: unable to add onion: %v",
+				version, err)
+		}
+		if addr.ServiceID != "service" {
+			t.Fatalf("version %q: unexpected service id %v",
+				version, string(addr.ServiceID))
+		}
+
+		cmd := server.lastCommand()
+		if !strings.HasPrefix(cmd, "ADD_ONION NEW:ED25519-V3 ") {
+			t.Fatalf("version %q: expected v3 onion service "+
+				"request, got %q", version, cmd)
+		}
+	}
+}
+
+// TestOnionStatus ensures that the status of the descriptor uploads of an onion
+// service is built from the HS_DESC events received, and reset once a new
+// descriptor is created.
+func TestOnionStatus(t *testing.T) {
+	t.Parallel()
+
+	serviceID := strings.Repeat("a", 56)
+	otherID := strings.Repeat("b", 56)
+	dir1 := strings.Repeat("1", 40)
+	dir2 := strings.Repeat("2", 40)
+	dir3 := strings.Repeat("3", 40)
+
+	event := func(action, id, hsDir, extra string) string {
+		return fmt.Sprintf("650 HS_DESC %v %v UNKNOWN %v %v\r\n",
+			action, id, hsDir, extra)
+	}
+
+	// Each GETINFO command is preceded by the next batch of events.
+	batches := []string{
+		event("CREATED", serviceID, "UNKNOWN", "desc") +
+			event("UPLOAD", serviceID, "$"+dir1+"~dir1", "desc") +
+			event("UPLOAD", serviceID, "$"+dir2+"~dir2", "desc") +
+			event("UPLOAD", serviceID, "$"+dir3+"~dir3", "desc") +
+			event("UPLOADED", serviceID, "$"+dir1+"~dir1", "") +
+			event("FAILED", serviceID, "$"+dir2+"~dir2",
+				"desc REASON=UPLOAD_REJECTED") +
+			event("UPLOADED", otherID, "$"+dir3, ""),
+		event("CREATED", serviceID, "UNKNOWN", "desc"),
+	}
+	c, _ := newMockController(t, "", func(cmd string) string {
+		switch cmd {
+		case "SETEVENTS HS_DESC":
+			return "250 OK\r\n"
+
+		case "GETINFO version":
+			batch := batches[0]
+			batches = batches[1:]
+			return batch + "250-version=0.4.8.9\r\n250 OK\r\n"
+
+		default:
+			return "510 Unrecognized command\r\n"
+		}
+	})
+	defer c.conn.Close()
+
+	if _, err := c.SubscribeEvents("HS_DESC"); err != nil {
+		t.Fatalf("unable to subscribe to events: %v", err)
+	}
+
+	// As the events are read before the reply to the command, their
+	// status is known once the command completes.
+	if err := c.Ping(); err != nil {
+		t.Fatalf("unable to ping: %v", err)
+	}
+
+	status, err := c.OnionStatus(serviceID + OnionSuffix)
+	if err != nil {
+		t.Fatalf("unable to get onion status: %v", err)
+	}
+	expected := HSDescStatus{
+		dir1: {State: HSDescUploaded},
+		dir2: {State: HSDescFailed, Reason: "UPLOAD_REJECTED"},
+		dir3: {State: HSDescPending},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("expected status %v, got %v", expected, status)
+	}
+	if !status.Uploaded() {
+		t.Fatalf("expected descriptor to be uploaded")
+	}
+
+	// Once a new descriptor is created, the status of the previous one
+	// should be discarded.
+	if err := c.Ping(); err != nil {
+		t.Fatalf("unable to ping: %v", err)
+	}
+	status, err = c.OnionStatus(serviceID)
+	if err != nil {
+		t.Fatalf("unable to get onion status: %v", err)
+	}
+	if len(status) != 0 || status.Uploaded() {
+		t.Fatalf("expected empty status, got %v", status)
+	}
+
+	// The other onion service's status should be tracked on its own.
+	status, err = c.OnionStatus(otherID)
+	if err != nil {
+		t.Fatalf("unable to get onion status: %v", err)
+	}
+	if !reflect.DeepEqual(status, HSDescStatus{
+		dir3: {State: HSDescUploaded},
+	}) {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	if _, err := c.OnionStatus("invalid"); err == nil {
+		t.Fatalf("expected invalid service id to be rejected")
+	}
+}
+
+// TestCookieAuthErrors ensures that authenticating with a Tor server that
+// doesn't support cookie authentication, and with an unreadable cookie file,
+// fail with distinct errors.
+func TestCookieAuthErrors(t *testing.T) {
+	t.Parallel()
+
+	// A Tor server only supporting password authentication should result
+	// in ErrCookieAuthDisabled.
+	c, _ := newMockController(t, "", func(cmd string) string {
+		return "250-PROTOCOLINFO 1\r\n" +
+			"250-AUTH METHODS=HASHEDPASSWORD " +
+			"COOKIEFILE=\"/tmp/cookie\"\r\n" +
+			"250-VERSION Tor=\"0.3.3.6\"\r\n" +
+			"250 OK\r\n"
+	})
+	err := c.authenticate()
+	c.conn.Close()
+	if err != ErrCookieAuthDisabled {
+		t.Fatalf("expected ErrCookieAuthDisabled, got %v", err)
+	}
+	if errors.Is(err, ErrCookieFileUnreadable) {
+		t.Fatalf("expected error not to match ErrCookieFileUnreadable")
+	}
+
+	// A cookie file that doesn't exist should result in a CookieFileError
+	// wrapping the error returned by the OS.
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cookiePath := filepath.Join(tempDir, "control_auth_cookie")
+	c, _ = newMockController(
+		t, "", safeCookieHandler(nil, cookiePath, strings.ToUpper),
+	)
+	err = c.authenticate()
+	c.conn.Close()
+
+	cookieErr, ok := err.(*CookieFileError)
+	if !ok {
+		t.Fatalf("expected CookieFileError, got %v", err)
+	}
+	if cookieErr.Path != cookiePath {
+		t.Fatalf("expected path %v, got %v", cookiePath,
+			cookieErr.Path)
+	}
+	if !os.IsNotExist(cookieErr.Err) {
+		t.Fatalf("expected OS error to be wrapped, got %v",
+			cookieErr.Err)
+	}
+	if !errors.Is(err, ErrCookieFileUnreadable) {
+		t.Fatalf("expected error to match ErrCookieFileUnreadable")
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected error to match os.ErrNotExist")
+	}
+	if err == ErrCookieAuthDisabled {
+		t.Fatalf("expected error not to be ErrCookieAuthDisabled")
+	}
+}
+
+// TestProtocolInfoQuotedCookieFile ensures that the path of the authentication
+// cookie file is unquoted when it contains spaces and escaped characters, such
+// as in a Tor data directory with a space in its name.
+func TestProtocolInfoQuotedCookieFile(t *testing.T) {
+	t.Parallel()
+
+	cookieFile := "/var/lib/Tor Data/\"control\"\\auth\tcookie"
+	c, _ := newMockController(t, "", func(cmd string) string {
+		return "250-PROTOCOLINFO 1\r\n" +
+			"250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=" +
+			escapeControlString(cookieFile) + "\r\n" +
+			"250-VERSION Tor=\"0.4.8.9\"\r\n" +
+			"250 OK\r\n"
+	})
+	defer c.conn.Close()
+
+	_, path, _, err := c.ProtocolInfo()
+	if err != nil {
+		t.Fatalf("unable to get protocol info: %v", err)
+	}
+	if path != cookieFile {
+		t.Fatalf("expected cookie file %q, got %q", cookieFile, path)
+	}
+}
+
+// TestRawCommand ensures that arbitrary commands can be sent to the Tor
+// server, and that their code and reply are returned as is.
+func TestRawCommand(t *testing.T) {
+	t.Parallel()
+
+	handler := func(cmd string) string {
+		if cmd == "GETINFO net/listeners/socks" {
+			return "250-net/listeners/socks=" +
+				"\"127.0.0.1:9050\"\r\n" +
+				"250 OK\r\n"
+		}
+
+		return "552 Unrecognized key\r\n"
+	}
+	c, server := newMockController(t, MinTorVersion, handler)
+	defer c.conn.Close()
+
+	code, reply, err := c.RawCommand("GETINFO net/listeners/socks")
+	if err != nil {
+		t.Fatalf("unable to send command: %v", err)
+	}
+	if code != success {
+		t.Fatalf("expected code %d, got %d", success, code)
+	}
+	expectedReply := "net/listeners/socks=\"127.0.0.1:9050\"\nOK"
+	if reply != expectedReply {
+		t.Fatalf("expected reply %q, got %q", expectedReply, reply)
+	}
+	if cmd := server.lastCommand(); cmd != "GETINFO net/listeners/socks" {
+		t.Fatalf("unexpected command %q", cmd)
+	}
+
+	// Unsuccessful replies should be returned along with a ControlError.
+	code, reply, err = c.RawCommand("GETINFO unknown/key")
+	if _, ok := err.(*ControlError); !ok {
+		t.Fatalf("expected ControlError, got %v", err)
+	}
+	if code != 552 || reply != "Unrecognized key" {
+		t.Fatalf("unexpected reply %d %q", code, reply)
+	}
+
+	// Commands containing line breaks must not be sent.
+	server.mu.Lock()
+	numCommands := len(server.commands)
+	server.mu.Unlock()
+
+	_, _, err = c.RawCommand("GETINFO version\r\nSIGNAL HALT")
+	if err == nil {
+		t.Fatalf("expected command with line break to be rejected")
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.commands) != numCommands {
+		t.Fatalf("expected command not to be sent")
+	}
+}
+
+// TestMaxReplySize ensures that replies exceeding the maximum reply size are
+// rejected, whether they consist of a single long line or of many lines.
+func TestMaxReplySize(t *testing.T) {
+	t.Parallel()
+
+	const maxSize = 1024
+
+	// A single line without any line break should be rejected before
+	// being read entirely.
+	longLine := "250-key=" + strings.Repeat("a", 100*maxSize)
+
+	// The size of a data block should be accounted for as well, even
+	// though each of its lines is short.
+	dataBlock := "250+key=\r\n" +
+		strings.Repeat("0123456789\r\n", maxSize/10) +
+		".\r\n250 OK\r\n"
+
+	tests := []struct {
+		name  string
+		reply string
+		valid bool
+	}{
+		{
+			name:  "within limit",
+			reply: "250-key=\"value\"\r\n250 OK\r\n",
+			valid: true,
+		},
+		{
+			name:  "long line",
+			reply: longLine,
+		},
+		{
+			name:  "data block",
+			reply: dataBlock,
+		},
+	}
+
+	for _, test := range tests {
+		reply := test.reply
+		handler := func(string) string {
+			return reply
+		}
+		c, _ := newMockController(t, MinTorVersion, handler)
+		c.SetMaxReplySize(maxSize)
+
+		_, _, err := c.RawCommand("GETINFO key")
+		c.conn.Close()
+
+		if test.valid {
+			if err != nil {
+				t.Fatalf("test %q: unable to send command: %v",
+					test.name, err)
+			}
+			continue
+		}
+
+		tooLarge, ok := err.(*ReplyTooLargeError)
+		if !ok {
+			t.Fatalf("test %q: expected ReplyTooLargeError, got %v",
+				test.name, err)
+		}
+		if tooLarge.MaxSize != maxSize {
+			t.Fatalf("test %q: expected max size %d, got %d",
+				test.name, maxSize, tooLarge.MaxSize)
+		}
+	}
+
+	// Without a limit, the data block should be read in full.
+	c, _ := newMockController(t, MinTorVersion, func(string) string {
+		return dataBlock
+	})
+	defer c.conn.Close()
+	c.SetMaxReplySize(0)
+
+	_, reply, err := c.RawCommand("GETINFO key")
+	if err != nil {
+		t.Fatalf("unable to send command: %v", err)
+	}
+	if lines := strings.Split(reply, "\n"); len(lines) != maxSize/10+2 {
+		t.Fatalf("expected %d lines, got %d", maxSize/10+2, len(lines))
+	}
+}
+
+// TestAddOnionCorruptKeyFile ensures that an empty or corrupt private key file
+// results in a clear error by default, and is replaced by the private key of a
+// new onion service with the recreate policy.
+func TestAddOnionCorruptKeyFile(t *testing.T) {
+	t.Parallel()
+
+	tempDir, err := ioutil.TempDir("", "tor")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unable to generate rsa key: %v", err)
+	}
+	v2Key := "RSA1024:" + base64.StdEncoding.EncodeToString(
+		x509.MarshalPKCS1PrivateKey(rsaKey),
+	)
+
+	tests := []struct {
+		name     string
+		contents string
+		policy   CorruptKeyPolicy
+		errStr   string
+	}{
+		{
+			name:   "empty file",
+			errStr: "is empty",
+		},
+		{
+			name:     "empty file with newline",
+			contents: "\n",
+			errStr:   "is empty",
+		},
+		{
+			name:   "empty file recreated",
+			policy: CorruptKeyRecreate,
+		},
+		{
+			name:     "garbage recreated",
+			contents: "\x00\x00\x00",
+			policy:   CorruptKeyRecreate,
+		},
+		{
+			name:     "truncated key recreated",
+			contents: testV3PrivateKey[:20],
+			policy:   CorruptKeyRecreate,
+		},
+		{
+			name:     "key of wrong type kept",
+			contents: v2Key,
+			policy:   CorruptKeyRecreate,
+			errStr:   "expected v3 private key",
+		},
+	}
+
+	for i, test := range tests {
+		keyPath := filepath.Join(tempDir, fmt.Sprintf("onion_key%d", i))
+		err := ioutil.WriteFile(keyPath, []byte(test.contents), 0600)
+		if err != nil {
+			t.Fatalf("test %q: unable to write key file: %v",
+				test.name, err)
+		}
+
+		c, server := newMockController(
+			t, MinTorVersion,
+			addOnionHandler("recreated", testV3PrivateKey),
+		)
+		addr, err := c.AddOnion(AddOnionConfig{
+			Type:             V3,
+			VirtualPort:      9735,
+			PrivateKeyPath:   keyPath,
+			CorruptKeyPolicy: test.policy,
+		})
+		c.conn.Close()
+
+		contents, readErr := ioutil.ReadFile(keyPath)
+		if readErr != nil {
+			t.Fatalf("test %q: unable to read key file: %v",
+				test.name, readErr)
+		}
+
+		// On failure, no command should have been sent, and the key
+		// file should be left untouched.
+		if test.errStr != "" {
+			if err == nil || !strings.Contains(err.Error(),
+				test.errStr) {
+
+				t.Fatalf("test %q: expected error containing "+
+					"%q, got %v", test.name, test.errStr,
+					err)
+			}
+
+			server.mu.Lock()
+			numCommands := len(server.commands)
+			server.mu.Unlock()
+			if numCommands != 0 {
+				t.Fatalf("test %q: expected no command to be "+
+					"sent", test.name)
+			}
+			if string(contents) != test.contents {
+				t.Fatalf("test %q: expected key file to be "+
+					"left untouched", test.name)
+			}
+			continue
+		}
+
+		// Otherwise, a new onion service should have been created,
+		// whose private key replaced the corrupt file.
+		if err != nil {
+			t.Fatalf("test %q: unable to add onion: %v", test.name,
+				err)
+		}
+		cmd := server.lastCommand()
+		if !strings.HasPrefix(cmd, "ADD_ONION NEW:ED25519-V3 ") {
+			t.Fatalf("test %q: expected new onion service, got %q",
+				test.name, cmd)
+		}
+		if addr.PrivateKey != testV3PrivateKey {
+			t.Fatalf("test %q: expected private key to be "+
+				"returned", test.name)
+		}
+		if string(contents) != testV3PrivateKey {
+			t.Fatalf("test %q: expected key file to be replaced",
+				test.name)
+		}
+	}
+}
+
+// TestMaxReplySizeClosesConnection ensures that the connection is closed once
+// a reply exceeds the maximum size, such that the rest of the reply isn't read
+// as the reply to the next command.
+func TestMaxReplySizeClosesConnection(t *testing.T) {
+	t.Parallel()
+
+	const maxSize = 1024
+
+	// The first reply exceeds the maximum size, while leaving a complete
+	// reply unread in the connection.
+	oversized := "250-key=" + strings.Repeat("a", 2*maxSize) + "\r\n" +
+		"250 OK\r\n"
+	c, _ := newMockController(t, MinTorVersion, func(cmd string) string {
+		if cmd == "GETINFO key" {
+			return oversized
+		}
+		return "250 OK\r\n"
+	})
+	c.SetMaxReplySize(maxSize)
+
+	_, _, err := c.RawCommand("GETINFO key")
+	if _, ok := err.(*ReplyTooLargeError); !ok {
+		t.Fatalf("expected ReplyTooLargeError, got %v", err)
+	}
+
+	// Any further command should fail, instead of returning the leftover
+	// of the oversized reply.
+	_, reply, err := c.RawCommand("GETINFO version")
+	if _, ok := err.(*ConnectionError); !ok {
+		t.Fatalf("expected ConnectionError, got reply %q, err %v",
+			reply, err)
+	}
+	if err := c.Ping(); err == nil {
+		t.Fatalf("expected ping to fail")
+	}
+
+	// Stopping the controller shouldn't fail on the closed connection.
+	if err := c.Stop(); err != nil {
+		t.Fatalf("unable to stop controller: %v", err)
+	}
+}
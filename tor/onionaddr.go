@@ -2,8 +2,10 @@ package tor
 
 import (
 	"encoding/base32"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -38,13 +40,70 @@ var (
 	Base32Encoding = base32.NewEncoding(base32Alphabet)
 )
 
+// redactedPrivateKey is the string representation of a non-empty
+// OnionPrivateKey.
+const redactedPrivateKey = "[redacted]"
+
+// OnionPrivateKey is the private key of an onion service, in the format used
+// by the ADD_ONION command, e.g. "ED25519-V3:<blob>". Its String and GoString
+// methods redact the key, such that it can't leak into logs when formatted.
+type OnionPrivateKey string
+
+// String returns a redacted representation of the private key.
+func (k OnionPrivateKey) String() string {
+	if k == "" {
+		return ""
+	}
+
+	return redactedPrivateKey
+}
+
+// GoString returns a redacted representation of the private key, used when
+// formatting it with the %#v verb.
+func (k OnionPrivateKey) GoString() string {
+	return k.String()
+}
+
+// OnionServiceID is the service ID of an onion service, without the onion
+// suffix.
+type OnionServiceID string
+
+// String returns the hostname of the onion service, i.e. its service ID
+// followed by the onion suffix.
+func (id OnionServiceID) String() string {
+	return string(id) + OnionSuffix
+}
+
+// PortMapping is a mapping from the virtual port of an onion service to a
+// local target port the traffic is forwarded to.
+type PortMapping struct {
+	// VirtualPort is the externally reachable port of the onion service.
+	VirtualPort int
+
+	// TargetPort is the local port the traffic is forwarded to.
+	TargetPort int
+}
+
 // OnionAddr represents a Tor network end point onion address.
 type OnionAddr struct {
 	// OnionService is the host of the onion address.
 	OnionService string
 
+	// ServiceID is the bare service ID of the onion service, without the
+	// onion suffix. It is only set by AddOnion.
+	ServiceID OnionServiceID
+
 	// Port is the port of the onion address.
 	Port int
+
+	// PrivateKey is the private key of the onion service. It is only set
+	// by AddOnion when a new onion service was created, and its private
+	// key wasn't discarded.
+	PrivateKey OnionPrivateKey
+
+	// PortMappings is the set of mappings from the virtual port to the
+	// target ports of the onion service. It is only set by AddOnion.
+	PortMappings []PortMapping
 }
 
 // A compile-time check to ensure that OnionAddr implements the net.Addr
@@ -56,6 +115,27 @@ func (o *OnionAddr) String() string {
 	return net.JoinHostPort(o.OnionService, strconv.Itoa(o.Port))
 }
 
+// Type returns the type of the onion service, derived from the length of its
+// service ID, such that it's known regardless of how the address was created.
+// An error is returned if the length doesn't match either type.
+func (o *OnionAddr) Type() (OnionType, error) {
+	return serviceIDType(strings.TrimSuffix(o.OnionService, OnionSuffix))
+}
+
+// serviceIDType returns the type of the onion service with the given service
+// ID, without the onion suffix, derived from its length.
+func serviceIDType(serviceID string) (OnionType, error) {
+	switch len(serviceID) + OnionSuffixLen {
+	case V2Len:
+		return V2, nil
+	case V3Len:
+		return V3, nil
+	default:
+		return 0, fmt.Errorf("unknown onion service type for %v",
+			serviceID)
+	}
+}
+
 // Network returns the network that this implementation of net.Addr will use.
 // In this case, because Tor only allows TCP connections, the network is "tcp".
 func (o *OnionAddr) Network() string {